@@ -10,11 +10,16 @@ import (
 
 var binaryMagic = [8]byte{'C', 'V', 'M', 'B', 'C', 0, 0, 1}
 
+// Version 2 added the Internal flag to global records. Version 1 files lay
+// out every later field one byte earlier, so they are rejected rather than
+// misread.
 const (
-	binaryFormatVersion = uint16(1)
-	binarySectionModule = uint16(1)
-	maxBinaryCount      = uint32(1 << 24)
-	maxBinaryPayload    = uint64(1 << 32)
+	binaryFormatVersion  = uint16(2)
+	binarySectionVersion = uint16(2)
+	binarySectionModule  = uint16(1)
+	binarySectionDebug   = uint16(2)
+	maxBinaryCount       = uint32(1 << 24)
+	maxBinaryPayload     = uint64(1 << 32)
 )
 
 func EncodeModule(w io.Writer, m *Module) error {
@@ -27,35 +32,58 @@ func EncodeModule(w io.Writer, m *Module) error {
 	if bw.err != nil {
 		return bw.err
 	}
-	data := payload.Bytes()
+	sections := []binarySection{{id: binarySectionModule, data: payload.Bytes()}}
+	if m.Debug != nil {
+		var debug bytes.Buffer
+		dw := binaryModuleWriter{w: &debug}
+		dw.debugInfo(m.Debug)
+		if dw.err != nil {
+			return dw.err
+		}
+		sections = append(sections, binarySection{id: binarySectionDebug, data: debug.Bytes()})
+	}
 	if _, err := w.Write(binaryMagic[:]); err != nil {
 		return err
 	}
 	if err := binary.Write(w, binary.LittleEndian, binaryFormatVersion); err != nil {
 		return err
 	}
-	if err := binary.Write(w, binary.LittleEndian, uint16(1)); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(sections))); err != nil {
 		return err
 	}
 	if err := binary.Write(w, binary.LittleEndian, uint32(0)); err != nil {
 		return err
 	}
-	if err := binary.Write(w, binary.LittleEndian, binarySectionModule); err != nil {
+	for _, section := range sections {
+		if err := writeBinarySection(w, section); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type binarySection struct {
+	id   uint16
+	data []byte
+}
+
+func writeBinarySection(w io.Writer, section binarySection) error {
+	if err := binary.Write(w, binary.LittleEndian, section.id); err != nil {
 		return err
 	}
-	if err := binary.Write(w, binary.LittleEndian, uint16(1)); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, binarySectionVersion); err != nil {
 		return err
 	}
-	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(section.data))); err != nil {
 		return err
 	}
-	if err := binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(data)); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(section.data)); err != nil {
 		return err
 	}
 	if err := binary.Write(w, binary.LittleEndian, uint32(0)); err != nil {
 		return err
 	}
-	_, err := w.Write(data)
+	_, err := w.Write(section.data)
 	return err
 }
 
@@ -77,30 +105,13 @@ func DecodeModule(r io.Reader) (*Module, error) {
 	if formatVersion != binaryFormatVersion {
 		return nil, fmt.Errorf("unsupported bytecode binary version %d", formatVersion)
 	}
-	if sectionCount != 1 {
+	if sectionCount != 1 && sectionCount != 2 {
 		return nil, fmt.Errorf("unsupported bytecode section count %d", sectionCount)
 	}
-	sectionID := br.u16()
-	sectionVersion := br.u16()
-	length := br.u64()
-	checksum := br.u32()
-	_ = br.u32()
-	if br.err != nil {
-		return nil, br.err
-	}
-	if sectionID != binarySectionModule || sectionVersion != 1 {
-		return nil, fmt.Errorf("unsupported bytecode section id=%d version=%d", sectionID, sectionVersion)
-	}
-	if length > maxBinaryPayload {
-		return nil, fmt.Errorf("bytecode module payload length %d exceeds limit", length)
-	}
-	data := make([]byte, length)
-	if _, err := io.ReadFull(r, data); err != nil {
+	data, err := readBinarySection(r, binarySectionModule)
+	if err != nil {
 		return nil, err
 	}
-	if got := crc32.ChecksumIEEE(data); got != checksum {
-		return nil, fmt.Errorf("bytecode module checksum mismatch: got %#x want %#x", got, checksum)
-	}
 	payload := bytes.NewReader(data)
 	mr := binaryModuleReader{r: payload}
 	mod := mr.module()
@@ -110,6 +121,21 @@ func DecodeModule(r io.Reader) (*Module, error) {
 	if payload.Len() != 0 {
 		return nil, fmt.Errorf("bytecode module payload has %d trailing bytes", payload.Len())
 	}
+	if sectionCount == 2 {
+		data, err := readBinarySection(r, binarySectionDebug)
+		if err != nil {
+			return nil, err
+		}
+		payload := bytes.NewReader(data)
+		dr := binaryModuleReader{r: payload}
+		mod.Debug = dr.debugInfo()
+		if dr.err != nil {
+			return nil, dr.err
+		}
+		if payload.Len() != 0 {
+			return nil, fmt.Errorf("bytecode debug payload has %d trailing bytes", payload.Len())
+		}
+	}
 	var trailing [1]byte
 	n, err := r.Read(trailing[:])
 	if err != nil && err != io.EOF {
@@ -124,6 +150,39 @@ func DecodeModule(r io.Reader) (*Module, error) {
 	return mod, nil
 }
 
+func readBinarySection(r io.Reader, wantID uint16) ([]byte, error) {
+	br := binaryHeaderReader{r: r}
+	sectionID := br.u16()
+	sectionVersion := br.u16()
+	length := br.u64()
+	checksum := br.u32()
+	_ = br.u32()
+	if br.err != nil {
+		return nil, br.err
+	}
+	if sectionID != wantID || sectionVersion != binarySectionVersion {
+		return nil, fmt.Errorf("unsupported bytecode section id=%d version=%d", sectionID, sectionVersion)
+	}
+	if length > maxBinaryPayload {
+		return nil, fmt.Errorf("bytecode %s payload length %d exceeds limit", binarySectionName(sectionID), length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if got := crc32.ChecksumIEEE(data); got != checksum {
+		return nil, fmt.Errorf("bytecode %s checksum mismatch: got %#x want %#x", binarySectionName(sectionID), got, checksum)
+	}
+	return data, nil
+}
+
+func binarySectionName(id uint16) string {
+	if id == binarySectionDebug {
+		return "debug"
+	}
+	return "module"
+}
+
 type binaryModuleWriter struct {
 	w   io.Writer
 	err error
@@ -166,6 +225,7 @@ func (w *binaryModuleWriter) globals(gs []Global) {
 		w.i64(g.Size)
 		w.i64(g.Align)
 		w.bool(g.Readonly)
+		w.bool(g.Internal)
 		w.init(g.Init)
 	}
 }
@@ -315,6 +375,26 @@ func (w *binaryModuleWriter) instr(ins Instr) {
 	w.i32(ins.Argc)
 }
 
+func (w *binaryModuleWriter) debugInfo(d *DebugInfo) {
+	w.count(len(d.Files))
+	for _, f := range d.Files {
+		w.str(f)
+	}
+	w.count(len(d.Functions))
+	for _, fd := range d.Functions {
+		w.i32(fd.Func)
+		w.count(len(fd.Lines))
+		for _, l := range fd.Lines {
+			w.i32(l.PC)
+			w.i32(l.File)
+			w.i32(l.Line)
+			w.i32(l.Column)
+			w.i32(l.EndLine)
+			w.i32(l.EndColumn)
+		}
+	}
+}
+
 func (w *binaryModuleWriter) str(s string) {
 	w.bytes([]byte(s))
 }
@@ -464,6 +544,7 @@ func (r *binaryModuleReader) globals() []Global {
 			Size:     r.i64(),
 			Align:    r.i64(),
 			Readonly: r.bool(),
+			Internal: r.bool(),
 			Init:     r.init(),
 		}
 	}
@@ -653,6 +734,39 @@ func (r *binaryModuleReader) instr() Instr {
 	return ins
 }
 
+func (r *binaryModuleReader) debugInfo() *DebugInfo {
+	d := &DebugInfo{}
+	fileCount := r.count()
+	if fileCount > 0 {
+		d.Files = make([]string, fileCount)
+	}
+	for i := range d.Files {
+		d.Files[i] = r.str()
+	}
+	funcCount := r.count()
+	if funcCount > 0 {
+		d.Functions = make([]FunctionDebugInfo, funcCount)
+	}
+	for i := range d.Functions {
+		d.Functions[i].Func = r.i32()
+		lineCount := r.count()
+		if lineCount > 0 {
+			d.Functions[i].Lines = make([]LineEntry, lineCount)
+		}
+		for j := range d.Functions[i].Lines {
+			d.Functions[i].Lines[j] = LineEntry{
+				PC:        r.i32(),
+				File:      r.i32(),
+				Line:      r.i32(),
+				Column:    r.i32(),
+				EndLine:   r.i32(),
+				EndColumn: r.i32(),
+			}
+		}
+	}
+	return d
+}
+
 func (r *binaryModuleReader) str() string {
 	return string(r.bytes())
 }
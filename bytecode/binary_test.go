@@ -2,6 +2,7 @@ package bytecode
 
 import (
 	"bytes"
+	"encoding/binary"
 	"reflect"
 	"strings"
 	"testing"
@@ -28,6 +29,35 @@ func TestBinaryModuleRoundTrip(t *testing.T) {
 	}
 }
 
+func TestBinaryModuleRoundTripWithDebugInfo(t *testing.T) {
+	mod := binaryFixtureModule()
+	mod.Debug = &DebugInfo{
+		Files: []string{"main.c"},
+		Functions: []FunctionDebugInfo{{
+			Func:  0,
+			Lines: []LineEntry{{PC: 0, File: 0, Line: 3, Column: 5, EndLine: 3, EndColumn: 14}},
+		}},
+	}
+	var buf bytes.Buffer
+	if err := EncodeModule(&buf, mod); err != nil {
+		t.Fatalf("EncodeModule: %v", err)
+	}
+	got, err := DecodeModule(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeModule: %v", err)
+	}
+	if !reflect.DeepEqual(got, mod) {
+		t.Fatalf("round-trip mismatch\nwant:\n%s\ngot:\n%s", PrintModule(mod), PrintModule(got))
+	}
+	loc, ok := got.Debug.Lookup(0, 1)
+	if !ok || loc.String() != "main.c:3:5" {
+		t.Fatalf("Lookup = %v, %v; want main.c:3:5", loc, ok)
+	}
+	if _, ok := got.Debug.Lookup(1, 0); ok {
+		t.Fatalf("Lookup found location for function without line table")
+	}
+}
+
 func TestDecodeModuleRejectsCorruptPayload(t *testing.T) {
 	mod := binaryFixtureModule()
 	var buf bytes.Buffer
@@ -61,6 +91,32 @@ func TestDecodeModuleRejectsTrailingFileBytes(t *testing.T) {
 	}
 }
 
+func TestDecodeModuleRejectsOlderVersions(t *testing.T) {
+	mod := binaryFixtureModule()
+	var buf bytes.Buffer
+	if err := EncodeModule(&buf, mod); err != nil {
+		t.Fatalf("EncodeModule: %v", err)
+	}
+	tests := []struct {
+		name   string
+		offset int
+		want   string
+	}{
+		{"format", 8, "unsupported bytecode binary version 1"},
+		{"section", 18, "unsupported bytecode section id=1 version=1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := append([]byte(nil), buf.Bytes()...)
+			binary.LittleEndian.PutUint16(data[tc.offset:], 1)
+			_, err := DecodeModule(bytes.NewReader(data))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("DecodeModule error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
 func binaryFixtureModule() *Module {
 	return &Module{
 		Version: CurrentModuleVersion,
@@ -0,0 +1,102 @@
+package bytecode
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DebugInfo maps bytecode program counters back to source positions. It is
+// optional: modules without it still validate, encode and run.
+type DebugInfo struct {
+	Files     []string
+	Functions []FunctionDebugInfo
+}
+
+// FunctionDebugInfo is the line table of one function. Each entry covers the
+// instructions from its PC up to the PC of the next entry.
+type FunctionDebugInfo struct {
+	Func  int
+	Lines []LineEntry
+}
+
+type LineEntry struct {
+	PC        int
+	File      int
+	Line      int
+	Column    int
+	EndLine   int
+	EndColumn int
+}
+
+type SourceLocation struct {
+	File      string
+	Line      int
+	Column    int
+	EndLine   int
+	EndColumn int
+}
+
+func (l SourceLocation) String() string {
+	file := l.File
+	if file == "" {
+		file = "<unknown>"
+	}
+	return fmt.Sprintf("%s:%d:%d", file, l.Line, l.Column)
+}
+
+// Lookup returns the source location covering pc in function funcID.
+func (d *DebugInfo) Lookup(funcID, pc int) (SourceLocation, bool) {
+	if d == nil {
+		return SourceLocation{}, false
+	}
+	idx := sort.Search(len(d.Functions), func(i int) bool { return d.Functions[i].Func >= funcID })
+	if idx >= len(d.Functions) || d.Functions[idx].Func != funcID {
+		return SourceLocation{}, false
+	}
+	lines := d.Functions[idx].Lines
+	entry := sort.Search(len(lines), func(i int) bool { return lines[i].PC > pc }) - 1
+	if entry < 0 || lines[entry].Line <= 0 {
+		return SourceLocation{}, false
+	}
+	l := lines[entry]
+	loc := SourceLocation{Line: l.Line, Column: l.Column, EndLine: l.EndLine, EndColumn: l.EndColumn}
+	if l.File >= 0 && l.File < len(d.Files) {
+		loc.File = d.Files[l.File]
+	}
+	return loc, true
+}
+
+func validateDebugInfo(m *Module) error {
+	d := m.Debug
+	if d == nil {
+		return nil
+	}
+	prevFunc := -1
+	for _, fd := range d.Functions {
+		if fd.Func < 0 || fd.Func >= len(m.Functions) {
+			return fmt.Errorf("debug info references invalid function %d", fd.Func)
+		}
+		if fd.Func <= prevFunc {
+			return fmt.Errorf("debug info function %d is out of order", fd.Func)
+		}
+		prevFunc = fd.Func
+		f := m.Functions[fd.Func]
+		prevPC := -1
+		for _, l := range fd.Lines {
+			if l.PC < 0 || l.PC > len(f.Instrs) {
+				return fmt.Errorf("debug info for function %q has pc %d outside [0,%d]", f.Name, l.PC, len(f.Instrs))
+			}
+			if l.PC <= prevPC {
+				return fmt.Errorf("debug info for function %q has non-increasing pc %d", f.Name, l.PC)
+			}
+			prevPC = l.PC
+			if l.File < 0 || l.File >= len(d.Files) {
+				return fmt.Errorf("debug info for function %q pc %d references invalid file %d", f.Name, l.PC, l.File)
+			}
+			if l.Line < 0 || l.Column < 0 || l.EndLine < 0 || l.EndColumn < 0 {
+				return fmt.Errorf("debug info for function %q pc %d has negative position", f.Name, l.PC)
+			}
+		}
+	}
+	return nil
+}
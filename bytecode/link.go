@@ -0,0 +1,326 @@
+package bytecode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LinkUnit is one module taking part in a link. Name identifies the module in
+// diagnostics, usually the file it was loaded from.
+type LinkUnit struct {
+	Name   string
+	Module *Module
+}
+
+type LinkOptions struct {
+	// HostSymbol reports whether an extern that no unit defines is provided
+	// by the host at load time. When nil such externs are kept unresolved
+	// without complaint.
+	HostSymbol func(g Global) bool
+}
+
+// Link merges units into a single module. Extern globals are bound to the
+// external definitions of other units; everything else is renumbered and
+// concatenated in unit order.
+func Link(units []LinkUnit, opts LinkOptions) (*Module, error) {
+	if len(units) == 0 {
+		return nil, fmt.Errorf("link: no modules")
+	}
+	for _, u := range units {
+		if u.Module == nil {
+			return nil, fmt.Errorf("link: %s: nil module", u.Name)
+		}
+		if err := ValidateModule(u.Module); err != nil {
+			return nil, fmt.Errorf("link: %s: %w", u.Name, err)
+		}
+		if u.Module.Version != units[0].Module.Version {
+			return nil, fmt.Errorf("link: %s: module version %q does not match %q", u.Name, u.Module.Version, units[0].Module.Version)
+		}
+		if u.Module.Target != units[0].Module.Target {
+			return nil, fmt.Errorf("link: %s: target %q does not match %q", u.Name, u.Module.Target.Name, units[0].Module.Target.Name)
+		}
+	}
+	l := &linker{
+		units:    units,
+		out:      NewModule(),
+		sigKeys:  map[string]int{},
+		strKeys:  map[string]int{},
+		defs:     map[string]linkSymbol{},
+		imports:  map[string]int{},
+		globals:  make([][]int, len(units)),
+		sigs:     make([][]int, len(units)),
+		strs:     make([][]int, len(units)),
+		layouts:  make([]int, len(units)),
+		funcBase: make([]int, len(units)),
+	}
+	l.out.Target = units[0].Module.Target
+	l.out.Version = units[0].Module.Version
+	l.collectDefinitions()
+	l.mergeTables()
+	l.assignGlobals()
+	l.resolveExterns(opts)
+	if len(l.errs) > 0 {
+		return nil, errors.Join(l.errs...)
+	}
+	l.emitGlobals()
+	l.emitFunctions()
+	l.emitDebugInfo()
+	if err := ValidateModule(l.out); err != nil {
+		return nil, fmt.Errorf("link: %w", err)
+	}
+	return l.out, nil
+}
+
+type linkSymbol struct {
+	unit   int
+	global int
+}
+
+type linker struct {
+	units    []LinkUnit
+	out      *Module
+	sigKeys  map[string]int
+	strKeys  map[string]int
+	defs     map[string]linkSymbol
+	imports  map[string]int
+	globals  [][]int
+	owners   []linkSymbol
+	sigs     [][]int
+	strs     [][]int
+	layouts  []int
+	funcBase []int
+	errs     []error
+}
+
+func (l *linker) errorf(format string, args ...any) {
+	l.errs = append(l.errs, fmt.Errorf("link: "+format, args...))
+}
+
+func (l *linker) collectDefinitions() {
+	for ui, u := range l.units {
+		for gi, g := range u.Module.Globals {
+			if g.Kind == GlobalExtern || g.Internal {
+				continue
+			}
+			if prev, ok := l.defs[g.Name]; ok {
+				l.errorf("duplicate symbol %q defined in %s and %s", g.Name, l.units[prev.unit].Name, u.Name)
+				continue
+			}
+			l.defs[g.Name] = linkSymbol{unit: ui, global: gi}
+		}
+	}
+}
+
+func (l *linker) mergeTables() {
+	funcCount := 0
+	for ui, u := range l.units {
+		m := u.Module
+		l.sigs[ui] = make([]int, len(m.Sigs))
+		for i, sig := range m.Sigs {
+			key := fmt.Sprintf("%s/%v/%v", sig.Ret, sig.Params, sig.Variadic)
+			id, ok := l.sigKeys[key]
+			if !ok {
+				id = len(l.out.Sigs)
+				l.out.Sigs = append(l.out.Sigs, FuncSig{ID: id, Ret: sig.Ret, Params: sig.Params, Variadic: sig.Variadic})
+				l.sigKeys[key] = id
+			}
+			l.sigs[ui][i] = id
+		}
+		l.strs[ui] = make([]int, len(m.Strings))
+		for i, s := range m.Strings {
+			key := string(s.Bytes)
+			id, ok := l.strKeys[key]
+			if !ok {
+				id = len(l.out.Strings)
+				l.out.Strings = append(l.out.Strings, StringConst{ID: id, Value: s.Value, Bytes: s.Bytes})
+				l.strKeys[key] = id
+			}
+			l.strs[ui][i] = id
+		}
+		l.layouts[ui] = len(l.out.Layouts)
+		for _, layout := range m.Layouts {
+			layout.ID += l.layouts[ui]
+			l.out.Layouts = append(l.out.Layouts, layout)
+		}
+		l.funcBase[ui] = funcCount
+		funcCount += len(m.Functions)
+	}
+}
+
+// assignGlobals gives every global that survives the link its new id. Externs
+// bound to another unit's definition are filled in by resolveExterns.
+func (l *linker) assignGlobals() {
+	next := 0
+	for ui, u := range l.units {
+		l.globals[ui] = make([]int, len(u.Module.Globals))
+		for gi, g := range u.Module.Globals {
+			l.globals[ui][gi] = -1
+			if g.Kind == GlobalExtern {
+				if _, ok := l.defs[g.Extern.Name]; ok && g.Extern.Module == "" {
+					continue
+				}
+				key := l.importKey(ui, g)
+				if id, ok := l.imports[key]; ok {
+					l.globals[ui][gi] = id
+					continue
+				}
+				l.imports[key] = next
+			}
+			l.globals[ui][gi] = next
+			l.owners = append(l.owners, linkSymbol{unit: ui, global: gi})
+			next++
+		}
+	}
+}
+
+func (l *linker) importKey(ui int, g Global) string {
+	sig := -1
+	if g.Sig >= 0 {
+		sig = l.sigs[ui][g.Sig]
+	}
+	return strings.Join([]string{g.Extern.Module, g.Extern.Name, g.Extern.ABI, fmt.Sprint(sig, g.Size, g.Align)}, "\x00")
+}
+
+func (l *linker) resolveExterns(opts LinkOptions) {
+	for ui, u := range l.units {
+		for gi, g := range u.Module.Globals {
+			if g.Kind != GlobalExtern {
+				continue
+			}
+			def, ok := l.defs[g.Extern.Name]
+			if !ok || g.Extern.Module != "" {
+				if opts.HostSymbol != nil && !opts.HostSymbol(g) {
+					l.errorf("undefined symbol %q referenced in %s", g.Extern.Name, u.Name)
+				}
+				continue
+			}
+			target := l.units[def.unit].Module.Globals[def.global]
+			if err := l.checkBinding(ui, g, def.unit, target); err != nil {
+				l.errorf("symbol %q referenced in %s %v in %s", g.Extern.Name, u.Name, err, l.units[def.unit].Name)
+				continue
+			}
+			l.globals[ui][gi] = l.globals[def.unit][def.global]
+		}
+	}
+}
+
+func (l *linker) checkBinding(ui int, g Global, defUnit int, target Global) error {
+	if isExternFunctionGlobal(g) {
+		if target.Kind != GlobalFunc {
+			return fmt.Errorf("is used as a function but defined as a variable")
+		}
+		if l.sigs[ui][g.Sig] != l.sigs[defUnit][target.Sig] {
+			return fmt.Errorf("has a signature that conflicts with its definition")
+		}
+		return nil
+	}
+	if target.Kind != GlobalVar {
+		return fmt.Errorf("is used as a variable but defined as a function")
+	}
+	if g.Size != 0 && g.Size != target.Size {
+		return fmt.Errorf("has size %d but is defined with size %d", g.Size, target.Size)
+	}
+	return nil
+}
+
+func (l *linker) emitGlobals() {
+	for id, owner := range l.owners {
+		m := l.units[owner.unit].Module
+		g := m.Globals[owner.global]
+		g.ID = id
+		if g.Sig >= 0 {
+			g.Sig = l.sigs[owner.unit][g.Sig]
+		}
+		if g.Kind == GlobalFunc {
+			g.Func += l.funcBase[owner.unit]
+		}
+		if len(g.Init.Relocations) > 0 {
+			relocs := make([]Relocation, len(g.Init.Relocations))
+			for i, r := range g.Init.Relocations {
+				switch r.Kind {
+				case RelocGlobal, RelocFunc:
+					r.Target = l.globals[owner.unit][r.Target]
+				case RelocString:
+					r.Target = l.strs[owner.unit][r.Target]
+				}
+				relocs[i] = r
+			}
+			g.Init.Relocations = relocs
+		}
+		l.out.Globals = append(l.out.Globals, g)
+		if m.Entry.Global == owner.global {
+			l.out.Entry = &EntryPoint{Global: id, Name: m.Entry.Name}
+		}
+	}
+}
+
+func (l *linker) emitFunctions() {
+	for ui, u := range l.units {
+		for _, f := range u.Module.Functions {
+			f.ID += l.funcBase[ui]
+			f.GlobalID = l.globals[ui][f.GlobalID]
+			f.Sig = l.sigs[ui][f.Sig]
+			f.Objects = append([]LocalObject(nil), f.Objects...)
+			for i := range f.Objects {
+				f.Objects[i].Layout += l.layouts[ui]
+			}
+			f.DynamicObjects = append([]DynamicObject(nil), f.DynamicObjects...)
+			for i := range f.DynamicObjects {
+				f.DynamicObjects[i].Layout += l.layouts[ui]
+			}
+			f.Instrs = append([]Instr(nil), f.Instrs...)
+			for i := range f.Instrs {
+				l.relinkInstr(ui, &f.Instrs[i])
+			}
+			l.out.Functions = append(l.out.Functions, f)
+		}
+	}
+}
+
+func (l *linker) relinkInstr(ui int, ins *Instr) {
+	switch ins.Op {
+	case OpAddrString:
+		ins.Int = int64(l.strs[ui][ins.Int])
+	case OpAddrGlobal, OpLoadConst, OpAddrFunc:
+		ins.Global = l.globals[ui][ins.Global]
+	case OpCall, OpMakeClosure:
+		ins.Global = l.globals[ui][ins.Global]
+		ins.Sig = l.sigs[ui][ins.Sig]
+	case OpCallIndirect:
+		ins.Sig = l.sigs[ui][ins.Sig]
+	case OpFieldAddr, OpBitFieldLoad, OpBitFieldStore, OpAllocDynamicObject:
+		ins.Layout += l.layouts[ui]
+	}
+}
+
+func (l *linker) emitDebugInfo() {
+	files := map[string]int{}
+	for ui, u := range l.units {
+		d := u.Module.Debug
+		if d == nil {
+			continue
+		}
+		if l.out.Debug == nil {
+			l.out.Debug = &DebugInfo{}
+		}
+		fileIDs := make([]int, len(d.Files))
+		for i, name := range d.Files {
+			id, ok := files[name]
+			if !ok {
+				id = len(l.out.Debug.Files)
+				l.out.Debug.Files = append(l.out.Debug.Files, name)
+				files[name] = id
+			}
+			fileIDs[i] = id
+		}
+		for _, fd := range d.Functions {
+			lines := make([]LineEntry, len(fd.Lines))
+			for i, line := range fd.Lines {
+				line.File = fileIDs[line.File]
+				lines[i] = line
+			}
+			l.out.Debug.Functions = append(l.out.Debug.Functions, FunctionDebugInfo{Func: fd.Func + l.funcBase[ui], Lines: lines})
+		}
+	}
+}
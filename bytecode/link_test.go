@@ -0,0 +1,83 @@
+package bytecode
+
+import (
+	"strings"
+	"testing"
+)
+
+func linkCallerModule(calleeSig FuncSig) *Module {
+	return &Module{
+		Version: CurrentModuleVersion,
+		Entry:   &EntryPoint{Global: 0, Name: "main"},
+		Target:  DefaultTarget(),
+		Globals: []Global{
+			{ID: 0, Name: "main", Kind: GlobalFunc, Func: 0, Sig: 0},
+			{ID: 1, Name: "helper", Kind: GlobalExtern, Func: -1, Sig: 1, Extern: ExternRef{Name: "helper", ABI: DefaultExternABI}},
+		},
+		Sigs: []FuncSig{{ID: 0, Ret: TypeI32}, {ID: 1, Ret: calleeSig.Ret, Params: calleeSig.Params, Variadic: calleeSig.Variadic}},
+		Functions: []Function{{
+			ID:       0,
+			GlobalID: 0,
+			Name:     "main",
+			Sig:      0,
+			Instrs:   []Instr{Call(1, 1, 0), Return(TypeI32)},
+		}},
+	}
+}
+
+func linkHelperModule(internal bool) *Module {
+	return &Module{
+		Version: CurrentModuleVersion,
+		Entry:   &EntryPoint{Global: NoEntryGlobal},
+		Target:  DefaultTarget(),
+		Globals: []Global{{ID: 0, Name: "helper", Kind: GlobalFunc, Func: 0, Sig: 0, Internal: internal}},
+		Sigs:    []FuncSig{{ID: 0, Ret: TypeI32}},
+		Functions: []Function{{
+			ID:       0,
+			GlobalID: 0,
+			Name:     "helper",
+			Sig:      0,
+			Instrs:   []Instr{I32Const(7), Return(TypeI32)},
+		}},
+	}
+}
+
+func TestLinkBindsExternToDefinitionInLaterUnit(t *testing.T) {
+	mod, err := Link([]LinkUnit{
+		{Name: "main", Module: linkCallerModule(FuncSig{Ret: TypeI32})},
+		{Name: "helper", Module: linkHelperModule(false)},
+	}, LinkOptions{})
+	if err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if len(mod.Globals) != 2 || len(mod.Functions) != 2 || len(mod.Sigs) != 1 {
+		t.Fatalf("linked module has %d globals, %d functions, %d sigs; want 2, 2, 1\n%s", len(mod.Globals), len(mod.Functions), len(mod.Sigs), PrintModule(mod))
+	}
+	call := mod.Functions[0].Instrs[0]
+	if g := mod.Globals[call.Global]; g.Kind != GlobalFunc || g.Name != "helper" || g.Func != 1 {
+		t.Fatalf("call target = %+v, want helper function 1", g)
+	}
+	if mod.Entry.Global != 0 || mod.Entry.Name != "main" {
+		t.Fatalf("entry = %+v, want main", mod.Entry)
+	}
+}
+
+func TestLinkKeepsInternalDefinitionsPrivate(t *testing.T) {
+	_, err := Link([]LinkUnit{
+		{Name: "main", Module: linkCallerModule(FuncSig{Ret: TypeI32})},
+		{Name: "helper", Module: linkHelperModule(true)},
+	}, LinkOptions{HostSymbol: func(Global) bool { return false }})
+	if err == nil || !strings.Contains(err.Error(), `undefined symbol "helper" referenced in main`) {
+		t.Fatalf("Link error = %v, want undefined helper", err)
+	}
+}
+
+func TestLinkRejectsConflictingSignature(t *testing.T) {
+	_, err := Link([]LinkUnit{
+		{Name: "main", Module: linkCallerModule(FuncSig{Ret: TypeI32, Variadic: true})},
+		{Name: "helper", Module: linkHelperModule(false)},
+	}, LinkOptions{})
+	if err == nil || !strings.Contains(err.Error(), "conflicts with its definition") {
+		t.Fatalf("Link error = %v, want signature conflict", err)
+	}
+}
@@ -47,19 +47,38 @@ func PrintModule(m *Module) string {
 	for _, f := range m.Functions {
 		printFunction(&b, f)
 	}
+	if m.Debug != nil {
+		printDebugInfo(&b, m.Debug)
+	}
 	return b.String()
 }
 
+func printDebugInfo(b *strings.Builder, d *DebugInfo) {
+	for i, f := range d.Files {
+		fmt.Fprintf(b, "DebugFile #%d name=%q\n", i, f)
+	}
+	for _, fd := range d.Functions {
+		fmt.Fprintf(b, "DebugFunc func=%d lines=%d\n", fd.Func, len(fd.Lines))
+		for _, l := range fd.Lines {
+			fmt.Fprintf(b, "  %04d: file=%d %d:%d-%d:%d\n", l.PC, l.File, l.Line, l.Column, l.EndLine, l.EndColumn)
+		}
+	}
+}
+
 func printGlobal(b *strings.Builder, m *Module, g Global) {
+	linkage := ""
+	if g.Internal {
+		linkage = " linkage=internal"
+	}
 	switch g.Kind {
 	case GlobalFunc:
-		fmt.Fprintf(b, "Global #%d func name=%q func=%d sig=%d\n", g.ID, g.Name, g.Func, g.Sig)
+		fmt.Fprintf(b, "Global #%d func name=%q func=%d sig=%d%s\n", g.ID, g.Name, g.Func, g.Sig, linkage)
 	case GlobalExtern:
 		fmt.Fprintf(b, "Global #%d extern name=%q size=%d align=%d sig=%d import_module=%q import_name=%q abi=%q\n",
 			g.ID, g.Name, g.Size, g.Align, g.Sig, g.Extern.Module, g.Extern.Name, g.Extern.ABI)
 	default:
-		fmt.Fprintf(b, "Global #%d var name=%q size=%d align=%d readonly=%v init_zero=%d init_bytes=%d init_relocs=%d\n",
-			g.ID, g.Name, g.Size, g.Align, g.Readonly, g.Init.ZeroFill, len(g.Init.Bytes), len(g.Init.Relocations))
+		fmt.Fprintf(b, "Global #%d var name=%q size=%d align=%d readonly=%v init_zero=%d init_bytes=%d init_relocs=%d%s\n",
+			g.ID, g.Name, g.Size, g.Align, g.Readonly, g.Init.ZeroFill, len(g.Init.Bytes), len(g.Init.Relocations), linkage)
 		if len(g.Init.Bytes) > 0 {
 			fmt.Fprintf(b, "  InitBytes hex=%x\n", g.Init.Bytes)
 		}
@@ -195,7 +214,7 @@ func FormatInstr(i Instr) string {
 	case OpVaStart:
 		return fmt.Sprintf("VaStart slot=%d", i.Slot)
 	case OpVaArg:
-		return fmt.Sprintf("%sVaArg", instrTypePrefix(i.Type))
+		return fmt.Sprintf("%sVaArg slot=%d", instrTypePrefix(i.Type), i.Slot)
 	case OpVaCopy:
 		return fmt.Sprintf("VaCopy dst=%d src=%d", i.Slot, i.Object)
 	case OpVaEnd:
@@ -227,7 +227,7 @@ func TestFormatInstrCoversCurrentOpcodeEnum(t *testing.T) {
 		{"call-indirect", Instr{Op: OpCallIndirect, Sig: 2, Argc: 3}, "CallIndirect sig=2 argc=3"},
 		{"make-closure", MakeClosure(1, 2, 3), "MakeClosure global=1 sig=2 argc=3"},
 		{"va-start", Instr{Op: OpVaStart, Slot: 1}, "VaStart slot=1"},
-		{"va-arg", Instr{Op: OpVaArg, Type: TypeI64}, "I64VaArg"},
+		{"va-arg", Instr{Op: OpVaArg, Type: TypeI64, Slot: 1}, "I64VaArg slot=1"},
 		{"va-copy", Instr{Op: OpVaCopy, Slot: 2, Object: 1}, "VaCopy dst=2 src=1"},
 		{"va-end", Instr{Op: OpVaEnd, Slot: 1}, "VaEnd slot=1"},
 		{"invalid", Instr{Op: Opcode(999), Type: TypeI32, Int: 7}, "InvalidOpcode(999)"},
@@ -107,6 +107,7 @@ type Module struct {
 	Strings   []StringConst
 	Layouts   []ObjectLayout
 	Sigs      []FuncSig
+	Debug     *DebugInfo
 }
 
 type EntryPoint struct {
@@ -139,6 +140,9 @@ type Global struct {
 	Size     int64
 	Align    int64
 	Readonly bool
+	// Internal globals have internal or no linkage and are never matched
+	// against other modules' externs when linking.
+	Internal bool
 	Init     InitData
 }
 
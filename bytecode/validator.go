@@ -75,7 +75,7 @@ func ValidateModule(m *Module) error {
 			return err
 		}
 	}
-	return nil
+	return validateDebugInfo(m)
 }
 
 func validateFunctionLikeGlobalSig(m *Module, g Global) error {
@@ -117,6 +117,9 @@ func validateGlobalBinding(g Global) error {
 		if g.Extern.ABI == "" {
 			return fmt.Errorf("extern global %q has empty ABI", g.Name)
 		}
+		if g.Internal {
+			return fmt.Errorf("extern global %q has internal linkage", g.Name)
+		}
 	case GlobalFunc, GlobalVar:
 		if g.Extern != (ExternRef{}) {
 			return fmt.Errorf("non-extern global %q has extern binding metadata", g.Name)
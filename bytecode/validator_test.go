@@ -741,3 +741,14 @@ func moduleWithCallee() *Module {
 		},
 	}
 }
+
+func TestValidateModuleRejectsDebugInfoPCOutsideFunction(t *testing.T) {
+	mod := minimalModule()
+	mod.Debug = &DebugInfo{
+		Files:     []string{"main.c"},
+		Functions: []FunctionDebugInfo{{Func: 0, Lines: []LineEntry{{PC: len(mod.Functions[0].Instrs) + 1, Line: 1, Column: 1}}}},
+	}
+	if err := ValidateModule(mod); err == nil || !strings.Contains(err.Error(), "debug info") {
+		t.Fatalf("ValidateModule error = %v, want debug info error", err)
+	}
+}
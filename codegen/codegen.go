@@ -8,11 +8,16 @@ import (
 )
 
 func Generate(prog *sema.Program) (*bytecode.Module, error) {
+	return GenerateWithOptions(prog, Options{})
+}
+
+func GenerateWithOptions(prog *sema.Program, opts Options) (*bytecode.Module, error) {
 	if err := sema.ValidateProgramInvariants(prog); err != nil {
 		return nil, err
 	}
 	g := &generator{
 		prog:                     prog,
+		opts:                     opts,
 		mod:                      bytecode.NewModule(),
 		globalMap:                map[*sema.Symbol]int{},
 		externMap:                map[string]int{},
@@ -26,6 +31,10 @@ func Generate(prog *sema.Program) (*bytecode.Module, error) {
 		nestedCaptures:           map[*sema.FuncDef][]capture{},
 		capturedByOwner:          map[*sema.FuncDef]map[*sema.Symbol]bool{},
 	}
+	if opts.DebugInfo {
+		g.mod.Debug = &bytecode.DebugInfo{}
+		g.debugFiles = map[string]int{}
+	}
 	g.prepareNestedCaptures()
 	if err := g.emitModule(); err != nil {
 		return nil, err
@@ -33,11 +42,15 @@ func Generate(prog *sema.Program) (*bytecode.Module, error) {
 	if err := bytecode.ValidateModule(g.mod); err != nil {
 		return nil, err
 	}
+	if err := Optimize(g.mod, opts.OptLevel); err != nil {
+		return nil, err
+	}
 	return g.mod, nil
 }
 
 type generator struct {
 	prog                     *sema.Program
+	opts                     Options
 	mod                      *bytecode.Module
 	globalMap                map[*sema.Symbol]int
 	externMap                map[string]int
@@ -51,6 +64,7 @@ type generator struct {
 	nestedCaptures           map[*sema.FuncDef][]capture
 	capturedByOwner          map[*sema.FuncDef]map[*sema.Symbol]bool
 	fn                       *funcGen
+	debugFiles               map[string]int
 }
 
 type funcGen struct {
@@ -81,6 +95,9 @@ type funcGen struct {
 	labelCleanupMarks     map[*sema.LabeledStmt]int
 	caseLabels            map[*sema.CaseStmt]int
 	defaultLabels         map[*sema.DefaultStmt]int
+	lines                 []bytecode.LineEntry
+	line                  bytecode.LineEntry
+	hasLine               bool
 }
 
 func (g *generator) emitModule() error {
@@ -146,10 +163,12 @@ func (g *generator) addGlobal(sym *sema.Symbol, kind bytecode.GlobalKind, fnInde
 			g.mod.Globals[id].Kind = kind
 			g.mod.Globals[id].Func = fnIndex
 			g.mod.Globals[id].Extern = bytecode.ExternRef{}
+			g.mod.Globals[id].Internal = g.internalLinkage(sym, fnIndex)
 		}
 		if kind == bytecode.GlobalVar && g.mod.Globals[id].Kind == bytecode.GlobalExtern {
 			g.mod.Globals[id].Kind = kind
 			g.mod.Globals[id].Extern = bytecode.ExternRef{}
+			g.mod.Globals[id].Internal = g.internalLinkage(sym, fnIndex)
 			g.mod.Globals[id].Size = g.sizeof(sym.T)
 			g.mod.Globals[id].Align = g.alignof(sym.T)
 			g.mod.Globals[id].Init.ZeroFill = g.mod.Globals[id].Size
@@ -166,6 +185,8 @@ func (g *generator) addGlobal(sym *sema.Symbol, kind bytecode.GlobalKind, fnInde
 	global := bytecode.Global{ID: id, Name: sym.Name, Kind: kind, Func: fnIndex, Sig: bytecode.NoFuncSig}
 	if kind == bytecode.GlobalExtern {
 		global.Extern = externRefForSymbol(sym)
+	} else {
+		global.Internal = g.internalLinkage(sym, fnIndex)
 	}
 	if kind == bytecode.GlobalVar || (kind == bytecode.GlobalExtern && sym.Kind == sema.SymVar) {
 		global.Size = g.sizeof(sym.T)
@@ -184,6 +205,16 @@ func (g *generator) addGlobal(sym *sema.Symbol, kind bytecode.GlobalKind, fnInde
 	return id, nil
 }
 
+// internalLinkage reports whether a defined global must stay private to this
+// module. C99 inline definitions are included: they never provide the
+// external definition of a function.
+func (g *generator) internalLinkage(sym *sema.Symbol, fnIndex int) bool {
+	if sym.Linkage != sema.LinkageExternal || sym.Storage == sema.StorageStatic {
+		return true
+	}
+	return fnIndex >= 0 && fnIndex < len(g.prog.Funcs) && g.prog.Funcs[fnIndex].IsInlineDefinition
+}
+
 func externRefForSymbol(sym *sema.Symbol) bytecode.ExternRef {
 	return bytecode.ExternRef{
 		Name: sym.Name,
@@ -356,6 +387,7 @@ func (g *generator) emitFunction(fn *sema.FuncDef) error {
 	for sym, slots := range capturedSizeSlots {
 		fg.dynamicSizeSymbolMap[sym] = slots
 	}
+	fg.enterSource(fn)
 	for _, p := range fn.Params {
 		objectID, ok := objectMap[p.Sym]
 		if !ok {
@@ -385,6 +417,7 @@ func (g *generator) emitFunction(fn *sema.FuncDef) error {
 	if err := fg.emitImplicitTerminal(); err != nil {
 		return err
 	}
+	fg.finishDebugInfo()
 	g.mod.Functions = append(g.mod.Functions, *fg.out)
 	if fn.Sym.GlobalID >= 0 && fn.Sym.GlobalID < len(g.mod.Globals) {
 		g.mod.Globals[fn.Sym.GlobalID].Func = f.ID
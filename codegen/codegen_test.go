@@ -1289,3 +1289,27 @@ func labelBeforePostStore(t *testing.T, fn bytecode.Function, slot int) int {
 	t.Fatalf("missing post label before increment of local slot %d in %#v", slot, fn.Instrs)
 	return -1
 }
+
+func TestGenerateWithDebugInfoRecordsStatementLines(t *testing.T) {
+	prog := analyzeProgram(t, "int main(void) {\n  int x = 1;\n  x = x + 2;\n  return x;\n}\n")
+	mod, err := GenerateWithOptions(prog, Options{DebugInfo: true, FileName: "main.c"})
+	if err != nil {
+		t.Fatalf("codegen: %v", err)
+	}
+	if mod.Debug == nil || len(mod.Debug.Functions) != 1 {
+		t.Fatalf("debug info = %#v, want one function table", mod.Debug)
+	}
+	fn := mod.Functions[0]
+	ret := instrPC(t, fn, func(ins bytecode.Instr) bool { return ins.Op == bytecode.OpReturn })
+	loc, ok := mod.Debug.Lookup(fn.ID, ret)
+	if !ok || loc.File != "main.c" || loc.Line != 4 {
+		t.Fatalf("return location = %v, %v; want main.c line 4", loc, ok)
+	}
+	plain, err := Generate(prog)
+	if err != nil {
+		t.Fatalf("codegen: %v", err)
+	}
+	if plain.Debug != nil {
+		t.Fatalf("Generate attached debug info by default")
+	}
+}
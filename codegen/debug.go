@@ -0,0 +1,105 @@
+package codegen
+
+import (
+	"shinya.click/cvm/bytecode"
+	"shinya.click/cvm/entity"
+	"shinya.click/cvm/sema"
+)
+
+// Options controls optional codegen output.
+type Options struct {
+	// DebugInfo attaches a pc -> source line table to the module.
+	DebugInfo bool
+	// FileName is used for positions that Locate cannot resolve.
+	FileName string
+	// Locate maps a token position to its presumed file, line and column.
+	// When nil the raw line and column of the position are used.
+	Locate func(entity.SourcePos) (file string, line, column int)
+	// OptLevel selects the bytecode optimization passes run by Optimize;
+	// 0 emits the code exactly as generated.
+	OptLevel int
+}
+
+func (g *generator) sourceLocation(pos entity.SourcePos) (string, int, int) {
+	if g.opts.Locate != nil {
+		file, line, column := g.opts.Locate(pos)
+		if line > 0 {
+			if file == "" {
+				file = g.opts.FileName
+			}
+			return file, line, column
+		}
+	}
+	return g.opts.FileName, pos.Line, pos.Column
+}
+
+func (g *generator) debugFile(name string) int {
+	if id, ok := g.debugFiles[name]; ok {
+		return id
+	}
+	id := len(g.mod.Debug.Files)
+	g.mod.Debug.Files = append(g.mod.Debug.Files, name)
+	g.debugFiles[name] = id
+	return id
+}
+
+func (g *generator) lineEntry(r entity.SourceRange) (bytecode.LineEntry, bool) {
+	file, line, column := g.sourceLocation(r.SourceStart)
+	if line <= 0 {
+		return bytecode.LineEntry{}, false
+	}
+	entry := bytecode.LineEntry{File: g.debugFile(file), Line: line, Column: column}
+	if endFile, endLine, endColumn := g.sourceLocation(r.SourceEnd); endFile == file && endLine >= line {
+		entry.EndLine, entry.EndColumn = endLine, endColumn
+	}
+	return entry, true
+}
+
+// enterSource records n as the source of the instructions emitted until the
+// returned function is called, which restores the enclosing location.
+func (fg *funcGen) enterSource(n sema.Node) func() {
+	if fg.g.mod.Debug == nil || n == nil {
+		return func() {}
+	}
+	entry, ok := fg.g.lineEntry(n.Pos())
+	if !ok {
+		return func() {}
+	}
+	prev, hadPrev := fg.line, fg.hasLine
+	fg.setLine(entry)
+	return func() {
+		if hadPrev {
+			fg.setLine(prev)
+		}
+	}
+}
+
+func (fg *funcGen) setLine(entry bytecode.LineEntry) {
+	entry.PC = len(fg.out.Instrs)
+	fg.line, fg.hasLine = entry, true
+	n := len(fg.lines)
+	if n > 0 && fg.lines[n-1].PC == entry.PC {
+		fg.lines = fg.lines[:n-1]
+		n--
+	}
+	if n > 0 && sameLine(fg.lines[n-1], entry) {
+		return
+	}
+	fg.lines = append(fg.lines, entry)
+}
+
+func sameLine(a, b bytecode.LineEntry) bool {
+	a.PC, b.PC = 0, 0
+	return a == b
+}
+
+func (fg *funcGen) finishDebugInfo() {
+	if fg.g.mod.Debug == nil {
+		return
+	}
+	lines := fg.lines
+	for len(lines) > 0 && lines[len(lines)-1].PC >= len(fg.out.Instrs) {
+		lines = lines[:len(lines)-1]
+	}
+	fg.g.mod.Debug.Functions = append(fg.g.mod.Debug.Functions, bytecode.FunctionDebugInfo{Func: fg.out.ID, Lines: lines})
+}
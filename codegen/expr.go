@@ -8,6 +8,7 @@ import (
 )
 
 func (fg *funcGen) emitValue(e sema.Expr) error {
+	defer fg.enterSource(e)()
 	switch x := e.(type) {
 	case *sema.IntLit:
 		t, err := fg.g.lowerValueType(x.T)
@@ -37,6 +37,9 @@ func TestGCCBytecodeCompileSuite(t *testing.T) {
 			if err := bytecode.ValidateModule(mod); err != nil {
 				t.Fatalf("validate bytecode: %v\n%s", err, bytecode.PrintModule(mod))
 			}
+			if err := Optimize(mod, 1); err != nil {
+				t.Fatalf("-O1: %v", err)
+			}
 		})
 	}
 }
@@ -504,6 +504,7 @@ func (g *generator) ensureStaticCompoundLiteral(cl *sema.CompoundLit) (int, erro
 		Size:     g.sizeof(cl.T),
 		Align:    g.alignof(cl.T),
 		Readonly: isConst(cl.T),
+		Internal: true,
 	}
 	global.Init = bytecode.InitData{ZeroFill: global.Size}
 	g.mod.Globals = append(g.mod.Globals, global)
@@ -1245,7 +1246,9 @@ func (fg *funcGen) fieldAddress(base address, container sema.Type, field *sema.F
 		return address{emit: base.emit, bit: true, layout: layout.ID, field: fieldID, valueType: vt, volatile: layout.Bit[fieldID].Volatile || isVolatile(field.T)}, nil
 	}
 	addr := fg.offsetAddress(base, field.Offset)
-	if align := fg.g.alignof(field.T); align > 1 && field.Offset%align != 0 {
+	// Structs are only byte aligned, so member stores cannot assume more,
+	// matching loadStoreAlign.
+	if fg.g.alignof(field.T) > 1 {
 		addr.align = 1
 	}
 	return addr, nil
@@ -0,0 +1,717 @@
+package codegen
+
+import (
+	"fmt"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// maxOptRounds bounds how often the pass list is repeated while it keeps
+// finding work; one pass usually exposes a little more for the others.
+const maxOptRounds = 8
+
+type optPass struct {
+	name string
+	run  func(*optFunc) bool
+}
+
+var o1Passes = []optPass{
+	{"constant-fold", foldConstants},
+	{"jump-thread", threadJumps},
+	{"unreachable", removeUnreachable},
+	{"peephole", peephole},
+	{"dead-locals", removeDeadLocals},
+}
+
+// Optimize rewrites the functions of m in place. Level 0 leaves m untouched
+// and level 1 or above runs the -O1 passes. The module is re-validated after
+// every pass that changed code, and line tables follow the instructions they
+// describe.
+func Optimize(m *bytecode.Module, level int) error {
+	if level <= 0 {
+		return nil
+	}
+	funcs := make([]*optFunc, len(m.Functions))
+	for i := range m.Functions {
+		funcs[i] = newOptFunc(m, i)
+	}
+	for round := 0; round < maxOptRounds; round++ {
+		changed := false
+		for _, pass := range o1Passes {
+			passChanged := false
+			for _, f := range funcs {
+				if pass.run(f) {
+					f.commit()
+					passChanged = true
+				}
+			}
+			if !passChanged {
+				continue
+			}
+			changed = true
+			if err := bytecode.ValidateModule(m); err != nil {
+				return fmt.Errorf("codegen -O%d %s pass produced invalid bytecode: %w", level, pass.name, err)
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return nil
+}
+
+// optFunc is the working copy of one function. Every instruction remembers
+// the line table entry it came from, so passes may freely drop, merge and
+// replace instructions.
+type optFunc struct {
+	fn      *bytecode.Function
+	labels  map[int]bytecode.Label
+	code    []optInstr
+	debug   *bytecode.FunctionDebugInfo
+	entries []bytecode.LineEntry
+}
+
+type optInstr struct {
+	bytecode.Instr
+	// line indexes optFunc.entries, or is -1 when no entry covers the
+	// instruction.
+	line int
+}
+
+func newOptFunc(m *bytecode.Module, index int) *optFunc {
+	fn := &m.Functions[index]
+	f := &optFunc{fn: fn, labels: map[int]bytecode.Label{}, code: make([]optInstr, len(fn.Instrs))}
+	for _, l := range fn.Labels {
+		f.labels[l.ID] = l
+	}
+	if m.Debug != nil {
+		for i := range m.Debug.Functions {
+			if m.Debug.Functions[i].Func == index {
+				f.debug = &m.Debug.Functions[i]
+				f.entries = append([]bytecode.LineEntry(nil), f.debug.Lines...)
+				break
+			}
+		}
+	}
+	entry := -1
+	for pc, ins := range fn.Instrs {
+		for entry+1 < len(f.entries) && f.entries[entry+1].PC <= pc {
+			entry++
+		}
+		f.code[pc] = optInstr{Instr: ins, line: entry}
+	}
+	return f
+}
+
+// commit writes the working code back into the function, dropping label
+// declarations whose marker is gone and rebuilding the line table.
+func (f *optFunc) commit() {
+	instrs := make([]bytecode.Instr, len(f.code))
+	marked := map[int]bool{}
+	for pc, c := range f.code {
+		instrs[pc] = c.Instr
+		if c.Op == bytecode.OpLabel {
+			marked[c.Label] = true
+		}
+	}
+	f.fn.Instrs = instrs
+	var labels []bytecode.Label
+	for _, l := range f.fn.Labels {
+		if marked[l.ID] {
+			labels = append(labels, l)
+		}
+	}
+	f.fn.Labels = labels
+	if f.debug == nil {
+		return
+	}
+	var lines []bytecode.LineEntry
+	prev := -1
+	for pc, c := range f.code {
+		if c.line == prev {
+			continue
+		}
+		prev = c.line
+		var entry bytecode.LineEntry
+		switch {
+		case c.line >= 0:
+			entry = f.entries[c.line]
+		case len(lines) > 0:
+			// A zero line ends the previous entry without claiming a location.
+			entry = bytecode.LineEntry{File: lines[len(lines)-1].File}
+		default:
+			continue
+		}
+		entry.PC = pc
+		lines = append(lines, entry)
+	}
+	f.debug.Lines = lines
+}
+
+func isTerminal(op bytecode.Opcode) bool {
+	switch op {
+	case bytecode.OpJump, bytecode.OpReturn, bytecode.OpReturnVoid, bytecode.OpReturnObject, bytecode.OpUnreachable:
+		return true
+	}
+	return false
+}
+
+// branchTargets calls fn for every label operand of ins.
+func branchTargets(ins *bytecode.Instr, fn func(*int)) {
+	switch ins.Op {
+	case bytecode.OpJump, bytecode.OpJumpIfZero, bytecode.OpJumpIfNonZero:
+		fn(&ins.Label)
+	case bytecode.OpSwitch:
+		fn(&ins.Label)
+		for i := range ins.Labels {
+			fn(&ins.Labels[i].Label)
+		}
+	}
+}
+
+func sameValueTypes(a, b []bytecode.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// foldConstants evaluates integer arithmetic, casts and branches whose
+// operands are constants. Floating-point operations are left alone because
+// their result depends on the runtime rounding mode and raises fenv flags,
+// and operations that would trap keep trapping at run time.
+func foldConstants(f *optFunc) bool {
+	changed := false
+	out := make([]optInstr, 0, len(f.code))
+	for _, c := range f.code {
+		out = append(out, c)
+		n := len(out)
+		switch c.Op {
+		case bytecode.OpBinary:
+			if n < 3 || !isIntConst(out[n-3].Instr, c.Type) || !isIntConst(out[n-2].Instr, c.Type) {
+				continue
+			}
+			v, ok := foldBinary(c.Type, c.Binary, uint64(out[n-3].Int), uint64(out[n-2].Int))
+			if !ok {
+				continue
+			}
+			t := c.Type
+			if c.Binary >= bytecode.BinEq {
+				t = bytecode.TypeBool
+			}
+			out = append(out[:n-3], optInstr{Instr: bytecode.Const(t, int64(v)), line: out[n-3].line})
+		case bytecode.OpUnary:
+			if n < 2 || c.Unary != bytecode.UnaryNeg || !isIntConst(out[n-2].Instr, c.Type) {
+				continue
+			}
+			v := maskToWidth(uint64(-signedValue(c.Type, uint64(out[n-2].Int))), bitWidth(c.Type))
+			out = append(out[:n-2], optInstr{Instr: bytecode.Const(c.Type, int64(v)), line: out[n-2].line})
+		case bytecode.OpCast:
+			if n < 2 || out[n-2].Op != bytecode.OpConst || out[n-2].Type != c.Type {
+				continue
+			}
+			folded, ok := foldCast(c.Instr, out[n-2].Instr)
+			if !ok {
+				continue
+			}
+			out = append(out[:n-2], optInstr{Instr: folded, line: out[n-2].line})
+		case bytecode.OpJumpIfZero, bytecode.OpJumpIfNonZero:
+			if n < 2 || out[n-2].Op != bytecode.OpConst || out[n-2].Type != c.Type {
+				continue
+			}
+			taken := constIsZero(out[n-2].Instr) == (c.Op == bytecode.OpJumpIfZero)
+			out = out[:n-2]
+			if taken {
+				out = append(out, optInstr{Instr: bytecode.Jump(c.Label), line: c.line})
+			}
+		case bytecode.OpSwitch:
+			if n < 2 || !isIntConst(out[n-2].Instr, c.Type) {
+				continue
+			}
+			target := c.Label
+			for _, sc := range c.Labels {
+				if switchMatches(c.Type, uint64(out[n-2].Int), sc.Value) {
+					target = sc.Label
+					break
+				}
+			}
+			out = append(out[:n-2], optInstr{Instr: bytecode.Jump(target), line: c.line})
+		default:
+			continue
+		}
+		changed = true
+	}
+	f.code = out
+	return changed
+}
+
+func isIntConst(ins bytecode.Instr, t bytecode.ValueType) bool {
+	return ins.Op == bytecode.OpConst && ins.Type == t && bitWidth(t) > 0 && t != bytecode.TypePtr && t != bytecode.TypeObjectAddr
+}
+
+func constIsZero(ins bytecode.Instr) bool {
+	switch ins.Type {
+	case bytecode.TypeF32, bytecode.TypeF64, bytecode.TypeFLong:
+		return ins.Float == 0
+	}
+	return ins.Int == 0
+}
+
+// The helpers below mirror the runtime's integer semantics exactly: values
+// are kept as raw 64-bit patterns and narrowed to the type width on use.
+
+func bitWidth(t bytecode.ValueType) uint {
+	switch t {
+	case bytecode.TypeBool, bytecode.TypeI8, bytecode.TypeU8:
+		return 8
+	case bytecode.TypeI16, bytecode.TypeU16:
+		return 16
+	case bytecode.TypeI32, bytecode.TypeU32:
+		return 32
+	case bytecode.TypeI64, bytecode.TypeU64, bytecode.TypePtr, bytecode.TypeObjectAddr:
+		return 64
+	}
+	return 0
+}
+
+func isSignedValueType(t bytecode.ValueType) bool {
+	switch t {
+	case bytecode.TypeI8, bytecode.TypeI16, bytecode.TypeI32, bytecode.TypeI64:
+		return true
+	}
+	return false
+}
+
+func maskToWidth(v uint64, width uint) uint64 {
+	if width >= 64 {
+		return v
+	}
+	return v & (uint64(1)<<width - 1)
+}
+
+func signedValue(t bytecode.ValueType, v uint64) int64 {
+	width := bitWidth(t)
+	u := maskToWidth(v, width)
+	if width >= 64 {
+		return int64(u)
+	}
+	if u&(uint64(1)<<(width-1)) == 0 {
+		return int64(u)
+	}
+	return int64(u | ^(uint64(1)<<width - 1))
+}
+
+func unsignedValue(t bytecode.ValueType, v uint64) uint64 {
+	return maskToWidth(v, bitWidth(t))
+}
+
+func foldBinary(t bytecode.ValueType, op bytecode.BinaryOp, l, r uint64) (uint64, bool) {
+	width := bitWidth(t)
+	minSigned := int64(-1) << (width - 1)
+	boolean := func(b bool) (uint64, bool) {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	shift := func() (uint, bool) {
+		if isSignedValueType(t) {
+			n := signedValue(t, r)
+			return uint(n), n >= 0 && uint64(n) < uint64(width)
+		}
+		n := unsignedValue(t, r)
+		return uint(n), n < uint64(width)
+	}
+	switch op {
+	case bytecode.BinAdd:
+		return maskToWidth(l+r, width), true
+	case bytecode.BinSub:
+		return maskToWidth(l-r, width), true
+	case bytecode.BinMul:
+		return maskToWidth(l*r, width), true
+	case bytecode.BinAnd:
+		return maskToWidth(l&r, width), true
+	case bytecode.BinOr:
+		return maskToWidth(l|r, width), true
+	case bytecode.BinXor:
+		return maskToWidth(l^r, width), true
+	case bytecode.BinDivS, bytecode.BinRemS:
+		ls, rs := signedValue(t, l), signedValue(t, r)
+		if rs == 0 || ls == minSigned && rs == -1 {
+			return 0, false
+		}
+		if op == bytecode.BinDivS {
+			return maskToWidth(uint64(ls/rs), width), true
+		}
+		return maskToWidth(uint64(ls%rs), width), true
+	case bytecode.BinDivU, bytecode.BinRemU:
+		lu, ru := unsignedValue(t, l), unsignedValue(t, r)
+		if ru == 0 {
+			return 0, false
+		}
+		if op == bytecode.BinDivU {
+			return lu / ru, true
+		}
+		return lu % ru, true
+	case bytecode.BinShl:
+		n, ok := shift()
+		return maskToWidth(unsignedValue(t, l)<<n, width), ok
+	case bytecode.BinShrS:
+		n, ok := shift()
+		return maskToWidth(uint64(signedValue(t, l)>>n), width), ok
+	case bytecode.BinShrU:
+		n, ok := shift()
+		return unsignedValue(t, l) >> n, ok
+	case bytecode.BinEq:
+		return boolean(unsignedValue(t, l) == unsignedValue(t, r))
+	case bytecode.BinNe:
+		return boolean(unsignedValue(t, l) != unsignedValue(t, r))
+	case bytecode.BinLtS:
+		return boolean(signedValue(t, l) < signedValue(t, r))
+	case bytecode.BinLtU:
+		return boolean(unsignedValue(t, l) < unsignedValue(t, r))
+	case bytecode.BinLeS:
+		return boolean(signedValue(t, l) <= signedValue(t, r))
+	case bytecode.BinLeU:
+		return boolean(unsignedValue(t, l) <= unsignedValue(t, r))
+	case bytecode.BinGtS:
+		return boolean(signedValue(t, l) > signedValue(t, r))
+	case bytecode.BinGtU:
+		return boolean(unsignedValue(t, l) > unsignedValue(t, r))
+	case bytecode.BinGeS:
+		return boolean(signedValue(t, l) >= signedValue(t, r))
+	case bytecode.BinGeU:
+		return boolean(unsignedValue(t, l) >= unsignedValue(t, r))
+	}
+	return 0, false
+}
+
+func foldCast(cast, c bytecode.Instr) (bytecode.Instr, bool) {
+	if cast.Cast == bytecode.CastBool {
+		if cast.Type2 != bytecode.TypeBool {
+			return bytecode.Instr{}, false
+		}
+		if constIsZero(c) {
+			return bytecode.Const(bytecode.TypeBool, 0), true
+		}
+		return bytecode.Const(bytecode.TypeBool, 1), true
+	}
+	if cast.Type == cast.Type2 {
+		return c, true
+	}
+	if !isIntConst(c, cast.Type) || bitWidth(cast.Type2) == 0 || cast.Type2 == bytecode.TypePtr || cast.Type2 == bytecode.TypeObjectAddr {
+		return bytecode.Instr{}, false
+	}
+	switch cast.Cast {
+	case bytecode.CastTrunc, bytecode.CastZExt:
+		return bytecode.Const(cast.Type2, int64(maskToWidth(unsignedValue(c.Type, uint64(c.Int)), bitWidth(cast.Type2)))), true
+	case bytecode.CastSExt:
+		return bytecode.Const(cast.Type2, int64(maskToWidth(uint64(signedValue(c.Type, uint64(c.Int))), bitWidth(cast.Type2)))), true
+	}
+	return bytecode.Instr{}, false
+}
+
+func switchMatches(t bytecode.ValueType, v uint64, c int64) bool {
+	if isSignedValueType(t) {
+		return signedValue(t, v) == c
+	}
+	return c >= 0 && unsignedValue(t, v) == uint64(c)
+}
+
+// threadJumps retargets branches to a label that is immediately followed by
+// an unconditional jump straight to that jump's destination.
+func threadJumps(f *optFunc) bool {
+	forward := map[int]int{}
+	for pc, c := range f.code {
+		if c.Op != bytecode.OpLabel {
+			continue
+		}
+		next := pc + 1
+		for next < len(f.code) && f.code[next].Op == bytecode.OpLabel {
+			next++
+		}
+		if next < len(f.code) && f.code[next].Op == bytecode.OpJump && f.code[next].Label != c.Label {
+			forward[c.Label] = f.code[next].Label
+		}
+	}
+	if len(forward) == 0 {
+		return false
+	}
+	resolve := func(label int) int {
+		seen := map[int]bool{label: true}
+		for {
+			next, ok := forward[label]
+			if !ok || seen[next] {
+				return label
+			}
+			seen[next] = true
+			label = next
+		}
+	}
+	changed := false
+	for i := range f.code {
+		ins := &f.code[i].Instr
+		if ins.Op == bytecode.OpSwitch {
+			ins.Labels = append([]bytecode.SwitchCase(nil), ins.Labels...)
+		}
+		branchTargets(ins, func(label *int) {
+			if target := resolve(*label); target != *label {
+				*label = target
+				changed = true
+			}
+		})
+	}
+	return changed
+}
+
+// removeUnreachable drops labels nothing branches to and the code between a
+// terminal instruction and the next live label.
+func removeUnreachable(f *optFunc) bool {
+	referenced := map[int]bool{}
+	for i := range f.code {
+		branchTargets(&f.code[i].Instr, func(label *int) { referenced[*label] = true })
+	}
+	changed := false
+	dead := false
+	out := make([]optInstr, 0, len(f.code))
+	for _, c := range f.code {
+		if c.Op == bytecode.OpLabel && referenced[c.Label] {
+			dead = false
+		} else if dead || c.Op == bytecode.OpLabel {
+			changed = true
+			continue
+		}
+		out = append(out, c)
+		dead = isTerminal(c.Op)
+	}
+	f.code = out
+	return changed
+}
+
+// peephole rewrites short instruction sequences into cheaper equivalents.
+// Patterns are matched against the tail of the rewritten code, so one
+// rewrite can enable the next.
+func peephole(f *optFunc) bool {
+	changed := false
+	out := make([]optInstr, 0, len(f.code))
+	for _, c := range f.code {
+		out = append(out, c)
+		for {
+			next, ok := f.peepholeTail(out)
+			if !ok {
+				break
+			}
+			out = next
+			changed = true
+		}
+	}
+	f.code = out
+	return changed
+}
+
+func (f *optFunc) peepholeTail(out []optInstr) ([]optInstr, bool) {
+	n := len(out)
+	if n == 0 {
+		return out, false
+	}
+	last := out[n-1]
+	at := func(back int) *optInstr {
+		if n-back < 0 {
+			return nil
+		}
+		return &out[n-back]
+	}
+	is := func(back int, op bytecode.Opcode) bool {
+		c := at(back)
+		return c != nil && c.Op == op
+	}
+	switch last.Op {
+	case bytecode.OpPop:
+		prev := at(2)
+		if prev == nil {
+			break
+		}
+		switch prev.Op {
+		case bytecode.OpConst, bytecode.OpAddrString, bytecode.OpAddrGlobal, bytecode.OpAddrFunc, bytecode.OpLoadLocal, bytecode.OpAddrLocalObject, bytecode.OpDup:
+			// A value that is pushed and immediately discarded.
+			return out[:n-2], true
+		case bytecode.OpStoreLocal:
+			if is(3, bytecode.OpDup) {
+				// dup; store; pop -> store
+				store := *prev
+				store.line = out[n-3].line
+				return append(out[:n-3], store), true
+			}
+			if n >= 5 && is(5, bytecode.OpDup) && is(3, bytecode.OpBinary) && (is(4, bytecode.OpConst) || is(4, bytecode.OpLoadLocal)) {
+				// dup; push x; op; store; pop -> push x; op; store, as in i++
+				// or x += 1 used as a statement.
+				return append(out[:n-5], out[n-4], out[n-3], out[n-2]), true
+			}
+		}
+	case bytecode.OpLoadLocal:
+		if prev := at(2); prev != nil && prev.Op == bytecode.OpStoreLocal && prev.Slot == last.Slot && prev.Type == last.Type {
+			// store s; load s -> dup; store s
+			store := *prev
+			return append(out[:n-2], optInstr{Instr: bytecode.Instr{Op: bytecode.OpDup}, line: prev.line}, store), true
+		}
+	case bytecode.OpStoreLocal:
+		if prev := at(2); prev != nil && prev.Op == bytecode.OpLoadLocal && prev.Slot == last.Slot && prev.Type == last.Type {
+			return out[:n-2], true
+		}
+	case bytecode.OpSwap:
+		if is(2, bytecode.OpSwap) {
+			return out[:n-2], true
+		}
+	case bytecode.OpCast:
+		if last.Type == last.Type2 && last.Cast != bytecode.CastBool {
+			return out[:n-1], true
+		}
+		if last.Cast == bytecode.CastBool && n >= 3 {
+			widen := out[n-2]
+			if widen.Op == bytecode.OpCast && widen.Cast == bytecode.CastZExt && widen.Type == bytecode.TypeBool && widen.Type2 == last.Type && producesBool(out[n-3].Instr) {
+				// A 0/1 value widened and converted back to bool.
+				return out[:n-2], true
+			}
+		}
+	case bytecode.OpJumpIfZero, bytecode.OpJumpIfNonZero:
+		if prev := at(2); prev != nil && prev.Op == bytecode.OpCast && prev.Type2 == last.Type &&
+			(prev.Cast == bytecode.CastBool || prev.Cast == bytecode.CastZExt && prev.Type == bytecode.TypeBool) {
+			// Branching on a bool conversion or a widened bool tests the same
+			// zero-ness as branching on the operand itself.
+			jump := last
+			jump.Type = prev.Type
+			jump.line = prev.line
+			return append(out[:n-2], jump), true
+		}
+	case bytecode.OpLabel:
+		if n >= 3 && is(2, bytecode.OpJump) && (is(3, bytecode.OpJumpIfZero) || is(3, bytecode.OpJumpIfNonZero)) && out[n-3].Label == last.Label {
+			// jz L; jmp M; L: -> jnz M; L:
+			branch := out[n-3]
+			branch.Label = out[n-2].Label
+			branch.Op = bytecode.OpJumpIfNonZero
+			if out[n-3].Op == bytecode.OpJumpIfNonZero {
+				branch.Op = bytecode.OpJumpIfZero
+			}
+			return append(out[:n-3], branch, last), true
+		}
+		first := n - 1
+		for first > 0 && out[first-1].Op == bytecode.OpLabel {
+			first--
+		}
+		if first == 0 || out[first-1].Op != bytecode.OpJump || !f.fallsInto(out[first:], out[first-1].Label) {
+			break
+		}
+		// A jump to one of the labels that directly follow it.
+		return append(out[:first-1], out[first:]...), true
+	}
+	return out, false
+}
+
+// producesBool reports whether ins always leaves a canonical 0 or 1 bool.
+func producesBool(ins bytecode.Instr) bool {
+	switch ins.Op {
+	case bytecode.OpBinary:
+		return ins.Binary >= bytecode.BinEq
+	case bytecode.OpCast:
+		return ins.Cast == bytecode.CastBool
+	case bytecode.OpConst:
+		return ins.Type == bytecode.TypeBool && (ins.Int == 0 || ins.Int == 1)
+	}
+	return false
+}
+
+// fallsInto reports whether a jump to target can be replaced by falling
+// through the given run of labels, one of which must be target.
+func (f *optFunc) fallsInto(run []optInstr, target int) bool {
+	want := f.labels[target].Stack
+	found := false
+	for _, c := range run {
+		l := f.labels[c.Label]
+		if !sameValueTypes(l.Stack, want) || l.Statement && len(want) != 0 {
+			return false
+		}
+		found = found || c.Label == target
+	}
+	return found
+}
+
+// removeDeadLocals turns stores to slots that are never loaded into pops,
+// then drops and renumbers local slots no instruction mentions.
+func removeDeadLocals(f *optFunc) bool {
+	loads := map[int]int{}
+	for i := range f.code {
+		c := &f.code[i]
+		if c.Op == bytecode.OpStoreLocal {
+			continue
+		}
+		for _, slot := range localOperands(&c.Instr) {
+			loads[*slot]++
+		}
+	}
+	changed := false
+	used := map[int]bool{}
+	for i := range f.code {
+		c := &f.code[i]
+		if c.Op == bytecode.OpStoreLocal && loads[c.Slot] == 0 {
+			c.Instr = bytecode.Instr{Op: bytecode.OpPop}
+			changed = true
+			continue
+		}
+		for _, slot := range localOperands(&c.Instr) {
+			used[*slot] = true
+		}
+	}
+	paramSlots := map[int]bool{}
+	for _, p := range f.fn.Params {
+		paramSlots[p.Slot] = true
+	}
+	renumber := map[int]int{}
+	var locals []bytecode.LocalSlot
+	next := 0
+	for _, l := range f.fn.Locals {
+		if !used[l.ID] {
+			changed = true
+			continue
+		}
+		for paramSlots[next] {
+			next++
+		}
+		if l.ID != next {
+			renumber[l.ID] = next
+			changed = true
+		}
+		l.ID = next
+		locals = append(locals, l)
+		next++
+	}
+	if !changed {
+		return false
+	}
+	f.fn.Locals = locals
+	for i := range f.code {
+		for _, slot := range localOperands(&f.code[i].Instr) {
+			if to, ok := renumber[*slot]; ok {
+				*slot = to
+			}
+		}
+	}
+	return true
+}
+
+// localOperands returns the fields of ins that name local slots. The va_*
+// instructions read their va_list slots, and OpVaCopy names its source slot
+// in Object.
+func localOperands(ins *bytecode.Instr) []*int {
+	switch ins.Op {
+	case bytecode.OpLoadLocal, bytecode.OpStoreLocal, bytecode.OpVaStart, bytecode.OpVaArg, bytecode.OpVaEnd:
+		return []*int{&ins.Slot}
+	case bytecode.OpVaCopy:
+		return []*int{&ins.Slot, &ins.Object}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package codegen
+
+import (
+	"testing"
+
+	"shinya.click/cvm/bytecode"
+)
+
+func optimizedFunction(t *testing.T, source, name string) (*bytecode.Module, *bytecode.Function) {
+	t.Helper()
+	mod, err := GenerateWithOptions(analyzeProgram(t, source), Options{OptLevel: 1, DebugInfo: true, FileName: "opt.c"})
+	if err != nil {
+		t.Fatalf("codegen -O1: %v", err)
+	}
+	for i := range mod.Functions {
+		if mod.Functions[i].Name == name {
+			return mod, &mod.Functions[i]
+		}
+	}
+	t.Fatalf("function %s not found", name)
+	return nil, nil
+}
+
+func countOps(fn *bytecode.Function, op bytecode.Opcode) int {
+	n := 0
+	for _, ins := range fn.Instrs {
+		if ins.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+func TestOptimizeFoldsIntegerConstants(t *testing.T) {
+	_, fn := optimizedFunction(t, `int main(void) { return (1 + 2 * 3) << 2 == 28 ? -(7 % 4) : 5; }`, "main")
+	if n := countOps(fn, bytecode.OpBinary) + countOps(fn, bytecode.OpUnary) + countOps(fn, bytecode.OpJumpIfZero); n != 0 {
+		t.Fatalf("constant expression not folded:\n%s", bytecode.PrintModule(&bytecode.Module{Functions: []bytecode.Function{*fn}}))
+	}
+	if ins := fn.Instrs[0]; ins.Op != bytecode.OpConst || int32(ins.Int) != -3 {
+		t.Fatalf("first instruction = %+v, want const -3", ins)
+	}
+}
+
+func TestOptimizeKeepsTrapsAndFloatingPoint(t *testing.T) {
+	mod, _ := optimizedFunction(t, `int f(void) { return 1 / 0; }
+int g(void) { return 1 << 40; }
+double h(void) { return 0.1 + 0.2; }`, "f")
+	for i := range mod.Functions {
+		if countOps(&mod.Functions[i], bytecode.OpBinary) != 1 {
+			t.Fatalf("%s: trapping or floating-point operation was folded: %+v", mod.Functions[i].Name, mod.Functions[i].Instrs)
+		}
+	}
+}
+
+func TestOptimizeRemovesDeadStoresAndJumps(t *testing.T) {
+	src := `int main(void) {
+	int s = 0, unused = 3;
+	for (int i = 0; i < 10; i++) {
+		if (i % 2 == 0)
+			s += i;
+		else
+			continue;
+	}
+	return s;
+}`
+	plain := compileModule(t, src).Functions[0]
+	mod, fn := optimizedFunction(t, src, "main")
+	if len(fn.Instrs) >= len(plain.Instrs) {
+		t.Fatalf("-O1 has %d instructions, -O0 %d", len(fn.Instrs), len(plain.Instrs))
+	}
+	for _, l := range fn.Locals {
+		if l.Name == "unused" {
+			t.Fatalf("dead local slot kept: %+v", fn.Locals)
+		}
+	}
+	if countOps(fn, bytecode.OpPop) != 0 || countOps(fn, bytecode.OpDup) != 0 {
+		t.Fatalf("dup/store/pop sequence not combined:\n%s", bytecode.PrintModule(mod))
+	}
+	labelPC := map[int]int{}
+	for pc, ins := range fn.Instrs {
+		if ins.Op == bytecode.OpLabel {
+			labelPC[ins.Label] = pc
+		}
+	}
+	for pc, ins := range fn.Instrs {
+		if ins.Op != bytecode.OpJump && ins.Op != bytecode.OpJumpIfZero && ins.Op != bytecode.OpJumpIfNonZero {
+			continue
+		}
+		target := labelPC[ins.Label]
+		for target < len(fn.Instrs) && fn.Instrs[target].Op == bytecode.OpLabel {
+			target++
+		}
+		if fn.Instrs[target].Op == bytecode.OpJump {
+			t.Fatalf("pc %d jumps to a jump:\n%s", pc, bytecode.PrintModule(mod))
+		}
+		if ins.Op == bytecode.OpJump && labelPC[ins.Label] > pc {
+			next := pc + 1
+			for next < labelPC[ins.Label] && fn.Instrs[next].Op == bytecode.OpLabel {
+				next++
+			}
+			if next == labelPC[ins.Label] {
+				t.Fatalf("pc %d jumps past labels only:\n%s", pc, bytecode.PrintModule(mod))
+			}
+		}
+	}
+	for _, l := range fn.Labels {
+		if _, ok := labelPC[l.ID]; !ok {
+			t.Fatalf("label L%d declared without a marker", l.ID)
+		}
+	}
+}
+
+func TestOptimizeKeepsLineTable(t *testing.T) {
+	mod, fn := optimizedFunction(t, "int main(void) {\n\tint x = 1 + 2;\n\treturn x * 2;\n}\n", "main")
+	lines := map[int]bool{}
+	for pc := range fn.Instrs {
+		loc, ok := mod.Debug.Lookup(fn.ID, pc)
+		if !ok {
+			t.Fatalf("pc %d has no source location", pc)
+		}
+		lines[loc.Line] = true
+	}
+	if !lines[2] || !lines[3] {
+		t.Fatalf("lines covered = %v, want 2 and 3", lines)
+	}
+}
+
+func TestOptimizeLevelZeroIsIdentity(t *testing.T) {
+	mod := compileModule(t, `int main(void) { int x = 1 + 2; return x; }`)
+	before := bytecode.PrintModule(mod)
+	if err := Optimize(mod, 0); err != nil {
+		t.Fatal(err)
+	}
+	if after := bytecode.PrintModule(mod); after != before {
+		t.Fatalf("-O0 changed the module:\n%s", after)
+	}
+}
@@ -8,6 +8,7 @@ import (
 )
 
 func (fg *funcGen) emitStmt(s sema.Stmt) error {
+	defer fg.enterSource(s)()
 	switch x := s.(type) {
 	case *sema.Block:
 		scopeMark := len(fg.activeDynamicObjects)
@@ -12,6 +12,7 @@ type MessageLevel int
 const (
 	MessageLevelNote MessageLevel = iota
 	MessageLevelError
+	MessageLevelWarning
 )
 
 type CvmErrorMessages struct {
@@ -36,6 +37,14 @@ func NewNoteMessage(pos entity.SourcePos, customMessage string) *CvmErrorMessage
 	}
 }
 
+func NewWarningMessage(pos entity.SourcePos, customMessage string) *CvmErrorMessages {
+	return &CvmErrorMessages{
+		Level:         MessageLevelWarning,
+		SourcePos:     pos,
+		CustomMessage: customMessage,
+	}
+}
+
 type CvmError struct {
 	Messages []*CvmErrorMessages
 }
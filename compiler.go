@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,40 +12,46 @@ import (
 	"shinya.click/cvm/entity"
 	"shinya.click/cvm/parser"
 	"shinya.click/cvm/preprocessor"
+	cvmruntime "shinya.click/cvm/runtime"
 	"shinya.click/cvm/sema"
 	"strings"
 )
 
 type Compiler struct {
-	FileName     string
-	Source       string
-	Lines        []string
-	Sources      *preprocessor.SourceManager
-	DumpIR       bool
-	DumpBytecode bool
-	EmitBytecode string
-	Output       io.Writer
+	FileName       string
+	Source         string
+	Lines          []string
+	Sources        *preprocessor.SourceManager
+	Preprocessor   preprocessor.Options
+	Sema           sema.SemaOptions
+	PreprocessOnly bool
+	DumpIR         bool
+	DumpBytecode   bool
+	EmitBytecode   string
+	OptLevel       int
+	Output         io.Writer
+	// Diagnostics receives warnings from a successful compile, or the whole
+	// JSON/SARIF document; it defaults to os.Stderr so neither mixes with -E
+	// or dump output.
+	Diagnostics       io.Writer
+	DiagnosticsFormat string
+
+	warnings []*common.CvmError
 }
 
 func (c *Compiler) RunSource(source string) error {
-	if c.FileName == "" {
-		c.FileName = "main.c"
-	}
 	if err := c.validateDumpModes(); err != nil {
 		return err
 	}
-	c.Source = source
-	c.Lines = strings.Split(source, "\n")
-	pp, err := preprocessor.PreprocessSource(c.FileName, source, preprocessor.Options{})
+	pp, err := c.preprocess(source)
 	if err != nil {
 		return err
 	}
-	c.Sources = pp.Sources
-	candidates, err := parser.NewParser(pp.Tokens).Parse()
-	if err != nil {
-		return err
+	if c.PreprocessOnly {
+		fmt.Fprint(c.output(), preprocessor.PrintResult(pp))
+		return nil
 	}
-	prog, err := sema.Analyze(candidates)
+	prog, err := c.analyze(pp)
 	if err != nil {
 		return err
 	}
@@ -53,7 +60,7 @@ func (c *Compiler) RunSource(source string) error {
 		return nil
 	}
 	if c.DumpBytecode {
-		mod, err := codegen.Generate(prog)
+		mod, err := codegen.GenerateWithOptions(prog, codegen.Options{OptLevel: c.OptLevel})
 		if err != nil {
 			return err
 		}
@@ -61,7 +68,7 @@ func (c *Compiler) RunSource(source string) error {
 		return nil
 	}
 	if c.EmitBytecode != "" {
-		mod, err := codegen.Generate(prog)
+		mod, err := codegen.GenerateWithOptions(prog, c.codegenOptions())
 		if err != nil {
 			return err
 		}
@@ -78,6 +85,99 @@ func (c *Compiler) RunSource(source string) error {
 	return nil
 }
 
+// Compile translates source into a bytecode module with debug info, ready to
+// be handed to runtime.LoadModule.
+func (c *Compiler) Compile(source string) (*bytecode.Module, error) {
+	pp, err := c.preprocess(source)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := c.analyze(pp)
+	if err != nil {
+		return nil, err
+	}
+	return codegen.GenerateWithOptions(prog, c.codegenOptions())
+}
+
+// Run compiles fileName and executes it in memory. loadOpts supplies the
+// program arguments and extern registry exactly as for runtime.Load, with
+// argv[0] defaulting to fileName; runOpts sets the limits, quotas and profile
+// of the run.
+func (c *Compiler) Run(ctx context.Context, fileName string, loadOpts cvmruntime.LoadOptions, runOpts cvmruntime.RunOptions) (cvmruntime.ExitStatus, error) {
+	c.FileName = fileName
+	source, err := os.ReadFile(fileName)
+	if err != nil {
+		return cvmruntime.ExitStatus{}, err
+	}
+	mod, err := c.Compile(string(source))
+	if err != nil {
+		return cvmruntime.ExitStatus{}, err
+	}
+	if loadOpts.Args == nil {
+		loadOpts.Args = []string{fileName}
+	}
+	prog, err := cvmruntime.LoadModule(mod, loadOpts)
+	if err != nil {
+		return cvmruntime.ExitStatus{}, err
+	}
+	return cvmruntime.Run(ctx, prog, runOpts)
+}
+
+func (c *Compiler) preprocess(source string) (*preprocessor.Result, error) {
+	if c.FileName == "" {
+		c.FileName = "main.c"
+	}
+	c.Source = source
+	c.warnings = nil
+	c.Lines = strings.Split(source, "\n")
+	pp, err := preprocessor.PreprocessSource(c.FileName, source, c.Preprocessor)
+	if err != nil {
+		return nil, err
+	}
+	c.Sources = pp.Sources
+	return pp, nil
+}
+
+func (c *Compiler) analyze(pp *preprocessor.Result) (*sema.Program, error) {
+	candidates, err := parser.NewParser(pp.Tokens).Parse()
+	if err != nil {
+		return nil, err
+	}
+	// A failed analysis still reports the warnings it gathered.
+	prog, warnings, err := sema.AnalyzeWithWarnings(candidates, c.Sema)
+	c.warnings = warnings
+	if c.DiagnosticsFormat == "" || c.DiagnosticsFormat == DiagnosticsText {
+		for _, warning := range c.warnings {
+			for _, message := range warning.Messages {
+				c.printDiagnostic(c.diagnostics(), message)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+func (c *Compiler) diagnostics() io.Writer {
+	if c.Diagnostics != nil {
+		return c.Diagnostics
+	}
+	return os.Stderr
+}
+
+func (c *Compiler) codegenOptions() codegen.Options {
+	opts := codegen.Options{DebugInfo: true, FileName: c.FileName, OptLevel: c.OptLevel}
+	if c.Sources != nil {
+		sources := c.Sources
+		opts.Locate = func(pos entity.SourcePos) (string, int, int) {
+			loc := sources.DisplayLocation(pos)
+			return loc.File, loc.Line, loc.Column
+		}
+	}
+	return opts
+}
+
 func (c *Compiler) output() io.Writer {
 	if c.Output != nil {
 		return c.Output
@@ -87,13 +187,13 @@ func (c *Compiler) output() io.Writer {
 
 func (c *Compiler) validateDumpModes() error {
 	selected := 0
-	for _, enabled := range []bool{c.DumpIR, c.DumpBytecode, c.EmitBytecode != ""} {
+	for _, enabled := range []bool{c.PreprocessOnly, c.DumpIR, c.DumpBytecode, c.EmitBytecode != ""} {
 		if enabled {
 			selected++
 		}
 	}
 	if selected > 1 {
-		return fmt.Errorf("--dump-ir, --dump-bytecode, and --emit-bytecode are mutually exclusive")
+		return fmt.Errorf("-E, --dump-ir, --dump-bytecode, and --emit-bytecode are mutually exclusive")
 	}
 	return nil
 }
@@ -110,26 +210,34 @@ func (c *Compiler) RunFile(fileName string) error {
 	return c.RunSource(string(source))
 }
 
-func (c *Compiler) handleError(err error) {
+func (c *Compiler) handleError(w io.Writer, err error) {
 	var cvmError *common.CvmError
 	switch {
 	case errors.As(err, &cvmError):
 		for _, message := range cvmError.Messages {
-			file, line, column, text := c.displayErrorLocation(message.SourcePos)
-			fmt.Printf("%s:%d:%d: %s %s\n", file,
-				line, column,
-				common.IfElse(message.Level == common.MessageLevelError, common.RedText("error:"), common.GrayText("note:")),
-				message.CustomMessage)
-			fmt.Printf("    %d | %s\n", line, text)
-			fmt.Printf("    %s | ", spaceByStringLength(fmt.Sprintf("%d", line)))
-			for i := 0; i < column-1; i++ {
-				fmt.Print(" ")
-			}
-			fmt.Printf("%s\n", common.GreenText("^"))
+			c.printDiagnostic(w, message)
 		}
 	default:
-		fmt.Println(err.Error())
+		fmt.Fprintln(w, err.Error())
+	}
+}
+
+func (c *Compiler) printDiagnostic(w io.Writer, message *common.CvmErrorMessages) {
+	file, line, column, text := c.displayErrorLocation(message.SourcePos)
+	label := common.GrayText("note:")
+	switch message.Level {
+	case common.MessageLevelError:
+		label = common.RedText("error:")
+	case common.MessageLevelWarning:
+		label = common.YellowText("warning:")
+	}
+	fmt.Fprintf(w, "%s:%d:%d: %s %s\n", file, line, column, label, message.CustomMessage)
+	fmt.Fprintf(w, "    %d | %s\n", line, text)
+	fmt.Fprintf(w, "    %s | ", spaceByStringLength(fmt.Sprintf("%d", line)))
+	for i := 0; i < column-1; i++ {
+		fmt.Fprint(w, " ")
 	}
+	fmt.Fprintf(w, "%s\n", common.GreenText("^"))
 }
 
 func (c *Compiler) displayErrorLocation(pos entity.SourcePos) (string, int, int, string) {
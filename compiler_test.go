@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 
 	"shinya.click/cvm/bytecode"
+	cvmruntime "shinya.click/cvm/runtime"
+	"shinya.click/cvm/sema"
 )
 
 func TestError(t *testing.T) {
@@ -126,6 +134,38 @@ func TestCompilerEmitBytecodeWritesLoadableBinaryModule(t *testing.T) {
 	}
 }
 
+func TestEmittedBytecodeReportsTrapSourceLocation(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	out := filepath.Join(dir, "main.cvmbc")
+	source := "int divide(int a, int b) {\n  return a / b;\n}\nint main(void) {\n  return divide(1, 0);\n}\n"
+	if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if err := (&Compiler{EmitBytecode: out}).RunFile(src); err != nil {
+		t.Fatalf("emit bytecode: %v", err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatalf("open emitted bytecode: %v", err)
+	}
+	defer f.Close()
+	prog, err := cvmruntime.Load(f, cvmruntime.LoadOptions{})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	_, err = cvmruntime.Run(context.Background(), prog, cvmruntime.RunOptions{})
+	if err == nil {
+		t.Fatal("Run succeeded, want division trap")
+	}
+	got := err.Error()
+	for _, want := range []string{"at " + src + ":2:", "divide#0 (" + src + ":2:", "main#1 (" + src + ":5:"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("trap missing %q: %s", want, got)
+		}
+	}
+}
+
 func TestMainEmitBytecodeFlagWritesLoadableBinaryModule(t *testing.T) {
 	dir := t.TempDir()
 	src := filepath.Join(dir, "main.c")
@@ -229,3 +269,498 @@ int main(void) {
 		t.Fatalf("runMain exit code = %d, want 0", code)
 	}
 }
+
+func TestRunBytecodeRequiresPOSIXFlagForPOSIXExterns(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	source := `#define _DEFAULT_SOURCE
+#include <strings.h>
+#include <unistd.h>
+int main(int argc, char **argv) {
+	int c = getopt(argc, argv, "x");
+	return c == 'x' && optind == 2 && strcasecmp("OK", "ok") == 0 ? 0 : 3;
+}`
+	if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if code := runMain([]string{"run", src, "-x"}); code != 1 {
+		t.Fatalf("runMain exit code without --posix = %d, want load failure 1", code)
+	}
+	if code := runMain([]string{"run", "--posix", src, "-x"}); code != 0 {
+		t.Fatalf("runMain exit code with --posix = %d, want 0", code)
+	}
+}
+
+func TestRunBytecodeReportsCompileErrorsAsDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	if err := os.WriteFile(src, []byte("int main(void) {\n\treturn missing;\n}\n"), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	var diags strings.Builder
+	_, err := loadBytecode(runBytecodeConfig{file: src}, nil, &diags)
+	if !errors.Is(err, errCompileFailed) {
+		t.Fatalf("loadBytecode err = %v, want errCompileFailed", err)
+	}
+	if got := diags.String(); !strings.Contains(got, "main.c:2:9:") || !strings.Contains(got, "use of undeclared identifier 'missing'") {
+		t.Fatalf("diagnostics = %q", got)
+	}
+}
+
+func TestDebugBytecodeBreaksStepsAndPrintsLocals(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	out := filepath.Join(dir, "main.cvmbc")
+	source := "int twice(int n) {\n\treturn n * 2;\n}\nint main(void) {\n\treturn twice(4);\n}\n"
+	if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if err := (&Compiler{EmitBytecode: out}).RunFile(src); err != nil {
+		t.Fatalf("emit bytecode: %v", err)
+	}
+	commands := strings.NewReader("break twice\ncontinue\nlocals\nwhere\nstep\nstack\ncontinue\n")
+	var transcript strings.Builder
+	if code := debugBytecode([]string{out}, commands, &transcript); code != 8 {
+		t.Fatalf("debugBytecode exit code = %d, want 8\n%s", code, transcript.String())
+	}
+	got := transcript.String()
+	for _, want := range []string{
+		"breakpoint at twice:0",
+		"hit breakpoint twice:0",
+		"param n slot=0 = i32 4",
+		"#1 main#1",
+		"at " + src + ":2:",
+		"[0] i32 4",
+		"program exited with code 8",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("debug transcript missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestLinkBytecodeResolvesSymbolsAcrossUnits(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"main.c": `#include <stdio.h>
+extern int counter;
+int bump(int by);
+static int twice(int v) { return v * 2; }
+int main(void) {
+	bump(3);
+	printf("%d\n", counter);
+	return twice(counter);
+}`,
+		"counter.c": `int counter = 1;
+static int twice(int v) { return v + v + 1; }
+int bump(int by) { counter += twice(by) - 1; return counter; }`,
+	}
+	var objects []string
+	for name, source := range sources {
+		src := filepath.Join(dir, name)
+		obj := strings.TrimSuffix(src, ".c") + ".cvmbc"
+		if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+			t.Fatalf("write source: %v", err)
+		}
+		if code := runMain([]string{"--emit-bytecode", obj, src}); code != 0 {
+			t.Fatalf("emit %s exit code = %d", name, code)
+		}
+		objects = append(objects, obj)
+	}
+	out := filepath.Join(dir, "prog.cvmbc")
+	if code := runMain(append(append([]string{"link"}, objects...), "-o", out)); code != 0 {
+		t.Fatalf("link exit code = %d", code)
+	}
+	if code := runMain([]string{"run", out}); code != 14 {
+		t.Fatalf("run exit code = %d, want 14", code)
+	}
+}
+
+func TestLinkBytecodeReportsDuplicateAndMissingSymbols(t *testing.T) {
+	dir := t.TempDir()
+	emit := func(name, source string) string {
+		src := filepath.Join(dir, name)
+		obj := strings.TrimSuffix(src, ".c") + ".cvmbc"
+		if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+			t.Fatalf("write source: %v", err)
+		}
+		if err := (&Compiler{EmitBytecode: obj}).RunFile(src); err != nil {
+			t.Fatalf("emit %s: %v", name, err)
+		}
+		return obj
+	}
+	a := emit("a.c", `int shared = 1; int missing(void); int main(void) { return missing(); }`)
+	b := emit("b.c", `int shared = 2;`)
+	if code := runMain([]string{"link", a, b, "-o", filepath.Join(dir, "out.cvmbc")}); code != 1 {
+		t.Fatalf("link exit code = %d, want 1", code)
+	}
+	units := make([]bytecode.LinkUnit, 0, 2)
+	for _, obj := range []string{a, b} {
+		mod, err := readBytecodeFile(obj)
+		if err != nil {
+			t.Fatalf("read %s: %v", obj, err)
+		}
+		units = append(units, bytecode.LinkUnit{Name: obj, Module: mod})
+	}
+	_, err := bytecode.Link(units, bytecode.LinkOptions{HostSymbol: hostSymbolResolver(false)})
+	if err == nil {
+		t.Fatal("Link succeeded, want symbol errors")
+	}
+	for _, want := range []string{`duplicate symbol "shared"`, `undefined symbol "missing"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("Link error missing %q: %v", want, err)
+		}
+	}
+}
+
+func TestParseCompileArgsConfiguresPreprocessorAndStandard(t *testing.T) {
+	dir := t.TempDir()
+	inc := filepath.Join(dir, "include")
+	if err := os.Mkdir(inc, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inc, "answer.h"), []byte("#define ANSWER (BASE + 1)\n"), 0644); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	src := filepath.Join(dir, "main.c")
+	if err := os.WriteFile(src, []byte(`#include "answer.h"
+#ifdef DROPPED
+#error DROPPED should be undefined
+#endif
+#if FLAG != 1
+#error bare -D should define 1
+#endif
+int main(void) { return ANSWER EMPTY; }
+`), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	c, files, err := parseCompileArgs([]string{"-E", "-I", inc, "-DBASE=41", "-DDROPPED", "-U", "DROPPED", "-DFLAG", "-DEMPTY=", "-std=gnu99", src})
+	if err != nil {
+		t.Fatalf("parseCompileArgs: %v", err)
+	}
+	if len(files) != 1 || files[0] != src {
+		t.Fatalf("files = %v, want [%s]", files, src)
+	}
+	if !c.PreprocessOnly || !c.Sema.GNUExtensions {
+		t.Fatalf("compiler = %+v, want -E with GNU extensions", c)
+	}
+	var out strings.Builder
+	c.Output = &out
+	if err := c.RunFile(src); err != nil {
+		t.Fatalf("RunFile: %v", err)
+	}
+	if !strings.Contains(out.String(), "int main(void) { return (41 + 1); }") {
+		t.Fatalf("preprocessed output = %q", out.String())
+	}
+
+	for _, args := range [][]string{{"-std=c11", src}, {"-D"}, {"--bogus", src}} {
+		if _, _, err := parseCompileArgs(args); err == nil {
+			t.Fatalf("parseCompileArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestParseCompileArgsConfiguresWarnings(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	if err := os.WriteFile(src, []byte(`int f(int a, unsigned b) {
+	int unused;
+	if (a < b) return 1;
+}
+int main(void) { return f(1, 2); }
+`), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	c, _, err := parseCompileArgs([]string{"-Wall", "-Wno-unused-variable", "-Wsign-compare", src})
+	if err != nil {
+		t.Fatalf("parseCompileArgs: %v", err)
+	}
+	if c.Sema.Warnings.Has(sema.WarnUnusedVariable) || !c.Sema.Warnings.Has(sema.WarnReturnType) || !c.Sema.Warnings.Has(sema.WarnSignCompare) {
+		t.Fatalf("warnings = %b", c.Sema.Warnings)
+	}
+	var diags strings.Builder
+	c.Diagnostics = &diags
+	if err := c.RunFile(src); err != nil {
+		t.Fatalf("RunFile: %v", err)
+	}
+	out := diags.String()
+	if !strings.Contains(out, "main.c:3:6: ") || !strings.Contains(out, "[-Wsign-compare]") ||
+		!strings.Contains(out, "main.c:4:1: ") || !strings.Contains(out, "[-Wreturn-type]") || strings.Contains(out, "unused") {
+		t.Fatalf("diagnostics = %q", out)
+	}
+
+	c, _, err = parseCompileArgs([]string{"-Wextra", "-Werror=unused-parameter", "-Werror=declaration-after-statement", src})
+	if err != nil {
+		t.Fatalf("parseCompileArgs: %v", err)
+	}
+	if !c.Sema.ErrorWarnings.Has(sema.WarnUnusedParameter) || c.Sema.WarningsAsErrors || !c.Sema.WErrorDeclarationAfterStatement {
+		t.Fatalf("sema options = %+v", c.Sema)
+	}
+	c, _, _ = parseCompileArgs([]string{"-Wall", "-Werror", src})
+	c.Diagnostics = io.Discard
+	if err := c.RunFile(src); err == nil || !strings.Contains(err.Error(), "[-Werror=unused-variable]") {
+		t.Fatalf("RunFile with -Werror = %v, want promoted warning", err)
+	}
+	for _, args := range [][]string{{"-Wbogus", src}, {"-Wno-bogus", src}, {"-Werror=bogus", src}} {
+		if _, _, err := parseCompileArgs(args); err == nil {
+			t.Fatalf("parseCompileArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestCompilerRunExecutesSourceInMemory(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "hello.c")
+	source := `#include <stdio.h>
+#include <string.h>
+int main(int argc, char **argv) {
+	printf("%s %s\n", strrchr(argv[0], '/') + 1, argv[1]);
+	return argc;
+}`
+	if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	var stdout strings.Builder
+	st, err := (&Compiler{}).Run(context.Background(), src, cvmruntime.LoadOptions{
+		Args:    []string{src, "world"},
+		Externs: cvmruntime.DefaultExternRegistry(&stdout, nil),
+	}, cvmruntime.RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if st.Code != 2 || stdout.String() != "hello.c world\n" {
+		t.Fatalf("Run = exit %d, stdout %q; want exit 2, %q", st.Code, stdout.String(), "hello.c world\n")
+	}
+
+	profile := cvmruntime.NewProfile()
+	_, err = (&Compiler{}).Run(context.Background(), src, cvmruntime.LoadOptions{
+		Externs: cvmruntime.DefaultExternRegistry(&stdout, nil),
+	}, cvmruntime.RunOptions{StepLimit: 5, Profile: profile})
+	if err == nil || !strings.Contains(err.Error(), "step limit exceeded") {
+		t.Fatalf("Run with StepLimit error = %v, want step limit trap", err)
+	}
+	if fns := profile.Functions(); len(fns) == 0 || fns[0].Steps != 5 {
+		t.Fatalf("profile = %+v, want 5 steps in main", fns)
+	}
+}
+
+func TestMainRunCompilesSourceWithStdinAndEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	source := `#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+int main(int argc, char **argv) {
+	if (argc != 2 || strcmp(argv[1], "arg") != 0) return 1;
+	if (getchar() != 'Z') return 2;
+	char *value = getenv("CVM_TEST");
+	return value && strcmp(value, "ok") == 0 ? 12 : 3;
+}`
+	if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if code := runMain([]string{"run", "--stdin", "Z", "--env", "CVM_TEST=ok", src, "arg"}); code != 12 {
+		t.Fatalf("runMain exit code = %d, want 12", code)
+	}
+
+	bad := filepath.Join(dir, "bad.c")
+	if err := os.WriteFile(bad, []byte(`int main(void) { return missing; }`), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if code := runMain([]string{"run", bad}); code != 1 {
+		t.Fatalf("runMain exit code for compile error = %d, want 1", code)
+	}
+}
+
+func TestMainRunWritesProfile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	prof := filepath.Join(dir, "out.pprof")
+	if err := os.WriteFile(src, []byte(`int sq(int x) { return x * x; }
+int main(void) { int t = 0; for (int i = 0; i < 4; i++) t += sq(i); return t; }`), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if code := runMain([]string{"run", "--profile", prof, src}); code != 14 {
+		t.Fatalf("runMain exit code = %d, want 14", code)
+	}
+	f, err := os.Open(prof)
+	if err != nil {
+		t.Fatalf("open profile: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("profile is not gzip: %v", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("read profile: %v", err)
+	}
+	if !bytes.Contains(raw, []byte("sq")) || !bytes.Contains(raw, []byte(src)) {
+		t.Fatalf("profile lacks function name or source file")
+	}
+	if code := runMain([]string{"run", "--profile-period", "0", src}); code != 2 {
+		t.Fatalf("runMain with bad period exit code = %d, want 2", code)
+	}
+}
+
+func TestMainRunMountsHostDirectories(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	out := filepath.Join(dir, "out")
+	for _, d := range []string{in, out} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(in, "data.txt"), []byte("42\n"), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(out, "stale.txt"), []byte("x"), 0644); err != nil {
+		t.Fatalf("write stale: %v", err)
+	}
+	src := filepath.Join(dir, "main.c")
+	source := `#include <errno.h>
+#include <stdio.h>
+int main(void) {
+	int n = 0;
+	FILE *f = fopen("/data/data.txt", "r");
+	if (!f || fscanf(f, "%d", &n) != 1) return 1;
+	fclose(f);
+	errno = 0;
+	if (fopen("/data/new.txt", "w") || errno != 30) return 2;
+	if (fopen("/data/../../etc/passwd", "r") || fopen("/elsewhere.txt", "w")) return 3;
+	if (remove("/out/stale.txt") != 0) return 4;
+	FILE *w = fopen("/out/tmp.txt", "w");
+	fprintf(w, "%d\n", n * 2);
+	fclose(w);
+	if (rename("/out/tmp.txt", "/out/result.txt") != 0) return 5;
+	FILE *open = fopen("/out/open.txt", "w");
+	fputs("flushed at exit\n", open);
+	return 0;
+}`
+	if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if code := runMain([]string{"run", "--mount", in + ":/data:ro", "--mount=" + out + ":/out", src}); code != 0 {
+		t.Fatalf("runMain exit code = %d, want 0", code)
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "result.txt")); err != nil || string(got) != "84\n" {
+		t.Fatalf("result.txt = %q, %v; want %q", got, err, "84\n")
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "open.txt")); err != nil || string(got) != "flushed at exit\n" {
+		t.Fatalf("open.txt = %q, %v; want %q", got, err, "flushed at exit\n")
+	}
+	for _, name := range []string{filepath.Join(out, "stale.txt"), filepath.Join(out, "tmp.txt"), filepath.Join(in, "new.txt")} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("%s still exists or failed to stat: %v", name, err)
+		}
+	}
+	if code := runMain([]string{"run", "--mount", in + ":data", src}); code != 2 {
+		t.Fatalf("runMain with relative guest dir exit code = %d, want 2", code)
+	}
+}
+
+func TestOptLevelFlagsReachCodegen(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	if err := os.WriteFile(src, []byte("int main(void) { int unused = 1 + 2; return 6 * 7 - 42; }\n"), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	dump := func(args ...string) string {
+		c, _, err := parseCompileArgs(append(args, "--dump-bytecode", src))
+		if err != nil {
+			t.Fatalf("parseCompileArgs(%q): %v", args, err)
+		}
+		var out strings.Builder
+		c.Output = &out
+		if err := c.RunFile(src); err != nil {
+			t.Fatalf("RunFile: %v", err)
+		}
+		return out.String()
+	}
+	if plain := dump(); !strings.Contains(plain, "I32Mul") || !strings.Contains(plain, `name="unused"`) {
+		t.Fatalf("-O0 dump = %s", plain)
+	}
+	if opt := dump("-O1"); strings.Contains(opt, "I32Mul") || strings.Contains(opt, `name="unused"`) {
+		t.Fatalf("-O1 dump = %s", opt)
+	}
+	if _, _, err := parseCompileArgs([]string{"-O2", src}); err == nil {
+		t.Fatalf("parseCompileArgs accepted -O2")
+	}
+	cfg, err := parseRunBytecodeArgs([]string{"-O", src, "arg"})
+	if err != nil || cfg.optLevel != 1 || cfg.file != src || cfg.posix {
+		t.Fatalf("parseRunBytecodeArgs = %+v, %v", cfg, err)
+	}
+}
+
+func TestOptimizedVariadicFunctionKeepsVaListSlots(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	prog := `#include <stdarg.h>
+int sum(int n, ...) {
+	int unused = 5;
+	va_list ap, cp;
+	va_start(ap, n);
+	va_copy(cp, ap);
+	int s = 0;
+	for (int i = 0; i < n; i++)
+		s += va_arg(cp, int);
+	va_end(cp);
+	va_end(ap);
+	return s;
+}
+int main(void) { return sum(3, 1, 2, 3) == 6 ? 0 : 3; }
+`
+	if err := os.WriteFile(src, []byte(prog), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	c, _, err := parseCompileArgs([]string{"-O1", "--dump-bytecode", src})
+	if err != nil {
+		t.Fatalf("parseCompileArgs: %v", err)
+	}
+	var out strings.Builder
+	c.Output = &out
+	if err := c.RunFile(src); err != nil {
+		t.Fatalf("RunFile: %v", err)
+	}
+	dump := out.String()
+	start := strings.Index(dump, `name="sum" sig=`)
+	if start < 0 {
+		t.Fatalf("dump has no sum: %s", dump)
+	}
+	body := dump[start:]
+	if end := strings.Index(body, "\nFunc #"); end >= 0 {
+		body = body[:end]
+	}
+	if strings.Contains(body, `name="unused"`) {
+		t.Fatalf("-O1 kept the unused local: %s", body)
+	}
+	locals := map[string]string{}
+	for _, m := range regexp.MustCompile(`Local #(\d+) name="(\w+)"`).FindAllStringSubmatch(body, -1) {
+		locals[m[1]] = m[2]
+	}
+	ops := regexp.MustCompile(`Va\w+ (?:slot|dst)=(\d+)(?: src=(\d+))?`).FindAllStringSubmatch(body, -1)
+	if len(ops) != 5 {
+		t.Fatalf("va instructions = %q in %s", ops, body)
+	}
+	for _, m := range ops {
+		for _, slot := range m[1:] {
+			if slot == "" {
+				continue
+			}
+			if name := locals[slot]; name != "ap" && name != "cp" {
+				t.Fatalf("%q names slot %s (%q), not a va_list local: %s", m[0], slot, name, body)
+			}
+		}
+	}
+	bc := filepath.Join(dir, "main.cvmbc")
+	if err := (&Compiler{EmitBytecode: bc, OptLevel: 1}).RunFile(src); err != nil {
+		t.Fatalf("emit bytecode: %v", err)
+	}
+	if code := runMain([]string{"run", bc}); code != 0 {
+		t.Fatalf("runMain exit code = %d, want 0", code)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"shinya.click/cvm/bytecode"
+	cvmruntime "shinya.click/cvm/runtime"
+)
+
+const debugHelp = `commands:
+  break FUNC[:PC]     set a breakpoint at the entry of FUNC or at PC
+  delete FUNC[:PC]    remove a breakpoint
+  breakpoints         list breakpoints
+  step [N]            execute N instructions (default 1)
+  continue            run until the next breakpoint or program exit
+  where               print the call stack
+  stack               print the operand stack
+  locals              print the current frame's parameters and locals
+  mem ADDR [SIZE]     dump SIZE bytes of memory at ADDR (default 16)
+  quit                stop debugging`
+
+// debugBytecode runs `cvm debug`. Debugger commands are read from in, so the
+// program itself only sees input given with --stdin.
+func debugBytecode(args []string, in io.Reader, out io.Writer) int {
+	cfg, err := parseRunBytecodeArgs(args)
+	if err == nil && cfg.profile != "" {
+		err = fmt.Errorf("--profile is only supported by cvm run")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Usage: cvm debug [--posix] [--stdin text] [--env NAME=VALUE] [--mount HOSTDIR:GUESTDIR[:ro]] file.cvmbc|file.c [args...]")
+		return 2
+	}
+	prog, err := loadBytecode(cfg, strings.NewReader(cfg.stdin), os.Stderr)
+	if errors.Is(err, errCompileFailed) {
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	d, err := cvmruntime.NewDebugger(prog, cvmruntime.RunOptions{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s := &debugSession{d: d, out: out}
+	s.printLocation()
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "(cvm) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "q" {
+			break
+		}
+		if err := s.exec(fields[0], fields[1:]); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+	if !d.Done() {
+		return 0
+	}
+	if d.Err() != nil {
+		return 1
+	}
+	return d.Status().Code
+}
+
+type debugSession struct {
+	d   *cvmruntime.Debugger
+	out io.Writer
+}
+
+func (s *debugSession) exec(cmd string, args []string) error {
+	switch cmd {
+	case "break", "b":
+		bp, err := s.breakpoint(args)
+		if err != nil {
+			return err
+		}
+		if _, err := s.d.AddBreakpoint(bp.Func, bp.PC); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "breakpoint at %s\n", s.breakpointName(bp))
+	case "delete", "d":
+		bp, err := s.breakpoint(args)
+		if err != nil {
+			return err
+		}
+		if !s.d.RemoveBreakpoint(bp) {
+			return fmt.Errorf("no breakpoint at %s", s.breakpointName(bp))
+		}
+	case "breakpoints", "info":
+		for _, bp := range s.d.Breakpoints() {
+			fmt.Fprintln(s.out, s.breakpointName(bp))
+		}
+	case "step", "s":
+		n := 1
+		if len(args) > 0 {
+			v, err := strconv.Atoi(args[0])
+			if err != nil || v <= 0 {
+				return fmt.Errorf("step expects a positive count")
+			}
+			n = v
+		}
+		if err := s.ensureRunning(); err != nil {
+			return err
+		}
+		for i := 0; i < n && !s.d.Done(); i++ {
+			if err := s.d.Step(context.Background()); err != nil {
+				break
+			}
+		}
+		s.printStop()
+	case "continue", "c":
+		if err := s.ensureRunning(); err != nil {
+			return err
+		}
+		bp, hit, _ := s.d.Continue(context.Background())
+		if hit {
+			fmt.Fprintf(s.out, "hit breakpoint %s\n", s.breakpointName(bp))
+		}
+		s.printStop()
+	case "where", "bt":
+		for i, fr := range s.d.Frames() {
+			fmt.Fprintf(s.out, "#%d %s\n", i, formatFrame(fr))
+		}
+	case "stack":
+		stack := s.d.OperandStack()
+		for i := len(stack) - 1; i >= 0; i-- {
+			fmt.Fprintf(s.out, "[%d] %s\n", i, stack[i])
+		}
+	case "locals":
+		for _, l := range s.d.Locals() {
+			kind := "local"
+			if l.Param {
+				kind = "param"
+			}
+			fmt.Fprintf(s.out, "%s %s slot=%d = %s\n", kind, l.Name, l.Slot, l.Value)
+		}
+	case "mem", "x":
+		return s.dumpMemory(args)
+	case "help", "h":
+		fmt.Fprintln(s.out, debugHelp)
+	default:
+		return fmt.Errorf("unknown command %q (try help)", cmd)
+	}
+	return nil
+}
+
+func (s *debugSession) ensureRunning() error {
+	if s.d.Done() {
+		return fmt.Errorf("program is not running")
+	}
+	return nil
+}
+
+func (s *debugSession) breakpoint(args []string) (cvmruntime.Breakpoint, error) {
+	if len(args) != 1 {
+		return cvmruntime.Breakpoint{}, fmt.Errorf("expected FUNC[:PC]")
+	}
+	name, pcText, hasPC := strings.Cut(args[0], ":")
+	funcID, err := s.d.FunctionID(name)
+	if err != nil {
+		return cvmruntime.Breakpoint{}, err
+	}
+	pc := 0
+	if hasPC {
+		pc, err = strconv.Atoi(pcText)
+		if err != nil {
+			return cvmruntime.Breakpoint{}, fmt.Errorf("invalid pc %q", pcText)
+		}
+	}
+	return cvmruntime.Breakpoint{Func: funcID, PC: pc}, nil
+}
+
+func (s *debugSession) breakpointName(bp cvmruntime.Breakpoint) string {
+	return fmt.Sprintf("%s:%d", s.d.FunctionName(bp.Func), bp.PC)
+}
+
+func (s *debugSession) dumpMemory(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("expected ADDR [SIZE]")
+	}
+	addr, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", args[0])
+	}
+	size := int64(16)
+	if len(args) == 2 {
+		size, err = strconv.ParseInt(args[1], 0, 64)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid size %q", args[1])
+		}
+	}
+	block, ok := s.d.MemoryBlock(addr)
+	if !ok {
+		return fmt.Errorf("no memory block at %#x", addr)
+	}
+	flags := ""
+	if block.Readonly {
+		flags += " readonly"
+	}
+	if block.Freed {
+		flags += " freed"
+	}
+	fmt.Fprintf(s.out, "block %q base=%#x size=%d%s\n", block.Name, block.Base, block.Size, flags)
+	if end := block.Base + uint64(block.Size); addr+uint64(size) > end {
+		size = int64(end - addr)
+	}
+	data, err := s.d.ReadMemory(addr, size)
+	if err != nil {
+		return err
+	}
+	for off := 0; off < len(data); off += 16 {
+		line := data[off:min(off+16, len(data))]
+		hex := make([]string, len(line))
+		for i, b := range line {
+			hex[i] = fmt.Sprintf("%02x", b)
+		}
+		fmt.Fprintf(s.out, "%#x: %s\n", addr+uint64(off), strings.Join(hex, " "))
+	}
+	return nil
+}
+
+func (s *debugSession) printStop() {
+	if !s.d.Done() {
+		s.printLocation()
+		return
+	}
+	if err := s.d.Err(); err != nil {
+		fmt.Fprintln(s.out, err)
+		return
+	}
+	fmt.Fprintf(s.out, "program exited with code %d\n", s.d.Status().Code)
+}
+
+func (s *debugSession) printLocation() {
+	frames := s.d.Frames()
+	if len(frames) == 0 {
+		return
+	}
+	fmt.Fprintln(s.out, formatFrame(frames[0]))
+}
+
+func formatFrame(fr cvmruntime.FrameInfo) string {
+	text := fmt.Sprintf("%s#%d pc=%d", fr.Function, fr.FunctionID, fr.PC)
+	if fr.HasInstr {
+		text += " " + bytecode.FormatInstr(fr.Instr)
+	}
+	if fr.HasSource {
+		text += " at " + fr.Source.String()
+	}
+	return text
+}
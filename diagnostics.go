@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"shinya.click/cvm/common"
+	"shinya.click/cvm/entity"
+)
+
+const (
+	DiagnosticsText  = "text"
+	DiagnosticsJSON  = "json"
+	DiagnosticsSARIF = "sarif"
+)
+
+type diagnosticLocation struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+type diagnosticExpansion struct {
+	Spelling   diagnosticLocation `json:"spelling"`
+	Expansion  diagnosticLocation `json:"expansion"`
+	Definition diagnosticLocation `json:"definition"`
+}
+
+type diagnostic struct {
+	Severity       string                `json:"severity"`
+	Message        string                `json:"message"`
+	File           string                `json:"file,omitempty"`
+	Line           int                   `json:"line,omitempty"`
+	Column         int                   `json:"column,omitempty"`
+	IncludeTrace   []diagnosticLocation  `json:"includeTrace,omitempty"`
+	ExpansionTrace []diagnosticExpansion `json:"expansionTrace,omitempty"`
+	Notes          []*diagnostic         `json:"notes,omitempty"`
+	text           string
+}
+
+// collectDiagnostics flattens the warnings of the last compile and err into
+// diagnostics. Notes attach to the error or warning they follow.
+func (c *Compiler) collectDiagnostics(err error) []*diagnostic {
+	var messages []*common.CvmErrorMessages
+	for _, w := range c.warnings {
+		messages = append(messages, w.Messages...)
+	}
+	var cvmError *common.CvmError
+	switch {
+	case errors.As(err, &cvmError):
+		messages = append(messages, cvmError.Messages...)
+	case err != nil:
+		messages = append(messages, common.NewErrorMessage(entity.SourcePos{}, err.Error()))
+	}
+	var out []*diagnostic
+	for _, m := range messages {
+		d := c.diagnostic(m)
+		if m.Level == common.MessageLevelNote && len(out) > 0 {
+			parent := out[len(out)-1]
+			parent.Notes = append(parent.Notes, d)
+			continue
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+func (c *Compiler) diagnostic(m *common.CvmErrorMessages) *diagnostic {
+	d := &diagnostic{Severity: "note", Message: m.CustomMessage}
+	switch m.Level {
+	case common.MessageLevelError:
+		d.Severity = "error"
+	case common.MessageLevelWarning:
+		d.Severity = "warning"
+	}
+	if m.SourcePos == (entity.SourcePos{}) {
+		return d
+	}
+	d.File, d.Line, d.Column, d.text = c.displayErrorLocation(m.SourcePos)
+	if c.Sources == nil {
+		return d
+	}
+	pos := m.SourcePos
+	for pos.LocationID < 0 {
+		trace := c.Sources.ExpansionTrace(pos)
+		d.ExpansionTrace = append(d.ExpansionTrace, diagnosticExpansion{
+			Spelling:   c.diagnosticLocation(trace.Spelling),
+			Expansion:  c.diagnosticLocation(trace.Expansion),
+			Definition: c.diagnosticLocation(trace.Definition),
+		})
+		pos = trace.Expansion
+	}
+	for _, entry := range c.Sources.IncludeTrace(pos) {
+		d.IncludeTrace = append(d.IncludeTrace, diagnosticLocation{File: entry.File, Line: entry.Line, Column: entry.Column})
+	}
+	return d
+}
+
+func (c *Compiler) diagnosticLocation(pos entity.SourcePos) diagnosticLocation {
+	display := c.Sources.DisplayLocation(pos)
+	return diagnosticLocation{File: display.File, Line: display.Line, Column: display.Column}
+}
+
+// writeDiagnostics emits the diagnostics of the last compile, including its
+// warnings, as one JSON or SARIF document.
+func (c *Compiler) writeDiagnostics(w io.Writer, err error) error {
+	diags := c.collectDiagnostics(err)
+	var doc any
+	switch c.DiagnosticsFormat {
+	case DiagnosticsJSON:
+		if diags == nil {
+			diags = []*diagnostic{}
+		}
+		doc = struct {
+			Diagnostics []*diagnostic `json:"diagnostics"`
+		}{diags}
+	case DiagnosticsSARIF:
+		doc = sarifDocument(diags)
+	default:
+		return fmt.Errorf("unsupported diagnostics format %q", c.DiagnosticsFormat)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name string `json:"name"`
+	} `json:"driver"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId,omitempty"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations,omitempty"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	ID               int                    `json:"id,omitempty"`
+	PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation,omitempty"`
+	Message          *sarifMessage          `json:"message,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation struct {
+		URI string `json:"uri"`
+	} `json:"artifactLocation"`
+	Region *sarifRegion `json:"region,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int           `json:"startLine"`
+	StartColumn int           `json:"startColumn,omitempty"`
+	Snippet     *sarifMessage `json:"snippet,omitempty"`
+}
+
+func sarifDocument(diags []*diagnostic) sarifLog {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "cvm"
+	for _, d := range diags {
+		result := sarifResult{RuleID: diagnosticRule(d.Message), Level: d.Severity, Message: sarifMessage{Text: d.Message}}
+		if loc := sarifPhysical(d.File, d.Line, d.Column, d.text); loc != nil {
+			result.Locations = []sarifLocation{{PhysicalLocation: loc}}
+		}
+		related := func(file string, line, column int, text string) {
+			if loc := sarifPhysical(file, line, column, ""); loc != nil {
+				result.RelatedLocations = append(result.RelatedLocations, sarifLocation{
+					ID:               len(result.RelatedLocations) + 1,
+					PhysicalLocation: loc,
+					Message:          &sarifMessage{Text: text},
+				})
+			}
+		}
+		for _, exp := range d.ExpansionTrace {
+			related(exp.Expansion.File, exp.Expansion.Line, exp.Expansion.Column, "in expansion of macro")
+			related(exp.Definition.File, exp.Definition.Line, exp.Definition.Column, "macro defined here")
+		}
+		for _, inc := range d.IncludeTrace {
+			related(inc.File, inc.Line, inc.Column, "in file included from here")
+		}
+		for _, note := range d.Notes {
+			related(note.File, note.Line, note.Column, note.Message)
+		}
+		run.Results = append(run.Results, result)
+	}
+	return sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+}
+
+func sarifPhysical(file string, line, column int, text string) *sarifPhysicalLocation {
+	if file == "" || line <= 0 {
+		return nil
+	}
+	loc := &sarifPhysicalLocation{Region: &sarifRegion{StartLine: line, StartColumn: column}}
+	loc.ArtifactLocation.URI = filepath.ToSlash(file)
+	if text != "" {
+		loc.Region.Snippet = &sarifMessage{Text: text}
+	}
+	return loc
+}
+
+// diagnosticRule recovers the warning name from the " [-Wname]" or
+// " [-Werror=name]" suffix sema appends to warning messages.
+func diagnosticRule(message string) string {
+	start := strings.LastIndex(message, " [-W")
+	if start < 0 || !strings.HasSuffix(message, "]") {
+		return ""
+	}
+	name := message[start+len(" [-W") : len(message)-1]
+	return strings.TrimPrefix(name, "error=")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeDiagnosticsFixture(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func compileDiagnostics(t *testing.T, src string, args ...string) []byte {
+	t.Helper()
+	c, _, err := parseCompileArgs(append(args, src))
+	if err != nil {
+		t.Fatalf("parseCompileArgs: %v", err)
+	}
+	var out bytes.Buffer
+	c.Diagnostics = &out
+	runErr := c.RunFile(src)
+	if err := c.writeDiagnostics(&out, runErr); err != nil {
+		t.Fatalf("writeDiagnostics: %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestJSONDiagnosticsIncludeTracesAndNotes(t *testing.T) {
+	dir := writeDiagnosticsFixture(t, map[string]string{
+		"defs.h":  "#define MISSING missing_value\nint f(void) { return MISSING; }\n",
+		"main.c":  "#include \"defs.h\"\nint main(void) { return f(); }\n",
+		"redef.c": "int twice;\nint twice(void) { return 2; }\n",
+	})
+	var doc struct {
+		Diagnostics []diagnostic `json:"diagnostics"`
+	}
+	out := compileDiagnostics(t, filepath.Join(dir, "main.c"), "--diagnostics-format=json")
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("decode %s: %v", out, err)
+	}
+	if len(doc.Diagnostics) != 1 {
+		t.Fatalf("diagnostics = %s", out)
+	}
+	d := doc.Diagnostics[0]
+	header := filepath.Join(dir, "defs.h")
+	if d.Severity != "error" || d.Message != "use of undeclared identifier 'missing_value'" || d.File != header || d.Line != 2 || d.Column != 22 {
+		t.Fatalf("diagnostic = %+v", d)
+	}
+	if len(d.IncludeTrace) != 1 || d.IncludeTrace[0].File != filepath.Join(dir, "main.c") || d.IncludeTrace[0].Line != 1 {
+		t.Fatalf("include trace = %+v", d.IncludeTrace)
+	}
+	want := diagnosticExpansion{
+		Spelling:   diagnosticLocation{File: header, Line: 1, Column: 17},
+		Expansion:  diagnosticLocation{File: header, Line: 2, Column: 22},
+		Definition: diagnosticLocation{File: header, Line: 1, Column: 9},
+	}
+	if len(d.ExpansionTrace) != 1 || d.ExpansionTrace[0] != want {
+		t.Fatalf("expansion trace = %+v, want %+v", d.ExpansionTrace, want)
+	}
+
+	out = compileDiagnostics(t, filepath.Join(dir, "redef.c"), "--diagnostics-format=json")
+	doc.Diagnostics = nil
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("decode %s: %v", out, err)
+	}
+	if len(doc.Diagnostics) != 1 || len(doc.Diagnostics[0].Notes) != 1 {
+		t.Fatalf("diagnostics = %s", out)
+	}
+	if note := doc.Diagnostics[0].Notes[0]; note.Severity != "note" || note.Message != "previous definition is here" || note.Line != 1 {
+		t.Fatalf("note = %+v", note)
+	}
+}
+
+func TestSARIFDiagnosticsReportWarnings(t *testing.T) {
+	dir := writeDiagnosticsFixture(t, map[string]string{
+		"main.c": "int main(void) {\n\tint unused;\n\treturn 0;\n}\n",
+	})
+	src := filepath.Join(dir, "main.c")
+	out := compileDiagnostics(t, src, "-Wall", "--diagnostics-format=sarif")
+	var log sarifLog
+	if err := json.Unmarshal(out, &log); err != nil {
+		t.Fatalf("decode %s: %v", out, err)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 || log.Runs[0].Tool.Driver.Name != "cvm" || len(log.Runs[0].Results) != 1 {
+		t.Fatalf("sarif = %s", out)
+	}
+	r := log.Runs[0].Results[0]
+	if r.RuleID != "unused-variable" || r.Level != "warning" || len(r.Locations) != 1 {
+		t.Fatalf("result = %+v", r)
+	}
+	loc := r.Locations[0].PhysicalLocation
+	if loc.ArtifactLocation.URI != filepath.ToSlash(src) || loc.Region.StartLine != 2 || loc.Region.StartColumn != 6 || loc.Region.Snippet.Text != "\tint unused;" {
+		t.Fatalf("location = %+v, region %+v", loc, loc.Region)
+	}
+
+	clean := compileDiagnostics(t, src, "--diagnostics-format=sarif")
+	log = sarifLog{}
+	if err := json.Unmarshal(clean, &log); err != nil || len(log.Runs) != 1 || len(log.Runs[0].Results) != 0 {
+		t.Fatalf("clean sarif = %s, %v", clean, err)
+	}
+	if _, _, err := parseCompileArgs([]string{"--diagnostics-format=xml", src}); err == nil {
+		t.Fatalf("parseCompileArgs accepted an unknown diagnostics format")
+	}
+}
+
+func TestJSONDiagnosticsKeepWarningsOfFailedCompile(t *testing.T) {
+	dir := writeDiagnosticsFixture(t, map[string]string{
+		"main.c": "int f(void) {\n\tint unused;\n\treturn 0;\n}\nint main(void) { return missing; }\n",
+	})
+	out := compileDiagnostics(t, filepath.Join(dir, "main.c"), "-Wall", "--diagnostics-format=json")
+	var doc struct {
+		Diagnostics []diagnostic `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("decode %s: %v", out, err)
+	}
+	if len(doc.Diagnostics) != 2 {
+		t.Fatalf("diagnostics = %s", out)
+	}
+	if w := doc.Diagnostics[0]; w.Severity != "warning" || w.Line != 2 {
+		t.Fatalf("warning = %+v", w)
+	}
+	if e := doc.Diagnostics[1]; e.Severity != "error" || e.Message != "use of undeclared identifier 'missing'" || e.Line != 5 {
+		t.Fatalf("error = %+v", e)
+	}
+}
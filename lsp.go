@@ -0,0 +1,836 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"shinya.click/cvm/entity"
+	"shinya.click/cvm/preprocessor"
+	"shinya.click/cvm/sema"
+)
+
+const lspUsage = "Usage: cvm lsp [-I dir] [-D NAME[=VALUE]] [-U NAME] [-std=c99|gnu99] [-pedantic-errors] [-W...]"
+
+// runLSP runs `cvm lsp`, a Language Server Protocol server on stdio. The
+// compile options apply to every document the editor opens.
+func runLSP(args []string, in io.Reader, out io.Writer) int {
+	c, files, err := parseCompileArgs(args)
+	if err == nil && len(files) > 0 {
+		err = fmt.Errorf("unexpected argument %s", files[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, lspUsage)
+		return 2
+	}
+	s := &lspServer{in: bufio.NewReader(in), out: out, template: *c, docs: map[string]*lspDocument{}}
+	return s.serve()
+}
+
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	template Compiler
+	docs     map[string]*lspDocument
+	shutdown bool
+}
+
+// lspDocument is an open editor buffer together with the result of its last
+// analysis. prog is nil when the buffer does not compile.
+type lspDocument struct {
+	uri      string
+	path     string
+	text     string
+	compiler *Compiler
+	prog     *sema.Program
+}
+
+type lspRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	lspParseError     = -32700
+	lspInvalidParams  = -32602
+	lspMethodNotFound = -32601
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+type lspDiagnostic struct {
+	Range              lspRange                `json:"range"`
+	Severity           int                     `json:"severity"`
+	Code               string                  `json:"code,omitempty"`
+	Source             string                  `json:"source"`
+	Message            string                  `json:"message"`
+	RelatedInformation []lspRelatedInformation `json:"relatedInformation,omitempty"`
+}
+
+type lspRelatedInformation struct {
+	Location lspLocation `json:"location"`
+	Message  string      `json:"message"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Detail         string              `json:"detail,omitempty"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+// LSP SymbolKind values.
+const (
+	lspSymbolClass      = 5
+	lspSymbolField      = 8
+	lspSymbolEnum       = 10
+	lspSymbolFunction   = 12
+	lspSymbolVariable   = 13
+	lspSymbolEnumMember = 22
+	lspSymbolStruct     = 23
+)
+
+func (s *lspServer) serve() int {
+	for {
+		body, err := readLSPMessage(s.in)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			return 1
+		}
+		var req lspRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.reply(json.RawMessage("null"), nil, &lspError{Code: lspParseError, Message: err.Error()})
+			continue
+		}
+		if req.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		}
+		result, rerr := s.handle(req)
+		if len(req.ID) > 0 {
+			s.reply(req.ID, result, rerr)
+		}
+	}
+}
+
+func (s *lspServer) handle(req lspRequest) (any, *lspError) {
+	switch req.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       1,
+				"hoverProvider":          true,
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "cvm"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &lspError{Code: lspInvalidParams, Message: err.Error()}
+		}
+		s.update(params.TextDocument.URI, params.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &lspError{Code: lspInvalidParams, Message: err.Error()}
+		}
+		// Only full-document sync is advertised, so the last change is the
+		// whole buffer.
+		if n := len(params.ContentChanges); n > 0 {
+			s.update(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &lspError{Code: lspInvalidParams, Message: err.Error()}
+		}
+		delete(s.docs, params.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]any{"uri": params.TextDocument.URI, "diagnostics": []lspDiagnostic{}})
+		return nil, nil
+	case "textDocument/hover", "textDocument/definition", "textDocument/references", "textDocument/documentSymbol":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &lspError{Code: lspInvalidParams, Message: err.Error()}
+		}
+		doc := s.docs[params.TextDocument.URI]
+		if doc == nil || doc.prog == nil {
+			if req.Method == "textDocument/references" || req.Method == "textDocument/documentSymbol" {
+				return []any{}, nil
+			}
+			return nil, nil
+		}
+		switch req.Method {
+		case "textDocument/hover":
+			return doc.hover(params.Position), nil
+		case "textDocument/definition":
+			return doc.definition(params.Position), nil
+		case "textDocument/references":
+			return doc.references(params.Position, params.Context.IncludeDeclaration), nil
+		default:
+			return doc.documentSymbols(), nil
+		}
+	}
+	if len(req.ID) == 0 {
+		return nil, nil
+	}
+	return nil, &lspError{Code: lspMethodNotFound, Message: "method not found: " + req.Method}
+}
+
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (s *lspServer) write(msg map[string]any) {
+	msg["jsonrpc"] = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) reply(id json.RawMessage, result any, err *lspError) {
+	if err != nil {
+		s.write(map[string]any{"id": id, "error": err})
+		return
+	}
+	s.write(map[string]any{"id": id, "result": result})
+}
+
+func (s *lspServer) notify(method string, params any) {
+	s.write(map[string]any{"method": method, "params": params})
+}
+
+// update re-analyses a document from scratch and publishes its diagnostics.
+func (s *lspServer) update(uri, text string) {
+	c := s.template
+	c.FileName = uriToPath(uri)
+	c.DiagnosticsFormat = DiagnosticsJSON
+	doc := &lspDocument{uri: uri, path: c.FileName, text: text, compiler: &c}
+	pp, err := c.preprocess(text)
+	if err == nil {
+		doc.prog, err = c.analyze(pp)
+	}
+	s.docs[uri] = doc
+	diags := []lspDiagnostic{}
+	for _, d := range c.collectDiagnostics(err) {
+		diags = append(diags, doc.lspDiagnostic(d))
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]any{"uri": uri, "diagnostics": diags})
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+func (d *lspDocument) lspDiagnostic(diag *diagnostic) lspDiagnostic {
+	out := lspDiagnostic{
+		Range:    d.spanRange(diag.Line, diag.Column, diag.text),
+		Severity: 3,
+		Code:     diagnosticRule(diag.Message),
+		Source:   "cvm",
+		Message:  diag.Message,
+	}
+	switch diag.Severity {
+	case "error":
+		out.Severity = 1
+	case "warning":
+		out.Severity = 2
+	}
+	if diag.File != "" && diag.File != d.path {
+		// Problems inside headers are reported on the #include that pulled
+		// them in, with the header location attached.
+		for _, inc := range diag.IncludeTrace {
+			if inc.File == d.path {
+				out.Range = d.spanRange(inc.Line, inc.Column, d.line(inc.Line))
+				out.Message = fmt.Sprintf("in included file %s:%d:%d: %s", diag.File, diag.Line, diag.Column, diag.Message)
+				break
+			}
+		}
+		out.RelatedInformation = appendRelated(out.RelatedInformation, diag.File, diag.Line, diag.Column, diag.text, diag.Message)
+	}
+	for _, exp := range diag.ExpansionTrace {
+		out.RelatedInformation = appendRelated(out.RelatedInformation, exp.Definition.File, exp.Definition.Line, exp.Definition.Column, "", "macro defined here")
+	}
+	for _, note := range diag.Notes {
+		out.RelatedInformation = appendRelated(out.RelatedInformation, note.File, note.Line, note.Column, note.text, note.Message)
+	}
+	return out
+}
+
+func appendRelated(related []lspRelatedInformation, file string, line, column int, text, message string) []lspRelatedInformation {
+	if file == "" || line <= 0 {
+		return related
+	}
+	return append(related, lspRelatedInformation{
+		Location: lspLocation{URI: pathToURI(file), Range: spanRange(line, column, text)},
+		Message:  message,
+	})
+}
+
+func (d *lspDocument) line(n int) string {
+	lines := strings.Split(d.text, "\n")
+	if n <= 0 || n > len(lines) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[n-1], "\r")
+}
+
+func (d *lspDocument) spanRange(line, column int, text string) lspRange {
+	if line <= 0 {
+		return lspRange{}
+	}
+	return spanRange(line, column, text)
+}
+
+// spanRange converts a 1-based line and byte column into an LSP range that
+// covers the token starting there. LSP characters count UTF-16 code units.
+func spanRange(line, column int, text string) lspRange {
+	start := lspPosition{Line: line - 1, Character: utf16Len(clampPrefix(text, column-1))}
+	end := start
+	end.Character += utf16Len(clampPrefix(text[len(clampPrefix(text, column-1)):], tokenLength(text, column)))
+	return lspRange{Start: start, End: end}
+}
+
+func clampPrefix(text string, n int) string {
+	if n < 0 {
+		return ""
+	}
+	if n > len(text) {
+		return text
+	}
+	return text[:n]
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return n
+}
+
+// byteColumn converts an LSP character offset on text to a 1-based byte column.
+func byteColumn(text string, character int) int {
+	units := 0
+	for i, r := range text {
+		if units >= character {
+			return i + 1
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return len(text) + 1
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b >= utf8.RuneSelf
+}
+
+var lspPunctuators = []string{"<<=", ">>=", "...", "->", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "*=", "/=", "%=", "+=", "-=", "&=", "^=", "|=", "##"}
+
+// tokenLength returns the byte length of the C token starting at column.
+func tokenLength(text string, column int) int {
+	i := column - 1
+	if i < 0 || i >= len(text) {
+		return 0
+	}
+	switch c := text[i]; {
+	case isIdentByte(c):
+		j := i
+		for j < len(text) && (isIdentByte(text[j]) || text[j] == '.' && c >= '0' && c <= '9') {
+			j++
+		}
+		return j - i
+	case c == '"' || c == '\'':
+		for j := i + 1; j < len(text); j++ {
+			if text[j] == '\\' {
+				j++
+				continue
+			}
+			if text[j] == c {
+				return j + 1 - i
+			}
+		}
+		return len(text) - i
+	}
+	for _, p := range lspPunctuators {
+		if strings.HasPrefix(text[i:], p) {
+			return len(p)
+		}
+	}
+	return 1
+}
+
+func (d *lspDocument) display(pos entity.SourcePos) preprocessor.DisplayLocation {
+	if d.compiler.Sources == nil {
+		return preprocessor.DisplayLocation{}
+	}
+	return d.compiler.Sources.DisplayLocation(pos)
+}
+
+// nameAt moves pos forward to the first whole-word occurrence of name on its
+// line, so declarations that start with specifiers or '*' land on the name.
+func (d *lspDocument) nameAt(pos entity.SourcePos, name string) preprocessor.DisplayLocation {
+	loc := d.display(pos)
+	if name == "" || loc.Column <= 0 || loc.Column > len(loc.Text) {
+		return loc
+	}
+	for from := loc.Column - 1; ; {
+		idx := strings.Index(loc.Text[from:], name)
+		if idx < 0 {
+			return loc
+		}
+		start, end := from+idx, from+idx+len(name)
+		if (start == 0 || !isIdentByte(loc.Text[start-1])) && (end == len(loc.Text) || !isIdentByte(loc.Text[end])) {
+			loc.Column = start + 1
+			return loc
+		}
+		from = end
+	}
+}
+
+func locationRange(loc preprocessor.DisplayLocation) lspRange {
+	return spanRange(loc.Line, loc.Column, loc.Text)
+}
+
+// cursor converts an LSP position to the line and column of the token under
+// it; a cursor just past an identifier still selects that identifier.
+func (d *lspDocument) cursor(pos lspPosition) (int, int) {
+	text := d.line(pos.Line + 1)
+	col := byteColumn(text, pos.Character)
+	i := col - 1
+	if i > len(text) {
+		i = len(text)
+	}
+	if (i == len(text) || !isIdentByte(text[i])) && i > 0 && isIdentByte(text[i-1]) {
+		i--
+	}
+	for i > 0 && i < len(text) && isIdentByte(text[i]) && isIdentByte(text[i-1]) {
+		i--
+	}
+	return pos.Line + 1, i + 1
+}
+
+func (d *lspDocument) walk(fn func(sema.Node) bool) {
+	for _, g := range d.prog.Globals {
+		sema.Walk(g, fn)
+	}
+	for _, f := range d.prog.Funcs {
+		sema.Walk(f, fn)
+	}
+}
+
+func (d *lspDocument) contains(r entity.SourceRange, line, col int) bool {
+	start, end := d.display(r.SourceStart), d.display(r.SourceEnd)
+	if start.File != d.path || end.File != d.path {
+		return false
+	}
+	before := func(l1, c1, l2, c2 int) bool { return l1 < l2 || l1 == l2 && c1 <= c2 }
+	return before(start.Line, start.Column, line, col) && before(line, col, end.Line, end.Column)
+}
+
+func (d *lspDocument) hover(pos lspPosition) any {
+	line, col := d.cursor(pos)
+	var best sema.Expr
+	d.walk(func(n sema.Node) bool {
+		if e, ok := n.(sema.Expr); ok && e.GetType() != nil && d.contains(e.Pos(), line, col) {
+			best = e
+		}
+		return true
+	})
+	var value string
+	var rng lspRange
+	switch {
+	case best != nil:
+		value = best.GetType().String()
+		if name := exprName(best); name != "" {
+			value = name + ": " + value
+		}
+		start, end := d.display(best.Pos().SourceStart), d.display(best.Pos().SourceEnd)
+		rng = lspRange{Start: locationRange(start).Start, End: locationRange(end).End}
+	default:
+		occ := d.occurrenceAt(line, col)
+		if occ == nil {
+			return nil
+		}
+		value = occ.name + ": " + occ.typ.String()
+		rng = locationRange(occ.at)
+	}
+	return map[string]any{
+		"contents": map[string]string{"kind": "plaintext", "value": value},
+		"range":    rng,
+	}
+}
+
+func exprName(e sema.Expr) string {
+	switch x := e.(type) {
+	case *sema.VarRef:
+		if x.Sym != nil {
+			return x.Sym.Name
+		}
+	case *sema.MemberExpr:
+		if x.Field != nil {
+			return x.Field.Name
+		}
+	case *sema.EnumRef:
+		if x.Enumerator != nil {
+			return x.Enumerator.Name
+		}
+	}
+	return ""
+}
+
+// lspOccurrence is one spelling of a symbol, struct field or enumerator.
+// target identifies the entity: *sema.Symbol, *sema.Field or *sema.Enumerator.
+type lspOccurrence struct {
+	target any
+	name   string
+	typ    sema.Type
+	at     preprocessor.DisplayLocation
+	decl   bool
+}
+
+func (d *lspDocument) occurrences() []lspOccurrence {
+	var out []lspOccurrence
+	seen := map[lspOccurrenceKey]bool{}
+	add := func(target any, name string, typ sema.Type, at preprocessor.DisplayLocation, decl bool) {
+		key := lspOccurrenceKey{target, at.File, at.Line, at.Column}
+		if name == "" || at.Line <= 0 || seen[key] {
+			return
+		}
+		seen[key] = true
+		out = append(out, lspOccurrence{target: target, name: name, typ: typ, at: at, decl: decl})
+	}
+	d.walk(func(n sema.Node) bool {
+		switch x := n.(type) {
+		case *sema.VarRef:
+			if x.Sym != nil {
+				add(x.Sym, x.Sym.Name, x.Sym.T, d.display(x.Range.SourceStart), false)
+			}
+		case *sema.AddrConst:
+			if x.Sym != nil {
+				add(x.Sym, x.Sym.Name, x.Sym.T, d.nameAt(x.Range.SourceStart, x.Sym.Name), false)
+			}
+		case *sema.EnumRef:
+			if x.Enumerator != nil {
+				add(x.Enumerator, x.Enumerator.Name, x.T, d.display(x.Range.SourceStart), false)
+			}
+		case *sema.MemberExpr:
+			if x.Field != nil {
+				add(x.Field, x.Field.Name, x.Field.T, d.display(x.Range.SourceEnd), false)
+			}
+		case *sema.VarDecl:
+			if x.Sym != nil {
+				add(x.Sym, x.Sym.Name, x.Sym.T, d.nameAt(x.Sym.Pos, x.Sym.Name), true)
+			}
+		case *sema.FuncDef:
+			add(x.Sym, x.Sym.Name, x.Sym.T, d.nameAt(x.Range.SourceStart, x.Sym.Name), true)
+		case *sema.FuncDecl:
+			add(x.Sym, x.Sym.Name, x.Sym.T, d.nameAt(x.Range.SourceStart, x.Sym.Name), true)
+		case *sema.TypedefDecl:
+			add(x.Sym, x.Sym.Name, x.T, d.nameAt(x.Range.SourceStart, x.Sym.Name), true)
+		case *sema.TagDecl:
+			switch t := x.T.(type) {
+			case *sema.StructType:
+				for _, f := range t.Fields {
+					add(f, f.Name, f.T, d.display(f.Pos), true)
+				}
+			case *sema.UnionType:
+				for _, f := range t.Fields {
+					add(f, f.Name, f.T, d.display(f.Pos), true)
+				}
+			case *sema.EnumType:
+				for _, e := range t.Enumerators {
+					add(e, e.Name, x.T, d.display(e.Pos), true)
+				}
+			}
+		}
+		return true
+	})
+	return out
+}
+
+type lspOccurrenceKey struct {
+	target       any
+	file         string
+	line, column int
+}
+
+func (d *lspDocument) occurrenceAt(line, col int) *lspOccurrence {
+	for _, occ := range d.occurrences() {
+		if occ.at.File == d.path && occ.at.Line == line && occ.at.Column == col {
+			return &occ
+		}
+	}
+	return nil
+}
+
+// declaration returns where target is defined: the function definition if
+// there is one, otherwise its first declaration.
+func (d *lspDocument) declaration(target any, occs []lspOccurrence) (preprocessor.DisplayLocation, bool) {
+	switch x := target.(type) {
+	case *sema.Symbol:
+		for _, def := range x.Defs {
+			if fd, ok := def.(*sema.FuncDef); ok {
+				return d.nameAt(fd.Range.SourceStart, x.Name), true
+			}
+		}
+		return d.nameAt(x.Pos, x.Name), true
+	case *sema.Field:
+		return d.display(x.Pos), true
+	case *sema.Enumerator:
+		return d.display(x.Pos), true
+	}
+	for _, occ := range occs {
+		if occ.target == target && occ.decl {
+			return occ.at, true
+		}
+	}
+	return preprocessor.DisplayLocation{}, false
+}
+
+func (d *lspDocument) location(at preprocessor.DisplayLocation) (lspLocation, bool) {
+	if at.File == "" || at.Line <= 0 {
+		return lspLocation{}, false
+	}
+	if at.File != d.path {
+		if _, err := os.Stat(at.File); err != nil {
+			// Built-in headers have no file an editor could open.
+			return lspLocation{}, false
+		}
+	}
+	return lspLocation{URI: pathToURI(at.File), Range: locationRange(at)}, true
+}
+
+func (d *lspDocument) definition(pos lspPosition) any {
+	line, col := d.cursor(pos)
+	occ := d.occurrenceAt(line, col)
+	if occ == nil {
+		return nil
+	}
+	at, ok := d.declaration(occ.target, nil)
+	if !ok {
+		return nil
+	}
+	loc, ok := d.location(at)
+	if !ok {
+		return nil
+	}
+	return loc
+}
+
+func (d *lspDocument) references(pos lspPosition, includeDeclaration bool) []lspLocation {
+	refs := []lspLocation{}
+	line, col := d.cursor(pos)
+	occs := d.occurrences()
+	var target any
+	for _, occ := range occs {
+		if occ.at.File == d.path && occ.at.Line == line && occ.at.Column == col {
+			target = occ.target
+			break
+		}
+	}
+	if target == nil {
+		return refs
+	}
+	for _, occ := range occs {
+		if occ.target != target || occ.decl && !includeDeclaration {
+			continue
+		}
+		if loc, ok := d.location(occ.at); ok {
+			refs = append(refs, loc)
+		}
+	}
+	return refs
+}
+
+func (d *lspDocument) documentSymbols() []lspDocumentSymbol {
+	type positioned struct {
+		line, col int
+		sym       lspDocumentSymbol
+	}
+	var syms []positioned
+	add := func(start entity.SourcePos, end entity.SourcePos, name string, kind int, detail string, sel preprocessor.DisplayLocation, children []lspDocumentSymbol) {
+		from, to := d.display(start), d.display(end)
+		if from.File != d.path || sel.File != d.path || name == "" {
+			return
+		}
+		syms = append(syms, positioned{from.Line, from.Column, lspDocumentSymbol{
+			Name:           name,
+			Detail:         detail,
+			Kind:           kind,
+			Range:          lspRange{Start: locationRange(from).Start, End: locationRange(to).End},
+			SelectionRange: locationRange(sel),
+			Children:       children,
+		}})
+	}
+	defined := map[*sema.Symbol]bool{}
+	for _, f := range d.prog.Funcs {
+		defined[f.Sym] = true
+		var children []lspDocumentSymbol
+		for _, vd := range append(append([]*sema.VarDecl(nil), f.Params...), f.Locals...) {
+			if vd.Sym == nil || vd.Sym.Name == "" || vd.Sym.Name == "__func__" {
+				continue
+			}
+			at := d.nameAt(vd.Sym.Pos, vd.Sym.Name)
+			if at.File == d.path {
+				children = append(children, lspDocumentSymbol{Name: vd.Sym.Name, Detail: vd.T.String(), Kind: lspSymbolVariable, Range: locationRange(at), SelectionRange: locationRange(at)})
+			}
+		}
+		add(f.Range.SourceStart, f.Range.SourceEnd, f.Sym.Name, lspSymbolFunction, f.T.String(), d.nameAt(f.Range.SourceStart, f.Sym.Name), children)
+	}
+	for _, g := range d.prog.Globals {
+		switch x := g.(type) {
+		case *sema.VarDecl:
+			add(x.Range.SourceStart, x.Range.SourceEnd, x.Sym.Name, lspSymbolVariable, x.T.String(), d.nameAt(x.Sym.Pos, x.Sym.Name), nil)
+		case *sema.FuncDecl:
+			if !defined[x.Sym] {
+				add(x.Range.SourceStart, x.Range.SourceEnd, x.Sym.Name, lspSymbolFunction, x.T.String(), d.nameAt(x.Range.SourceStart, x.Sym.Name), nil)
+			}
+		case *sema.TypedefDecl:
+			add(x.Range.SourceStart, x.Range.SourceEnd, x.Sym.Name, lspSymbolClass, x.T.String(), d.nameAt(x.Range.SourceStart, x.Sym.Name), nil)
+		}
+	}
+	// Tags are only named in the file scope's tag namespace.
+	for tagName, tag := range d.prog.SymTab.File.Tags {
+		name, kind := tagName, lspSymbolStruct
+		var children []lspDocumentSymbol
+		member := func(child string, childKind int, detail string, pos entity.SourcePos) {
+			if at := d.display(pos); at.File == d.path {
+				children = append(children, lspDocumentSymbol{Name: child, Detail: detail, Kind: childKind, Range: locationRange(at), SelectionRange: locationRange(at)})
+			}
+		}
+		switch t := tag.T.(type) {
+		case *sema.StructType:
+			name = "struct " + name
+			for _, f := range t.Fields {
+				member(f.Name, lspSymbolField, f.T.String(), f.Pos)
+			}
+		case *sema.UnionType:
+			name = "union " + name
+			for _, f := range t.Fields {
+				member(f.Name, lspSymbolField, f.T.String(), f.Pos)
+			}
+		case *sema.EnumType:
+			name, kind = "enum "+name, lspSymbolEnum
+			for _, e := range t.Enumerators {
+				member(e.Name, lspSymbolEnumMember, strconv.FormatInt(e.Value, 10), e.Pos)
+			}
+		}
+		end := tag.Pos
+		if tag.Decl != nil {
+			end = tag.Decl.Pos().SourceEnd
+		}
+		add(tag.Pos, end, name, kind, "", d.nameAt(tag.Pos, tagName), children)
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		return syms[i].line < syms[j].line || syms[i].line == syms[j].line && syms[i].col < syms[j].col
+	})
+	out := make([]lspDocumentSymbol, len(syms))
+	for i, s := range syms {
+		out[i] = s.sym
+	}
+	return out
+}
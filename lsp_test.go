@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type lspClient struct {
+	t      *testing.T
+	in     io.Writer
+	out    *bufio.Reader
+	nextID int
+}
+
+func (c *lspClient) send(method string, id int, params any) {
+	c.t.Helper()
+	msg := map[string]any{"jsonrpc": "2.0", "method": method, "params": params}
+	if id > 0 {
+		msg["id"] = id
+	}
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (c *lspClient) read() map[string]json.RawMessage {
+	c.t.Helper()
+	body, err := readLSPMessage(c.out)
+	if err != nil {
+		c.t.Fatalf("read message: %v", err)
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		c.t.Fatalf("decode %s: %v", body, err)
+	}
+	return msg
+}
+
+func (c *lspClient) call(method string, params any, result any) {
+	c.t.Helper()
+	c.nextID++
+	c.send(method, c.nextID, params)
+	msg := c.read()
+	if msg["error"] != nil {
+		c.t.Fatalf("%s: error %s", method, msg["error"])
+	}
+	if err := json.Unmarshal(msg["result"], result); err != nil {
+		c.t.Fatalf("%s: decode %s: %v", method, msg["result"], err)
+	}
+}
+
+func (c *lspClient) diagnostics() []lspDiagnostic {
+	c.t.Helper()
+	msg := c.read()
+	var params struct {
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+	}
+	if string(msg["method"]) != `"textDocument/publishDiagnostics"` {
+		c.t.Fatalf("message = %v, want publishDiagnostics", msg)
+	}
+	if err := json.Unmarshal(msg["params"], &params); err != nil {
+		c.t.Fatalf("decode diagnostics: %v", err)
+	}
+	return params.Diagnostics
+}
+
+func startLSP(t *testing.T, args ...string) (*lspClient, chan int) {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan int, 1)
+	go func() {
+		done <- runLSP(args, inR, outW)
+		outW.Close()
+	}()
+	t.Cleanup(func() { inW.Close() })
+	return &lspClient{t: t, in: inW, out: bufio.NewReader(outR)}, done
+}
+
+func TestLSPSession(t *testing.T) {
+	dir := writeDiagnosticsFixture(t, map[string]string{})
+	path := filepath.Join(dir, "main.c")
+	uri := pathToURI(path)
+	src := `struct point { int x; int y; };
+enum color { RED, GREEN };
+int total;
+int add(int a, int b) {
+	struct point p;
+	p.x = a;
+	total = p.x + b;
+	return total;
+}
+int main(void) { return add(1, RED); }
+int getx(struct point *q) { return q->x; }
+`
+	c, done := startLSP(t, "-Wall")
+	var init struct {
+		Capabilities map[string]any `json:"capabilities"`
+	}
+	c.call("initialize", map[string]any{}, &init)
+	if init.Capabilities["hoverProvider"] != true || init.Capabilities["definitionProvider"] != true {
+		t.Fatalf("capabilities = %v", init.Capabilities)
+	}
+	c.send("initialized", 0, map[string]any{})
+
+	c.send("textDocument/didOpen", 0, map[string]any{"textDocument": map[string]any{"uri": uri, "languageId": "c", "version": 1, "text": "int main(void) {\n\tint unused;\n\treturn missing;\n}\n"}})
+	diags := c.diagnostics()
+	if len(diags) != 2 || diags[0].Severity != 2 || diags[0].Code != "unused-variable" || diags[0].Range.Start != (lspPosition{Line: 1, Character: 5}) {
+		t.Fatalf("diagnostics = %+v", diags)
+	}
+	if diags[1].Severity != 1 || diags[1].Message != "use of undeclared identifier 'missing'" || diags[1].Range.Start != (lspPosition{Line: 2, Character: 8}) || diags[1].Range.End.Character != 15 {
+		t.Fatalf("diagnostics = %+v", diags)
+	}
+
+	c.send("textDocument/didChange", 0, map[string]any{"textDocument": map[string]any{"uri": uri, "version": 2}, "contentChanges": []map[string]string{{"text": src}}})
+	if diags := c.diagnostics(); len(diags) != 0 {
+		t.Fatalf("diagnostics after fix = %+v", diags)
+	}
+
+	at := func(line, character int) map[string]any {
+		return map[string]any{"textDocument": map[string]string{"uri": uri}, "position": lspPosition{Line: line, Character: character}, "context": map[string]bool{"includeDeclaration": true}}
+	}
+	var hover struct {
+		Contents struct{ Value string } `json:"contents"`
+	}
+	for _, tt := range []struct {
+		line, character int
+		want            string
+	}{
+		{6, 12, "x: int"},
+		{6, 2, "total: int"},
+		{9, 25, "add: int (int, int)"},
+		{9, 32, "RED: enum color"},
+		{10, 36, "q: struct point*"},
+		{3, 13, "a: int"},
+	} {
+		c.call("textDocument/hover", at(tt.line, tt.character), &hover)
+		if hover.Contents.Value != tt.want {
+			t.Fatalf("hover at %d:%d = %q, want %q", tt.line, tt.character, hover.Contents.Value, tt.want)
+		}
+	}
+
+	var def lspLocation
+	c.call("textDocument/definition", at(9, 25), &def)
+	if def.URI != uri || def.Range.Start != (lspPosition{Line: 3, Character: 4}) || def.Range.End.Character != 7 {
+		t.Fatalf("definition of add = %+v", def)
+	}
+	c.call("textDocument/definition", at(6, 12), &def)
+	if def.Range.Start != (lspPosition{Line: 0, Character: 19}) {
+		t.Fatalf("definition of p.x = %+v", def)
+	}
+
+	var refs []lspLocation
+	c.call("textDocument/references", at(2, 5), &refs)
+	var lines []int
+	for _, r := range refs {
+		lines = append(lines, r.Range.Start.Line)
+	}
+	if fmt.Sprint(lines) != "[2 6 7]" {
+		t.Fatalf("references to total = %+v", refs)
+	}
+
+	var syms []lspDocumentSymbol
+	c.call("textDocument/documentSymbol", at(0, 0), &syms)
+	var names []string
+	for _, s := range syms {
+		names = append(names, s.Name)
+	}
+	if got := strings.Join(names, ","); got != "struct point,enum color,total,add,main,getx" {
+		t.Fatalf("document symbols = %s", got)
+	}
+	if len(syms[0].Children) != 2 || syms[0].Children[1].Name != "y" || len(syms[3].Children) != 3 || syms[3].Kind != lspSymbolFunction {
+		t.Fatalf("symbol children = %+v", syms)
+	}
+	if sel := syms[0].SelectionRange; sel.Start != (lspPosition{Line: 0, Character: 7}) || sel.End != (lspPosition{Line: 0, Character: 12}) {
+		t.Fatalf("struct point selection range = %+v", sel)
+	}
+
+	var none any
+	c.call("shutdown", nil, &none)
+	c.send("exit", 0, nil)
+	if code := <-done; code != 0 {
+		t.Fatalf("exit code = %d, want 0", code)
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 
+	"shinya.click/cvm/bytecode"
+	"shinya.click/cvm/preprocessor"
 	cvmruntime "shinya.click/cvm/runtime"
+	"shinya.click/cvm/sema"
 )
 
 func main() {
@@ -18,6 +23,15 @@ func runMain(args []string) int {
 	if len(args) > 0 && args[0] == "run" {
 		return runBytecode(args[1:])
 	}
+	if len(args) > 0 && args[0] == "debug" {
+		return debugBytecode(args[1:], os.Stdin, os.Stdout)
+	}
+	if len(args) > 0 && args[0] == "link" {
+		return linkBytecode(args[1:])
+	}
+	if len(args) > 0 && args[0] == "lsp" {
+		return runLSP(args[1:], os.Stdin, os.Stdout)
+	}
 	return runCompileMode(args)
 }
 
@@ -25,31 +39,36 @@ func runBytecode(args []string) int {
 	cfg, err := parseRunBytecodeArgs(args)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		fmt.Fprintln(os.Stderr, "Usage: cvm run [--stdin text] [--env NAME=VALUE] file.cvmbc [args...]")
+		fmt.Fprintln(os.Stderr, "Usage: cvm run [-O0|-O1] [--posix] [--stdin text] [--env NAME=VALUE] [--mount HOSTDIR:GUESTDIR[:ro]] [--profile out.pprof [--profile-period N]] file.cvmbc|file.c [args...]")
 		return 2
 	}
-	f, err := os.Open(cfg.file)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return 1
-	}
-	defer f.Close()
 	var stdin io.Reader
 	if cfg.stdinSet {
 		stdin = strings.NewReader(cfg.stdin)
 	}
-	reg := cvmruntime.DefaultExternRegistryWithIO(stdin, nil, nil)
-	for _, env := range cfg.env {
-		name, value, _ := strings.Cut(env, "=")
-		reg.SetEnv(name, value)
+	prog, err := loadBytecode(cfg, stdin, os.Stderr)
+	if errors.Is(err, errCompileFailed) {
+		return 1
 	}
-	progArgs := append([]string{cfg.file}, cfg.programArgs...)
-	prog, err := cvmruntime.Load(f, cvmruntime.LoadOptions{Args: progArgs, Externs: reg})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return 1
 	}
-	st, err := cvmruntime.Run(context.Background(), prog, cvmruntime.RunOptions{})
+	var opts cvmruntime.RunOptions
+	if cfg.profile != "" {
+		opts.Profile = cvmruntime.NewProfile()
+		opts.Profile.SamplePeriod = cfg.profilePeriod
+	}
+	st, err := cvmruntime.Run(context.Background(), prog, opts)
+	if opts.Profile != nil {
+		// A trapped run still has a useful profile up to the trap.
+		if perr := writeProfile(cfg.profile, opts.Profile); perr != nil {
+			fmt.Fprintln(os.Stderr, perr)
+			if err == nil {
+				return 1
+			}
+		}
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return 1
@@ -57,12 +76,88 @@ func runBytecode(args []string) int {
 	return st.Code
 }
 
+func writeProfile(name string, prof *cvmruntime.Profile) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := prof.WritePprof(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// errCompileFailed is returned once the diagnostics of a failed compile have
+// already been printed.
+var errCompileFailed = errors.New("compilation failed")
+
+// loadBytecode loads cfg.file for `cvm run` and `cvm debug`. C sources are
+// compiled in memory and handed straight to the runtime; their diagnostics go
+// to diagnostics, away from the program's output.
+func loadBytecode(cfg runBytecodeConfig, stdin io.Reader, diagnostics io.Writer) (*cvmruntime.Program, error) {
+	reg := cvmruntime.DefaultExternRegistryWithIO(stdin, nil, nil)
+	if cfg.posix {
+		reg.RegisterPOSIXSubset()
+	}
+	for _, env := range cfg.env {
+		name, value, _ := strings.Cut(env, "=")
+		reg.SetEnv(name, value)
+	}
+	if len(cfg.mounts) > 0 {
+		mounts := &cvmruntime.MountFileSystem{}
+		for _, m := range cfg.mounts {
+			info, err := os.Stat(m.hostDir)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				return nil, fmt.Errorf("--mount %s: not a directory", m.hostDir)
+			}
+			mounts.Mount(m.guestDir, cvmruntime.NewDirFileSystem(m.hostDir, m.readOnly))
+		}
+		reg.SetFileSystem(mounts)
+	}
+	opts := cvmruntime.LoadOptions{Args: append([]string{cfg.file}, cfg.programArgs...), Externs: reg}
+	if strings.HasSuffix(cfg.file, ".c") {
+		c := &Compiler{FileName: cfg.file, OptLevel: cfg.optLevel, Diagnostics: diagnostics}
+		source, err := os.ReadFile(cfg.file)
+		if err != nil {
+			return nil, err
+		}
+		mod, err := c.Compile(string(source))
+		if err != nil {
+			c.handleError(c.diagnostics(), err)
+			return nil, errCompileFailed
+		}
+		return cvmruntime.LoadModule(mod, opts)
+	}
+	f, err := os.Open(cfg.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return cvmruntime.Load(f, opts)
+}
+
 type runBytecodeConfig struct {
-	file        string
-	programArgs []string
-	stdin       string
-	stdinSet    bool
-	env         []string
+	file          string
+	programArgs   []string
+	stdin         string
+	stdinSet      bool
+	env           []string
+	mounts        []runMount
+	profile       string
+	profilePeriod int
+	optLevel      int
+	posix         bool
+}
+
+// runMount is a host directory made visible to the program with --mount.
+type runMount struct {
+	hostDir  string
+	guestDir string
+	readOnly bool
 }
 
 func parseRunBytecodeArgs(args []string) (runBytecodeConfig, error) {
@@ -73,11 +168,19 @@ func parseRunBytecodeArgs(args []string) (runBytecodeConfig, error) {
 		case arg == "--":
 			i++
 			if i >= len(args) {
-				return cfg, fmt.Errorf("missing bytecode file")
+				return cfg, fmt.Errorf("missing program file")
 			}
 			cfg.file = args[i]
 			cfg.programArgs = append([]string(nil), args[i+1:]...)
 			return cfg, nil
+		case strings.HasPrefix(arg, "-O"):
+			level, err := parseOptLevel(arg)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.optLevel = level
+		case arg == "--posix":
+			cfg.posix = true
 		case arg == "--stdin":
 			i++
 			if i >= len(args) {
@@ -88,6 +191,24 @@ func parseRunBytecodeArgs(args []string) (runBytecodeConfig, error) {
 		case strings.HasPrefix(arg, "--stdin="):
 			cfg.stdin = strings.TrimPrefix(arg, "--stdin=")
 			cfg.stdinSet = true
+		case arg == "--profile":
+			i++
+			if i >= len(args) {
+				return cfg, fmt.Errorf("missing value for --profile")
+			}
+			cfg.profile = args[i]
+		case strings.HasPrefix(arg, "--profile="):
+			cfg.profile = strings.TrimPrefix(arg, "--profile=")
+		case arg == "--profile-period":
+			i++
+			if i >= len(args) {
+				return cfg, fmt.Errorf("missing value for --profile-period")
+			}
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n <= 0 {
+				return cfg, fmt.Errorf("--profile-period expects a positive count")
+			}
+			cfg.profilePeriod = n
 		case arg == "--env":
 			i++
 			if i >= len(args) {
@@ -103,13 +224,44 @@ func parseRunBytecodeArgs(args []string) (runBytecodeConfig, error) {
 				return cfg, err
 			}
 			cfg.env = append(cfg.env, env)
+		case arg == "--mount":
+			i++
+			if i >= len(args) {
+				return cfg, fmt.Errorf("missing value for --mount")
+			}
+			m, err := parseRunMount(args[i])
+			if err != nil {
+				return cfg, err
+			}
+			cfg.mounts = append(cfg.mounts, m)
+		case strings.HasPrefix(arg, "--mount="):
+			m, err := parseRunMount(strings.TrimPrefix(arg, "--mount="))
+			if err != nil {
+				return cfg, err
+			}
+			cfg.mounts = append(cfg.mounts, m)
 		default:
 			cfg.file = arg
 			cfg.programArgs = append([]string(nil), args[i+1:]...)
 			return cfg, nil
 		}
 	}
-	return cfg, fmt.Errorf("missing bytecode file")
+	return cfg, fmt.Errorf("missing program file")
+}
+
+func parseRunMount(spec string) (runMount, error) {
+	var m runMount
+	if rest, ok := strings.CutSuffix(spec, ":ro"); ok {
+		spec = rest
+		m.readOnly = true
+	}
+	host, guest, ok := strings.Cut(spec, ":")
+	if !ok || host == "" || !strings.HasPrefix(guest, "/") {
+		return m, fmt.Errorf("--mount expects HOSTDIR:GUESTDIR[:ro] with an absolute GUESTDIR")
+	}
+	m.hostDir = host
+	m.guestDir = guest
+	return m, nil
 }
 
 func validateRunEnv(env string) error {
@@ -120,37 +272,237 @@ func validateRunEnv(env string) error {
 	return nil
 }
 
+func linkBytecode(args []string) int {
+	output := ""
+	posix := false
+	var inputs []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--posix":
+			posix = true
+		case arg == "-o":
+			if i+1 < len(args) {
+				i++
+				output = args[i]
+			}
+		case strings.HasPrefix(arg, "-o="):
+			output = strings.TrimPrefix(arg, "-o=")
+		default:
+			inputs = append(inputs, arg)
+		}
+	}
+	if output == "" || len(inputs) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cvm link [--posix] a.cvmbc [b.cvmbc...] -o out.cvmbc")
+		return 2
+	}
+	units := make([]bytecode.LinkUnit, 0, len(inputs))
+	for _, input := range inputs {
+		mod, err := readBytecodeFile(input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		units = append(units, bytecode.LinkUnit{Name: input, Module: mod})
+	}
+	mod, err := bytecode.Link(units, bytecode.LinkOptions{HostSymbol: hostSymbolResolver(posix)})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := bytecode.EncodeModule(f, mod); err != nil {
+		_ = f.Close()
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func readBytecodeFile(name string) (*bytecode.Module, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mod, err := bytecode.DecodeModule(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return mod, nil
+}
+
+// hostSymbolResolver reports which unresolved externs the runtime registry
+// used by `cvm run` can bind at load time, with the POSIX subset when posix
+// is set.
+func hostSymbolResolver(posix bool) func(bytecode.Global) bool {
+	reg := cvmruntime.DefaultExternRegistry(nil, nil)
+	if posix {
+		reg.RegisterPOSIXSubset()
+	}
+	return func(g bytecode.Global) bool {
+		if g.Size == 0 && g.Align == 0 {
+			_, ok := reg.Lookup(g.Extern.Name)
+			return ok
+		}
+		_, ok := reg.LookupVariable(g.Extern.Name, cvmruntime.NewMemory(bytecode.DefaultTarget()))
+		return ok
+	}
+}
+
+const compileUsage = "Usage: cvm [-E|--dump-ir|--dump-bytecode|--emit-bytecode out.cvmbc] [-I dir] [-D NAME[=VALUE]] [-U NAME] [-std=c99|gnu99] [-pedantic-errors] [-Wall] [-Wextra] [-W[no-]name] [-Werror[=name]] [-O0|-O1] [--diagnostics-format=text|json|sarif] file"
+
 func runCompileMode(args []string) int {
-	dumpIR := false
-	dumpBytecode := false
-	emitBytecode := ""
-	files := make([]string, 0, 1)
+	c, files, err := parseCompileArgs(args)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if err != nil || len(files) != 1 {
+		fmt.Println(compileUsage)
+		return 2
+	}
+	err = c.RunFile(files[0])
+	if c.DiagnosticsFormat != DiagnosticsText {
+		if werr := c.writeDiagnostics(c.diagnostics(), err); werr != nil {
+			fmt.Println(werr)
+			return 1
+		}
+	} else if err != nil {
+		c.handleError(os.Stdout, err)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// parseOptLevel accepts -O0 and -O1; a bare -O means -O1 as in GCC.
+func parseOptLevel(arg string) (int, error) {
+	switch arg {
+	case "-O0":
+		return 0, nil
+	case "-O", "-O1":
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unsupported optimization level %s", arg)
+}
+
+func parseCompileArgs(args []string) (*Compiler, []string, error) {
+	c := &Compiler{DiagnosticsFormat: DiagnosticsText}
+	var files []string
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
-		switch arg {
-		case "--dump-ir":
-			dumpIR = true
-		case "--dump-bytecode":
-			dumpBytecode = true
-		case "--emit-bytecode":
+		switch {
+		case arg == "--dump-ir":
+			c.DumpIR = true
+		case arg == "--dump-bytecode":
+			c.DumpBytecode = true
+		case arg == "--emit-bytecode":
 			i++
 			if i >= len(args) {
-				fmt.Println("Usage: cvm [--dump-ir|--dump-bytecode|--emit-bytecode out.cvmbc] [file]")
-				return 2
+				return nil, nil, fmt.Errorf("missing value for --emit-bytecode")
+			}
+			c.EmitBytecode = args[i]
+		case arg == "-E":
+			c.PreprocessOnly = true
+		case arg == "-pedantic-errors":
+			c.Sema.PedanticErrors = true
+		case strings.HasPrefix(arg, "-O"):
+			level, err := parseOptLevel(arg)
+			if err != nil {
+				return nil, nil, err
+			}
+			c.OptLevel = level
+		case strings.HasPrefix(arg, "-std="):
+			switch std := strings.TrimPrefix(arg, "-std="); std {
+			case "c99":
+				c.Preprocessor.Std = preprocessor.StandardC99
+				c.Sema.GNUExtensions = false
+			case "gnu99":
+				c.Preprocessor.Std = preprocessor.StandardGNU99
+				c.Sema.GNUExtensions = true
+			default:
+				return nil, nil, fmt.Errorf("unsupported language standard %q", std)
+			}
+		case strings.HasPrefix(arg, "--diagnostics-format="):
+			switch format := strings.TrimPrefix(arg, "--diagnostics-format="); format {
+			case DiagnosticsText, DiagnosticsJSON, DiagnosticsSARIF:
+				c.DiagnosticsFormat = format
+			default:
+				return nil, nil, fmt.Errorf("unsupported diagnostics format %q", format)
 			}
-			emitBytecode = args[i]
+		case strings.HasPrefix(arg, "-W"):
+			if err := parseWarningFlag(&c.Sema, arg); err != nil {
+				return nil, nil, err
+			}
+		case strings.HasPrefix(arg, "-I"), strings.HasPrefix(arg, "-D"), strings.HasPrefix(arg, "-U"):
+			flag, value := arg[:2], arg[2:]
+			if value == "" {
+				i++
+				if i >= len(args) {
+					return nil, nil, fmt.Errorf("missing value for %s", flag)
+				}
+				value = args[i]
+			}
+			switch flag {
+			case "-I":
+				c.Preprocessor.IncludePaths = append(c.Preprocessor.IncludePaths, value)
+			case "-D":
+				// As with cc, a bare -DNAME means 1 and -DNAME= an empty definition.
+				name, def, hasDef := strings.Cut(value, "=")
+				c.Preprocessor.MacroActions = append(c.Preprocessor.MacroActions, preprocessor.MacroAction{Kind: preprocessor.MacroDefine, Name: name, Value: def, Empty: hasDef && def == ""})
+			case "-U":
+				c.Preprocessor.MacroActions = append(c.Preprocessor.MacroActions, preprocessor.MacroAction{Kind: preprocessor.MacroUndef, Name: value})
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return nil, nil, fmt.Errorf("unknown option %s", arg)
 		default:
 			files = append(files, arg)
 		}
 	}
-	if len(files) != 1 {
-		fmt.Println("Usage: cvm [--dump-ir|--dump-bytecode|--emit-bytecode out.cvmbc] [file]")
-		return 2
+	return c, files, nil
+}
+
+func parseWarningFlag(opts *sema.SemaOptions, arg string) error {
+	switch arg {
+	case "-Wall":
+		opts.Warnings |= sema.WarningsAll
+		return nil
+	case "-Wextra":
+		opts.Warnings |= sema.WarningsExtra
+		return nil
+	case "-Werror":
+		opts.WarningsAsErrors = true
+		return nil
+	case "-Werror=declaration-after-statement":
+		opts.WErrorDeclarationAfterStatement = true
+		return nil
 	}
-	c := &Compiler{DumpIR: dumpIR, DumpBytecode: dumpBytecode, EmitBytecode: emitBytecode}
-	if err := c.RunFile(files[0]); err != nil {
-		c.handleError(err)
-		return 1
+	name, enable, promote := strings.TrimPrefix(arg, "-W"), true, false
+	switch {
+	case strings.HasPrefix(name, "error="):
+		name, promote = strings.TrimPrefix(name, "error="), true
+	case strings.HasPrefix(name, "no-"):
+		name, enable = strings.TrimPrefix(name, "no-"), false
 	}
-	return 0
+	w, ok := sema.ParseWarning(name)
+	if !ok {
+		return fmt.Errorf("unknown warning option %s", arg)
+	}
+	if !enable {
+		opts.Warnings = opts.Warnings.Without(w)
+		return nil
+	}
+	opts.Warnings = opts.Warnings.With(w)
+	if promote {
+		opts.ErrorWarnings = opts.ErrorWarnings.With(w)
+	}
+	return nil
 }
@@ -38,7 +38,7 @@ func (pp *preprocessor) applyMacroActions(actions []MacroAction) {
 		switch action.Kind {
 		case MacroDefine:
 			value := action.Value
-			if value == "" {
+			if value == "" && !action.Empty {
 				value = "1"
 			}
 			pp.macros.DefineObject(action.Name, pp.scanReplacement(value))
@@ -55,7 +55,13 @@ func (pp *preprocessor) scanReplacement(value string) []PPToken {
 	if err != nil {
 		return []PPToken{{Kind: PPIdentifier, Lexeme: value}}
 	}
-	return dropNewlines(tokens)
+	tokens = dropNewlines(tokens)
+	// The replacement is spliced into whatever line invokes the macro, and its
+	// locations belong to a throwaway source manager.
+	for i := range tokens {
+		tokens[i].StartOfLine = false
+	}
+	return tokens
 }
 
 func (pp *preprocessor) process(tokens []PPToken) ([]PPToken, error) {
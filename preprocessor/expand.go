@@ -212,7 +212,11 @@ func (p *Preprocessor) expandIdentifier(tok PPToken) (PPToken, bool, error) {
 		p.pushMacro(macro, replacement)
 		return PPToken{}, true, nil
 	}
-	p.pushMacro(macro, cloneTokens(macro.Replacement))
+	replacement := cloneTokens(macro.Replacement)
+	for i := range replacement {
+		replacement[i].Location = p.pp.sm.AddExpansion(replacement[i].Location, tok.Location, macro.Definition)
+	}
+	p.pushMacro(macro, replacement)
 	return PPToken{}, true, nil
 }
 
@@ -361,7 +365,7 @@ func (pp *preprocessor) substitute(m *Macro, args []macroArg, use entity.SourceP
 			}
 			left := out[len(out)-1]
 			out = out[:len(out)-1]
-			rightTokens := pp.substitutionFor(m.Replacement[i+1], args, paramIndex, rawParam, use)
+			rightTokens := pp.substitutionFor(m.Replacement[i+1], args, paramIndex, rawParam, use, m.Definition)
 			if len(rightTokens) == 0 {
 				out = append(out, left)
 				i++
@@ -376,7 +380,7 @@ func (pp *preprocessor) substitute(m *Macro, args []macroArg, use entity.SourceP
 			i++
 			continue
 		}
-		replacement := pp.substitutionFor(tok, args, paramIndex, rawParam, use)
+		replacement := pp.substitutionFor(tok, args, paramIndex, rawParam, use, m.Definition)
 		if m.Variadic && tok.Kind == PPIdentifier && tok.Lexeme == "__VA_ARGS__" && len(replacement) == 0 && len(out) > 0 && out[len(out)-1].Kind == PPPunctuator && out[len(out)-1].Lexeme == "," {
 			out = out[:len(out)-1]
 		}
@@ -404,14 +408,10 @@ func rawParamSet(replacement []PPToken, params map[string]int) map[string]bool {
 	return raw
 }
 
-func (pp *preprocessor) substitutionFor(tok PPToken, args []macroArg, params map[string]int, rawParam map[string]bool, use entity.SourcePos) []PPToken {
-	if tok.Kind != PPIdentifier {
-		tok.Location = use
-		return []PPToken{tok}
-	}
+func (pp *preprocessor) substitutionFor(tok PPToken, args []macroArg, params map[string]int, rawParam map[string]bool, use, definition entity.SourcePos) []PPToken {
 	idx, ok := params[tok.Lexeme]
-	if !ok || idx >= len(args) {
-		tok.Location = use
+	if tok.Kind != PPIdentifier || !ok || idx >= len(args) {
+		tok.Location = pp.sm.AddExpansion(tok.Location, use, definition)
 		return []PPToken{tok}
 	}
 	if rawParam[tok.Lexeme] {
@@ -104,6 +104,36 @@ func TestBuiltinFileAndLineMacros(t *testing.T) {
 	}
 }
 
+func TestMacroReplacementTokensRecordExpansion(t *testing.T) {
+	res, err := PreprocessSource("main.c", "#define ONE 1\n#define ADD(x) (ONE + x)\n\n\n#define HERE __LINE__\nint v = ADD(2) + HERE;\n", Options{})
+	if err != nil {
+		t.Fatalf("PreprocessSource failed: %v", err)
+	}
+	var one, here entity.Token
+	for _, tok := range res.Tokens {
+		switch {
+		case tok.Lexeme == "1":
+			one = tok
+		case tok.Lexeme == "6":
+			here = tok
+		}
+	}
+	if got := res.Sources.DisplayLocation(one.SourceStart); got.Line != 6 || got.Column != 9 {
+		t.Fatalf("ONE displayed at %#v, want the ADD use at 6:9", got)
+	}
+	inner := res.Sources.ExpansionTrace(one.SourceStart)
+	if def := res.Sources.DisplayLocation(inner.Definition); def.Line != 1 || def.Column != 9 {
+		t.Fatalf("ONE definition = %#v, want 1:9", def)
+	}
+	outer := res.Sources.ExpansionTrace(inner.Expansion)
+	if def := res.Sources.DisplayLocation(outer.Definition); def.Line != 2 || def.Column != 9 {
+		t.Fatalf("ADD definition = %#v, want 2:9", def)
+	}
+	if here.Lexeme != "6" {
+		t.Fatalf("__LINE__ inside a macro did not use the expansion line: %v", nonEOFParserLexemes(res.Tokens))
+	}
+}
+
 func hasLexeme(tokens []entity.Token, lexeme string) bool {
 	for _, tok := range tokens {
 		if tok.Lexeme == lexeme {
@@ -1,6 +1,9 @@
 package preprocessor
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 func builtinHeader(name string, target TargetInfo) (string, bool) {
 	switch name {
@@ -13,7 +16,7 @@ func builtinHeader(name string, target TargetInfo) (string, bool) {
 	case "stdint.h":
 		return stdintHeader(target), true
 	case "inttypes.h":
-		return "#ifndef __CVM_INTTYPES_H\n#define __CVM_INTTYPES_H\n#include <stdint.h>\n#endif\n", true
+		return inttypesHeader(target), true
 	case "iso646.h":
 		return "#ifndef __CVM_ISO646_H\n#define __CVM_ISO646_H\n#define and &&\n#define and_eq &=\n#define bitand &\n#define bitor |\n#define compl ~\n#define not !\n#define not_eq !=\n#define or ||\n#define or_eq |=\n#define xor ^\n#define xor_eq ^=\n#endif\n", true
 	case "math.h":
@@ -21,11 +24,11 @@ func builtinHeader(name string, target TargetInfo) (string, bool) {
 	case "complex.h":
 		return complexHeader(), true
 	case "fenv.h":
-		return "#ifndef __CVM_FENV_H\n#define __CVM_FENV_H\n#define FE_ALL_EXCEPT 0\nint feclearexcept(int);\nint fetestexcept(int);\n#endif\n", true
+		return fenvHeader(), true
 	case "errno.h":
 		return "#ifndef __CVM_ERRNO_H\n#define __CVM_ERRNO_H\n#define EDOM 33\n#define ERANGE 34\n#define EILSEQ 84\nextern int errno;\n#endif\n", true
 	case "assert.h":
-		return "#ifndef __CVM_ASSERT_H\n#define __CVM_ASSERT_H\n#ifdef NDEBUG\n#define assert(expr) ((void)0)\n#else\nvoid abort(void);\n#define assert(expr) ((expr) ? (void)0 : abort())\n#endif\n#endif\n", true
+		return "#ifndef __CVM_ASSERT_H\n#define __CVM_ASSERT_H\nvoid __assert_fail(const char *, const char *, unsigned int, const char *);\n#endif\n#undef assert\n#ifdef NDEBUG\n#define assert(expr) ((void)0)\n#else\n#define assert(expr) ((expr) ? (void)0 : __assert_fail(#expr, __FILE__, __LINE__, __func__))\n#endif\n", true
 	case "tgmath.h":
 		return tgmathHeader(), true
 	case "chk.h":
@@ -33,7 +36,11 @@ func builtinHeader(name string, target TargetInfo) (string, bool) {
 	case "builtins-config.h":
 		return "#ifndef __CVM_BUILTINS_CONFIG_H\n#define __CVM_BUILTINS_CONFIG_H\n#define HAVE_C99_RUNTIME 1\n#endif\n", true
 	case "sys/types.h":
-		return "#ifndef __CVM_SYS_TYPES_H\n#define __CVM_SYS_TYPES_H\n#endif\n", true
+		return "#ifndef __CVM_SYS_TYPES_H\n#define __CVM_SYS_TYPES_H\n#ifndef __CVM_SSIZE_T\n#define __CVM_SSIZE_T\ntypedef long ssize_t;\n#endif\n#endif\n", true
+	case "unistd.h":
+		return unistdHeader(), true
+	case "getopt.h":
+		return getoptHeader(), true
 	case "stdio.h":
 		return stdioHeader(), true
 	case "stdlib.h":
@@ -52,8 +59,10 @@ func builtinHeader(name string, target TargetInfo) (string, bool) {
 		return stringHeader(), true
 	case "strings.h":
 		return stringsHeader(), true
+	case "setjmp.h":
+		return setjmpHeader(), true
 	case "signal.h":
-		return "#ifndef __CVM_SIGNAL_H\n#define __CVM_SIGNAL_H\ntypedef int sig_atomic_t;\n#define SIG_ATOMIC_MIN (-2147483647-1)\n#define SIG_ATOMIC_MAX 2147483647\n#endif\n", true
+		return signalHeader(), true
 	case "limits.h":
 		return "#ifndef __CVM_LIMITS_H\n#define __CVM_LIMITS_H\n#define CHAR_BIT 8\n#define SCHAR_MIN (-128)\n#define SCHAR_MAX 127\n#define UCHAR_MAX 255\n#define SHRT_MIN (-32768)\n#define SHRT_MAX 32767\n#define USHRT_MAX 65535\n#define INT_MIN (-2147483647-1)\n#define INT_MAX 2147483647\n#define UINT_MAX 4294967295U\n#define LONG_MIN (-9223372036854775807L-1L)\n#define LONG_MAX 9223372036854775807L\n#define ULONG_MAX 18446744073709551615UL\n#define LLONG_MIN (-9223372036854775807LL-1LL)\n#define LLONG_MAX 9223372036854775807LL\n#define ULLONG_MAX 18446744073709551615ULL\n#endif\n", true
 	case "float.h":
@@ -221,12 +230,26 @@ int fprintf_unlocked(FILE *, const char *, ...);
 int sprintf(char *, const char *, ...);
 int snprintf(char *, size_t, const char *, ...);
 int sscanf(const char *, const char *, ...);
+int vscanf(const char *, void *);
+int vfscanf(FILE *, const char *, void *);
+int vsscanf(const char *, const char *, void *);
 int vprintf(const char *, void *);
 int vprintf_unlocked(const char *, void *);
 int vfprintf(FILE *, const char *, void *);
 int vfprintf_unlocked(FILE *, const char *, void *);
 int vsprintf(char *, const char *, void *);
 int vsnprintf(char *, size_t, const char *, void *);
+` + posixVisible + `
+#ifndef __CVM_SSIZE_T
+#define __CVM_SSIZE_T
+typedef long ssize_t;
+#endif
+ssize_t getline(char ** restrict, size_t * restrict, FILE * restrict);
+ssize_t getdelim(char ** restrict, size_t * restrict, int, FILE * restrict);
+FILE *fdopen(int, const char *);
+int asprintf(char ** restrict, const char * restrict, ...);
+int vasprintf(char ** restrict, const char * restrict, void *);
+#endif
 #endif
 `
 }
@@ -281,6 +304,12 @@ int atexit(void (*)(void));
 void exit(int);
 void _Exit(int);
 void abort(void);
+void qsort(void *, size_t, size_t, int (*)(const void *, const void *));
+void *bsearch(const void *, const void *, size_t, size_t, int (*)(const void *, const void *));
+` + posixVisible + `
+void *aligned_alloc(size_t, size_t);
+int posix_memalign(void **, size_t, size_t);
+#endif
 #endif
 `
 }
@@ -306,6 +335,74 @@ int toupper(int);
 `
 }
 
+func signalHeader() string {
+	return `#ifndef __CVM_SIGNAL_H
+#define __CVM_SIGNAL_H
+typedef int sig_atomic_t;
+#define SIG_ATOMIC_MIN (-2147483647-1)
+#define SIG_ATOMIC_MAX 2147483647
+#define SIG_DFL ((void (*)(int))0)
+#define SIG_IGN ((void (*)(int))1)
+#define SIG_ERR ((void (*)(int))-1L)
+#define SIGINT 2
+#define SIGILL 4
+#define SIGABRT 6
+#define SIGFPE 8
+#define SIGSEGV 11
+#define SIGTERM 15
+void (*signal(int sig, void (*func)(int)))(int);
+int raise(int sig);
+#endif
+`
+}
+
+func setjmpHeader() string {
+	return `#ifndef __CVM_SETJMP_H
+#define __CVM_SETJMP_H
+typedef long jmp_buf[4];
+int setjmp(jmp_buf env);
+void longjmp(jmp_buf env, int val);
+int _setjmp(jmp_buf env);
+void _longjmp(jmp_buf env, int val);
+#endif
+`
+}
+
+func fenvHeader() string {
+	return `#ifndef __CVM_FENV_H
+#define __CVM_FENV_H
+typedef unsigned short fexcept_t;
+typedef struct {
+	unsigned int __except;
+	unsigned int __round;
+} fenv_t;
+#define FE_INVALID 0x01
+#define FE_DIVBYZERO 0x04
+#define FE_OVERFLOW 0x08
+#define FE_UNDERFLOW 0x10
+#define FE_INEXACT 0x20
+#define FE_ALL_EXCEPT (FE_INVALID | FE_DIVBYZERO | FE_OVERFLOW | FE_UNDERFLOW | FE_INEXACT)
+#define FE_TONEAREST 0
+#define FE_DOWNWARD 0x400
+#define FE_UPWARD 0x800
+#define FE_TOWARDZERO 0xc00
+extern const fenv_t __cvm_fe_dfl_env;
+#define FE_DFL_ENV (&__cvm_fe_dfl_env)
+int feclearexcept(int);
+int fegetexceptflag(fexcept_t *, int);
+int feraiseexcept(int);
+int fesetexceptflag(const fexcept_t *, int);
+int fetestexcept(int);
+int fegetround(void);
+int fesetround(int);
+int fegetenv(fenv_t *);
+int feholdexcept(fenv_t *);
+int fesetenv(const fenv_t *);
+int feupdateenv(const fenv_t *);
+#endif
+`
+}
+
 func localeHeader() string {
 	return `#ifndef __CVM_LOCALE_H
 #define __CVM_LOCALE_H
@@ -390,6 +487,32 @@ size_t mbrtowc(wchar_t *, const char *, size_t, mbstate_t *);
 size_t wcrtomb(char *, wchar_t, mbstate_t *);
 size_t mbsrtowcs(wchar_t *, const char **, size_t, mbstate_t *);
 size_t wcsrtombs(char *, const wchar_t **, size_t, mbstate_t *);
+long wcstol(const wchar_t * restrict, wchar_t ** restrict, int);
+long long wcstoll(const wchar_t * restrict, wchar_t ** restrict, int);
+unsigned long wcstoul(const wchar_t * restrict, wchar_t ** restrict, int);
+unsigned long long wcstoull(const wchar_t * restrict, wchar_t ** restrict, int);
+double wcstod(const wchar_t * restrict, wchar_t ** restrict);
+float wcstof(const wchar_t * restrict, wchar_t ** restrict);
+long double wcstold(const wchar_t * restrict, wchar_t ** restrict);
+int fwide(struct __cvm_FILE *, int);
+wint_t fgetwc(struct __cvm_FILE *);
+wint_t getwc(struct __cvm_FILE *);
+wint_t getwchar(void);
+wint_t fputwc(wchar_t, struct __cvm_FILE *);
+wint_t putwc(wchar_t, struct __cvm_FILE *);
+wint_t putwchar(wchar_t);
+wint_t ungetwc(wint_t, struct __cvm_FILE *);
+wchar_t *fgetws(wchar_t * restrict, int, struct __cvm_FILE * restrict);
+int fputws(const wchar_t * restrict, struct __cvm_FILE * restrict);
+int wprintf(const wchar_t * restrict, ...);
+int fwprintf(struct __cvm_FILE * restrict, const wchar_t * restrict, ...);
+int swprintf(wchar_t * restrict, size_t, const wchar_t * restrict, ...);
+int vwprintf(const wchar_t * restrict, void *);
+int vfwprintf(struct __cvm_FILE * restrict, const wchar_t * restrict, void *);
+int vswprintf(wchar_t * restrict, size_t, const wchar_t * restrict, void *);
+int wscanf(const wchar_t * restrict, ...);
+int fwscanf(struct __cvm_FILE * restrict, const wchar_t * restrict, ...);
+int swscanf(const wchar_t * restrict, const wchar_t * restrict, ...);
 #endif
 `
 }
@@ -431,12 +554,38 @@ wint_t towctrans(wint_t, wctrans_t);
 func timeHeader() string {
 	return `#ifndef __CVM_TIME_H
 #define __CVM_TIME_H
+#ifndef __CVM_SIZE_T
+#define __CVM_SIZE_T
+typedef __SIZE_TYPE__ size_t;
+#endif
+#ifndef NULL
+#define NULL ((void *)0)
+#endif
 typedef long clock_t;
 typedef long time_t;
 #define CLOCKS_PER_SEC 1000000L
+struct tm {
+  int tm_sec;
+  int tm_min;
+  int tm_hour;
+  int tm_mday;
+  int tm_mon;
+  int tm_year;
+  int tm_wday;
+  int tm_yday;
+  int tm_isdst;
+  long tm_gmtoff;
+  const char *tm_zone;
+};
 clock_t clock(void);
 double difftime(time_t, time_t);
+time_t mktime(struct tm *);
 time_t time(time_t *);
+char *asctime(const struct tm *);
+char *ctime(const time_t *);
+struct tm *gmtime(const time_t *);
+struct tm *localtime(const time_t *);
+size_t strftime(char * restrict, size_t, const char * restrict, const struct tm * restrict);
 #endif
 `
 }
@@ -477,6 +626,12 @@ char *strcat(char *, const char *);
 char *strncpy(char *, const char *, size_t);
 char *stpncpy(char *, const char *, size_t);
 char *strncat(char *, const char *, size_t);
+` + posixVisible + `
+int strcasecmp(const char *, const char *);
+int strncasecmp(const char *, const char *, size_t);
+void *memmem(const void *, size_t, const void *, size_t);
+char *strsep(char **, const char *);
+#endif
 #endif
 `
 }
@@ -491,6 +646,60 @@ typedef __SIZE_TYPE__ size_t;
 int bcmp(const void *, const void *, size_t);
 void bcopy(const void *, void *, size_t);
 void bzero(void *, size_t);
+` + posixVisible + `
+int strcasecmp(const char *, const char *);
+int strncasecmp(const char *, const char *, size_t);
+#endif
+#endif
+`
+}
+
+// posixVisible opens the part of an ISO C header that declares POSIX and GNU
+// extensions. Like glibc, the extensions stay hidden unless the program asks
+// for them with a feature test macro.
+const posixVisible = "#if defined(_POSIX_C_SOURCE) || defined(_XOPEN_SOURCE) || defined(_GNU_SOURCE) || defined(_DEFAULT_SOURCE) || defined(_BSD_SOURCE)"
+
+func unistdHeader() string {
+	return `#ifndef __CVM_UNISTD_H
+#define __CVM_UNISTD_H
+#ifndef __CVM_SIZE_T
+#define __CVM_SIZE_T
+typedef __SIZE_TYPE__ size_t;
+#endif
+#ifndef __CVM_SSIZE_T
+#define __CVM_SSIZE_T
+typedef long ssize_t;
+#endif
+#define STDIN_FILENO 0
+#define STDOUT_FILENO 1
+#define STDERR_FILENO 2
+extern char *optarg;
+extern int optind;
+extern int opterr;
+extern int optopt;
+int getopt(int, char * const [], const char *);
+#endif
+`
+}
+
+func getoptHeader() string {
+	return `#ifndef __CVM_GETOPT_H
+#define __CVM_GETOPT_H
+extern char *optarg;
+extern int optind;
+extern int opterr;
+extern int optopt;
+struct option {
+  const char *name;
+  int has_arg;
+  int *flag;
+  int val;
+};
+#define no_argument 0
+#define required_argument 1
+#define optional_argument 2
+int getopt(int, char * const [], const char *);
+int getopt_long(int, char * const [], const char *, const struct option *, int *);
 #endif
 `
 }
@@ -615,6 +824,55 @@ typedef %s uintmax_t;
 `, target.PtrdiffType, target.SizeType, target.IntmaxType, target.UIntmaxType)
 }
 
+func inttypesHeader(target TargetInfo) string {
+	var b strings.Builder
+	b.WriteString(`#ifndef __CVM_INTTYPES_H
+#define __CVM_INTTYPES_H
+#include <stdint.h>
+#ifndef __CVM_WCHAR_T
+#define __CVM_WCHAR_T
+typedef __WCHAR_TYPE__ wchar_t;
+#endif
+typedef struct { intmax_t quot; intmax_t rem; } imaxdiv_t;
+`)
+	widths := []struct{ name, pri, scn string }{
+		{"8", "", "hh"}, {"16", "", "h"}, {"32", "", ""}, {"64", "l", "l"},
+		{"LEAST8", "", "hh"}, {"LEAST16", "", "h"}, {"LEAST32", "", ""}, {"LEAST64", "l", "l"},
+		{"FAST8", "", "hh"}, {"FAST16", "l", "l"}, {"FAST32", "l", "l"}, {"FAST64", "l", "l"},
+		{"MAX", lengthModifier(target.IntmaxType), lengthModifier(target.IntmaxType)},
+		{"PTR", lengthModifier(target.PtrdiffType), lengthModifier(target.PtrdiffType)},
+	}
+	for _, w := range widths {
+		for _, conv := range "diouxX" {
+			fmt.Fprintf(&b, "#define PRI%c%s \"%s%c\"\n", conv, w.name, w.pri, conv)
+		}
+		for _, conv := range "dioux" {
+			fmt.Fprintf(&b, "#define SCN%c%s \"%s%c\"\n", conv, w.name, w.scn, conv)
+		}
+	}
+	b.WriteString(`intmax_t imaxabs(intmax_t);
+imaxdiv_t imaxdiv(intmax_t, intmax_t);
+intmax_t strtoimax(const char * restrict, char ** restrict, int);
+uintmax_t strtoumax(const char * restrict, char ** restrict, int);
+intmax_t wcstoimax(const wchar_t * restrict, wchar_t ** restrict, int);
+uintmax_t wcstoumax(const wchar_t * restrict, wchar_t ** restrict, int);
+#endif
+`)
+	return b.String()
+}
+
+// lengthModifier is the printf length modifier for an integer type spelling.
+func lengthModifier(spelling string) string {
+	switch spelling {
+	case "long", "unsigned long":
+		return "l"
+	case "long long", "unsigned long long":
+		return "ll"
+	default:
+		return ""
+	}
+}
+
 func mathHeader() string {
 	return `#ifndef __CVM_MATH_H
 #define __CVM_MATH_H
@@ -820,6 +1078,11 @@ int __cvm_signbitf(float);
 int __cvm_signbit(double);
 int __cvm_signbitl(long double);
 int __cvm_isunordered(double, double);
+int __cvm_isgreater(double, double);
+int __cvm_isgreaterequal(double, double);
+int __cvm_isless(double, double);
+int __cvm_islessequal(double, double);
+int __cvm_islessgreater(double, double);
 #define __cvm_math_select1(x, f, d, l) ((sizeof(x) == sizeof(float)) ? f(x) : ((sizeof(x) == sizeof(long double)) ? l(x) : d(x)))
 #define fpclassify(x) __cvm_math_select1((x), __cvm_fpclassifyf, __cvm_fpclassify, __cvm_fpclassifyl)
 #define isfinite(x) __cvm_math_select1((x), __cvm_isfinitef, __cvm_isfinite, __cvm_isfinitel)
@@ -827,11 +1090,11 @@ int __cvm_isunordered(double, double);
 #define isnan(x) __cvm_math_select1((x), __cvm_isnanf, __cvm_isnan, __cvm_isnanl)
 #define isnormal(x) __cvm_math_select1((x), __cvm_isnormalf, __cvm_isnormal, __cvm_isnormall)
 #define signbit(x) __cvm_math_select1((x), __cvm_signbitf, __cvm_signbit, __cvm_signbitl)
-#define isgreater(x, y) ((x) > (y))
-#define isgreaterequal(x, y) ((x) >= (y))
-#define isless(x, y) ((x) < (y))
-#define islessequal(x, y) ((x) <= (y))
-#define islessgreater(x, y) (!__cvm_isunordered((x), (y)) && ((x) != (y)))
+#define isgreater(x, y) __cvm_isgreater((x), (y))
+#define isgreaterequal(x, y) __cvm_isgreaterequal((x), (y))
+#define isless(x, y) __cvm_isless((x), (y))
+#define islessequal(x, y) __cvm_islessequal((x), (y))
+#define islessgreater(x, y) __cvm_islessgreater((x), (y))
 #define isunordered(x, y) __cvm_isunordered((x), (y))
 #endif
 `
@@ -82,7 +82,7 @@ func TestBuiltinStdlibHeaderDeclaresRuntimeSurface(t *testing.T) {
 	if err != nil {
 		t.Fatalf("PreprocessSource failed: %v", err)
 	}
-	for _, name := range []string{"size_t", "wchar_t", "div_t", "ldiv_t", "lldiv_t", "abs", "labs", "llabs", "div", "ldiv", "lldiv", "atoi", "atol", "atoll", "atof", "strtol", "strtoul", "strtoll", "strtoull", "strtod", "strtof", "strtold", "mblen", "mbtowc", "wctomb", "mbstowcs", "wcstombs", "malloc", "calloc", "realloc", "free", "strdup", "rand", "srand", "getenv", "system", "atexit", "exit", "_Exit", "abort"} {
+	for _, name := range []string{"size_t", "wchar_t", "div_t", "ldiv_t", "lldiv_t", "abs", "labs", "llabs", "div", "ldiv", "lldiv", "atoi", "atol", "atoll", "atof", "strtol", "strtoul", "strtoll", "strtoull", "strtod", "strtof", "strtold", "mblen", "mbtowc", "wctomb", "mbstowcs", "wcstombs", "malloc", "calloc", "realloc", "free", "strdup", "rand", "srand", "getenv", "system", "atexit", "exit", "_Exit", "abort", "qsort", "bsearch"} {
 		if !hasIdentifier(res.Tokens, name) {
 			t.Fatalf("stdlib identifier %q missing: %#v", name, res.Tokens)
 		}
@@ -151,7 +151,7 @@ wctrans_t named_trans = wctrans("tolower");
 	if err != nil {
 		t.Fatalf("PreprocessSource failed: %v", err)
 	}
-	for _, name := range []string{"wchar_t", "wint_t", "mbstate_t", "wctype_t", "wctrans_t", "mbrlen", "mbrtowc", "wcrtomb", "mbsrtowcs", "wcsrtombs", "iswalnum", "iswalpha", "iswblank", "iswcntrl", "iswdigit", "iswgraph", "iswlower", "iswprint", "iswpunct", "iswspace", "iswupper", "iswxdigit", "towlower", "towupper", "wctype", "iswctype", "wctrans", "towctrans"} {
+	for _, name := range []string{"wchar_t", "wint_t", "mbstate_t", "wctype_t", "wctrans_t", "mbrlen", "mbrtowc", "wcrtomb", "mbsrtowcs", "wcsrtombs", "iswalnum", "iswalpha", "iswblank", "iswcntrl", "iswdigit", "iswgraph", "iswlower", "iswprint", "iswpunct", "iswspace", "iswupper", "iswxdigit", "towlower", "towupper", "wctype", "iswctype", "wctrans", "towctrans", "fwide", "fgetwc", "fputwc", "fgetws", "fputws", "ungetwc", "wprintf", "fwprintf", "swprintf", "vwprintf", "vfwprintf", "vswprintf", "wscanf", "fwscanf", "swscanf", "wcstol", "wcstoll", "wcstoul", "wcstoull", "wcstod", "wcstof", "wcstold"} {
 		if !hasIdentifier(res.Tokens, name) {
 			t.Fatalf("wide header identifier %q missing: %#v", name, res.Tokens)
 		}
@@ -171,7 +171,7 @@ long ticks = CLOCKS_PER_SEC;
 	if err != nil {
 		t.Fatalf("PreprocessSource failed: %v", err)
 	}
-	for _, name := range []string{"clock_t", "time_t", "clock", "difftime", "time"} {
+	for _, name := range []string{"clock_t", "time_t", "clock", "difftime", "time", "tm", "mktime", "gmtime", "localtime", "asctime", "ctime", "strftime"} {
 		if !hasIdentifier(res.Tokens, name) {
 			t.Fatalf("time identifier %q missing: %#v", name, res.Tokens)
 		}
@@ -181,6 +181,27 @@ long ticks = CLOCKS_PER_SEC;
 	}
 }
 
+func TestBuiltinInttypesHeaderDeclaresFormatMacros(t *testing.T) {
+	res, err := PreprocessSource("main.c", `
+#include <inttypes.h>
+const char *formats[] = {PRId64, PRIuMAX, PRIxPTR, SCNd8, SCNu16, PRIXFAST32};
+imaxdiv_t qr;
+`, Options{})
+	if err != nil {
+		t.Fatalf("PreprocessSource failed: %v", err)
+	}
+	for _, lexeme := range []string{`"ld"`, `"lu"`, `"lx"`, `"hhd"`, `"hu"`, `"lX"`} {
+		if !hasLexeme(res.Tokens, lexeme) {
+			t.Fatalf("format macro %s missing: %#v", lexeme, res.Tokens)
+		}
+	}
+	for _, name := range []string{"imaxdiv_t", "imaxabs", "imaxdiv", "strtoimax", "strtoumax", "wcstoimax", "wcstoumax"} {
+		if !hasIdentifier(res.Tokens, name) {
+			t.Fatalf("inttypes identifier %q missing: %#v", name, res.Tokens)
+		}
+	}
+}
+
 func TestBuiltinMathHeaderDeclaresRuntimeSurface(t *testing.T) {
 	res, err := PreprocessSource("main.c", `
 #include <math.h>
@@ -228,6 +249,50 @@ int values[] = { EDOM, ERANGE, EILSEQ };
 	}
 }
 
+func TestBuiltinFenvHeaderDeclaresRuntimeSurface(t *testing.T) {
+	res, err := PreprocessSource("main.c", `
+#include <fenv.h>
+fenv_t env;
+fexcept_t flags;
+int modes[] = { FE_TONEAREST, FE_DOWNWARD, FE_UPWARD, FE_TOWARDZERO };
+const fenv_t *dfl = FE_DFL_ENV;
+`, Options{})
+	if err != nil {
+		t.Fatalf("PreprocessSource failed: %v", err)
+	}
+	for _, name := range []string{"fenv_t", "fexcept_t", "feclearexcept", "fegetexceptflag", "feraiseexcept", "fesetexceptflag", "fetestexcept", "fegetround", "fesetround", "fegetenv", "feholdexcept", "fesetenv", "feupdateenv", "__cvm_fe_dfl_env"} {
+		if !hasIdentifier(res.Tokens, name) {
+			t.Fatalf("fenv identifier %q missing: %#v", name, res.Tokens)
+		}
+	}
+	for _, value := range []string{"0x400", "0x800", "0xc00"} {
+		if !hasLexeme(res.Tokens, value) {
+			t.Fatalf("rounding mode %q missing: %#v", value, res.Tokens)
+		}
+	}
+}
+
+func TestBuiltinSignalAndSetjmpHeadersDeclareRuntimeSurface(t *testing.T) {
+	res, err := PreprocessSource("main.c", `
+#include <signal.h>
+#include <setjmp.h>
+int sigs[] = { SIGINT, SIGILL, SIGABRT, SIGFPE, SIGSEGV, SIGTERM };
+`, Options{})
+	if err != nil {
+		t.Fatalf("PreprocessSource failed: %v", err)
+	}
+	for _, name := range []string{"sig_atomic_t", "signal", "raise", "jmp_buf", "setjmp", "longjmp", "_setjmp", "_longjmp"} {
+		if !hasIdentifier(res.Tokens, name) {
+			t.Fatalf("identifier %q missing: %#v", name, res.Tokens)
+		}
+	}
+	for _, name := range []string{"SIGINT", "SIGFPE", "SIGSEGV"} {
+		if hasIdentifier(res.Tokens, name) {
+			t.Fatalf("macro %s was not expanded", name)
+		}
+	}
+}
+
 func TestBuiltinAssertHeaderDeclaresRuntimeSurface(t *testing.T) {
 	res, err := PreprocessSource("main.c", `
 #include <assert.h>
@@ -236,8 +301,8 @@ void f(void) { assert(1); }
 	if err != nil {
 		t.Fatalf("PreprocessSource failed: %v", err)
 	}
-	if !hasIdentifier(res.Tokens, "abort") {
-		t.Fatalf("assert did not expand to abort path: %#v", res.Tokens)
+	if !hasIdentifier(res.Tokens, "__assert_fail") || !hasIdentifier(res.Tokens, "__func__") {
+		t.Fatalf("assert did not expand to __assert_fail path: %#v", res.Tokens)
 	}
 
 	res, err = PreprocessSource("main.c", `
@@ -247,8 +312,8 @@ void f(void) { assert(0); }
 	if err != nil {
 		t.Fatalf("PreprocessSource with NDEBUG failed: %v", err)
 	}
-	if hasIdentifier(res.Tokens, "abort") {
-		t.Fatalf("NDEBUG assert expanded to abort path: %#v", res.Tokens)
+	if hasIdentifier(res.Tokens, "__func__") {
+		t.Fatalf("NDEBUG assert expanded to __assert_fail path: %#v", res.Tokens)
 	}
 }
 
@@ -278,6 +343,64 @@ func TestBuiltinStringsHeaderDeclaresRuntimeSurface(t *testing.T) {
 			t.Fatalf("strings identifier %q missing: %#v", name, res.Tokens)
 		}
 	}
+	if hasIdentifier(res.Tokens, "strcasecmp") {
+		t.Fatalf("strcasecmp declared without a feature test macro")
+	}
+	res, err = PreprocessSource("main.c", `
+#define _DEFAULT_SOURCE
+#include <strings.h>
+`, Options{})
+	if err != nil {
+		t.Fatalf("PreprocessSource failed: %v", err)
+	}
+	for _, name := range []string{"strcasecmp", "strncasecmp"} {
+		if !hasIdentifier(res.Tokens, name) {
+			t.Fatalf("strings identifier %q missing with _DEFAULT_SOURCE", name)
+		}
+	}
+}
+
+func TestBuiltinHeadersDeclarePOSIXExtensionsOnRequest(t *testing.T) {
+	src := `
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+`
+	extensions := []string{"ssize_t", "getline", "getdelim", "fdopen", "asprintf", "vasprintf", "aligned_alloc", "posix_memalign", "strcasecmp", "strncasecmp", "memmem", "strsep"}
+	res, err := PreprocessSource("main.c", src, Options{})
+	if err != nil {
+		t.Fatalf("PreprocessSource failed: %v", err)
+	}
+	for _, name := range extensions {
+		if hasIdentifier(res.Tokens, name) {
+			t.Fatalf("%q declared without a feature test macro", name)
+		}
+	}
+	for _, macro := range []string{"_POSIX_C_SOURCE", "_GNU_SOURCE"} {
+		res, err := PreprocessSource("main.c", src, Options{MacroActions: []MacroAction{{Kind: MacroDefine, Name: macro, Value: "200809L"}}})
+		if err != nil {
+			t.Fatalf("PreprocessSource with %s failed: %v", macro, err)
+		}
+		for _, name := range extensions {
+			if !hasIdentifier(res.Tokens, name) {
+				t.Fatalf("%q missing with %s", name, macro)
+			}
+		}
+	}
+
+	res, err = PreprocessSource("main.c", `
+#include <unistd.h>
+#include <getopt.h>
+int modes[] = { no_argument, required_argument, optional_argument, STDIN_FILENO };
+`, Options{})
+	if err != nil {
+		t.Fatalf("PreprocessSource failed: %v", err)
+	}
+	for _, name := range []string{"getopt", "getopt_long", "option", "optarg", "optind", "opterr", "optopt", "ssize_t"} {
+		if !hasIdentifier(res.Tokens, name) {
+			t.Fatalf("getopt identifier %q missing: %#v", name, res.Tokens)
+		}
+	}
 }
 
 func hasToken(tokens []entity.Token, typ entity.TokenType) bool {
@@ -23,6 +23,21 @@ func TestOptionsDefinesAndUndefines(t *testing.T) {
 	}
 }
 
+func TestOptionsDefineWithoutValueMeansOne(t *testing.T) {
+	pp := newPreprocessor("main.c", "", Options{
+		MacroActions: []MacroAction{
+			{Kind: MacroDefine, Name: "FLAG"},
+			{Kind: MacroDefine, Name: "EMPTY", Empty: true},
+		},
+	})
+	if m, ok := pp.macros.Lookup("FLAG"); !ok || len(m.Replacement) != 1 || m.Replacement[0].Lexeme != "1" {
+		t.Fatalf("FLAG = %+v, %v; want 1", m, ok)
+	}
+	if m, ok := pp.macros.Lookup("EMPTY"); !ok || len(m.Replacement) != 0 {
+		t.Fatalf("EMPTY = %+v, %v; want an empty definition", m, ok)
+	}
+}
+
 func TestPredefinedTargetMacros(t *testing.T) {
 	pp := newPreprocessor("main.c", "", Options{})
 	for _, name := range []string{"__STDC__", "__STDC_VERSION__", "__STDC_HOSTED__", "__SIZE_TYPE__", "__PTRDIFF_TYPE__", "__WCHAR_TYPE__", "__CHAR_BIT__"} {
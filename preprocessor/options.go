@@ -6,6 +6,7 @@ type Standard int
 
 const (
 	StandardC99 Standard = iota
+	StandardGNU99
 )
 
 type TargetInfo struct {
@@ -25,10 +26,14 @@ const (
 	MacroUndef
 )
 
+// MacroAction is a command-line style -D or -U. Value is the replacement
+// text of a define; an empty Value defines the macro as 1 unless Empty is
+// set, which is how -DNAME= asks for an empty definition.
 type MacroAction struct {
 	Kind  MacroActionKind
 	Name  string
 	Value string
+	Empty bool
 }
 
 func DefaultTarget() TargetInfo {
@@ -65,7 +70,7 @@ func normalizeOptions(opts Options) Options {
 	if opts.Target.SizeType == "" {
 		opts.Target = DefaultTarget()
 	}
-	if opts.Std != StandardC99 {
+	if opts.Std != StandardC99 && opts.Std != StandardGNU99 {
 		opts.Std = StandardC99
 	}
 	return opts
@@ -0,0 +1,102 @@
+package preprocessor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxBlankLines is how many empty lines PrintResult writes to keep output in
+// step with the source before it switches to a line marker instead.
+const maxBlankLines = 8
+
+// PrintResult renders the expanded token stream as C source text in the style
+// of `cc -E`: each source line stays on its presumed line, and GNU line
+// markers (`# 12 "file.c"`) are emitted whenever the file changes or lines are
+// skipped. Tokens produced by macro expansion stay on the line of the
+// invocation.
+func PrintResult(r *Result) string {
+	var b strings.Builder
+	file, line := "", 0
+	started := false
+	var prev PPToken
+	hasPrev, pendingSpace := false, false
+	for _, tok := range r.Expanded {
+		switch tok.Kind {
+		case PPEOF:
+			continue
+		case PPNewline, PPPadding:
+			pendingSpace = true
+			continue
+		}
+		atLineStart := false
+		if !started || tok.StartOfLine {
+			loc := r.Sources.DisplayLocation(tok.Location)
+			if loc.Line > 0 {
+				switch {
+				case !started || loc.File != file || loc.Line < line || loc.Line-line > maxBlankLines:
+					if started {
+						b.WriteByte('\n')
+					}
+					fmt.Fprintf(&b, "# %d %q\n", loc.Line, loc.File)
+				case loc.Line > line:
+					b.WriteString(strings.Repeat("\n", loc.Line-line))
+				}
+				file, line, started, atLineStart = loc.File, loc.Line, true, true
+				if loc.Column > 1 {
+					b.WriteString(strings.Repeat(" ", loc.Column-1))
+				}
+			}
+		}
+		if !atLineStart && hasPrev && (pendingSpace || tok.LeadingSpace || wouldPaste(prev, tok)) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(tok.Lexeme)
+		prev, hasPrev, pendingSpace = tok, true, false
+	}
+	if hasPrev {
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+var pasteablePunctuators = []string{
+	"->", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"*=", "/=", "%=", "+=", "-=", "<<=", ">>=", "&=", "^=", "|=",
+	"#", "##", "...", "<:", ":>", "<%", "%>", "%:", "%:%:", "//", "/*",
+}
+
+// wouldPaste reports whether writing cur directly after prev would lex as a
+// different token sequence.
+func wouldPaste(prev, cur PPToken) bool {
+	if prev.Lexeme == "" || cur.Lexeme == "" {
+		return false
+	}
+	last, first := prev.Lexeme[len(prev.Lexeme)-1], cur.Lexeme[0]
+	switch prev.Kind {
+	case PPIdentifier:
+		return isIdentByte(first) || cur.Kind == PPString || cur.Kind == PPCharacter
+	case PPNumber:
+		if isIdentByte(first) || first == '.' {
+			return true
+		}
+		return (first == '+' || first == '-') && strings.ContainsRune("eEpP", rune(last))
+	case PPPunctuator:
+		if prev.Lexeme == "." && cur.Kind == PPNumber {
+			return true
+		}
+		if cur.Kind != PPPunctuator {
+			return false
+		}
+		joined := prev.Lexeme + string(first)
+		for _, p := range pasteablePunctuators {
+			if strings.HasPrefix(p, joined) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -5,6 +5,9 @@ import "shinya.click/cvm/entity"
 type Result struct {
 	Tokens  []entity.Token
 	Sources *SourceManager
+	// Expanded is the fully expanded preprocessing token stream the parser
+	// tokens were converted from.
+	Expanded []PPToken
 }
 
 func PreprocessSource(name, source string, opts Options) (*Result, error) {
@@ -29,7 +32,7 @@ func PreprocessSource(name, source string, opts Options) (*Result, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Result{Tokens: tokens, Sources: sm}, nil
+	return &Result{Tokens: tokens, Sources: sm, Expanded: expanded}, nil
 }
 
 func PreprocessFile(path string, opts Options) (*Result, error) {
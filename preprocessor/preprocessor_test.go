@@ -17,3 +17,36 @@ func TestPreprocessSourceReturnsEOFTokenAndSourceManager(t *testing.T) {
 		t.Fatalf("EOF lexeme = %q, want empty", got)
 	}
 }
+
+func TestPrintResultKeepsLinesAndEmitsMarkers(t *testing.T) {
+	fs := mapFS{
+		"/work/main.c": "#include \"inc.h\"\n#define PLUS +\nint x = 1 PLUS+2;\n\n\n\n\n\n\n\n\n\n\nint y = VALUE;\n",
+		"/work/inc.h":  "#define VALUE 42\nint h;\n",
+	}
+	res, err := PreprocessFile("/work/main.c", Options{FileSystem: fs})
+	if err != nil {
+		t.Fatalf("PreprocessFile failed: %v", err)
+	}
+	want := "# 2 \"/work/inc.h\"\nint h;\n# 3 \"/work/main.c\"\nint x = 1 + +2;\n# 14 \"/work/main.c\"\nint y = 42;\n"
+	if got := PrintResult(res); got != want {
+		t.Fatalf("PrintResult =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGNU99DisablesTrigraphs(t *testing.T) {
+	for _, tt := range []struct {
+		std  Standard
+		want string
+	}{
+		{StandardC99, `"#"`},
+		{StandardGNU99, `"??="`},
+	} {
+		res, err := PreprocessSource("main.c", "char *s = \"??=\";\n", Options{Std: tt.std})
+		if err != nil {
+			t.Fatalf("PreprocessSource failed: %v", err)
+		}
+		if got := res.Tokens[4].Lexeme; got != tt.want {
+			t.Fatalf("std %d string literal = %s, want %s", tt.std, got, tt.want)
+		}
+	}
+}
@@ -94,7 +94,7 @@ func (sm *SourceManager) SetPresumedLine(fileID, offset int, file string, line i
 func (sm *SourceManager) AddExpansion(spelling, expansion, definition entity.SourcePos) entity.SourcePos {
 	sm.expansions = append(sm.expansions, ExpansionTrace{Spelling: spelling, Expansion: expansion, Definition: definition})
 	idx := len(sm.expansions) - 1
-	return entity.SourcePos{LocationID: -idx}
+	return entity.SourcePos{LocationID: -idx, Line: expansion.Line, Column: expansion.Column}
 }
 
 func (sm *SourceManager) SetIncludeTrace(fileID int, trace []IncludeTraceEntry) {
@@ -0,0 +1,214 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// Debugger drives a VM one instruction at a time. It uses the same step loop
+// as Run, so traps, exit and atexit behave exactly as in a normal run.
+type Debugger struct {
+	vm          *VM
+	breakpoints map[Breakpoint]bool
+	done        bool
+	status      ExitStatus
+	err         error
+}
+
+type Breakpoint struct {
+	Func int
+	PC   int
+}
+
+type FrameInfo struct {
+	Function   string
+	FunctionID int
+	PC         int
+	Instr      bytecode.Instr
+	HasInstr   bool
+	Source     bytecode.SourceLocation
+	HasSource  bool
+}
+
+type LocalInfo struct {
+	Name  string
+	Slot  int
+	Param bool
+	Value Value
+}
+
+func NewDebugger(p *Program, opts RunOptions) (*Debugger, error) {
+	vm, err := newVM(p, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Debugger{vm: vm, breakpoints: map[Breakpoint]bool{}}, nil
+}
+
+// FunctionID resolves a function name to its id in the loaded module.
+func (d *Debugger) FunctionID(name string) (int, error) {
+	for i, fn := range d.vm.program.module.Functions {
+		if fn.Name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown function %q", name)
+}
+
+func (d *Debugger) FunctionName(funcID int) string {
+	fns := d.vm.program.module.Functions
+	if funcID < 0 || funcID >= len(fns) {
+		return fmt.Sprintf("#%d", funcID)
+	}
+	return fns[funcID].Name
+}
+
+func (d *Debugger) AddBreakpoint(funcID, pc int) (Breakpoint, error) {
+	fns := d.vm.program.module.Functions
+	if funcID < 0 || funcID >= len(fns) {
+		return Breakpoint{}, fmt.Errorf("invalid function id %d", funcID)
+	}
+	if pc < 0 || pc >= len(fns[funcID].Instrs) {
+		return Breakpoint{}, fmt.Errorf("pc %d outside function %s", pc, fns[funcID].Name)
+	}
+	bp := Breakpoint{Func: funcID, PC: pc}
+	d.breakpoints[bp] = true
+	return bp, nil
+}
+
+func (d *Debugger) RemoveBreakpoint(bp Breakpoint) bool {
+	if !d.breakpoints[bp] {
+		return false
+	}
+	delete(d.breakpoints, bp)
+	return true
+}
+
+func (d *Debugger) Breakpoints() []Breakpoint {
+	out := make([]Breakpoint, 0, len(d.breakpoints))
+	for bp := range d.breakpoints {
+		out = append(out, bp)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Func != out[j].Func {
+			return out[i].Func < out[j].Func
+		}
+		return out[i].PC < out[j].PC
+	})
+	return out
+}
+
+// Done reports whether the program has finished, either normally or with a
+// trap. The trap, if any, is returned again by Err.
+func (d *Debugger) Done() bool { return d.done }
+
+func (d *Debugger) Status() ExitStatus { return d.status }
+
+func (d *Debugger) Err() error { return d.err }
+
+// Step executes a single instruction.
+func (d *Debugger) Step(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if d.done {
+		return d.err
+	}
+	st, done, err := d.vm.step(ctx)
+	if err != nil {
+		// Keep the frames so the trap site can still be inspected.
+		d.done, d.status, d.err = true, st, err
+		return err
+	}
+	if done {
+		d.status, d.err = d.vm.finish(ctx, st, nil)
+		d.done = true
+		return d.err
+	}
+	return nil
+}
+
+// Continue runs until the next breakpoint is reached or the program ends. It
+// always executes at least one instruction, so continuing from a breakpoint
+// does not stop on it again immediately.
+func (d *Debugger) Continue(ctx context.Context) (Breakpoint, bool, error) {
+	for first := true; !d.done; first = false {
+		if !first {
+			if bp, ok := d.atBreakpoint(); ok {
+				return bp, true, nil
+			}
+		}
+		if err := d.Step(ctx); err != nil {
+			return Breakpoint{}, false, err
+		}
+	}
+	return Breakpoint{}, false, d.err
+}
+
+func (d *Debugger) atBreakpoint() (Breakpoint, bool) {
+	if len(d.vm.frames) == 0 {
+		return Breakpoint{}, false
+	}
+	fr := d.vm.frames[len(d.vm.frames)-1]
+	bp := Breakpoint{Func: fr.fn.ID, PC: fr.pc}
+	return bp, d.breakpoints[bp]
+}
+
+// Frames returns the call stack, innermost frame first. The pc of the
+// innermost frame is the next instruction to execute; outer frames report the
+// call instruction they are suspended in.
+func (d *Debugger) Frames() []FrameInfo {
+	frames := make([]FrameInfo, 0, len(d.vm.frames))
+	for i := len(d.vm.frames) - 1; i >= 0; i-- {
+		fr := d.vm.frames[i]
+		pc := fr.pc
+		if i != len(d.vm.frames)-1 && pc > 0 {
+			pc--
+		}
+		info := FrameInfo{Function: fr.fn.Name, FunctionID: fr.fn.ID, PC: pc}
+		if pc >= 0 && pc < len(fr.fn.Instrs) {
+			info.Instr, info.HasInstr = fr.fn.Instrs[pc], true
+		}
+		info.Source, info.HasSource = d.vm.sourceLocation(fr.fn.ID, pc)
+		frames = append(frames, info)
+	}
+	return frames
+}
+
+// OperandStack returns a copy of the operand stack, bottom first.
+func (d *Debugger) OperandStack() []Value {
+	return append([]Value(nil), d.vm.stack...)
+}
+
+// Locals returns the parameters and local slots of the innermost frame.
+func (d *Debugger) Locals() []LocalInfo {
+	if len(d.vm.frames) == 0 {
+		return nil
+	}
+	fr := d.vm.frames[len(d.vm.frames)-1]
+	locals := make([]LocalInfo, 0, len(fr.fn.Params)+len(fr.fn.Locals))
+	seen := map[int]bool{}
+	for _, p := range fr.fn.Params {
+		if p.Slot >= 0 && p.Slot < len(fr.locals) {
+			seen[p.Slot] = true
+			locals = append(locals, LocalInfo{Name: p.Name, Slot: p.Slot, Param: true, Value: fr.locals[p.Slot]})
+		}
+	}
+	for _, l := range fr.fn.Locals {
+		if l.ID >= 0 && l.ID < len(fr.locals) && !seen[l.ID] {
+			locals = append(locals, LocalInfo{Name: l.Name, Slot: l.ID, Value: fr.locals[l.ID]})
+		}
+	}
+	return locals
+}
+
+func (d *Debugger) ReadMemory(addr uint64, size int64) ([]byte, error) {
+	return d.vm.program.memory.Read(addr, size)
+}
+
+func (d *Debugger) MemoryBlock(addr uint64) (MemoryBlockInfo, bool) {
+	return d.vm.program.memory.Block(addr)
+}
@@ -0,0 +1,82 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"shinya.click/cvm/sema"
+)
+
+func TestDebuggerStopsAtFunctionBreakpointAndInspectsFrame(t *testing.T) {
+	p := compileProgram(t, `
+int add(int a, int b) { int sum = a + b; return sum; }
+int main(void) { return add(2, 5); }
+`, &bytes.Buffer{}, sema.SemaOptions{})
+	d, err := NewDebugger(p, RunOptions{})
+	if err != nil {
+		t.Fatalf("NewDebugger: %v", err)
+	}
+	addID, err := d.FunctionID("add")
+	if err != nil {
+		t.Fatalf("FunctionID: %v", err)
+	}
+	if _, err := d.AddBreakpoint(addID, 0); err != nil {
+		t.Fatalf("AddBreakpoint: %v", err)
+	}
+	bp, hit, err := d.Continue(context.Background())
+	if err != nil || !hit || bp.Func != addID {
+		t.Fatalf("Continue = %v, %v, %v; want breakpoint in add", bp, hit, err)
+	}
+	frames := d.Frames()
+	if len(frames) != 2 || frames[0].Function != "add" || frames[1].Function != "main" {
+		t.Fatalf("frames = %#v, want add > main", frames)
+	}
+	values := map[string]int64{}
+	for _, l := range d.Locals() {
+		values[l.Name] = int64(int32(l.Value.Int))
+	}
+	if values["a"] != 2 || values["b"] != 5 {
+		t.Fatalf("locals = %v, want a=2 b=5", values)
+	}
+	if err := d.Step(context.Background()); err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+	if got := d.Frames()[0].PC; got != 1 {
+		t.Fatalf("pc after step = %d, want 1", got)
+	}
+	if _, hit, err := d.Continue(context.Background()); err != nil || hit {
+		t.Fatalf("Continue to exit = %v, %v", hit, err)
+	}
+	if !d.Done() || d.Status().Code != 7 {
+		t.Fatalf("done=%v status=%+v, want exit 7", d.Done(), d.Status())
+	}
+}
+
+func TestDebuggerReadsMemoryAndKeepsTrapFrame(t *testing.T) {
+	p := compileProgram(t, `
+int g = 0x01020304;
+int main(void) { int z = g - g; return g / z; }
+`, &bytes.Buffer{}, sema.SemaOptions{})
+	d, err := NewDebugger(p, RunOptions{})
+	if err != nil {
+		t.Fatalf("NewDebugger: %v", err)
+	}
+	addr := p.GlobalAddr(0)
+	data, err := d.ReadMemory(addr, 4)
+	if err != nil || !bytes.Equal(data, []byte{4, 3, 2, 1}) {
+		t.Fatalf("ReadMemory = %x, %v; want 04030201", data, err)
+	}
+	if block, ok := d.MemoryBlock(addr + 2); !ok || block.Base != addr || block.Size != 4 {
+		t.Fatalf("MemoryBlock = %+v, %v", block, ok)
+	}
+	if _, _, err := d.Continue(context.Background()); err == nil {
+		t.Fatal("Continue succeeded, want division trap")
+	}
+	if !d.Done() || d.Err() == nil {
+		t.Fatalf("debugger not finished after trap")
+	}
+	if frames := d.Frames(); len(frames) != 1 || frames[0].Function != "main" {
+		t.Fatalf("frames after trap = %#v, want main", frames)
+	}
+}
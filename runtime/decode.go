@@ -0,0 +1,419 @@
+package runtime
+
+import (
+	"fmt"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// decodedFunc is a bytecode.Function lowered once at load time for the
+// interpreter loop. It keeps one op per instruction, so pcs, and with them
+// traps, debug lines, profiles, breakpoints and setjmp points, mean the same
+// thing in both forms.
+type decodedFunc struct {
+	ops    []op
+	labels map[int]int
+	// locals is the zeroed local slot array copied into every new frame;
+	// frameErr, when set, is the trap pushFrame reports instead.
+	locals    []Value
+	frameErr  string
+	bitFields []bytecode.BitFieldLayout
+	switches  []switchTable
+}
+
+type switchTable struct {
+	cases []switchTarget
+	def   int
+}
+
+type switchTarget struct {
+	value int64
+	pc    int
+}
+
+type opKind uint8
+
+// opGeneric runs the original instruction. Every other kind is a fast path
+// for an opcode/type combination whose operands were resolved at load time;
+// when its run-time preconditions do not hold, for example a stack value of
+// an unexpected type or a zero divisor, the loop falls back to the original
+// instruction so traps are reported exactly as before.
+const (
+	opGeneric opKind = iota
+	opNop
+	opPush
+	opDup
+	opPop
+	opSwap
+	opLoadLocal
+	opStoreLocal
+	opLoad
+	opLoadConst
+	opStore
+	opOffset
+	opBitFieldLoad
+	opBitFieldStore
+	opPtrAdd
+	opAdd
+	opSub
+	opMul
+	opAnd
+	opOr
+	opXor
+	opShl
+	opShrS
+	opShrU
+	opDivS
+	opDivU
+	opRemS
+	opRemU
+	opEq
+	opNe
+	opLtS
+	opLtU
+	opLeS
+	opLeU
+	opGtS
+	opGtU
+	opGeS
+	opGeU
+	opNeg
+	opCastSame
+	opCastBool
+	opZExt
+	opSExt
+	opJump
+	opJumpIfZero
+	opJumpIfNonZero
+	opSwitch
+)
+
+// op is the compact form of one instruction. typ is the operand type the
+// fast path expects on the stack; mask and shift describe its width, and
+// typ2/mask2 the result of a cast. arg holds the slot, resolved jump target,
+// offset, alignment, element size or side-table index, and val a constant
+// or pre-resolved address.
+type op struct {
+	kind  opKind
+	shift uint8
+	typ   bytecode.ValueType
+	typ2  bytecode.ValueType
+	mask  uint64
+	mask2 uint64
+	arg   int64
+	align int64
+	val   Value
+}
+
+func (o *op) signed(v uint64) int64 {
+	return int64(v<<o.shift) >> o.shift
+}
+
+var binaryOps = map[bytecode.BinaryOp]opKind{
+	bytecode.BinAdd:  opAdd,
+	bytecode.BinSub:  opSub,
+	bytecode.BinMul:  opMul,
+	bytecode.BinAnd:  opAnd,
+	bytecode.BinOr:   opOr,
+	bytecode.BinXor:  opXor,
+	bytecode.BinShl:  opShl,
+	bytecode.BinShrS: opShrS,
+	bytecode.BinShrU: opShrU,
+	bytecode.BinDivS: opDivS,
+	bytecode.BinDivU: opDivU,
+	bytecode.BinRemS: opRemS,
+	bytecode.BinRemU: opRemU,
+	bytecode.BinEq:   opEq,
+	bytecode.BinNe:   opNe,
+	bytecode.BinLtS:  opLtS,
+	bytecode.BinLtU:  opLtU,
+	bytecode.BinLeS:  opLeS,
+	bytecode.BinLeU:  opLeU,
+	bytecode.BinGtS:  opGtS,
+	bytecode.BinGtU:  opGtU,
+	bytecode.BinGeS:  opGeS,
+	bytecode.BinGeU:  opGeU,
+}
+
+// decodeFunctions lowers every function of the module. It runs after the
+// globals and strings are placed so their addresses can be baked in.
+func (p *Program) decodeFunctions() {
+	p.code = make([]*decodedFunc, len(p.module.Functions))
+	for i := range p.module.Functions {
+		p.code[i] = p.decodeFunction(&p.module.Functions[i])
+	}
+}
+
+// decodedFunction returns the lowered form of function id, decoding it on
+// first use for programs that were not built by Load.
+func (p *Program) decodedFunction(id int) *decodedFunc {
+	if p.code == nil {
+		p.code = make([]*decodedFunc, len(p.module.Functions))
+	}
+	if p.code[id] == nil {
+		p.code[id] = p.decodeFunction(&p.module.Functions[id])
+	}
+	return p.code[id]
+}
+
+func (p *Program) decodeFunction(fn *bytecode.Function) *decodedFunc {
+	d := &decodedFunc{
+		ops:    make([]op, len(fn.Instrs)),
+		labels: make(map[int]int),
+	}
+	d.decodeFrame(fn)
+	for pc, ins := range fn.Instrs {
+		if ins.Op == bytecode.OpLabel {
+			d.labels[ins.Label] = pc
+		}
+	}
+	for pc := range fn.Instrs {
+		d.ops[pc] = p.decodeInstr(d, &fn.Instrs[pc])
+	}
+	return d
+}
+
+func (d *decodedFunc) decodeFrame(fn *bytecode.Function) {
+	maxSlot := -1
+	for _, param := range fn.Params {
+		if param.Slot < 0 {
+			d.frameErr = fmt.Sprintf("negative param slot %d in function %s", param.Slot, fn.Name)
+			return
+		}
+		maxSlot = max(maxSlot, param.Slot)
+	}
+	for _, local := range fn.Locals {
+		if local.ID < 0 {
+			d.frameErr = fmt.Sprintf("negative local slot %d in function %s", local.ID, fn.Name)
+			return
+		}
+		maxSlot = max(maxSlot, local.ID)
+	}
+	d.locals = make([]Value, maxSlot+1)
+	for _, param := range fn.Params {
+		d.locals[param.Slot] = zeroValue(param.Type)
+	}
+	for _, local := range fn.Locals {
+		d.locals[local.ID] = zeroValue(local.Type)
+	}
+}
+
+func (p *Program) decodeInstr(d *decodedFunc, ins *bytecode.Instr) op {
+	o := op{typ: ins.Type, typ2: ins.Type2, align: ins.Align}
+	if width := bitWidth(ins.Type); width != 0 {
+		o.mask = maskToWidth(^uint64(0), width)
+		o.shift = uint8(64 - width)
+	}
+	switch ins.Op {
+	case bytecode.OpLabel:
+		o.kind = opNop
+	case bytecode.OpConst:
+		o.kind, o.val = opPush, constValue(*ins)
+	case bytecode.OpDup:
+		o.kind = opDup
+	case bytecode.OpPop:
+		o.kind = opPop
+	case bytecode.OpSwap:
+		o.kind = opSwap
+	case bytecode.OpLoadLocal, bytecode.OpStoreLocal:
+		if ins.Slot < 0 || ins.Slot >= len(d.locals) {
+			break
+		}
+		o.kind, o.arg = opLoadLocal, int64(ins.Slot)
+		if ins.Op == bytecode.OpStoreLocal {
+			o.kind = opStoreLocal
+		}
+	case bytecode.OpAddrGlobal:
+		if ins.Global >= 0 && ins.Global < len(p.globalAddr) {
+			o.kind, o.val = opPush, ObjectAddrValue(p.globalAddr[ins.Global])
+		}
+	case bytecode.OpAddrString:
+		if ins.Int >= 0 && ins.Int < int64(len(p.stringAddr)) {
+			o.kind, o.val = opPush, ObjectAddrValue(p.stringAddr[ins.Int])
+		}
+	case bytecode.OpAddrFunc:
+		if ins.Global >= 0 && ins.Global < len(p.funcAddr) {
+			o.kind, o.val = opPush, PtrValue(p.funcAddr[ins.Global])
+		}
+	case bytecode.OpLoadConst:
+		if ins.Global < 0 || ins.Global >= len(p.globalAddr) {
+			break
+		}
+		if addr, err := addSignedOffset(p.globalAddr[ins.Global], ins.Int); err == nil {
+			o.kind, o.val = opLoadConst, ObjectAddrValue(addr)
+		}
+	case bytecode.OpLoad:
+		o.kind = opLoad
+	case bytecode.OpStore:
+		o.kind = opStore
+	case bytecode.OpOffset:
+		o.kind, o.arg = opOffset, ins.Int
+	case bytecode.OpFieldAddr:
+		if ins.Layout < 0 || ins.Layout >= len(p.module.Layouts) {
+			break
+		}
+		layout := p.module.Layouts[ins.Layout]
+		if ins.Field >= 0 && ins.Field < len(layout.Fields) {
+			o.kind, o.arg = opOffset, layout.Fields[ins.Field].Offset
+		}
+	case bytecode.OpBitFieldLoad, bytecode.OpBitFieldStore:
+		if ins.Layout < 0 || ins.Layout >= len(p.module.Layouts) {
+			break
+		}
+		layout := p.module.Layouts[ins.Layout]
+		if ins.Field < 0 || ins.Field >= len(layout.Bit) {
+			break
+		}
+		o.kind, o.arg = opBitFieldLoad, int64(len(d.bitFields))
+		if ins.Op == bytecode.OpBitFieldStore {
+			o.kind = opBitFieldStore
+		}
+		d.bitFields = append(d.bitFields, layout.Bit[ins.Field])
+	case bytecode.OpPtrAdd:
+		o.kind, o.arg = opPtrAdd, ins.Size
+	case bytecode.OpBinary:
+		kind, ok := binaryOps[ins.Binary]
+		switch {
+		case !ok:
+		case isIntegerLike(ins.Type):
+			o.kind = kind
+		case isPointerType(ins.Type) && (kind == opEq || kind == opNe):
+			o.kind = kind
+		}
+	case bytecode.OpUnary:
+		if ins.Unary == bytecode.UnaryNeg && isIntegerLike(ins.Type) {
+			o.kind = opNeg
+		}
+	case bytecode.OpCast:
+		o.kind = decodeCast(ins)
+		o.mask2 = maskToWidth(^uint64(0), bitWidth(ins.Type2))
+	case bytecode.OpJump, bytecode.OpJumpIfZero, bytecode.OpJumpIfNonZero:
+		pc, ok := d.labels[ins.Label]
+		if !ok {
+			break
+		}
+		o.arg = int64(pc)
+		switch ins.Op {
+		case bytecode.OpJump:
+			o.kind = opJump
+		case bytecode.OpJumpIfZero:
+			o.kind = opJumpIfZero
+		default:
+			o.kind = opJumpIfNonZero
+		}
+	case bytecode.OpSwitch:
+		if !isIntegerLike(ins.Type) {
+			break
+		}
+		def, resolved := d.labels[ins.Label]
+		table := switchTable{cases: make([]switchTarget, len(ins.Labels)), def: def}
+		for i, c := range ins.Labels {
+			pc, ok := d.labels[c.Label]
+			resolved = resolved && ok
+			table.cases[i] = switchTarget{value: c.Value, pc: pc}
+		}
+		if resolved {
+			o.kind, o.arg = opSwitch, int64(len(d.switches))
+			d.switches = append(d.switches, table)
+		}
+	}
+	return o
+}
+
+func decodeCast(ins *bytecode.Instr) opKind {
+	switch {
+	case ins.Cast == bytecode.CastBool:
+		if ins.Type2 == bytecode.TypeBool {
+			return opCastBool
+		}
+	case ins.Type == ins.Type2:
+		return opCastSame
+	case !isIntegerLike(ins.Type) || !isIntegerLike(ins.Type2):
+	case ins.Cast == bytecode.CastTrunc || ins.Cast == bytecode.CastZExt:
+		return opZExt
+	case ins.Cast == bytecode.CastSExt:
+		return opSExt
+	}
+	return opGeneric
+}
+
+// binary applies an integer op, or a pointer comparison, to operands already
+// masked to o.typ. It reports false for the divisions and shifts that trap.
+func (o *op) binary(l, r uint64) (Value, bool) {
+	var out uint64
+	switch o.kind {
+	case opAdd:
+		out = l + r
+	case opSub:
+		out = l - r
+	case opMul:
+		out = l * r
+	case opAnd:
+		out = l & r
+	case opOr:
+		out = l | r
+	case opXor:
+		out = l ^ r
+	case opShl, opShrS, opShrU:
+		// A negative signed count masks to at least 1<<7, so one unsigned
+		// comparison rejects every count outside [0,width).
+		if r >= uint64(64-o.shift) {
+			return Value{}, false
+		}
+		switch o.kind {
+		case opShl:
+			out = l << r
+		case opShrS:
+			out = uint64(o.signed(l) >> r)
+		default:
+			out = l >> r
+		}
+	case opDivS, opRemS:
+		ls, rs := o.signed(l), o.signed(r)
+		if rs == 0 || rs == -1 && ls == minSigned(uint(64-o.shift)) {
+			return Value{}, false
+		}
+		if o.kind == opDivS {
+			out = uint64(ls / rs)
+		} else {
+			out = uint64(ls % rs)
+		}
+	case opDivU, opRemU:
+		if r == 0 {
+			return Value{}, false
+		}
+		if o.kind == opDivU {
+			out = l / r
+		} else {
+			out = l % r
+		}
+	default:
+		return UIntValue(bytecode.TypeBool, uint64(boolInt(o.compare(l, r)))), true
+	}
+	return UIntValue(o.typ, out&o.mask), true
+}
+
+func (o *op) compare(l, r uint64) bool {
+	switch o.kind {
+	case opEq:
+		return l == r
+	case opNe:
+		return l != r
+	case opLtS:
+		return o.signed(l) < o.signed(r)
+	case opLtU:
+		return l < r
+	case opLeS:
+		return o.signed(l) <= o.signed(r)
+	case opLeU:
+		return l <= r
+	case opGtS:
+		return o.signed(l) > o.signed(r)
+	case opGtU:
+		return l > r
+	case opGeS:
+		return o.signed(l) >= o.signed(r)
+	default:
+		return l >= r
+	}
+}
@@ -0,0 +1,253 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+
+	"shinya.click/cvm/bytecode"
+	"shinya.click/cvm/sema"
+)
+
+// cpuBoundPrograms check their own results and exit with 0 on success.
+var cpuBoundPrograms = []struct {
+	name string
+	src  string
+}{
+	{"fib", `int fib(int n) { return n < 2 ? n : fib(n - 1) + fib(n - 2); }
+int main(void) { return fib(20) == 6765 ? 0 : 1; }`},
+	{"sieve", `char composite[20000];
+int main(void) {
+	int count = 0;
+	for (int i = 2; i < 20000; i++) {
+		if (composite[i])
+			continue;
+		count++;
+		for (int j = i * 2; j < 20000; j += i)
+			composite[j] = 1;
+	}
+	return count == 2262 ? 0 : 1;
+}`},
+	{"matmul", `#define N 24
+long a[N][N], b[N][N], c[N][N];
+int main(void) {
+	for (int i = 0; i < N; i++)
+		for (int j = 0; j < N; j++) {
+			a[i][j] = i + j;
+			b[i][j] = i == j ? 2 : 0;
+		}
+	for (int i = 0; i < N; i++)
+		for (int j = 0; j < N; j++) {
+			long sum = 0;
+			for (int k = 0; k < N; k++)
+				sum += a[i][k] * b[k][j];
+			c[i][j] = sum;
+		}
+	long total = 0;
+	for (int i = 0; i < N; i++)
+		for (int j = 0; j < N; j++)
+			total += c[i][j];
+	return total == 2L * N * N * (N - 1) ? 0 : 1;
+}`},
+	{"crc32", `unsigned crc32(const unsigned char *p, int n) {
+	unsigned crc = 0xFFFFFFFFu;
+	for (int i = 0; i < n; i++) {
+		crc ^= p[i];
+		for (int k = 0; k < 8; k++)
+			crc = (crc >> 1) ^ (0xEDB88320u & -(crc & 1u));
+	}
+	return ~crc;
+}
+int main(void) {
+	const unsigned char msg[10] = "123456789";
+	for (int round = 0; round < 40; round++)
+		if (crc32(msg, 9) != 0xCBF43926u)
+			return 1;
+	return 0;
+}`},
+	{"switch-interp", `enum { PUSH, ADD, DEC, OVER, SWAP, JNZ, HALT };
+int run(const int *code) {
+	int stack[16], sp = 0, pc = 0;
+	for (;;) {
+		switch (code[pc++]) {
+		case PUSH: stack[sp++] = code[pc++]; break;
+		case ADD: sp--; stack[sp - 1] += stack[sp]; break;
+		case DEC: stack[sp - 1]--; break;
+		case OVER: stack[sp] = stack[sp - 2]; sp++; break;
+		case SWAP: { int t = stack[sp - 1]; stack[sp - 1] = stack[sp - 2]; stack[sp - 2] = t; break; }
+		case JNZ: if (stack[sp - 1]) pc = code[pc]; else pc++; break;
+		case HALT: return stack[sp - 2];
+		}
+	}
+}
+int main(void) {
+	/* [acc n] -> [acc+n n-1] until n is zero */
+	const int sum[12] = { PUSH, 0, PUSH, 1000, SWAP, OVER, ADD, SWAP, DEC, JNZ, 4, HALT };
+	for (int round = 0; round < 3; round++)
+		if (run(sum) != 500500)
+			return 1;
+	return 0;
+}`},
+	{"bitfields", `struct packed { unsigned a : 3; signed b : 5; unsigned c : 12; };
+int main(void) {
+	struct packed s = {0};
+	long total = 0;
+	for (int i = 0; i < 5000; i++) {
+		s.a = i;
+		s.b = i - 16;
+		s.c += 3;
+		if (s.a != (i & 7))
+			return 1;
+		int b = (i - 16) & 31;
+		int want = b >= 16 ? b - 32 : b;
+		if (s.b != want)
+			return 2;
+		total += s.a + s.b + s.c;
+	}
+	if (total == 0)
+		return 3;
+	return s.c == (15000 & 4095) ? 0 : 4;
+}`},
+}
+
+// useReferencePath turns every decoded op back into opGeneric, so p runs each
+// instruction through the fully checked path.
+func useReferencePath(p *Program) {
+	for _, code := range p.code {
+		for i := range code.ops {
+			code.ops[i].kind = opGeneric
+		}
+	}
+}
+
+func runDecoded(t testing.TB, mod *bytecode.Module, reference bool, opts RunOptions) (ExitStatus, error) {
+	t.Helper()
+	p, err := LoadModule(mod, LoadOptions{})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	if reference {
+		useReferencePath(p)
+	}
+	return Run(context.Background(), p, opts)
+}
+
+func TestDecodedProgramsMatchReferencePath(t *testing.T) {
+	for _, tc := range cpuBoundPrograms {
+		t.Run(tc.name, func(t *testing.T) {
+			mod := compileModule(t, tc.src, sema.SemaOptions{})
+			fast, err := runDecoded(t, mod, false, RunOptions{})
+			if err != nil || fast.Code != 0 {
+				t.Fatalf("decoded Run = %+v, %v", fast, err)
+			}
+			ref, err := runDecoded(t, mod, true, RunOptions{})
+			if err != nil || ref.Code != 0 {
+				t.Fatalf("reference Run = %+v, %v", ref, err)
+			}
+		})
+	}
+}
+
+func TestDecodedTrapsMatchReferencePath(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		opts RunOptions
+	}{
+		{"division by zero", `int div(int a, int b) { return a / b; }
+int main(void) { return div(7, 0); }`, RunOptions{}},
+		{"unsigned remainder by zero", `unsigned rem(unsigned a, unsigned b) { return a % b; }
+int main(void) { return rem(7, 0); }`, RunOptions{}},
+		{"signed division overflow", `int div(int a, int b) { return a / b; }
+int main(void) { return div(-2147483647 - 1, -1); }`, RunOptions{}},
+		{"shift count too large", `int shl(int a, int n) { return a << n; }
+int main(void) { return shl(1, 40); }`, RunOptions{}},
+		{"negative shift count", `long shr(long a, long n) { return a >> n; }
+int main(void) { return (int)shr(8, -1); }`, RunOptions{}},
+		{"null load", `int get(int *p) { return *p; }
+int main(void) { return get(0); }`, RunOptions{}},
+		{"out of bounds store", `int a[4];
+int main(void) { int *p = a; for (int i = 0; i <= 4; i++) p[i] = i; return 0; }`, RunOptions{}},
+		{"step limit", `int main(void) { int n = 0; for (;;) n++; }`, RunOptions{StepLimit: 1000}},
+		{"stack limit", `int sum(int n) { return n == 0 ? 0 : n + sum(n - 1); }
+int main(void) { return sum(100); }`, RunOptions{MaxStackDepth: 12}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mod := compileModule(t, tc.src, sema.SemaOptions{})
+			_, fastErr := runDecoded(t, mod, false, tc.opts)
+			_, refErr := runDecoded(t, mod, true, tc.opts)
+			if fastErr == nil || refErr == nil {
+				t.Fatalf("errors = %v, %v; want traps", fastErr, refErr)
+			}
+			if fastErr.Error() != refErr.Error() {
+				t.Fatalf("decoded trap:\n%v\nreference trap:\n%v", fastErr, refErr)
+			}
+		})
+	}
+}
+
+func TestDecodeUsesFastPathsForHotCode(t *testing.T) {
+	mod := compileModule(t, cpuBoundPrograms[0].src, sema.SemaOptions{})
+	p, err := LoadModule(mod, LoadOptions{})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	for id, fn := range mod.Functions {
+		code := p.code[id]
+		if len(code.ops) != len(fn.Instrs) {
+			t.Fatalf("%s decoded to %d ops, want %d", fn.Name, len(code.ops), len(fn.Instrs))
+		}
+		for pc, ins := range fn.Instrs {
+			switch ins.Op {
+			case bytecode.OpCall, bytecode.OpReturn:
+				continue
+			}
+			if code.ops[pc].kind == opGeneric {
+				t.Errorf("%s pc %d %s has no fast path", fn.Name, pc, ins.Op)
+			}
+		}
+	}
+}
+
+func TestDecodedJumpsResolveToLabelPCs(t *testing.T) {
+	mod := testMainModule(
+		bytecode.I32Const(0),
+		bytecode.JumpIfZero(bytecode.TypeI32, 1),
+		bytecode.I32Const(1),
+		bytecode.Return(bytecode.TypeI32),
+		bytecode.LabelInstr(1),
+		bytecode.I32Const(2),
+		bytecode.Return(bytecode.TypeI32),
+	)
+	mod.Functions[0].Labels = []bytecode.Label{{ID: 1, Statement: true}}
+	p, err := LoadModule(mod, LoadOptions{})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	if got := p.code[0].ops[1]; got.kind != opJumpIfZero || got.arg != 4 {
+		t.Fatalf("decoded jump = %+v, want opJumpIfZero to pc 4", got)
+	}
+	st, err := Run(context.Background(), p, RunOptions{})
+	if err != nil || st.Code != 2 {
+		t.Fatalf("Run = %+v, %v; want exit 2", st, err)
+	}
+}
+
+func BenchmarkRunCPUBound(b *testing.B) {
+	for _, tc := range cpuBoundPrograms {
+		mod := compileModule(b, tc.src, sema.SemaOptions{})
+		for _, path := range []struct {
+			name      string
+			reference bool
+		}{{"decoded", false}, {"reference", true}} {
+			b.Run(tc.name+"/"+path.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					st, err := runDecoded(b, mod, path.reference, RunOptions{})
+					if err != nil || st.Code != 0 {
+						b.Fatalf("Run = %+v, %v", st, err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -36,8 +36,15 @@ type TrapError struct {
 	FunctionID  int
 	PC          int
 	Opcode      bytecode.Opcode
+	HasSource   bool
+	Source      bytecode.SourceLocation
 	Stack       []string
 	Cause       error
+
+	// signal is the signal a hosted implementation would report for the
+	// trap, or 0; signaled is set once it has been handed to a handler.
+	signal   int32
+	signaled bool
 }
 
 func (e *TrapError) Error() string {
@@ -52,6 +59,9 @@ func (e *TrapError) Error() string {
 		}
 		loc = fmt.Sprintf(" in %s#%d pc=%d opcode=%s", function, e.FunctionID, e.PC, e.Opcode)
 	}
+	if e.HasSource {
+		loc += " at " + e.Source.String()
+	}
 	stack := ""
 	if len(e.Stack) != 0 {
 		stack = fmt.Sprintf(" stack=[%s]", strings.Join(e.Stack, " > "))
@@ -69,6 +79,77 @@ func (e *TrapError) Unwrap() error {
 	return e.Cause
 }
 
+type Quota int
+
+const (
+	QuotaHeapBytes Quota = iota + 1
+	QuotaAllocSize
+	QuotaLiveBlocks
+	QuotaCallDepth
+	QuotaStackDepth
+)
+
+func (q Quota) String() string {
+	switch q {
+	case QuotaHeapBytes:
+		return "heap bytes"
+	case QuotaAllocSize:
+		return "allocation size"
+	case QuotaLiveBlocks:
+		return "live blocks"
+	case QuotaCallDepth:
+		return "call depth"
+	case QuotaStackDepth:
+		return "operand stack depth"
+	default:
+		return fmt.Sprintf("quota(%d)", int(q))
+	}
+}
+
+// QuotaError reports that a program ran into one of the RunOptions limits.
+// It is the cause of the resulting TrapError, so errors.As finds it.
+type QuotaError struct {
+	Quota     Quota
+	Limit     int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s limit %d exceeded: %d requested", e.Quota, e.Limit, e.Requested)
+}
+
+// AssertionFailure reports a failed assert. It is the cause of the resulting
+// TrapError, so errors.As finds it.
+type AssertionFailure struct {
+	Expr     string
+	File     string
+	Line     int
+	Function string
+}
+
+func (e *AssertionFailure) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s:%d: %s: Assertion `%s' failed.", e.File, e.Line, e.Function, e.Expr)
+}
+
+// ExitError reports that a function run through Program.Call terminated the
+// program, for example by calling exit.
+type ExitError struct {
+	Status ExitStatus
+}
+
+func (e *ExitError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("program exited with code %d", e.Status.Code)
+}
+
 type ExitStatus struct {
 	Code       int
 	skipAtexit bool
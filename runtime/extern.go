@@ -7,8 +7,10 @@ import (
 	"math"
 	"math/cmplx"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"shinya.click/cvm/bytecode"
 )
@@ -19,6 +21,33 @@ type ExternContext struct {
 	Memory *Memory
 	Stdout io.Writer
 	Stderr io.Writer
+	// Layouts are the object layouts of the running module, used to marshal
+	// structs for typed host functions.
+	Layouts []bytecode.ObjectLayout
+
+	vm   *VM
+	fenv *floatEnv
+}
+
+// CallFunction calls the guest function at addr, which may also be a GNU
+// nested function, from inside an extern. The call runs on the VM that
+// invoked the extern, so it shares its memory, step limit and quotas. If the
+// guest function exits, the error is an *ExitError; returning it from the
+// extern ends the run with that status.
+func (ec *ExternContext) CallFunction(ctx context.Context, addr uint64, args ...Value) (Value, error) {
+	if ec == nil || ec.vm == nil {
+		return Value{}, fmt.Errorf("guest functions can only be called while the VM runs an extern")
+	}
+	return ec.vm.callFunctionPointer(ctx, addr, args)
+}
+
+// vaListArgs resolves a va_list handle made by the VM that invoked the
+// extern.
+func (ec *ExternContext) vaListArgs(addr uint64) ([]Value, bool) {
+	if ec == nil || ec.vm == nil {
+		return nil, false
+	}
+	return ec.vm.vaListArgs(addr)
 }
 
 type ExternRegistry struct {
@@ -33,16 +62,26 @@ type ExternRegistry struct {
 	hostError      map[uint64]bool
 	hostClosed     map[uint64]bool
 	hostFiles      map[uint64]*hostFile
+	hostOrient     map[uint64]int32
 	files          map[string][]byte
+	fileSystem     FileSystem
 	env            map[string]string
 	atexitHandlers []uint64
+	signalHandlers map[int32]uint64
 	stdinHandle    uint64
+	stdoutHandle   uint64
 	staticStrings  map[*Memory]map[string]uint64
 	staticVars     map[*Memory]map[string]uint64
 	staticBlocks   map[*Memory]map[string]uint64
 	strtokNext     map[*Memory]uint64
+	getoptNext     map[*Memory]int
+	posix          bool
 	randSeed       uint32
 	tmpnamCounter  uint64
+	clock          Clock
+	clockStart     time.Time
+	clockStarted   bool
+	timeZone       *time.Location
 }
 
 type hostFile struct {
@@ -53,6 +92,7 @@ type hostFile struct {
 	writable   bool
 	appendMode bool
 	updateMode bool
+	temporary  bool
 	lastOp     hostFileOp
 }
 
@@ -92,6 +132,7 @@ func NewExternRegistryWithIO(stdin io.Reader, stdout, stderr io.Writer) *ExternR
 		hostError:     make(map[uint64]bool),
 		hostClosed:    make(map[uint64]bool),
 		hostFiles:     make(map[uint64]*hostFile),
+		hostOrient:    make(map[uint64]int32),
 		files:         make(map[string][]byte),
 		env:           make(map[string]string),
 		staticStrings: make(map[*Memory]map[string]uint64),
@@ -177,17 +218,24 @@ func DefaultExternRegistryWithIO(stdin io.Reader, stdout, stderr io.Writer) *Ext
 	r.Register("div", signedDivExtern("div", bytecode.TypeI32, 4, 4))
 	r.Register("ldiv", signedDivExtern("ldiv", bytecode.TypeI64, 8, 8))
 	r.Register("lldiv", signedDivExtern("lldiv", bytecode.TypeI64, 8, 8))
+	r.Register("imaxabs", signedAbsExtern("imaxabs", bytecode.TypeI64))
+	r.Register("imaxdiv", signedDivExtern("imaxdiv", bytecode.TypeI64, 8, 8))
 	r.Register("atoi", atoiExtern("atoi", bytecode.TypeI32))
 	r.Register("atol", atoiExtern("atol", bytecode.TypeI64))
 	r.Register("atoll", atoiExtern("atoll", bytecode.TypeI64))
 	r.Register("atof", atofExtern("atof", r))
-	r.Register("strtol", strtoIntegerExtern("strtol", bytecode.TypeI64, true))
-	r.Register("strtoul", strtoIntegerExtern("strtoul", bytecode.TypeU64, false))
-	r.Register("strtoll", strtoIntegerExtern("strtoll", bytecode.TypeI64, true))
-	r.Register("strtoull", strtoIntegerExtern("strtoull", bytecode.TypeU64, false))
-	r.Register("strtod", strtoFloatExtern("strtod", bytecode.TypeF64, r))
-	r.Register("strtof", strtoFloatExtern("strtof", bytecode.TypeF32, r))
-	r.Register("strtold", strtoFloatExtern("strtold", bytecode.TypeFLong, r))
+	for _, name := range []string{"strtol", "strtoll", "strtoimax", "wcstol", "wcstoll", "wcstoimax"} {
+		r.Register(name, strtoIntegerExtern(name, bytecode.TypeI64, true, strings.HasPrefix(name, "wcs")))
+	}
+	for _, name := range []string{"strtoul", "strtoull", "strtoumax", "wcstoul", "wcstoull", "wcstoumax"} {
+		r.Register(name, strtoIntegerExtern(name, bytecode.TypeU64, false, strings.HasPrefix(name, "wcs")))
+	}
+	r.Register("strtod", strtoFloatExtern("strtod", bytecode.TypeF64, false, r))
+	r.Register("strtof", strtoFloatExtern("strtof", bytecode.TypeF32, false, r))
+	r.Register("strtold", strtoFloatExtern("strtold", bytecode.TypeFLong, false, r))
+	r.Register("wcstod", strtoFloatExtern("wcstod", bytecode.TypeF64, true, r))
+	r.Register("wcstof", strtoFloatExtern("wcstof", bytecode.TypeF32, true, r))
+	r.Register("wcstold", strtoFloatExtern("wcstold", bytecode.TypeFLong, true, r))
 	r.Register("mblen", mblenExtern("mblen"))
 	r.Register("mbtowc", mbtowcExtern("mbtowc"))
 	r.Register("wctomb", wctombExtern("wctomb"))
@@ -205,9 +253,7 @@ func DefaultExternRegistryWithIO(stdin io.Reader, stdout, stderr io.Writer) *Ext
 	r.Register("atexit", atexitExtern("atexit", r))
 	r.Register("setlocale", setlocaleExtern("setlocale", r))
 	r.Register("localeconv", localeconvExtern("localeconv", r))
-	r.Register("clock", clockExtern("clock"))
-	r.Register("difftime", difftimeExtern("difftime"))
-	r.Register("time", timeExtern("time"))
+	registerTimeExterns(r)
 	registerCtypeClassificationExterns(r)
 	registerCtypeCaseExterns(r)
 	registerWideCtypeClassificationExterns(r)
@@ -233,21 +279,15 @@ func DefaultExternRegistryWithIO(stdin io.Reader, stdout, stderr io.Writer) *Ext
 	r.Register("memcmp", memoryCompareExtern("memcmp"))
 	r.Register("bcmp", memoryCompareExtern("bcmp"))
 	registerAllocationExterns(r)
+	registerSetjmpExterns(r)
+	registerSignalExterns(r)
+	r.Register("qsort", qsortExtern("qsort"))
+	r.Register("bsearch", bsearchExtern("bsearch"))
 	registerMemoryExterns(r)
 	registerOutputFormatExterns(r)
 	registerInputFormatExterns(r)
-	r.Register("feclearexcept", func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
-		if len(args) != 1 {
-			return Value{}, nil, fmt.Errorf("feclearexcept expects 1 argument")
-		}
-		return IntValue(bytecode.TypeI32, 0), nil, nil
-	})
-	r.Register("fetestexcept", func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
-		if len(args) != 1 {
-			return Value{}, nil, fmt.Errorf("fetestexcept expects 1 argument")
-		}
-		return IntValue(bytecode.TypeI32, 0), nil, nil
-	})
+	registerWideStdioExterns(r)
+	registerFenvExterns(r)
 	registerMathExterns(r)
 	return r
 }
@@ -360,11 +400,10 @@ func removeExtern(name string, r *ExternRegistry) ExternFunc {
 		if err != nil {
 			return Value{}, nil, err
 		}
-		if _, ok := r.files[path]; ok {
-			delete(r.files, path)
-			return IntValue(bytecode.TypeI32, 0), nil, nil
+		if err := r.removeFile(path); err != nil {
+			return IntValue(bytecode.TypeI32, -1), nil, r.setErrno(ec.Memory, fileErrno(err))
 		}
-		return IntValue(bytecode.TypeI32, -1), nil, nil
+		return IntValue(bytecode.TypeI32, 0), nil, nil
 	}
 }
 
@@ -387,13 +426,10 @@ func renameExtern(name string, r *ExternRegistry) ExternFunc {
 		if err != nil {
 			return Value{}, nil, err
 		}
-		data, ok := r.files[oldPath]
-		if ok {
-			r.files[newPath] = append([]byte(nil), data...)
-			delete(r.files, oldPath)
-			return IntValue(bytecode.TypeI32, 0), nil, nil
+		if err := r.renameFile(oldPath, newPath); err != nil {
+			return IntValue(bytecode.TypeI32, -1), nil, r.setErrno(ec.Memory, fileErrno(err))
 		}
-		return IntValue(bytecode.TypeI32, -1), nil, nil
+		return IntValue(bytecode.TypeI32, 0), nil, nil
 	}
 }
 
@@ -421,23 +457,9 @@ func fopenExtern(name string, r *ExternRegistry) ExternFunc {
 		if !readable && !writable {
 			return PtrValue(0), nil, nil
 		}
-		data, ok := r.files[path]
-		if strings.HasPrefix(mode, "r") && !ok {
-			return PtrValue(0), nil, nil
-		}
-		file := &hostFile{
-			path:       path,
-			data:       append([]byte(nil), data...),
-			readable:   readable,
-			writable:   writable,
-			appendMode: strings.HasPrefix(mode, "a"),
-			updateMode: strings.Contains(mode, "+"),
-		}
-		if strings.HasPrefix(mode, "w") {
-			file.data = nil
-		}
-		if strings.HasPrefix(mode, "a") {
-			file.pos = int64(len(file.data))
+		file, err := r.openFile(path, mode)
+		if err != nil {
+			return PtrValue(0), nil, r.setErrno(ec.Memory, fileErrno(err))
 		}
 		addr, err := r.allocHostWriter("file:"+path, ec.Memory, hostFileWriter{registry: r}, -1)
 		if err != nil {
@@ -445,9 +467,6 @@ func fopenExtern(name string, r *ExternRegistry) ExternFunc {
 		}
 		r.hostFiles[addr] = file
 		r.hostWriters[addr] = hostFileWriter{registry: r, addr: addr}
-		if writable {
-			r.files[path] = append([]byte(nil), file.data...)
-		}
 		delete(r.hostEOF, addr)
 		delete(r.hostError, addr)
 		return PtrValue(addr), nil, nil
@@ -482,38 +501,21 @@ func freopenExtern(name string, r *ExternRegistry) ExternFunc {
 		if !readMode && !writeMode && !appendMode {
 			return PtrValue(0), nil, nil
 		}
-		updateMode := strings.Contains(mode, "+")
-		readable := readMode || updateMode
-		writable := writeMode || appendMode || updateMode
-		data, ok := r.files[path]
-		if readMode && !ok {
-			return PtrValue(0), nil, nil
-		}
-		file := &hostFile{
-			path:       path,
-			data:       append([]byte(nil), data...),
-			readable:   readable,
-			writable:   writable,
-			appendMode: appendMode,
-			updateMode: updateMode,
-		}
-		if writeMode {
-			file.data = nil
-		}
-		if appendMode {
-			file.pos = int64(len(file.data))
+		old := r.hostFiles[args[2].Int]
+		if err := r.storeFile(old); err != nil {
+			return PtrValue(0), nil, r.setErrno(ec.Memory, fileErrno(err))
 		}
-		if old := r.hostFiles[args[2].Int]; old != nil && old.writable && old.path != "" {
-			r.files[old.path] = append([]byte(nil), old.data...)
+		file, err := r.openFile(path, mode)
+		if err != nil {
+			return PtrValue(0), nil, r.setErrno(ec.Memory, fileErrno(err))
 		}
+		r.discardFile(old)
 		r.hostFiles[args[2].Int] = file
 		r.hostWriters[args[2].Int] = hostFileWriter{registry: r, addr: args[2].Int}
-		if writable {
-			r.files[path] = append([]byte(nil), file.data...)
-		}
 		delete(r.hostPushback, args[2].Int)
 		delete(r.hostEOF, args[2].Int)
 		delete(r.hostError, args[2].Int)
+		delete(r.hostOrient, args[2].Int)
 		return PtrValue(args[2].Int), nil, nil
 	}
 }
@@ -526,7 +528,7 @@ func tmpfileExtern(name string, r *ExternRegistry) ExternFunc {
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		file := &hostFile{readable: true, writable: true, updateMode: true}
+		file := r.tempFile()
 		addr, err := r.allocHostWriter("tmpfile", ec.Memory, hostFileWriter{registry: r}, -1)
 		if err != nil {
 			return Value{}, nil, err
@@ -627,6 +629,7 @@ func fputcExtern(name string, r *ExternRegistry) ExternFunc {
 		if !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[1].Int)
 		}
+		r.orientStream(args[1].Int, -1)
 		ch := byte(args[0].Int)
 		if _, err := w.Write([]byte{ch}); err != nil {
 			r.hostError[args[1].Int] = true
@@ -647,6 +650,7 @@ func fgetcExtern(name string, r *ExternRegistry) ExternFunc {
 		if _, ok := r.lookupHostWriter(args[0].Int); !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
 		}
+		r.orientStream(args[0].Int, -1)
 		if r.markHostReadErrorIfUnreadable(args[0].Int) {
 			return IntValue(bytecode.TypeI32, -1), nil, nil
 		}
@@ -673,6 +677,7 @@ func ungetcExtern(name string, r *ExternRegistry) ExternFunc {
 		if _, ok := r.lookupHostWriter(args[1].Int); !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[1].Int)
 		}
+		r.orientStream(args[1].Int, -1)
 		b := byte(ch)
 		r.hostPushback[args[1].Int] = append(r.hostPushback[args[1].Int], b)
 		r.hostEOF[args[1].Int] = false
@@ -694,6 +699,7 @@ func fgetsExtern(name string, r *ExternRegistry) ExternFunc {
 		if _, ok := r.lookupHostWriter(args[2].Int); !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[2].Int)
 		}
+		r.orientStream(args[2].Int, -1)
 		if r.markHostReadErrorIfUnreadable(args[2].Int) {
 			return PtrValue(0), nil, nil
 		}
@@ -742,6 +748,7 @@ func fputsExtern(name string, r *ExternRegistry) ExternFunc {
 		if !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[1].Int)
 		}
+		r.orientStream(args[1].Int, -1)
 		if _, err := fmt.Fprint(w, s); err != nil {
 			r.hostError[args[1].Int] = true
 			return IntValue(bytecode.TypeI32, -1), nil, nil
@@ -792,9 +799,14 @@ func fflushExtern(name string, r *ExternRegistry) ExternFunc {
 			if _, ok := r.lookupHostWriter(args[0].Int); !ok {
 				return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
 			}
-			if file := r.hostFiles[args[0].Int]; file != nil && file.updateMode {
+			file := r.hostFiles[args[0].Int]
+			if file != nil && file.updateMode {
 				file.lastOp = hostFileOpNone
 			}
+			if err := r.storeFile(file); err != nil {
+				r.hostError[args[0].Int] = true
+				return IntValue(bytecode.TypeI32, -1), nil, r.setErrno(ec.Memory, fileErrno(err))
+			}
 		}
 		return IntValue(bytecode.TypeI32, 0), nil, nil
 	}
@@ -817,10 +829,16 @@ func fcloseExtern(name string, r *ExternRegistry) ExternFunc {
 		delete(r.hostPushback, args[0].Int)
 		delete(r.hostEOF, args[0].Int)
 		delete(r.hostError, args[0].Int)
-		if file := r.hostFiles[args[0].Int]; file != nil && file.writable && file.path != "" {
-			r.files[file.path] = append([]byte(nil), file.data...)
-		}
+		delete(r.hostOrient, args[0].Int)
+		file := r.hostFiles[args[0].Int]
 		delete(r.hostFiles, args[0].Int)
+		if file != nil && file.temporary {
+			r.discardFile(file)
+			return IntValue(bytecode.TypeI32, 0), nil, nil
+		}
+		if err := r.storeFile(file); err != nil {
+			return IntValue(bytecode.TypeI32, -1), nil, r.setErrno(ec.Memory, fileErrno(err))
+		}
 		return IntValue(bytecode.TypeI32, 0), nil, nil
 	}
 }
@@ -1144,7 +1162,7 @@ func parseAtoiString(s string) int64 {
 	return v
 }
 
-func strtoIntegerExtern(name string, ret bytecode.ValueType, signed bool) ExternFunc {
+func strtoIntegerExtern(name string, ret bytecode.ValueType, signed, wide bool) ExternFunc {
 	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
 		if len(args) != 3 {
 			return Value{}, nil, fmt.Errorf("%s expects 3 arguments", name)
@@ -1155,7 +1173,7 @@ func strtoIntegerExtern(name string, ret bytecode.ValueType, signed bool) Extern
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		s, err := ec.Memory.ReadCString(args[0].Int)
+		s, charSize, err := readStrtoSubject(ec.Memory, args[0].Int, wide)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -1165,7 +1183,7 @@ func strtoIntegerExtern(name string, ret bytecode.ValueType, signed bool) Extern
 		}
 		end := args[0].Int
 		if parsed.converted {
-			end, err = addSignedOffset(args[0].Int, int64(parsed.end))
+			end, err = addSignedOffset(args[0].Int, int64(parsed.end)*charSize)
 			if err != nil {
 				return Value{}, nil, err
 			}
@@ -1190,6 +1208,31 @@ func strtoIntegerExtern(name string, ret bytecode.ValueType, signed bool) Extern
 	}
 }
 
+// readStrtoSubject reads the string a strto or wcsto function parses and
+// returns it with the size of its characters. A wide character outside the C
+// locale ends the subject, since no conversion accepts it.
+func readStrtoSubject(mem *Memory, addr uint64, wide bool) (string, int64, error) {
+	if !wide {
+		s, err := mem.ReadCString(addr)
+		return s, 1, err
+	}
+	var buf []byte
+	for {
+		chAddr, err := wideElementAddr(addr, int64(len(buf)))
+		if err != nil {
+			return "", 0, err
+		}
+		ch, err := loadWideChar(mem, chAddr)
+		if err != nil {
+			return "", 0, err
+		}
+		if ch == 0 || ch > 0x7f {
+			return string(buf), 4, nil
+		}
+		buf = append(buf, byte(ch))
+	}
+}
+
 type parsedStrtoInteger struct {
 	value     uint64
 	neg       bool
@@ -1284,7 +1327,7 @@ func atofExtern(name string, r *ExternRegistry) ExternFunc {
 	}
 }
 
-func strtoFloatExtern(name string, ret bytecode.ValueType, r *ExternRegistry) ExternFunc {
+func strtoFloatExtern(name string, ret bytecode.ValueType, wide bool, r *ExternRegistry) ExternFunc {
 	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
 		if len(args) != 2 {
 			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
@@ -1295,14 +1338,14 @@ func strtoFloatExtern(name string, ret bytecode.ValueType, r *ExternRegistry) Ex
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		s, err := ec.Memory.ReadCString(args[0].Int)
+		s, charSize, err := readStrtoSubject(ec.Memory, args[0].Int, wide)
 		if err != nil {
 			return Value{}, nil, err
 		}
 		parsed := parseStrtoFloatString(s)
 		end := args[0].Int
 		if parsed.converted {
-			end, err = addSignedOffset(args[0].Int, int64(parsed.end))
+			end, err = addSignedOffset(args[0].Int, int64(parsed.end)*charSize)
 			if err != nil {
 				return Value{}, nil, err
 			}
@@ -1899,48 +1942,6 @@ var localeconvCharFields = []string{
 	"int_n_sign_posn",
 }
 
-func clockExtern(name string) ExternFunc {
-	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
-		if len(args) != 0 {
-			return Value{}, nil, fmt.Errorf("%s expects 0 arguments", name)
-		}
-		return IntValue(bytecode.TypeI64, 0), nil, nil
-	}
-}
-
-func difftimeExtern(name string) ExternFunc {
-	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
-		if len(args) != 2 {
-			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
-		}
-		if !isIntegerLike(args[0].Type) || !isIntegerLike(args[1].Type) {
-			return Value{}, nil, fmt.Errorf("%s expects time arguments", name)
-		}
-		return FloatValue(bytecode.TypeF64, float64(signedInt(args[0])-signedInt(args[1]))), nil, nil
-	}
-}
-
-func timeExtern(name string) ExternFunc {
-	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
-		if len(args) != 1 {
-			return Value{}, nil, fmt.Errorf("%s expects 1 argument", name)
-		}
-		if !isPointerType(args[0].Type) {
-			return Value{}, nil, fmt.Errorf("%s expects result pointer", name)
-		}
-		now := IntValue(bytecode.TypeI64, 0)
-		if args[0].Int != 0 {
-			if ec == nil || ec.Memory == nil {
-				return Value{}, nil, fmt.Errorf("%s requires memory", name)
-			}
-			if err := ec.Memory.Store(args[0].Int, bytecode.TypeI64, 8, now); err != nil {
-				return Value{}, nil, err
-			}
-		}
-		return now, nil, nil
-	}
-}
-
 type parsedStrtoFloat struct {
 	value     float64
 	end       int
@@ -2384,6 +2385,7 @@ func fwriteExtern(name string, r *ExternRegistry) ExternFunc {
 		if !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[3].Int)
 		}
+		r.orientStream(args[3].Int, -1)
 		size, err := memorySizeArg(name, args[1])
 		if err != nil {
 			return Value{}, nil, err
@@ -2425,6 +2427,7 @@ func freadExtern(name string, r *ExternRegistry) ExternFunc {
 		if _, ok := r.lookupHostWriter(args[3].Int); !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[3].Int)
 		}
+		r.orientStream(args[3].Int, -1)
 		if r.markHostReadErrorIfUnreadable(args[3].Int) {
 			return UIntValue(bytecode.TypeU64, 0), nil, nil
 		}
@@ -2518,6 +2521,144 @@ func registerAllocationExterns(r *ExternRegistry) {
 	r.Register("__builtin_dynamic_object_size", objectSizeExtern("__builtin_dynamic_object_size"))
 }
 
+func qsortExtern(name string) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 4 {
+			return Value{}, nil, fmt.Errorf("%s expects 4 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isIntegerLike(args[1].Type) || !isIntegerLike(args[2].Type) || !isPointerType(args[3].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects pointer, count, size, and comparator arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		count, err := memorySizeArg(name, args[1])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		size, err := memorySizeArg(name, args[2])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if count < 2 || size == 0 {
+			return Value{}, nil, nil
+		}
+		if count > math.MaxInt64/size {
+			return Value{}, nil, fmt.Errorf("%s array size overflows", name)
+		}
+		s := &guestSorter{ctx: ctx, ec: ec, base: args[0].Int, count: count, size: size, cmp: args[3].Int}
+		if _, _, err := ec.Memory.rangeAccess(s.base, count*size, true); err != nil {
+			return Value{}, nil, err
+		}
+		sort.Sort(s)
+		return Value{}, nil, s.err
+	}
+}
+
+// guestSorter sorts an array in guest memory with a guest comparator. The
+// comparator sees pointers into the array itself, as C requires. After the
+// first failed call Less reports false so sort.Sort winds down quickly.
+type guestSorter struct {
+	ctx   context.Context
+	ec    *ExternContext
+	base  uint64
+	count int64
+	size  int64
+	cmp   uint64
+	err   error
+}
+
+func (s *guestSorter) Len() int { return int(s.count) }
+
+func (s *guestSorter) Less(i, j int) bool {
+	if s.err != nil {
+		return false
+	}
+	r, err := compareGuest(s.ctx, s.ec, s.cmp, s.elem(i), s.elem(j))
+	if err != nil {
+		s.err = err
+		return false
+	}
+	return r < 0
+}
+
+func (s *guestSorter) Swap(i, j int) {
+	if s.err != nil || i == j {
+		return
+	}
+	a, err := s.ec.Memory.Read(s.elem(i), s.size)
+	if err == nil {
+		err = s.ec.Memory.Copy(s.elem(i), s.elem(j), s.size)
+	}
+	if err == nil {
+		err = writeMemoryBytes(s.ec.Memory, s.elem(j), a)
+	}
+	s.err = err
+}
+
+func (s *guestSorter) elem(i int) uint64 {
+	return s.base + uint64(int64(i)*s.size)
+}
+
+func bsearchExtern(name string) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 5 {
+			return Value{}, nil, fmt.Errorf("%s expects 5 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) || !isIntegerLike(args[2].Type) || !isIntegerLike(args[3].Type) || !isPointerType(args[4].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects key, pointer, count, size, and comparator arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		count, err := memorySizeArg(name, args[2])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		size, err := memorySizeArg(name, args[3])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if size != 0 && count > math.MaxInt64/size {
+			return Value{}, nil, fmt.Errorf("%s array size overflows", name)
+		}
+		if count > 0 {
+			if _, _, err := ec.Memory.rangeAccess(args[1].Int, count*size, false); err != nil {
+				return Value{}, nil, err
+			}
+		}
+		lo, hi := int64(0), count
+		for lo < hi {
+			mid := lo + (hi-lo)/2
+			elem := args[1].Int + uint64(mid*size)
+			r, err := compareGuest(ctx, ec, args[4].Int, args[0].Int, elem)
+			if err != nil {
+				return Value{}, nil, err
+			}
+			switch {
+			case r == 0:
+				return PtrValue(elem), nil, nil
+			case r < 0:
+				hi = mid
+			default:
+				lo = mid + 1
+			}
+		}
+		return PtrValue(0), nil, nil
+	}
+}
+
+func compareGuest(ctx context.Context, ec *ExternContext, cmp, a, b uint64) (int32, error) {
+	r, err := ec.CallFunction(ctx, cmp, PtrValue(a), PtrValue(b))
+	if err != nil {
+		return 0, err
+	}
+	if r.Type != bytecode.TypeI32 {
+		return 0, fmt.Errorf("comparator returned %s, want %s", r.Type, bytecode.TypeI32)
+	}
+	return int32(r.Int), nil
+}
+
 func registerMemoryExterns(r *ExternRegistry) {
 	for _, name := range []string{"__builtin_memcpy", "memcpy", "__builtin_memmove", "memmove"} {
 		r.Register(name, memoryCopyExtern(name, false))
@@ -2643,9 +2784,36 @@ func registerOutputFormatExterns(r *ExternRegistry) {
 }
 
 func registerInputFormatExterns(r *ExternRegistry) {
-	r.Register("scanf", scanfExtern("scanf", r))
-	r.Register("fscanf", fscanfExtern("fscanf", r))
-	r.Register("sscanf", sscanfExtern("sscanf"))
+	r.Register("scanf", scanfExtern("scanf", r, false))
+	r.Register("vscanf", scanfExtern("vscanf", r, true))
+	r.Register("fscanf", fscanfExtern("fscanf", r, false))
+	r.Register("vfscanf", fscanfExtern("vfscanf", r, true))
+	r.Register("sscanf", sscanfExtern("sscanf", false))
+	r.Register("vsscanf", sscanfExtern("vsscanf", true))
+}
+
+func registerWideStdioExterns(r *ExternRegistry) {
+	r.Register("fwide", fwideExtern("fwide", r))
+	for _, name := range []string{"fputwc", "putwc"} {
+		r.Register(name, fputwcExtern(name, r))
+	}
+	r.Register("putwchar", putwcharExtern("putwchar", r))
+	for _, name := range []string{"fgetwc", "getwc"} {
+		r.Register(name, fgetwcExtern(name, r))
+	}
+	r.Register("getwchar", getwcharExtern("getwchar", r))
+	r.Register("ungetwc", ungetwcExtern("ungetwc", r))
+	r.Register("fgetws", fgetwsExtern("fgetws", r))
+	r.Register("fputws", fputwsExtern("fputws", r))
+	r.Register("wprintf", wprintfExtern("wprintf", r, false))
+	r.Register("vwprintf", wprintfExtern("vwprintf", r, true))
+	r.Register("fwprintf", fwprintfExtern("fwprintf", r, false))
+	r.Register("vfwprintf", fwprintfExtern("vfwprintf", r, true))
+	r.Register("swprintf", swprintfExtern("swprintf", r, false))
+	r.Register("vswprintf", swprintfExtern("vswprintf", r, true))
+	r.Register("wscanf", wscanfExtern("wscanf", r))
+	r.Register("fwscanf", fwscanfExtern("fwscanf", r))
+	r.Register("swscanf", swscanfExtern("swscanf", r))
 }
 
 func registerMathExterns(r *ExternRegistry) {
@@ -2709,13 +2877,13 @@ func registerMathExterns(r *ExternRegistry) {
 	registerTgmathRealExterns(r, "floor", math.Floor)
 	registerTgmathRealExterns(r, "trunc", math.Trunc)
 	registerTgmathRealExterns(r, "round", math.Round)
-	registerTgmathRealExterns(r, "nearbyint", math.RoundToEven)
-	registerTgmathRealExterns(r, "rint", math.RoundToEven)
+	registerTgmathRintExterns(r, "nearbyint", false)
+	registerTgmathRintExterns(r, "rint", true)
 	registerTgmathRealExterns(r, "logb", math.Logb)
 	registerTgmathIntExterns(r, "ilogb", math.Ilogb)
-	registerTgmathLongExterns(r, "lrint", math.RoundToEven)
+	registerTgmathLongRintExterns(r, "lrint")
 	registerTgmathLongExterns(r, "lround", math.Round)
-	registerTgmathLongExterns(r, "llrint", math.RoundToEven)
+	registerTgmathLongRintExterns(r, "llrint")
 	registerTgmathLongExterns(r, "llround", math.Round)
 	registerTgmathRealIntBinaryExterns(r, "scalbn", math.Ldexp)
 	registerTgmathRealIntBinaryExterns(r, "scalbln", math.Ldexp)
@@ -3087,6 +3255,53 @@ func objectSizeExtern(name string) ExternFunc {
 	}
 }
 
+func asciiLower(ch byte) byte {
+	if ch >= 'A' && ch <= 'Z' {
+		return ch + 'a' - 'A'
+	}
+	return ch
+}
+
+func stringCaseCompareExtern(name string, bounded bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		want := 2
+		if bounded {
+			want = 3
+		}
+		if len(args) != want {
+			return Value{}, nil, fmt.Errorf("%s expects %d arguments", name, want)
+		}
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) || (bounded && !isIntegerLike(args[2].Type)) {
+			return Value{}, nil, fmt.Errorf("%s expects string arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		limit := int64(-1)
+		if bounded {
+			n, err := memorySizeArg(name, args[2])
+			if err != nil {
+				return Value{}, nil, err
+			}
+			limit = n
+		}
+		for i := int64(0); limit < 0 || i < limit; i++ {
+			l, err := readMemoryByte(ec.Memory, args[0].Int+uint64(i))
+			if err != nil {
+				return Value{}, nil, err
+			}
+			rr, err := readMemoryByte(ec.Memory, args[1].Int+uint64(i))
+			if err != nil {
+				return Value{}, nil, err
+			}
+			if diff := int64(asciiLower(l)) - int64(asciiLower(rr)); diff != 0 || l == 0 {
+				return IntValue(bytecode.TypeI32, diff), nil, nil
+			}
+		}
+		return IntValue(bytecode.TypeI32, 0), nil, nil
+	}
+}
+
 func memoryCompareExtern(name string) ExternFunc {
 	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
 		if len(args) != 3 {
@@ -4868,6 +5083,54 @@ func writeMemoryByte(mem *Memory, addr uint64, value byte) error {
 	return nil
 }
 
+// errIllegalSequence reports a character with no representation in the C
+// locale. Stdio functions that run into it fail with EILSEQ instead of
+// trapping.
+var errIllegalSequence = fmt.Errorf("illegal byte sequence")
+
+// cLocaleNarrow converts wide characters to their multibyte form in the C
+// locale, which only represents the 7-bit range.
+func cLocaleNarrow(chars []uint64) (string, error) {
+	buf := make([]byte, len(chars))
+	for i, wc := range chars {
+		if wc > 0x7f {
+			return "", errIllegalSequence
+		}
+		buf[i] = byte(wc)
+	}
+	return string(buf), nil
+}
+
+// readWideCStringNarrow reads the wide string at addr in its multibyte form,
+// stopping after limit characters unless limit is negative.
+func readWideCStringNarrow(mem *Memory, addr uint64, limit int) (string, error) {
+	var chars []uint64
+	for limit < 0 || len(chars) < limit {
+		chAddr, err := wideElementAddr(addr, int64(len(chars)))
+		if err != nil {
+			return "", err
+		}
+		ch, err := loadWideChar(mem, chAddr)
+		if err != nil {
+			return "", err
+		}
+		if ch == 0 {
+			break
+		}
+		chars = append(chars, uint64(ch))
+	}
+	return cLocaleNarrow(chars)
+}
+
+func cLocaleWideRepresentable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
 func readWideCString(mem *Memory, addr uint64) ([]uint64, error) {
 	var out []uint64
 	for {
@@ -4949,7 +5212,7 @@ func vsprintfExtern(name string) ExternFunc {
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		out, err := formatVaListCString(name, ec.Memory, args[1].Int, args[2].Int)
+		out, err := formatVaListCString(name, ec, args[1].Int, args[2].Int)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -4971,7 +5234,7 @@ func vsnprintfExtern(name string) ExternFunc {
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		out, err := formatVaListCString(name, ec.Memory, args[2].Int, args[3].Int)
+		out, err := formatVaListCString(name, ec, args[2].Int, args[3].Int)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5067,7 +5330,7 @@ func vsprintfCheckedExtern(name string) ExternFunc {
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		out, err := formatVaListCString(name, ec.Memory, args[3].Int, args[4].Int)
+		out, err := formatVaListCString(name, ec, args[3].Int, args[4].Int)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5099,7 +5362,7 @@ func vsnprintfCheckedExtern(name string) ExternFunc {
 		if err := checkObjectSize(name, uint64(size), args[3]); err != nil {
 			return Value{}, nil, err
 		}
-		out, err := formatVaListCString(name, ec.Memory, args[4].Int, args[5].Int)
+		out, err := formatVaListCString(name, ec, args[4].Int, args[5].Int)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5151,7 +5414,7 @@ func vprintfExtern(name string, r *ExternRegistry) ExternFunc {
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		out, err := formatVaListCString(name, ec.Memory, args[0].Int, args[1].Int)
+		out, err := formatVaListCString(name, ec, args[0].Int, args[1].Int)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5177,6 +5440,7 @@ func fprintfExtern(name string, r *ExternRegistry) ExternFunc {
 		if !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
 		}
+		r.orientStream(args[0].Int, -1)
 		out, err := formatCString(name, ec.Memory, args[1].Int, args[2:])
 		if err != nil {
 			return Value{}, nil, err
@@ -5203,7 +5467,8 @@ func vfprintfExtern(name string, r *ExternRegistry) ExternFunc {
 		if !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
 		}
-		out, err := formatVaListCString(name, ec.Memory, args[1].Int, args[2].Int)
+		r.orientStream(args[0].Int, -1)
+		out, err := formatVaListCString(name, ec, args[1].Int, args[2].Int)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5247,7 +5512,7 @@ func vprintfCheckedExtern(name string, r *ExternRegistry) ExternFunc {
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		out, err := formatVaListCString(name, ec.Memory, args[1].Int, args[2].Int)
+		out, err := formatVaListCString(name, ec, args[1].Int, args[2].Int)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5273,6 +5538,7 @@ func fprintfCheckedExtern(name string, r *ExternRegistry) ExternFunc {
 		if !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
 		}
+		r.orientStream(args[0].Int, -1)
 		out, err := formatCString(name, ec.Memory, args[2].Int, args[3:])
 		if err != nil {
 			return Value{}, nil, err
@@ -5299,7 +5565,8 @@ func vfprintfCheckedExtern(name string, r *ExternRegistry) ExternFunc {
 		if !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
 		}
-		out, err := formatVaListCString(name, ec.Memory, args[2].Int, args[3].Int)
+		r.orientStream(args[0].Int, -1)
+		out, err := formatVaListCString(name, ec, args[2].Int, args[3].Int)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5310,8 +5577,11 @@ func vfprintfCheckedExtern(name string, r *ExternRegistry) ExternFunc {
 	}
 }
 
-func scanfExtern(name string, r *ExternRegistry) ExternFunc {
+func scanfExtern(name string, r *ExternRegistry, vaList bool) ExternFunc {
 	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if vaList && len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
 		if len(args) < 1 {
 			return Value{}, nil, fmt.Errorf("%s expects at least 1 argument", name)
 		}
@@ -5326,7 +5596,11 @@ func scanfExtern(name string, r *ExternRegistry) ExternFunc {
 				return Value{}, nil, fmt.Errorf("%s could not initialize stdin", name)
 			}
 		}
-		n, err := scanHostStream(name, r, ec.Memory, r.stdinHandle, args[0].Int, args[1:])
+		targets, err := scanTargets(name, ec, args[1:], vaList)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		n, err := scanHostStream(name, r, ec.Memory, r.stdinHandle, args[0].Int, targets)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5334,8 +5608,11 @@ func scanfExtern(name string, r *ExternRegistry) ExternFunc {
 	}
 }
 
-func fscanfExtern(name string, r *ExternRegistry) ExternFunc {
+func fscanfExtern(name string, r *ExternRegistry, vaList bool) ExternFunc {
 	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if vaList && len(args) != 3 {
+			return Value{}, nil, fmt.Errorf("%s expects 3 arguments", name)
+		}
 		if len(args) < 2 {
 			return Value{}, nil, fmt.Errorf("%s expects at least 2 arguments", name)
 		}
@@ -5348,7 +5625,12 @@ func fscanfExtern(name string, r *ExternRegistry) ExternFunc {
 		if _, ok := r.lookupHostWriter(args[0].Int); !ok {
 			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
 		}
-		n, err := scanHostStream(name, r, ec.Memory, args[0].Int, args[1].Int, args[2:])
+		r.orientStream(args[0].Int, -1)
+		targets, err := scanTargets(name, ec, args[2:], vaList)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		n, err := scanHostStream(name, r, ec.Memory, args[0].Int, args[1].Int, targets)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5356,8 +5638,11 @@ func fscanfExtern(name string, r *ExternRegistry) ExternFunc {
 	}
 }
 
-func sscanfExtern(name string) ExternFunc {
+func sscanfExtern(name string, vaList bool) ExternFunc {
 	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if vaList && len(args) != 3 {
+			return Value{}, nil, fmt.Errorf("%s expects 3 arguments", name)
+		}
 		if len(args) < 2 {
 			return Value{}, nil, fmt.Errorf("%s expects at least 2 arguments", name)
 		}
@@ -5367,7 +5652,11 @@ func sscanfExtern(name string) ExternFunc {
 		if ec == nil || ec.Memory == nil {
 			return Value{}, nil, fmt.Errorf("%s requires memory", name)
 		}
-		n, err := scanCString(name, ec.Memory, args[0].Int, args[1].Int, args[2:])
+		targets, err := scanTargets(name, ec, args[2:], vaList)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		n, err := scanCString(name, ec.Memory, args[0].Int, args[1].Int, targets)
 		if err != nil {
 			return Value{}, nil, err
 		}
@@ -5375,6 +5664,18 @@ func sscanfExtern(name string) ExternFunc {
 	}
 }
 
+// scanTargets returns the pointers a scanf variant stores through: its
+// variadic arguments, or the contents of the va_list that replaces them.
+func scanTargets(name string, ec *ExternContext, rest []Value, vaList bool) ([]Value, error) {
+	if !vaList {
+		return rest, nil
+	}
+	if !isPointerType(rest[0].Type) {
+		return nil, fmt.Errorf("%s expects va_list pointer", name)
+	}
+	return readVaList(name, ec, rest[0].Int)
+}
+
 func scanCString(name string, mem *Memory, inputAddr, formatAddr uint64, args []Value) (int, error) {
 	input, err := mem.ReadCString(inputAddr)
 	if err != nil {
@@ -5396,6 +5697,10 @@ func scanHostStream(name string, r *ExternRegistry, mem *Memory, stream, formatA
 	if err != nil {
 		return 0, err
 	}
+	return scanHostStreamFormat(name, r, mem, stream, format, args)
+}
+
+func scanHostStreamFormat(name string, r *ExternRegistry, mem *Memory, stream uint64, format string, args []Value) (int, error) {
 	if r.markHostReadErrorIfUnreadable(stream) {
 		return 0, nil
 	}
@@ -5443,25 +5748,534 @@ func (r *ExternRegistry) markHostReadErrorIfUnreadable(addr uint64) bool {
 	return false
 }
 
-func scanString(name string, mem *Memory, input, format string, args []Value) (int, int, bool, error) {
-	inputIndex := 0
-	argIndex := 0
-	assigned := 0
-	for formatIndex := 0; formatIndex < len(format); formatIndex++ {
-		ch := format[formatIndex]
-		if isASCIIWhitespace(ch) {
-			for formatIndex+1 < len(format) && isASCIIWhitespace(format[formatIndex+1]) {
-				formatIndex++
-			}
-			inputIndex = scanSkipWhitespace(input, inputIndex)
-			continue
+func fwideExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
 		}
-		if ch != '%' {
-			if inputIndex >= len(input) || input[inputIndex] != ch {
-				return assigned, inputIndex, inputIndex >= len(input), nil
-			}
-			inputIndex++
-			continue
+		if !isPointerType(args[0].Type) || !isIntegerLike(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects stream and mode arguments", name)
+		}
+		if _, ok := r.lookupHostWriter(args[0].Int); !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
+		}
+		mode := signedInt(args[1])
+		if mode > 0 {
+			mode = 1
+		} else if mode < 0 {
+			mode = -1
+		}
+		return IntValue(bytecode.TypeI32, int64(r.orientStream(args[0].Int, int32(mode)))), nil, nil
+	}
+}
+
+func fputwcExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
+		if !isIntegerLike(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects wide character and stream arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		w, ok := r.lookupHostWriter(args[1].Int)
+		if !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[1].Int)
+		}
+		return r.putWideChar(ec.Memory, args[1].Int, w, uint32(args[0].Int))
+	}
+}
+
+func putwcharExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 {
+			return Value{}, nil, fmt.Errorf("%s expects 1 argument", name)
+		}
+		if !isIntegerLike(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects wide character argument", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		stream, err := r.stdoutStream(name, ec.Memory)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return r.putWideChar(ec.Memory, stream, r.externStdout(ec), uint32(args[0].Int))
+	}
+}
+
+func (r *ExternRegistry) putWideChar(mem *Memory, stream uint64, w io.Writer, wc uint32) (Value, *ExitStatus, error) {
+	weof := IntValue(bytecode.TypeI32, -1)
+	if r.orientStream(stream, 1) < 0 {
+		return weof, nil, nil
+	}
+	s, err := cLocaleNarrow([]uint64{uint64(wc)})
+	if err != nil {
+		r.hostError[stream] = true
+		if err := r.setErrno(mem, 84); err != nil {
+			return Value{}, nil, err
+		}
+		return weof, nil, nil
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		r.hostError[stream] = true
+		return weof, nil, nil
+	}
+	return IntValue(bytecode.TypeI32, int64(wc)), nil, nil
+}
+
+func fgetwcExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 {
+			return Value{}, nil, fmt.Errorf("%s expects 1 argument", name)
+		}
+		if !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects stream pointer", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		if _, ok := r.lookupHostWriter(args[0].Int); !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
+		}
+		return r.getWideChar(ec.Memory, args[0].Int)
+	}
+}
+
+func getwcharExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 0 {
+			return Value{}, nil, fmt.Errorf("%s expects 0 arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		stream, err := r.stdinStream(name, ec.Memory)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return r.getWideChar(ec.Memory, stream)
+	}
+}
+
+// getWideChar reads one multibyte character from a wide-oriented stream. In
+// the C locale every character is a single byte below 0x80.
+func (r *ExternRegistry) getWideChar(mem *Memory, stream uint64) (Value, *ExitStatus, error) {
+	weof := IntValue(bytecode.TypeI32, -1)
+	if r.orientStream(stream, 1) < 0 || r.markHostReadErrorIfUnreadable(stream) {
+		return weof, nil, nil
+	}
+	ch, ok := r.readHostChar(stream)
+	if !ok {
+		r.hostEOF[stream] = true
+		return weof, nil, nil
+	}
+	if ch >= 0x80 {
+		r.hostError[stream] = true
+		if err := r.setErrno(mem, 84); err != nil {
+			return Value{}, nil, err
+		}
+		return weof, nil, nil
+	}
+	return IntValue(bytecode.TypeI32, int64(ch)), nil, nil
+}
+
+func ungetwcExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
+		if !isIntegerLike(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects wide character and stream arguments", name)
+		}
+		weof := IntValue(bytecode.TypeI32, -1)
+		wc := int32(args[0].Int)
+		if wc == -1 {
+			return weof, nil, nil
+		}
+		if _, ok := r.lookupHostWriter(args[1].Int); !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[1].Int)
+		}
+		if r.orientStream(args[1].Int, 1) < 0 || wc < 0 || wc > 0x7f {
+			return weof, nil, nil
+		}
+		r.hostPushback[args[1].Int] = append(r.hostPushback[args[1].Int], byte(wc))
+		r.hostEOF[args[1].Int] = false
+		return IntValue(bytecode.TypeI32, int64(wc)), nil, nil
+	}
+}
+
+func fgetwsExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 3 {
+			return Value{}, nil, fmt.Errorf("%s expects 3 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isIntegerLike(args[1].Type) || !isPointerType(args[2].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects buffer, size, and stream arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		stream := args[2].Int
+		if _, ok := r.lookupHostWriter(stream); !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", stream)
+		}
+		if r.orientStream(stream, 1) < 0 || r.markHostReadErrorIfUnreadable(stream) {
+			return PtrValue(0), nil, nil
+		}
+		n := int32(args[1].Int)
+		if n <= 1 {
+			return PtrValue(0), nil, nil
+		}
+		buf := make([]byte, 0, n-1)
+		for len(buf) < int(n)-1 {
+			ch, ok := r.readHostChar(stream)
+			if !ok {
+				break
+			}
+			if ch >= 0x80 {
+				r.hostError[stream] = true
+				if err := r.setErrno(ec.Memory, 84); err != nil {
+					return Value{}, nil, err
+				}
+				return PtrValue(0), nil, nil
+			}
+			buf = append(buf, ch)
+			if ch == '\n' {
+				break
+			}
+		}
+		if len(buf) == 0 {
+			r.hostEOF[stream] = true
+			return PtrValue(0), nil, nil
+		}
+		if err := scanStoreChars(ec.Memory, args[0].Int, string(buf), true, true); err != nil {
+			return Value{}, nil, err
+		}
+		return PtrValue(args[0].Int), nil, nil
+	}
+}
+
+func fputwsExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects string and stream pointers", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		w, ok := r.lookupHostWriter(args[1].Int)
+		if !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[1].Int)
+		}
+		if r.orientStream(args[1].Int, 1) < 0 {
+			return IntValue(bytecode.TypeI32, -1), nil, nil
+		}
+		s, err := readWideCStringNarrow(ec.Memory, args[0].Int, -1)
+		if err == errIllegalSequence {
+			return r.wideOutputFailed(ec.Memory, args[1].Int)
+		}
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return r.writeWideOutput(args[1].Int, w, s)
+	}
+}
+
+func wprintfExtern(name string, r *ExternRegistry, vaList bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if vaList && len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
+		if len(args) < 1 {
+			return Value{}, nil, fmt.Errorf("%s expects at least 1 argument", name)
+		}
+		if !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects format pointer", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		stream, err := r.stdoutStream(name, ec.Memory)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return r.printWide(name, ec, stream, r.externStdout(ec), args, vaList)
+	}
+}
+
+func fwprintfExtern(name string, r *ExternRegistry, vaList bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if vaList && len(args) != 3 {
+			return Value{}, nil, fmt.Errorf("%s expects 3 arguments", name)
+		}
+		if len(args) < 2 {
+			return Value{}, nil, fmt.Errorf("%s expects at least 2 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects stream and format pointers", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		w, ok := r.lookupHostWriter(args[0].Int)
+		if !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
+		}
+		return r.printWide(name, ec, args[0].Int, w, args[1:], vaList)
+	}
+}
+
+func (r *ExternRegistry) printWide(name string, ec *ExternContext, stream uint64, w io.Writer, args []Value, vaList bool) (Value, *ExitStatus, error) {
+	if r.orientStream(stream, 1) < 0 {
+		return IntValue(bytecode.TypeI32, -1), nil, nil
+	}
+	out, ok, err := formatWideArgs(name, ec, args, vaList)
+	if err != nil {
+		return Value{}, nil, err
+	}
+	if !ok {
+		return r.wideOutputFailed(ec.Memory, stream)
+	}
+	return r.writeWideOutput(stream, w, out)
+}
+
+func (r *ExternRegistry) writeWideOutput(stream uint64, w io.Writer, out string) (Value, *ExitStatus, error) {
+	if _, err := io.WriteString(w, out); err != nil {
+		r.hostError[stream] = true
+		return IntValue(bytecode.TypeI32, -1), nil, nil
+	}
+	return IntValue(bytecode.TypeI32, int64(len(out))), nil, nil
+}
+
+func (r *ExternRegistry) wideOutputFailed(mem *Memory, stream uint64) (Value, *ExitStatus, error) {
+	r.hostError[stream] = true
+	if err := r.setErrno(mem, 84); err != nil {
+		return Value{}, nil, err
+	}
+	return IntValue(bytecode.TypeI32, -1), nil, nil
+}
+
+func swprintfExtern(name string, r *ExternRegistry, vaList bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if vaList && len(args) != 4 {
+			return Value{}, nil, fmt.Errorf("%s expects 4 arguments", name)
+		}
+		if len(args) < 3 {
+			return Value{}, nil, fmt.Errorf("%s expects at least 3 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isIntegerLike(args[1].Type) || !isPointerType(args[2].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects destination, size, and format arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		size, err := memorySizeArg(name, args[1])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		out, ok, err := formatWideArgs(name, ec, args[2:], vaList)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if !ok {
+			if err := r.setErrno(ec.Memory, 84); err != nil {
+				return Value{}, nil, err
+			}
+			return IntValue(bytecode.TypeI32, -1), nil, nil
+		}
+		if size == 0 {
+			return IntValue(bytecode.TypeI32, -1), nil, nil
+		}
+		// Unlike snprintf, a result that does not fit is an error rather
+		// than the length it would have had.
+		fits := int64(len(out)) < size
+		if !fits {
+			out = out[:size-1]
+		}
+		if err := scanStoreChars(ec.Memory, args[0].Int, out, true, true); err != nil {
+			return Value{}, nil, err
+		}
+		if !fits {
+			return IntValue(bytecode.TypeI32, -1), nil, nil
+		}
+		return IntValue(bytecode.TypeI32, int64(len(out))), nil, nil
+	}
+}
+
+// formatWideArgs formats the wide format string in args[0] with the variadic
+// arguments after it, or with the va_list in args[1] when vaList is set. ok
+// is false when the format, an argument or the result has no representation
+// in the C locale.
+func formatWideArgs(name string, ec *ExternContext, args []Value, vaList bool) (string, bool, error) {
+	mem := ec.Memory
+	format, err := readWideCStringNarrow(mem, args[0].Int, -1)
+	if err == errIllegalSequence {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	values := args[1:]
+	if vaList {
+		if !isPointerType(args[1].Type) {
+			return "", false, fmt.Errorf("%s expects va_list pointer", name)
+		}
+		values, err = readVaList(name, ec, args[1].Int)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	out, err := formatString(name, mem, format, values)
+	if err == errIllegalSequence {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return out, cLocaleWideRepresentable(out), nil
+}
+
+func wscanfExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) < 1 {
+			return Value{}, nil, fmt.Errorf("%s expects at least 1 argument", name)
+		}
+		if !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects format string argument", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		stream, err := r.stdinStream(name, ec.Memory)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return r.scanWideStream(name, ec.Memory, stream, args[0].Int, args[1:])
+	}
+}
+
+func fwscanfExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) < 2 {
+			return Value{}, nil, fmt.Errorf("%s expects at least 2 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects stream and format string arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		if _, ok := r.lookupHostWriter(args[0].Int); !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", args[0].Int)
+		}
+		return r.scanWideStream(name, ec.Memory, args[0].Int, args[1].Int, args[2:])
+	}
+}
+
+func (r *ExternRegistry) scanWideStream(name string, mem *Memory, stream, formatAddr uint64, args []Value) (Value, *ExitStatus, error) {
+	if r.orientStream(stream, 1) < 0 {
+		return IntValue(bytecode.TypeI32, -1), nil, nil
+	}
+	format, err := readWideCStringNarrow(mem, formatAddr, -1)
+	if err == errIllegalSequence {
+		if err := r.setErrno(mem, 84); err != nil {
+			return Value{}, nil, err
+		}
+		return IntValue(bytecode.TypeI32, -1), nil, nil
+	}
+	if err != nil {
+		return Value{}, nil, err
+	}
+	n, err := scanHostStreamFormat(name, r, mem, stream, format, args)
+	if err != nil {
+		return Value{}, nil, err
+	}
+	return IntValue(bytecode.TypeI32, int64(n)), nil, nil
+}
+
+func swscanfExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) < 2 {
+			return Value{}, nil, fmt.Errorf("%s expects at least 2 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects input and format string arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		input, err := readWideCStringNarrow(ec.Memory, args[0].Int, -1)
+		var format string
+		if err == nil {
+			format, err = readWideCStringNarrow(ec.Memory, args[1].Int, -1)
+		}
+		if err == errIllegalSequence {
+			if err := r.setErrno(ec.Memory, 84); err != nil {
+				return Value{}, nil, err
+			}
+			return IntValue(bytecode.TypeI32, -1), nil, nil
+		}
+		if err != nil {
+			return Value{}, nil, err
+		}
+		assigned, _, inputFailure, err := scanString(name, ec.Memory, input, format, args[2:])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if inputFailure && assigned == 0 {
+			return IntValue(bytecode.TypeI32, -1), nil, nil
+		}
+		return IntValue(bytecode.TypeI32, int64(assigned)), nil, nil
+	}
+}
+
+// stdinStream and stdoutStream return the handles of the standard streams,
+// creating them if the program never named them, so their orientation can be
+// tracked.
+func (r *ExternRegistry) stdinStream(name string, mem *Memory) (uint64, error) {
+	if r.stdinHandle == 0 {
+		if _, ok := r.LookupVariable("stdin", mem); !ok {
+			return 0, fmt.Errorf("%s could not initialize stdin", name)
+		}
+	}
+	return r.stdinHandle, nil
+}
+
+func (r *ExternRegistry) stdoutStream(name string, mem *Memory) (uint64, error) {
+	if r.stdoutHandle == 0 {
+		if _, ok := r.LookupVariable("stdout", mem); !ok {
+			return 0, fmt.Errorf("%s could not initialize stdout", name)
+		}
+	}
+	return r.stdoutHandle, nil
+}
+
+func scanString(name string, mem *Memory, input, format string, args []Value) (int, int, bool, error) {
+	inputIndex := 0
+	argIndex := 0
+	assigned := 0
+	for formatIndex := 0; formatIndex < len(format); formatIndex++ {
+		ch := format[formatIndex]
+		if isASCIIWhitespace(ch) {
+			for formatIndex+1 < len(format) && isASCIIWhitespace(format[formatIndex+1]) {
+				formatIndex++
+			}
+			inputIndex = scanSkipWhitespace(input, inputIndex)
+			continue
+		}
+		if ch != '%' {
+			if inputIndex >= len(input) || input[inputIndex] != ch {
+				return assigned, inputIndex, inputIndex >= len(input), nil
+			}
+			inputIndex++
+			continue
 		}
 		formatIndex++
 		if formatIndex >= len(format) {
@@ -5622,8 +6436,7 @@ func scanString(name string, mem *Memory, input, format string, args []Value) (i
 				return assigned, inputIndex, false, nil
 			}
 			if !suppress {
-				data := append([]byte(input[inputIndex:end]), 0)
-				if err := writeMemoryBytes(mem, args[argIndex].Int, data); err != nil {
+				if err := scanStoreChars(mem, args[argIndex].Int, input[inputIndex:end], lengthMod == "l", true); err != nil {
 					return 0, inputIndex, false, err
 				}
 				argIndex++
@@ -5639,7 +6452,7 @@ func scanString(name string, mem *Memory, input, format string, args []Value) (i
 				return assigned, inputIndex, true, nil
 			}
 			if !suppress {
-				if err := writeMemoryBytes(mem, args[argIndex].Int, []byte(input[inputIndex:inputIndex+count])); err != nil {
+				if err := scanStoreChars(mem, args[argIndex].Int, input[inputIndex:inputIndex+count], lengthMod == "l", false); err != nil {
 					return 0, inputIndex, false, err
 				}
 				argIndex++
@@ -5664,8 +6477,7 @@ func scanString(name string, mem *Memory, input, format string, args []Value) (i
 				return assigned, inputIndex, inputIndex >= len(input), nil
 			}
 			if !suppress {
-				data := append([]byte(input[inputIndex:end]), 0)
-				if err := writeMemoryBytes(mem, args[argIndex].Int, data); err != nil {
+				if err := scanStoreChars(mem, args[argIndex].Int, input[inputIndex:end], lengthMod == "l", true); err != nil {
 					return 0, inputIndex, false, err
 				}
 				argIndex++
@@ -5761,6 +6573,31 @@ func scanStoreInteger(mem *Memory, addr uint64, lengthMod string, unsigned bool,
 	return mem.Store(addr, t, align, normalizeInt(IntValue(t, v)))
 }
 
+// scanStoreChars stores the characters matched by %c, %s or %[, widening them
+// for the l length modifier.
+func scanStoreChars(mem *Memory, addr uint64, chars string, wide, terminate bool) error {
+	if !wide {
+		data := []byte(chars)
+		if terminate {
+			data = append(data, 0)
+		}
+		return writeMemoryBytes(mem, addr, data)
+	}
+	if terminate {
+		chars += "\x00"
+	}
+	for i := 0; i < len(chars); i++ {
+		chAddr, err := wideElementAddr(addr, int64(i))
+		if err != nil {
+			return err
+		}
+		if err := storeWideChar(mem, chAddr, uint32(chars[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func scanStoreFloat(mem *Memory, addr uint64, lengthMod string, value float64) error {
 	t, align, err := scanFloatType(lengthMod)
 	if err != nil {
@@ -5817,12 +6654,22 @@ const (
 	memoryVaListMaxArgs = 1024
 )
 
-func formatVaListCString(name string, mem *Memory, formatAddr, vaListAddr uint64) (string, error) {
-	args, err := readMemoryVaList(name, mem, vaListAddr)
+func formatVaListCString(name string, ec *ExternContext, formatAddr, vaListAddr uint64) (string, error) {
+	args, err := readVaList(name, ec, vaListAddr)
 	if err != nil {
 		return "", err
 	}
-	return formatCString(name, mem, formatAddr, args)
+	return formatCString(name, ec.Memory, formatAddr, args)
+}
+
+// readVaList returns the arguments a va_list refers to. One set up by
+// va_start or va_copy in a live frame yields that frame's remaining variadic
+// arguments; any other address is read as a tagged array in guest memory.
+func readVaList(name string, ec *ExternContext, vaListAddr uint64) ([]Value, error) {
+	if args, ok := ec.vaListArgs(vaListAddr); ok {
+		return args, nil
+	}
+	return readMemoryVaList(name, ec.Memory, vaListAddr)
 }
 
 func readMemoryVaList(name string, mem *Memory, vaListAddr uint64) ([]Value, error) {
@@ -5874,6 +6721,10 @@ func formatCString(name string, mem *Memory, formatAddr uint64, args []Value) (s
 	if err != nil {
 		return "", err
 	}
+	return formatString(name, mem, format, args)
+}
+
+func formatString(name string, mem *Memory, format string, args []Value) (string, error) {
 	var out strings.Builder
 	argIndex := 0
 	for i := 0; i < len(format); i++ {
@@ -5997,6 +6848,14 @@ func formatCString(name string, mem *Memory, formatAddr uint64, args []Value) (s
 			if !isPointerType(arg.Type) {
 				return "", fmt.Errorf("%s %%s expects pointer argument", name)
 			}
+			if lengthMod == "l" {
+				s, err := readWideCStringNarrow(mem, arg.Int, precision)
+				if err != nil {
+					return "", err
+				}
+				piece = s
+				break
+			}
 			s, err := mem.ReadCString(arg.Int)
 			if err != nil {
 				return "", err
@@ -6066,6 +6925,14 @@ func formatCString(name string, mem *Memory, formatAddr uint64, args []Value) (s
 			if precision >= 0 {
 				return "", fmt.Errorf("%s %%c does not support precision", name)
 			}
+			if lengthMod == "l" {
+				s, err := cLocaleNarrow([]uint64{uint64(uint32(arg.Int))})
+				if err != nil {
+					return "", err
+				}
+				piece = s
+				break
+			}
 			piece = string([]byte{byte(unsignedInt(arg))})
 		case 'n':
 			if !isPointerType(arg.Type) {
@@ -6372,6 +7239,18 @@ func registerTgmathLongExterns(r *ExternRegistry, base string, fn func(float64)
 	r.Register(base+"l", mathUnaryLongExtern(base+"l", fn))
 }
 
+func registerTgmathRintExterns(r *ExternRegistry, base string, inexact bool) {
+	r.Register(base+"f", mathRintExtern(base+"f", bytecode.TypeF32, inexact))
+	r.Register(base, mathRintExtern(base, bytecode.TypeF64, inexact))
+	r.Register(base+"l", mathRintExtern(base+"l", bytecode.TypeFLong, inexact))
+}
+
+func registerTgmathLongRintExterns(r *ExternRegistry, base string) {
+	r.Register(base+"f", mathRintExtern(base+"f", bytecode.TypeI64, true))
+	r.Register(base, mathRintExtern(base, bytecode.TypeI64, true))
+	r.Register(base+"l", mathRintExtern(base+"l", bytecode.TypeI64, true))
+}
+
 func registerTgmathRealBinaryExterns(r *ExternRegistry, base string, fn func(float64, float64) float64) {
 	r.Register(base+"f", mathBinaryFloatExtern(base+"f", bytecode.TypeF32, fn))
 	r.Register(base, mathBinaryFloatExtern(base, bytecode.TypeF64, fn))
@@ -6416,7 +7295,37 @@ func mathUnaryFloatExtern(name string, ret bytecode.ValueType, fn func(float64)
 		if !isFloatType(args[0].Type) {
 			return Value{}, nil, fmt.Errorf("%s expects floating argument", name)
 		}
-		return floatResult(ret, fn(cvmFloat(args[0]))), nil, nil
+		x := cvmFloat(args[0])
+		z := floatResult(ret, fn(x))
+		ec.floatEnv().raise(mathExceptions(name, ret, z.Float, x))
+		return z, nil, nil
+	}
+}
+
+// mathRintExtern rounds to an integer in the current rounding mode, for
+// rint, nearbyint, lrint and llrint. Only nearbyint leaves inexact alone.
+func mathRintExtern(name string, ret bytecode.ValueType, inexact bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 {
+			return Value{}, nil, fmt.Errorf("%s expects 1 argument", name)
+		}
+		if !isFloatType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects floating argument", name)
+		}
+		e := ec.floatEnv()
+		x := cvmFloat(args[0])
+		z := roundInMode(x, e.mode())
+		if isFloatType(ret) {
+			if inexact && z != x && !math.IsInf(x, 0) && !math.IsNaN(x) {
+				e.raise(feInexact)
+			}
+			return floatResult(ret, z), nil, nil
+		}
+		out := e.floatToInt(ret, z)
+		if z != x && !math.IsInf(x, 0) && !math.IsNaN(x) {
+			e.raise(feInexact)
+		}
+		return out, nil, nil
 	}
 }
 
@@ -6428,7 +7337,11 @@ func mathUnaryIntExtern(name string, fn func(float64) int) ExternFunc {
 		if !isFloatType(args[0].Type) {
 			return Value{}, nil, fmt.Errorf("%s expects floating argument", name)
 		}
-		return IntValue(bytecode.TypeI32, int64(fn(cvmFloat(args[0])))), nil, nil
+		x := cvmFloat(args[0])
+		if x == 0 || math.IsInf(x, 0) || math.IsNaN(x) {
+			ec.floatEnv().raise(feInvalid)
+		}
+		return IntValue(bytecode.TypeI32, int64(fn(x))), nil, nil
 	}
 }
 
@@ -6440,7 +7353,7 @@ func mathUnaryLongExtern(name string, fn func(float64) float64) ExternFunc {
 		if !isFloatType(args[0].Type) {
 			return Value{}, nil, fmt.Errorf("%s expects floating argument", name)
 		}
-		return IntValue(bytecode.TypeI64, int64(fn(cvmFloat(args[0])))), nil, nil
+		return ec.floatEnv().floatToInt(bytecode.TypeI64, fn(cvmFloat(args[0]))), nil, nil
 	}
 }
 
@@ -6473,7 +7386,10 @@ func mathBinaryFloatExtern(name string, ret bytecode.ValueType, fn func(float64,
 		if !isFloatType(args[0].Type) || !isFloatType(args[1].Type) {
 			return Value{}, nil, fmt.Errorf("%s expects floating arguments", name)
 		}
-		return floatResult(ret, fn(cvmFloat(args[0]), cvmFloat(args[1]))), nil, nil
+		x, y := cvmFloat(args[0]), cvmFloat(args[1])
+		z := floatResult(ret, fn(x, y))
+		ec.floatEnv().raise(mathExceptions(name, ret, z.Float, x, y))
+		return z, nil, nil
 	}
 }
 
@@ -6489,7 +7405,10 @@ func mathFloatIntExtern(name string, ret bytecode.ValueType, fn func(float64, in
 		if int64(int(exp)) != exp {
 			return Value{}, nil, fmt.Errorf("%s exponent %d exceeds int range", name, exp)
 		}
-		return floatResult(ret, fn(cvmFloat(args[0]), int(exp))), nil, nil
+		x := cvmFloat(args[0])
+		z := floatResult(ret, fn(x, int(exp)))
+		ec.floatEnv().raise(mathExceptions(name, ret, z.Float, x))
+		return z, nil, nil
 	}
 }
 
@@ -6547,7 +7466,9 @@ func mathRemquoExtern(name string, ret bytecode.ValueType) ExternFunc {
 		if err := ec.Memory.Store(args[2].Int, bytecode.TypeI32, 4, IntValue(bytecode.TypeI32, quo)); err != nil {
 			return Value{}, nil, err
 		}
-		return floatResult(ret, math.Remainder(x, y)), nil, nil
+		z := floatResult(ret, math.Remainder(x, y))
+		ec.floatEnv().raise(mathExceptions(name, ret, z.Float, x, y))
+		return z, nil, nil
 	}
 }
 
@@ -6559,7 +7480,10 @@ func mathTernaryFloatExtern(name string, ret bytecode.ValueType, fn func(float64
 		if !isFloatType(args[0].Type) || !isFloatType(args[1].Type) || !isFloatType(args[2].Type) {
 			return Value{}, nil, fmt.Errorf("%s expects floating arguments", name)
 		}
-		return floatResult(ret, fn(cvmFloat(args[0]), cvmFloat(args[1]), cvmFloat(args[2]))), nil, nil
+		x, y, w := cvmFloat(args[0]), cvmFloat(args[1]), cvmFloat(args[2])
+		z := floatResult(ret, fn(x, y, w))
+		ec.floatEnv().raise(mathExceptions(name, ret, z.Float, x, y, w))
+		return z, nil, nil
 	}
 }
 
@@ -6702,6 +7626,9 @@ func (r *ExternRegistry) LookupVariableAddr(name string, mem *Memory) (uint64, b
 		return addr, true, err
 	case "stdout":
 		addr, err := r.allocHostWriter(name, mem, r.stdout, 1)
+		if err == nil {
+			r.stdoutHandle = addr
+		}
 		return addr, true, err
 	case "stderr":
 		addr, err := r.allocHostWriter(name, mem, r.stderr, 2)
@@ -6709,8 +7636,12 @@ func (r *ExternRegistry) LookupVariableAddr(name string, mem *Memory) (uint64, b
 	case "errno":
 		addr, err := r.staticI32Variable(mem, name, 0)
 		return addr, true, err
+	case "__cvm_fe_dfl_env":
+		// The zero environment is the default one.
+		addr, _, err := r.staticBlock(mem, name, 8, 4)
+		return addr, true, err
 	default:
-		return 0, false, nil
+		return r.lookupPOSIXVariable(name, mem)
 	}
 }
 
@@ -6854,6 +7785,21 @@ func (r *ExternRegistry) lookupHostWriter(addr uint64) (io.Writer, bool) {
 	return w, ok
 }
 
+// orientStream gives an unoriented stream the orientation mode asks for,
+// positive for wide and negative for byte, and reports the orientation the
+// stream ends up with.
+func (r *ExternRegistry) orientStream(addr uint64, mode int32) int32 {
+	orient := r.hostOrient[addr]
+	if orient == 0 && mode != 0 {
+		orient = 1
+		if mode < 0 {
+			orient = -1
+		}
+		r.hostOrient[addr] = orient
+	}
+	return orient
+}
+
 func (r *ExternRegistry) readHostChar(addr uint64) (byte, bool) {
 	buf := r.hostPushback[addr]
 	if len(buf) == 0 {
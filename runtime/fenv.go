@@ -0,0 +1,515 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// Exception flags and rounding modes, with the values <fenv.h> gives them.
+const (
+	feInvalid   = 0x01
+	feDivByZero = 0x04
+	feOverflow  = 0x08
+	feUnderflow = 0x10
+	feInexact   = 0x20
+	feAllExcept = feInvalid | feDivByZero | feOverflow | feUnderflow | feInexact
+
+	feToNearest  = 0
+	feDownward   = 0x400
+	feUpward     = 0x800
+	feTowardZero = 0xc00
+)
+
+// floatEnv is the floating-point environment of one program. Arithmetic,
+// conversions and the math externs raise flags in it and round in its mode.
+// A nil *floatEnv rounds to nearest and drops the flags.
+type floatEnv struct {
+	except int32
+	round  int32
+}
+
+func (e *floatEnv) raise(flags int32) {
+	if e != nil {
+		e.except |= flags & feAllExcept
+	}
+}
+
+func (e *floatEnv) mode() int32 {
+	if e == nil {
+		return feToNearest
+	}
+	return e.round
+}
+
+func (ec *ExternContext) floatEnv() *floatEnv {
+	if ec == nil {
+		return nil
+	}
+	return ec.fenv
+}
+
+func validRoundingMode(mode int32) bool {
+	switch mode {
+	case feToNearest, feDownward, feUpward, feTowardZero:
+		return true
+	}
+	return false
+}
+
+// arith performs one IEEE operation of type t in the current rounding mode.
+func (e *floatEnv) arith(t bytecode.ValueType, op bytecode.BinaryOp, x, y float64) float64 {
+	var z float64
+	dir := 0
+	switch op {
+	case bytecode.BinAdd:
+		z = x + y
+		dir = twoSumDirection(x, y, z)
+	case bytecode.BinSub:
+		z = x - y
+		dir = twoSumDirection(x, -y, z)
+	case bytecode.BinMul:
+		z = x * y
+		dir = floatSign(math.FMA(x, y, -z))
+	case bytecode.BinDivS:
+		z = x / y
+		if y == 0 && !math.IsNaN(x) && x != 0 && !math.IsInf(x, 0) {
+			e.raise(feDivByZero)
+			return z
+		}
+		if !math.IsInf(z, 0) && !math.IsNaN(z) {
+			dir = floatSign(math.FMA(-z, y, x)) * floatSign(y)
+		}
+	}
+	if math.IsNaN(z) {
+		if !math.IsNaN(x) && !math.IsNaN(y) {
+			e.raise(feInvalid)
+		}
+		return z
+	}
+	finite := !math.IsInf(x, 0) && !math.IsInf(y, 0)
+	if z == 0 && dir == 0 && (op == bytecode.BinAdd || op == bytecode.BinSub) && x != 0 && e.mode() == feDownward {
+		// An exact zero sum of opposite signs is -0 when rounding down.
+		z = math.Copysign(0, -1)
+	}
+	return e.rounded(t, z, dir, finite && math.IsInf(z, 0))
+}
+
+// rounded takes the round-to-nearest result z of an operation whose exact
+// value lies in direction dir from z, narrows it to t and applies the
+// rounding mode. overflow reports an infinite z computed from finite operands.
+func (e *floatEnv) rounded(t bytecode.ValueType, z float64, dir int, overflow bool) float64 {
+	if math.IsNaN(z) {
+		return z
+	}
+	if t == bytecode.TypeF32 {
+		f := float64(float32(z))
+		if math.IsInf(f, 0) && !math.IsInf(z, 0) {
+			overflow = true
+		}
+		if f < z {
+			dir = 1
+		} else if f > z {
+			dir = -1
+		}
+		z = f
+	}
+	mode := e.mode()
+	if math.IsInf(z, 0) {
+		if !overflow {
+			return z
+		}
+		e.raise(feOverflow | feInexact)
+		if z > 0 && (mode == feDownward || mode == feTowardZero) {
+			return maxFinite(t)
+		}
+		if z < 0 && (mode == feUpward || mode == feTowardZero) {
+			return -maxFinite(t)
+		}
+		return z
+	}
+	if dir == 0 {
+		return z
+	}
+	e.raise(feInexact)
+	switch {
+	case mode == feUpward && dir > 0:
+		z = nextFloat(t, z, math.Inf(1))
+	case mode == feDownward && dir < 0:
+		z = nextFloat(t, z, math.Inf(-1))
+	case mode == feTowardZero && (z > 0 && dir < 0 || z < 0 && dir > 0):
+		z = nextFloat(t, z, 0)
+	}
+	if math.IsInf(z, 0) {
+		e.raise(feOverflow)
+	} else if math.Abs(z) < minNormal(t) {
+		e.raise(feUnderflow)
+	}
+	return z
+}
+
+// twoSumDirection returns the sign of the rounding error of z = x + y.
+func twoSumDirection(x, y, z float64) int {
+	if math.IsInf(z, 0) || math.IsNaN(z) {
+		return 0
+	}
+	yv := z - x
+	xv := z - yv
+	return floatSign((x - xv) + (y - yv))
+}
+
+func floatSign(v float64) int {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+func nextFloat(t bytecode.ValueType, z, toward float64) float64 {
+	if t == bytecode.TypeF32 {
+		return float64(math.Nextafter32(float32(z), float32(toward)))
+	}
+	return math.Nextafter(z, toward)
+}
+
+func maxFinite(t bytecode.ValueType) float64 {
+	if t == bytecode.TypeF32 {
+		return math.MaxFloat32
+	}
+	return math.MaxFloat64
+}
+
+func minNormal(t bytecode.ValueType) float64 {
+	if t == bytecode.TypeF32 {
+		return minNormalFloat32
+	}
+	return minNormalFloat64
+}
+
+// compare raises invalid for an ordered comparison involving a NaN; == and
+// != are quiet.
+func (e *floatEnv) compare(op bytecode.BinaryOp, x, y float64) {
+	if op != bytecode.BinEq && op != bytecode.BinNe && (math.IsNaN(x) || math.IsNaN(y)) {
+		e.raise(feInvalid)
+	}
+}
+
+// intToFloat converts an integer to t in the current rounding mode.
+func (e *floatEnv) intToFloat(t bytecode.ValueType, v Value) float64 {
+	dir := 0
+	var f float64
+	if isUnsignedIntegerType(v.Type) {
+		u := unsignedInt(v)
+		f = float64(u)
+		if f >= 1<<64 {
+			dir = -1
+		} else if back := uint64(f); back < u {
+			dir = 1
+		} else if back > u {
+			dir = -1
+		}
+	} else {
+		i := signedInt(v)
+		f = float64(i)
+		if f >= 1<<63 {
+			dir = -1
+		} else if back := int64(f); back < i {
+			dir = 1
+		} else if back > i {
+			dir = -1
+		}
+	}
+	return e.rounded(t, f, dir, false)
+}
+
+// floatToInt truncates f to an integer of type t. Values outside the range
+// of t raise invalid; dropping a fraction raises inexact.
+func (e *floatEnv) floatToInt(t bytecode.ValueType, f float64) Value {
+	trunc := math.Trunc(f)
+	width := bitWidth(t)
+	lo, hi := math.Ldexp(-1, int(width)-1), math.Ldexp(1, int(width)-1)
+	if isUnsignedIntegerType(t) {
+		lo, hi = 0, math.Ldexp(1, int(width))
+	}
+	if math.IsNaN(f) || trunc < lo || trunc >= hi {
+		e.raise(feInvalid)
+	} else if trunc != f {
+		e.raise(feInexact)
+	}
+	if isUnsignedIntegerType(t) {
+		return normalizeInt(UIntValue(t, uint64(f)))
+	}
+	return normalizeInt(IntValue(t, int64(f)))
+}
+
+// roundInMode rounds f to an integer in the given rounding mode.
+func roundInMode(f float64, mode int32) float64 {
+	switch mode {
+	case feDownward:
+		return math.Floor(f)
+	case feUpward:
+		return math.Ceil(f)
+	case feTowardZero:
+		return math.Trunc(f)
+	}
+	return math.RoundToEven(f)
+}
+
+// Math functions that never round, and those with a pole where a finite
+// argument gives an infinite result.
+var (
+	exactMathFunctions = map[string]bool{
+		"fabs": true, "ceil": true, "floor": true, "trunc": true, "round": true, "nearbyint": true,
+		"logb": true, "copysign": true, "fmax": true, "fmin": true, "fmod": true, "remainder": true,
+		"nextafter": true, "nexttoward": true, "ldexp": true, "scalbn": true, "scalbln": true,
+		"frexp": true, "modf": true, "remquo": true,
+	}
+	poleMathFunctions = map[string]bool{
+		"log": true, "log2": true, "log10": true, "log1p": true, "logb": true, "atanh": true,
+		"lgamma": true, "tgamma": true, "pow": true,
+	}
+)
+
+// mathFunctionIn reports whether name, with its tgmath prefix or f/l suffix,
+// is one of set.
+func mathFunctionIn(set map[string]bool, name string) bool {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "__cvm_tgmath_"), "__builtin_")
+	if set[name] {
+		return true
+	}
+	if strings.HasSuffix(name, "f") || strings.HasSuffix(name, "l") {
+		return set[name[:len(name)-1]]
+	}
+	return false
+}
+
+// mathExceptions returns the flags a libm call raises for result z of type t.
+// Library functions may raise inexact spuriously, so any result that is not
+// an integer computed from integers counts as rounded; sqrt is checked
+// exactly.
+func mathExceptions(name string, t bytecode.ValueType, z float64, args ...float64) int32 {
+	anyNaN, allFinite := false, true
+	for _, a := range args {
+		anyNaN = anyNaN || math.IsNaN(a)
+		allFinite = allFinite && !math.IsNaN(a) && !math.IsInf(a, 0)
+	}
+	switch {
+	case math.IsNaN(z):
+		if !anyNaN {
+			return feInvalid
+		}
+		return 0
+	case math.IsInf(z, 0):
+		if !allFinite {
+			return 0
+		}
+		if mathFunctionIn(poleMathFunctions, name) {
+			return feDivByZero
+		}
+		return feOverflow | feInexact
+	case !allFinite || mathFunctionIn(exactMathFunctions, name):
+		return 0
+	}
+	if mathResultExact(name, z, args) {
+		return 0
+	}
+	if math.Abs(z) < minNormal(t) {
+		return feUnderflow | feInexact
+	}
+	return feInexact
+}
+
+func mathResultExact(name string, z float64, args []float64) bool {
+	if mathFunctionIn(map[string]bool{"sqrt": true}, name) && len(args) == 1 {
+		return math.FMA(z, z, -args[0]) == 0
+	}
+	if z != math.Trunc(z) {
+		return false
+	}
+	trivial := false
+	for _, a := range args {
+		if a != math.Trunc(a) {
+			return false
+		}
+		trivial = trivial || a == 0 || math.Abs(a) == 1 || a == 2
+	}
+	// Transcendental functions only reach zero exactly at trivial arguments;
+	// elsewhere a zero result has underflowed.
+	return z != 0 || trivial
+}
+
+func registerFenvExterns(r *ExternRegistry) {
+	r.Register("feclearexcept", fenvExceptExtern("feclearexcept", func(e *floatEnv, flags int32) int32 {
+		if e != nil {
+			e.except &^= flags
+		}
+		return 0
+	}))
+	r.Register("feraiseexcept", fenvExceptExtern("feraiseexcept", func(e *floatEnv, flags int32) int32 {
+		e.raise(flags)
+		return 0
+	}))
+	r.Register("fetestexcept", fenvExceptExtern("fetestexcept", func(e *floatEnv, flags int32) int32 {
+		if e == nil {
+			return 0
+		}
+		return e.except & flags & feAllExcept
+	}))
+	r.Register("fegetexceptflag", fenvExceptFlagExtern("fegetexceptflag", false))
+	r.Register("fesetexceptflag", fenvExceptFlagExtern("fesetexceptflag", true))
+	r.Register("fegetround", func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 0 {
+			return Value{}, nil, fmt.Errorf("fegetround expects 0 arguments")
+		}
+		return IntValue(bytecode.TypeI32, int64(ec.floatEnv().mode())), nil, nil
+	})
+	r.Register("fesetround", func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 || !isIntegerLike(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("fesetround expects 1 argument")
+		}
+		mode := int32(signedInt(args[0]))
+		e := ec.floatEnv()
+		if !validRoundingMode(mode) || e == nil {
+			return IntValue(bytecode.TypeI32, 1), nil, nil
+		}
+		e.round = mode
+		return IntValue(bytecode.TypeI32, 0), nil, nil
+	})
+	r.Register("fegetenv", fenvEnvExtern("fegetenv", func(e *floatEnv, mem *Memory, addr uint64) error {
+		return storeFloatEnv(mem, addr, *e)
+	}))
+	r.Register("feholdexcept", fenvEnvExtern("feholdexcept", func(e *floatEnv, mem *Memory, addr uint64) error {
+		if err := storeFloatEnv(mem, addr, *e); err != nil {
+			return err
+		}
+		e.except = 0
+		return nil
+	}))
+	r.Register("fesetenv", fenvEnvExtern("fesetenv", func(e *floatEnv, mem *Memory, addr uint64) error {
+		env, err := loadFloatEnv(mem, addr)
+		if err != nil {
+			return err
+		}
+		*e = env
+		return nil
+	}))
+	r.Register("feupdateenv", fenvEnvExtern("feupdateenv", func(e *floatEnv, mem *Memory, addr uint64) error {
+		env, err := loadFloatEnv(mem, addr)
+		if err != nil {
+			return err
+		}
+		raised := e.except
+		*e = env
+		e.raise(raised)
+		return nil
+	}))
+	r.Register("__cvm_isgreater", quietCompareExtern("__cvm_isgreater", func(x, y float64) bool { return x > y }))
+	r.Register("__cvm_isgreaterequal", quietCompareExtern("__cvm_isgreaterequal", func(x, y float64) bool { return x >= y }))
+	r.Register("__cvm_isless", quietCompareExtern("__cvm_isless", func(x, y float64) bool { return x < y }))
+	r.Register("__cvm_islessequal", quietCompareExtern("__cvm_islessequal", func(x, y float64) bool { return x <= y }))
+	r.Register("__cvm_islessgreater", quietCompareExtern("__cvm_islessgreater", func(x, y float64) bool { return x < y || x > y }))
+}
+
+// quietCompareExtern implements the <math.h> comparison macros. Each operand
+// is evaluated once, and a NaN makes the result false without raising
+// invalid, unlike the relational operators.
+func quietCompareExtern(name string, cmp func(x, y float64) bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 || !isFloatType(args[0].Type) || !isFloatType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects 2 floating arguments", name)
+		}
+		return IntValue(bytecode.TypeI32, boolInt(cmp(cvmFloat(args[0]), cvmFloat(args[1])))), nil, nil
+	}
+}
+
+func fenvExceptExtern(name string, fn func(*floatEnv, int32) int32) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 || !isIntegerLike(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects 1 argument", name)
+		}
+		return IntValue(bytecode.TypeI32, int64(fn(ec.floatEnv(), int32(signedInt(args[0]))))), nil, nil
+	}
+}
+
+// fenvExceptFlagExtern implements fegetexceptflag and fesetexceptflag; a
+// fexcept_t is an unsigned short holding flag bits.
+func fenvExceptFlagExtern(name string, set bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 || !isPointerType(args[0].Type) || !isIntegerLike(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects flag pointer and exception arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		e := ec.floatEnv()
+		mask := int32(signedInt(args[1])) & feAllExcept
+		if !set {
+			var flags int32
+			if e != nil {
+				flags = e.except & mask
+			}
+			if err := ec.Memory.Store(args[0].Int, bytecode.TypeU16, 2, UIntValue(bytecode.TypeU16, uint64(flags))); err != nil {
+				return Value{}, nil, err
+			}
+			return IntValue(bytecode.TypeI32, 0), nil, nil
+		}
+		v, err := ec.Memory.Load(args[0].Int, bytecode.TypeU16, 2)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if e != nil {
+			e.except = e.except&^mask | int32(v.Int)&mask
+		}
+		return IntValue(bytecode.TypeI32, 0), nil, nil
+	}
+}
+
+func fenvEnvExtern(name string, fn func(*floatEnv, *Memory, uint64) error) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 || !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects environment pointer", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		e := ec.floatEnv()
+		if e == nil {
+			return IntValue(bytecode.TypeI32, 1), nil, nil
+		}
+		if err := fn(e, ec.Memory, args[0].Int); err != nil {
+			return Value{}, nil, err
+		}
+		return IntValue(bytecode.TypeI32, 0), nil, nil
+	}
+}
+
+// A fenv_t is two unsigned ints: the raised exceptions, then the rounding
+// mode.
+func storeFloatEnv(mem *Memory, addr uint64, env floatEnv) error {
+	if err := mem.Store(addr, bytecode.TypeU32, 4, UIntValue(bytecode.TypeU32, uint64(uint32(env.except)))); err != nil {
+		return err
+	}
+	return mem.Store(addr+4, bytecode.TypeU32, 4, UIntValue(bytecode.TypeU32, uint64(uint32(env.round))))
+}
+
+func loadFloatEnv(mem *Memory, addr uint64) (floatEnv, error) {
+	except, err := mem.Load(addr, bytecode.TypeU32, 4)
+	if err != nil {
+		return floatEnv{}, err
+	}
+	round, err := mem.Load(addr+4, bytecode.TypeU32, 4)
+	if err != nil {
+		return floatEnv{}, err
+	}
+	env := floatEnv{except: int32(except.Int) & feAllExcept, round: int32(round.Int)}
+	if !validRoundingMode(env.round) {
+		env.round = feToNearest
+	}
+	return env, nil
+}
@@ -0,0 +1,405 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileSystem is where fopen, freopen, remove, rename and tmpfile look for
+// files that are not already held in the registry's memory. Names are guest
+// paths as the program spelled them; implementations decide how they map to
+// storage. Contents written by the program are handed back with WriteFile
+// when a stream is opened for writing, flushed, closed, or left open at exit.
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+}
+
+var (
+	errReadOnlyFileSystem = errors.New("read-only file system")
+	errCrossDevice        = errors.New("cross-device link")
+)
+
+// guestRelPath cleans name against the guest root and returns it relative to
+// that root, so ".." can never climb above it.
+func guestRelPath(name string) string {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "."
+	}
+	return clean[1:]
+}
+
+type fsFileSystem struct {
+	fsys fs.FS
+}
+
+// NewFSFileSystem exposes fsys to the program read-only.
+func NewFSFileSystem(fsys fs.FS) FileSystem {
+	return fsFileSystem{fsys: fsys}
+}
+
+func (f fsFileSystem) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(f.fsys, guestRelPath(name))
+}
+
+func (f fsFileSystem) WriteFile(name string, data []byte) error {
+	return &fs.PathError{Op: "write", Path: name, Err: errReadOnlyFileSystem}
+}
+
+func (f fsFileSystem) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: errReadOnlyFileSystem}
+}
+
+func (f fsFileSystem) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errReadOnlyFileSystem}
+}
+
+type dirFileSystem struct {
+	dir      string
+	fsys     fs.FS
+	readOnly bool
+}
+
+// NewDirFileSystem returns a FileSystem rooted at the host directory dir.
+// Reads go through os.DirFS. Guest paths are confined to dir: they are
+// cleaned before use, and symlinks that lead outside dir are refused.
+func NewDirFileSystem(dir string, readOnly bool) FileSystem {
+	dir = filepath.Clean(dir)
+	return &dirFileSystem{dir: dir, fsys: os.DirFS(dir), readOnly: readOnly}
+}
+
+// hostPath maps name into the directory, checking that the nearest existing
+// ancestor still resolves inside it. A dangling symlink on the way is
+// refused, since writing through it would create its target wherever it
+// points.
+func (d *dirFileSystem) hostPath(op, name string) (string, string, error) {
+	rel := guestRelPath(name)
+	if rel == "." {
+		return "", "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := filepath.EvalSymlinks(d.dir)
+	if err != nil {
+		return "", "", err
+	}
+	host := filepath.Join(d.dir, filepath.FromSlash(rel))
+	for probe := host; ; probe = filepath.Dir(probe) {
+		resolved, err := filepath.EvalSymlinks(probe)
+		if err == nil {
+			if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+				return "", "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+			}
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) || probe == d.dir {
+			return "", "", err
+		}
+		if info, err := os.Lstat(probe); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return "", "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+		}
+	}
+	return host, rel, nil
+}
+
+func (d *dirFileSystem) ReadFile(name string) ([]byte, error) {
+	_, rel, err := d.hostPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(d.fsys, rel)
+}
+
+func (d *dirFileSystem) WriteFile(name string, data []byte) error {
+	if d.readOnly {
+		return &fs.PathError{Op: "write", Path: name, Err: errReadOnlyFileSystem}
+	}
+	host, _, err := d.hostPath("write", name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(host, data, 0o666)
+}
+
+func (d *dirFileSystem) Remove(name string) error {
+	if d.readOnly {
+		return &fs.PathError{Op: "remove", Path: name, Err: errReadOnlyFileSystem}
+	}
+	host, _, err := d.hostPath("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(host)
+}
+
+func (d *dirFileSystem) Rename(oldname, newname string) error {
+	if d.readOnly {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errReadOnlyFileSystem}
+	}
+	oldHost, _, err := d.hostPath("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newHost, _, err := d.hostPath("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldHost, newHost)
+}
+
+// MountFileSystem joins several file systems under guest directories. A path
+// belongs to the mount with the longest matching directory; paths outside
+// every mount do not exist.
+type MountFileSystem struct {
+	mounts []fileSystemMount
+}
+
+type fileSystemMount struct {
+	dir  string
+	fsys FileSystem
+}
+
+// Mount makes fsys visible at guestDir, replacing any earlier mount there.
+func (m *MountFileSystem) Mount(guestDir string, fsys FileSystem) {
+	dir := path.Clean("/" + guestDir)
+	for i := range m.mounts {
+		if m.mounts[i].dir == dir {
+			m.mounts[i].fsys = fsys
+			return
+		}
+	}
+	m.mounts = append(m.mounts, fileSystemMount{dir: dir, fsys: fsys})
+	sort.SliceStable(m.mounts, func(i, j int) bool { return len(m.mounts[i].dir) > len(m.mounts[j].dir) })
+}
+
+func (m *MountFileSystem) resolve(op, name string) (*fileSystemMount, string, error) {
+	clean := path.Clean("/" + name)
+	for i := range m.mounts {
+		mnt := &m.mounts[i]
+		if mnt.dir == "/" {
+			return mnt, clean, nil
+		}
+		if rest, ok := strings.CutPrefix(clean, mnt.dir); ok && (rest == "" || rest[0] == '/') {
+			return mnt, rest, nil
+		}
+	}
+	return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MountFileSystem) ReadFile(name string) ([]byte, error) {
+	mnt, rel, err := m.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return mnt.fsys.ReadFile(rel)
+}
+
+func (m *MountFileSystem) WriteFile(name string, data []byte) error {
+	mnt, rel, err := m.resolve("write", name)
+	if err != nil {
+		return err
+	}
+	return mnt.fsys.WriteFile(rel, data)
+}
+
+func (m *MountFileSystem) Remove(name string) error {
+	mnt, rel, err := m.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	return mnt.fsys.Remove(rel)
+}
+
+func (m *MountFileSystem) Rename(oldname, newname string) error {
+	oldMount, oldRel, err := m.resolve("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newMount, newRel, err := m.resolve("rename", newname)
+	if err != nil {
+		return err
+	}
+	if oldMount != newMount {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errCrossDevice}
+	}
+	return oldMount.fsys.Rename(oldRel, newRel)
+}
+
+// fileErrno maps a FileSystem error to the errno the C library would report.
+func fileErrno(err error) int32 {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return 2
+	case errors.Is(err, errReadOnlyFileSystem):
+		return 30
+	case errors.Is(err, errCrossDevice):
+		return 18
+	case errors.Is(err, fs.ErrPermission):
+		return 13
+	case errors.Is(err, fs.ErrInvalid):
+		return 22
+	}
+	return 5
+}
+
+// SetFileSystem routes file streams through fsys. Files added with AddFile
+// and files the program has written stay visible in memory on top of it.
+func (r *ExternRegistry) SetFileSystem(fsys FileSystem) {
+	if r == nil {
+		return
+	}
+	r.fileSystem = fsys
+}
+
+// readFile returns the contents of path, preferring the copy in memory.
+func (r *ExternRegistry) readFile(path string) ([]byte, error) {
+	if data, ok := r.files[path]; ok {
+		return data, nil
+	}
+	if r.fileSystem == nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	return r.fileSystem.ReadFile(path)
+}
+
+// storeFile records the contents of an open file in memory and hands them to
+// the file system.
+func (r *ExternRegistry) storeFile(file *hostFile) error {
+	if file == nil || !file.writable || file.path == "" {
+		return nil
+	}
+	r.files[file.path] = append([]byte(nil), file.data...)
+	if r.fileSystem == nil {
+		return nil
+	}
+	return r.fileSystem.WriteFile(file.path, file.data)
+}
+
+// discardFile drops a tmpfile once its stream is gone.
+func (r *ExternRegistry) discardFile(file *hostFile) {
+	if file == nil || !file.temporary {
+		return
+	}
+	delete(r.files, file.path)
+	if r.fileSystem != nil {
+		_ = r.fileSystem.Remove(file.path)
+	}
+}
+
+// closeFiles flushes every file still open when the program exits, in the
+// order the streams were opened, and removes tmpfiles.
+func (r *ExternRegistry) closeFiles() error {
+	if r == nil || len(r.hostFiles) == 0 {
+		return nil
+	}
+	addrs := make([]uint64, 0, len(r.hostFiles))
+	for addr := range r.hostFiles {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	var firstErr error
+	for _, addr := range addrs {
+		file := r.hostFiles[addr]
+		if file.temporary {
+			r.discardFile(file)
+			continue
+		}
+		if err := r.storeFile(file); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("flush %s: %w", file.path, err)
+		}
+	}
+	return firstErr
+}
+
+// removeFile deletes path from memory and from the file system. A file that
+// only ever lived in memory is removed even though the file system lacks it.
+func (r *ExternRegistry) removeFile(path string) error {
+	_, inMemory := r.files[path]
+	if r.fileSystem != nil {
+		if err := r.fileSystem.Remove(path); err != nil && !(inMemory && errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+	} else if !inMemory {
+		return &fs.PathError{Op: "remove", Path: path, Err: fs.ErrNotExist}
+	}
+	delete(r.files, path)
+	return nil
+}
+
+// renameFile moves oldPath to newPath in memory and in the file system.
+func (r *ExternRegistry) renameFile(oldPath, newPath string) error {
+	data, inMemory := r.files[oldPath]
+	if r.fileSystem != nil {
+		if err := r.fileSystem.Rename(oldPath, newPath); err != nil && !(inMemory && errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+	} else if !inMemory {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	delete(r.files, newPath)
+	if inMemory {
+		r.files[newPath] = data
+		delete(r.files, oldPath)
+	}
+	return nil
+}
+
+// openFile prepares the state of a stream opening path with an fopen mode
+// the caller has checked. Modes that write create or truncate the file in the
+// file system straight away, so a refused write fails the open.
+func (r *ExternRegistry) openFile(path, mode string) (*hostFile, error) {
+	file := &hostFile{
+		path:       path,
+		readable:   strings.HasPrefix(mode, "r") || strings.Contains(mode, "+"),
+		writable:   strings.HasPrefix(mode, "w") || strings.HasPrefix(mode, "a") || strings.Contains(mode, "+"),
+		appendMode: strings.HasPrefix(mode, "a"),
+		updateMode: strings.Contains(mode, "+"),
+	}
+	if !strings.HasPrefix(mode, "w") {
+		data, err := r.readFile(path)
+		if err != nil && (strings.HasPrefix(mode, "r") || !errors.Is(err, fs.ErrNotExist)) {
+			return nil, err
+		}
+		file.data = append([]byte(nil), data...)
+	}
+	if file.appendMode {
+		file.pos = int64(len(file.data))
+	}
+	if err := r.storeFile(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// tempFile returns the state of a new tmpfile stream. It lives in the file
+// system under a tmpnam name when the file system accepts one, and in memory
+// otherwise.
+func (r *ExternRegistry) tempFile() *hostFile {
+	file := &hostFile{readable: true, writable: true, updateMode: true}
+	if r.fileSystem == nil {
+		return file
+	}
+	// Give up after TMP_MAX names, like tmpnam.
+	for i := 0; i < 25; i++ {
+		path := fmt.Sprintf("/tmp/cvm-tmp-%d", r.tmpnamCounter)
+		r.tmpnamCounter++
+		_, err := r.readFile(path)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) || r.fileSystem.WriteFile(path, nil) != nil {
+			return file
+		}
+		file.path = path
+		file.temporary = true
+		return file
+	}
+	return file
+}
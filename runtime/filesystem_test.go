@@ -0,0 +1,121 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"shinya.click/cvm/sema"
+)
+
+func TestMountFileSystemJailsGuestPaths(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Skipf("symlink: %v", err)
+	}
+	var m MountFileSystem
+	m.Mount("/work", NewDirFileSystem(dir, false))
+	m.Mount("/assets", NewFSFileSystem(fstest.MapFS{"logo.txt": {Data: []byte("cvm")}}))
+
+	if err := m.WriteFile("/work/../work/a.txt", []byte("A")); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(got) != "A" {
+		t.Fatalf("host a.txt = %q, %v", got, err)
+	}
+	if got, err := m.ReadFile("/assets/logo.txt"); err != nil || string(got) != "cvm" {
+		t.Fatalf("ReadFile logo = %q, %v", got, err)
+	}
+	if _, err := m.ReadFile("/work/escape/secret.txt"); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("ReadFile through symlink err = %v, want permission error", err)
+	}
+	if err := m.WriteFile("/work/escape/new.txt", nil); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("WriteFile through symlink err = %v, want permission error", err)
+	}
+	if _, err := m.ReadFile("/etc/passwd"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("ReadFile outside mounts err = %v, want not exist", err)
+	}
+	if err := m.WriteFile("/assets/logo.txt", nil); fileErrno(err) != 30 {
+		t.Fatalf("WriteFile read-only err = %v, want EROFS", err)
+	}
+	if err := m.Rename("/work/a.txt", "/assets/a.txt"); fileErrno(err) != 18 {
+		t.Fatalf("Rename across mounts err = %v, want EXDEV", err)
+	}
+}
+
+func TestDirFileSystemRefusesDanglingSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	target := filepath.Join(outside, "pwned")
+	if err := os.Symlink(target, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("symlink: %v", err)
+	}
+	fsys := NewDirFileSystem(dir, false)
+	if err := fsys.WriteFile("link", []byte("x")); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("WriteFile through dangling symlink err = %v, want permission error", err)
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Fatalf("write escaped the directory: %v", err)
+	}
+	if err := fsys.Rename("link", "moved"); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("Rename of dangling symlink err = %v, want permission error", err)
+	}
+	if err := fsys.WriteFile("fresh.txt", []byte("ok")); err != nil {
+		t.Fatalf("WriteFile of a new file: %v", err)
+	}
+}
+
+func TestCompileAndRunFileStreamsThroughFileSystem(t *testing.T) {
+	dir := t.TempDir()
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "in.txt"), []byte("abc"), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	mod := compileModule(t, `#include <stdio.h>
+int main(void) {
+	char buf[8];
+	FILE *in = fopen("in.txt", "r");
+	if (!in || !fgets(buf, sizeof buf, in)) return 1;
+	fclose(in);
+	FILE *t = tmpfile();
+	fputs(buf, t);
+	fflush(t);
+	rewind(t);
+	if (fgetc(t) != 'a') return 2;
+	FILE *out = fopen("/copy.txt", "a");
+	fputs(buf, out);
+	fflush(out);
+	fputs("!", out);
+	return fopen("memory.txt", "r") ? 0 : 3;
+}`, sema.SemaOptions{})
+	var stdout bytes.Buffer
+	reg := DefaultExternRegistry(&stdout, nil)
+	reg.AddFile("memory.txt", []byte("kept in memory"))
+	var m MountFileSystem
+	m.Mount("/", NewDirFileSystem(dir, false))
+	m.Mount("/tmp", NewDirFileSystem(tmp, false))
+	reg.SetFileSystem(&m)
+	p, err := LoadModule(mod, LoadOptions{Externs: reg})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	st, err := Run(context.Background(), p, RunOptions{})
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %#v, %v", st, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "copy.txt")); err != nil || string(got) != "abc!" {
+		t.Fatalf("copy.txt = %q, %v; want %q", got, err, "abc!")
+	}
+	if entries, err := os.ReadDir(tmp); err != nil || len(entries) != 0 {
+		t.Fatalf("tmpfile left %d entries in %s: %v", len(entries), tmp, err)
+	}
+}
@@ -640,6 +640,36 @@ func TestGCCExecutionFixtures(t *testing.T) {
 	}
 }
 
+func TestGCCExecutionFixturesMatchAtO1(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "gcc-exec", "manifest.tsv"))
+	if err != nil {
+		t.Fatalf("read GCC execution manifest: %v", err)
+	}
+	for _, c := range parseGCCExecManifest(t, string(content)) {
+		c := c
+		t.Run(filepath.Base(c.path), func(t *testing.T) {
+			sourcePath := filepath.Join("..", c.path)
+			source, err := os.ReadFile(sourcePath)
+			if err != nil {
+				t.Fatalf("read fixture %s: %v", c.path, err)
+			}
+			// Trap messages carry pcs, which differ between levels, so only
+			// whether the run trapped is compared.
+			run := func(level int) (ExitStatus, bool, string) {
+				var stdout, stderr bytes.Buffer
+				reg := DefaultExternRegistryWithIO(strings.NewReader(""), &stdout, &stderr)
+				st, err := tryGCCExecFixture(t, sourcePath, string(source), gccExecStepLimit, LoadOptions{Externs: reg}, codegen.Options{OptLevel: level})
+				return st, err != nil, stdout.String() + stderr.String()
+			}
+			base, baseTrap, baseOut := run(0)
+			opt, optTrap, optOut := run(1)
+			if opt.Code != base.Code || optTrap != baseTrap || optOut != baseOut {
+				t.Fatalf("-O1 exit %d trap %v output %q, -O0 exit %d trap %v output %q", opt.Code, optTrap, optOut, base.Code, baseTrap, baseOut)
+			}
+		})
+	}
+}
+
 func TestGCCC90DeclarationAfterStatementExecutesThroughRuntime(t *testing.T) {
 	st := runGCCAcceptFixture(t, "sema/testdata/gcc-c90-as-c99/accept/Wdeclaration-after-statement-4.c")
 	if st.Code != 0 {
@@ -8100,6 +8130,22 @@ func runGCCExecFixtureWithStepLimit(t *testing.T, path, source string, stepLimit
 }
 
 func runGCCExecFixtureWithLoadOptions(t *testing.T, path, source string, stepLimit int, loadOpts LoadOptions) ExitStatus {
+	t.Helper()
+	return runGCCExecFixtureWithCodegenOptions(t, path, source, stepLimit, loadOpts, codegen.Options{})
+}
+
+func runGCCExecFixtureWithCodegenOptions(t *testing.T, path, source string, stepLimit int, loadOpts LoadOptions, genOpts codegen.Options) ExitStatus {
+	t.Helper()
+	st, err := tryGCCExecFixture(t, path, source, stepLimit, loadOpts, genOpts)
+	if err != nil {
+		t.Fatalf("%s Run: %v", path, err)
+	}
+	return st
+}
+
+// tryGCCExecFixture compiles and runs a fixture, failing the test for
+// compile and load errors but returning run-time traps to the caller.
+func tryGCCExecFixture(t *testing.T, path, source string, stepLimit int, loadOpts LoadOptions, genOpts codegen.Options) (ExitStatus, error) {
 	t.Helper()
 	src := stripGCCDirectives(source)
 	pp, err := preprocessor.PreprocessSource(path, src, preprocessor.Options{})
@@ -8117,7 +8163,7 @@ func runGCCExecFixtureWithLoadOptions(t *testing.T, path, source string, stepLim
 	if err != nil {
 		t.Fatalf("%s sema: %v", path, err)
 	}
-	mod, err := codegen.Generate(prog)
+	mod, err := codegen.GenerateWithOptions(prog, genOpts)
 	if err != nil {
 		t.Fatalf("%s codegen: %v", path, err)
 	}
@@ -8129,11 +8175,7 @@ func runGCCExecFixtureWithLoadOptions(t *testing.T, path, source string, stepLim
 	if err != nil {
 		t.Fatalf("%s Load: %v", path, err)
 	}
-	st, err := Run(context.Background(), p, RunOptions{StepLimit: stepLimit})
-	if err != nil {
-		t.Fatalf("%s Run: %v", path, err)
-	}
-	return st
+	return Run(context.Background(), p, RunOptions{StepLimit: stepLimit})
 }
 
 func runGCCAcceptFixture(t *testing.T, path string) ExitStatus {
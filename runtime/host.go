@@ -0,0 +1,438 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// Ptr is a guest address passed to or returned from a host function as is.
+type Ptr uint64
+
+// CString is a guest char pointer. As a parameter it is read up to the NUL
+// terminator; as a result it is copied into a fresh allocation that the guest
+// owns and may free.
+type CString string
+
+var (
+	contextType       = reflect.TypeOf((*context.Context)(nil)).Elem()
+	externContextType = reflect.TypeOf((*ExternContext)(nil))
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+	ptrType           = reflect.TypeOf(Ptr(0))
+	cstringType       = reflect.TypeOf(CString(""))
+)
+
+type hostParamKind int
+
+const (
+	hostScalar hostParamKind = iota
+	hostCString
+	hostScalarRef
+	hostStructRef
+)
+
+type hostParam struct {
+	kind hostParamKind
+	typ  reflect.Type
+	vt   bytecode.ValueType
+}
+
+// RegisterFunc binds a typed Go function as the extern name. See BindFunc for
+// the accepted function shapes.
+func (r *ExternRegistry) RegisterFunc(name string, fn any) error {
+	ext, err := BindFunc(fn)
+	if err != nil {
+		return fmt.Errorf("register %s: %w", name, err)
+	}
+	r.Register(name, ext)
+	return nil
+}
+
+// BindFunc wraps a Go function as an ExternFunc. The function may take a
+// leading context.Context and *ExternContext, followed by one parameter per C
+// argument, and may return one C result and a trailing error.
+//
+// C scalars map to the fixed-width Go types (int8..uint64, float32, float64,
+// bool), pointers to Ptr and strings to CString. A *T parameter, where T is
+// one of those scalars or a struct of them, is loaded from guest memory before
+// the call and stored back afterwards; NULL arrives as nil. Struct fields are
+// matched to a bytecode.ObjectLayout of the running module by name, using the
+// `cvm:"name"` tag when present and a case-insensitive match otherwise.
+func BindFunc(fn any) (ExternFunc, error) {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || fv.IsNil() {
+		return nil, fmt.Errorf("host function must be a non-nil func, got %T", fn)
+	}
+	if ft.IsVariadic() {
+		return nil, fmt.Errorf("variadic host functions are not supported")
+	}
+	first := 0
+	wantCtx := first < ft.NumIn() && ft.In(first) == contextType
+	if wantCtx {
+		first++
+	}
+	wantExternCtx := first < ft.NumIn() && ft.In(first) == externContextType
+	if wantExternCtx {
+		first++
+	}
+	params := make([]hostParam, 0, ft.NumIn()-first)
+	for i := first; i < ft.NumIn(); i++ {
+		p, err := bindHostParam(ft.In(i))
+		if err != nil {
+			return nil, fmt.Errorf("parameter %d: %w", i-first, err)
+		}
+		params = append(params, p)
+	}
+
+	results := ft.NumOut()
+	wantErr := results > 0 && ft.Out(results-1) == errorType
+	if wantErr {
+		results--
+	}
+	if results > 1 {
+		return nil, fmt.Errorf("host function returns %d values, want at most one result and an error", results)
+	}
+	var ret *hostParam
+	if results == 1 {
+		out := ft.Out(0)
+		vt, ok := hostValueType(out)
+		if out == cstringType {
+			vt, ok = bytecode.TypePtr, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unsupported result type %s", out)
+		}
+		ret = &hostParam{typ: out, vt: vt}
+	}
+
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != len(params) {
+			return Value{}, nil, fmt.Errorf("expects %d arguments, got %d", len(params), len(args))
+		}
+		in := make([]reflect.Value, 0, ft.NumIn())
+		if wantCtx {
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			in = append(in, reflect.ValueOf(ctx))
+		}
+		if wantExternCtx {
+			in = append(in, reflect.ValueOf(ec))
+		}
+		for i, p := range params {
+			v, err := p.decode(ec, args[i])
+			if err != nil {
+				return Value{}, nil, fmt.Errorf("argument %d: %w", i, err)
+			}
+			in = append(in, v)
+		}
+		out := fv.Call(in)
+		if wantErr {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return Value{}, nil, err
+			}
+		}
+		for i, p := range params {
+			if err := p.writeBack(ec, args[i], in[len(in)-len(params)+i]); err != nil {
+				return Value{}, nil, fmt.Errorf("argument %d: %w", i, err)
+			}
+		}
+		if ret == nil {
+			return Value{}, nil, nil
+		}
+		if ret.typ == cstringType {
+			addr, err := ec.allocCString(string(out[0].Interface().(CString)))
+			if err != nil {
+				return Value{}, nil, err
+			}
+			return PtrValue(addr), nil, nil
+		}
+		return hostToValue(out[0], ret.vt), nil, nil
+	}, nil
+}
+
+func bindHostParam(t reflect.Type) (hostParam, error) {
+	if t == cstringType {
+		return hostParam{kind: hostCString, typ: t, vt: bytecode.TypePtr}, nil
+	}
+	if vt, ok := hostValueType(t); ok {
+		return hostParam{kind: hostScalar, typ: t, vt: vt}, nil
+	}
+	if t.Kind() == reflect.Pointer {
+		if vt, ok := hostValueType(t.Elem()); ok {
+			return hostParam{kind: hostScalarRef, typ: t, vt: vt}, nil
+		}
+		if t.Elem().Kind() == reflect.Struct {
+			if _, err := hostStructFields(t.Elem()); err != nil {
+				return hostParam{}, err
+			}
+			return hostParam{kind: hostStructRef, typ: t, vt: bytecode.TypePtr}, nil
+		}
+	}
+	return hostParam{}, fmt.Errorf("unsupported parameter type %s", t)
+}
+
+// hostValueType maps a Go scalar type to the VM value type carrying it.
+// Platform-sized int and uint are rejected so the C type is never ambiguous.
+func hostValueType(t reflect.Type) (bytecode.ValueType, bool) {
+	if t == ptrType {
+		return bytecode.TypePtr, true
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return bytecode.TypeBool, true
+	case reflect.Int8:
+		return bytecode.TypeI8, true
+	case reflect.Uint8:
+		return bytecode.TypeU8, true
+	case reflect.Int16:
+		return bytecode.TypeI16, true
+	case reflect.Uint16:
+		return bytecode.TypeU16, true
+	case reflect.Int32:
+		return bytecode.TypeI32, true
+	case reflect.Uint32:
+		return bytecode.TypeU32, true
+	case reflect.Int64:
+		return bytecode.TypeI64, true
+	case reflect.Uint64:
+		return bytecode.TypeU64, true
+	case reflect.Float32:
+		return bytecode.TypeF32, true
+	case reflect.Float64:
+		return bytecode.TypeF64, true
+	}
+	return 0, false
+}
+
+func (p hostParam) decode(ec *ExternContext, v Value) (reflect.Value, error) {
+	if p.kind == hostScalar {
+		if v.Type != p.vt && !(isPointerType(p.vt) && isPointerType(v.Type)) {
+			return reflect.Value{}, fmt.Errorf("got %s, want %s", v.Type, p.vt)
+		}
+		return hostFromValue(v, p.typ), nil
+	}
+	if !isPointerType(v.Type) {
+		return reflect.Value{}, fmt.Errorf("got %s, want pointer", v.Type)
+	}
+	if ec == nil || ec.Memory == nil {
+		return reflect.Value{}, fmt.Errorf("requires memory")
+	}
+	switch p.kind {
+	case hostCString:
+		if v.Int == 0 {
+			return reflect.Value{}, fmt.Errorf("NULL string")
+		}
+		s, err := ec.Memory.ReadCString(v.Int)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(CString(s)), nil
+	case hostScalarRef:
+		if v.Int == 0 {
+			return reflect.Zero(p.typ), nil
+		}
+		loaded, err := ec.Memory.Load(v.Int, p.vt, 1)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ref := reflect.New(p.typ.Elem())
+		ref.Elem().Set(hostFromValue(loaded, p.typ.Elem()))
+		return ref, nil
+	default:
+		if v.Int == 0 {
+			return reflect.Zero(p.typ), nil
+		}
+		ref := reflect.New(p.typ.Elem())
+		if err := ec.ReadStruct(v.Int, ref.Interface()); err != nil {
+			return reflect.Value{}, err
+		}
+		return ref, nil
+	}
+}
+
+// writeBack stores the pointee of a reference parameter into guest memory so
+// that host functions can fill in out-parameters.
+func (p hostParam) writeBack(ec *ExternContext, v Value, arg reflect.Value) error {
+	if v.Int == 0 || arg.Kind() != reflect.Pointer || arg.IsNil() {
+		return nil
+	}
+	switch p.kind {
+	case hostScalarRef:
+		return ec.Memory.Store(v.Int, p.vt, 1, hostToValue(arg.Elem(), p.vt))
+	case hostStructRef:
+		return ec.WriteStruct(v.Int, arg.Interface())
+	}
+	return nil
+}
+
+func hostFromValue(v Value, t reflect.Type) reflect.Value {
+	out := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		out.SetBool(v.Int != 0)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		out.SetInt(signedInt(v))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		out.SetUint(v.Int)
+	case reflect.Float32, reflect.Float64:
+		out.SetFloat(v.Float)
+	}
+	return out
+}
+
+func hostToValue(v reflect.Value, vt bytecode.ValueType) Value {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return UIntValue(vt, 1)
+		}
+		return UIntValue(vt, 0)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return UIntValue(vt, maskToWidth(uint64(v.Int()), bitWidth(vt)))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return UIntValue(vt, v.Uint())
+	case reflect.Float32:
+		return FloatValue(vt, float64(float32(v.Float())))
+	default:
+		return FloatValue(vt, v.Float())
+	}
+}
+
+type hostStructField struct {
+	index  int
+	name   string
+	tagged bool
+	vt     bytecode.ValueType
+}
+
+func (f hostStructField) matches(lf bytecode.FieldLayout) bool {
+	if lf.Type != f.vt {
+		return false
+	}
+	if f.tagged {
+		return lf.Name == f.name
+	}
+	return strings.EqualFold(lf.Name, f.name)
+}
+
+func hostStructFields(t reflect.Type) ([]hostStructField, error) {
+	var fields []hostStructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, tagged := f.Tag.Lookup("cvm")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if !tagged || name == "" {
+			name, tagged = f.Name, false
+		}
+		vt, ok := hostValueType(f.Type)
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %s for field %s.%s", f.Type, t.Name(), f.Name)
+		}
+		fields = append(fields, hostStructField{index: i, name: name, tagged: tagged, vt: vt})
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("struct %s has no exported fields", t)
+	}
+	return fields, nil
+}
+
+// structLayout finds the module layout describing t. Every Go field must name
+// a layout field of the same value type; layouts that match but disagree on
+// offsets make the binding ambiguous.
+func (ec *ExternContext) structLayout(t reflect.Type) ([]hostStructField, []int64, error) {
+	fields, err := hostStructFields(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	var offsets []int64
+	for _, layout := range ec.Layouts {
+		candidate := make([]int64, len(fields))
+		matched := true
+		for i, f := range fields {
+			found := false
+			for _, lf := range layout.Fields {
+				if f.matches(lf) {
+					candidate[i], found = lf.Offset, true
+					break
+				}
+			}
+			if !found {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if offsets != nil && !reflect.DeepEqual(offsets, candidate) {
+			return nil, nil, fmt.Errorf("struct %s matches several layouts", t)
+		}
+		offsets = candidate
+	}
+	if offsets == nil {
+		return nil, nil, fmt.Errorf("no layout in the module matches struct %s", t)
+	}
+	return fields, offsets, nil
+}
+
+// ReadStruct loads the guest struct at addr into the Go struct dst points to.
+func (ec *ExternContext) ReadStruct(addr uint64, dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("ReadStruct needs a non-nil struct pointer, got %T", dst)
+	}
+	fields, offsets, err := ec.structLayout(rv.Elem().Type())
+	if err != nil {
+		return err
+	}
+	for i, f := range fields {
+		v, err := ec.Memory.Load(addr+uint64(offsets[i]), f.vt, 1)
+		if err != nil {
+			return err
+		}
+		field := rv.Elem().Field(f.index)
+		field.Set(hostFromValue(v, field.Type()))
+	}
+	return nil
+}
+
+// WriteStruct stores the Go struct src, or the struct it points to, into the
+// guest struct at addr. Fields without a Go counterpart are left untouched.
+func (ec *ExternContext) WriteStruct(addr uint64, src any) error {
+	rv := reflect.Indirect(reflect.ValueOf(src))
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("WriteStruct needs a struct, got %T", src)
+	}
+	fields, offsets, err := ec.structLayout(rv.Type())
+	if err != nil {
+		return err
+	}
+	for i, f := range fields {
+		if err := ec.Memory.Store(addr+uint64(offsets[i]), f.vt, 1, hostToValue(rv.Field(f.index), f.vt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ec *ExternContext) allocCString(s string) (uint64, error) {
+	if ec == nil || ec.Memory == nil {
+		return 0, fmt.Errorf("requires memory")
+	}
+	data := append([]byte(s), 0)
+	addr, err := ec.Memory.TryAlloc("extern:host-string", int64(len(data)), 1, false, blockGlobal)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeMemoryBytes(ec.Memory, addr, data); err != nil {
+		return 0, err
+	}
+	return addr, nil
+}
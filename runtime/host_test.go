@@ -0,0 +1,148 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"shinya.click/cvm/bytecode"
+	"shinya.click/cvm/sema"
+)
+
+type hostPoint struct {
+	X     int32
+	Y     float64
+	Label Ptr `cvm:"name"`
+	cache int
+}
+
+func TestRegisterFuncMarshalsScalarsStringsAndStructs(t *testing.T) {
+	mod := compileModule(t, `#include <stdio.h>
+#include <stdlib.h>
+struct point { int x; double y; const char *name; };
+long add(int a, long b);
+char *greet(const char *name);
+void scale(struct point *p, int k);
+int divmod(int a, int b, int *rem);
+int main(void) {
+	struct point p = { 2, 1.5, "p" };
+	int rem = 0;
+	char *s = greet("cvm");
+	scale(&p, 3);
+	printf("%ld %s %d %.1f %d %d\n", add(40, 2), s, p.x, p.y, divmod(17, 5, &rem), rem);
+	free(s);
+	return divmod(1, 0, 0);
+}`, sema.SemaOptions{})
+	var stdout bytes.Buffer
+	reg := DefaultExternRegistry(&stdout, nil)
+	var label uint64
+	for name, fn := range map[string]any{
+		"add": func(a int32, b int64) int64 { return int64(a) + b },
+		"greet": func(ctx context.Context, ec *ExternContext, name CString) CString {
+			return "hello, " + name
+		},
+		"scale": func(p *hostPoint, k int32) {
+			p.X *= k
+			p.Y *= float64(k)
+			label = uint64(p.Label)
+		},
+		"divmod": func(a, b int32, rem *int32) (int32, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			if rem != nil {
+				*rem = a % b
+			}
+			return a / b, nil
+		},
+	} {
+		if err := reg.RegisterFunc(name, fn); err != nil {
+			t.Fatalf("RegisterFunc(%s): %v", name, err)
+		}
+	}
+	p, err := LoadModule(mod, LoadOptions{Externs: reg})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	_, err = Run(context.Background(), p, RunOptions{})
+	var trap *TrapError
+	if !errors.As(err, &trap) || !strings.Contains(err.Error(), "extern divmod failed") || !strings.Contains(err.Error(), "division by zero") {
+		t.Fatalf("Run error = %v, want divmod trap", err)
+	}
+	if got, want := stdout.String(), "42 hello, cvm 6 4.5 3 2\n"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+	if s, err := p.Memory().ReadCString(label); err != nil || s != "p" {
+		t.Fatalf("struct pointer field = %q, %v; want \"p\"", s, err)
+	}
+}
+
+func TestBindFuncRejectsUnsupportedSignatures(t *testing.T) {
+	for _, fn := range []any{
+		42,
+		func(int) {},
+		func(string) {},
+		func() (int32, int32) { return 0, 0 },
+		func(*struct{ X []byte }) {},
+		func(...int32) {},
+	} {
+		if _, err := BindFunc(fn); err == nil {
+			t.Fatalf("BindFunc(%T) succeeded, want error", fn)
+		}
+	}
+}
+
+func TestBindFuncChecksArgumentTypes(t *testing.T) {
+	fn, err := BindFunc(func(a int32) int32 { return a })
+	if err != nil {
+		t.Fatalf("BindFunc: %v", err)
+	}
+	if _, _, err := fn(context.Background(), nil, []Value{IntValue(bytecode.TypeI64, 1)}); err == nil {
+		t.Fatalf("call with i64 argument succeeded, want type error")
+	}
+	if _, _, err := fn(context.Background(), nil, nil); err == nil {
+		t.Fatalf("call with no arguments succeeded, want arity error")
+	}
+}
+
+func TestExternContextCallFunctionReentersVM(t *testing.T) {
+	mod := compileModule(t, `int fold(int (*fn)(int, int), int n);
+static int steps;
+static int add(int acc, int i) { steps++; return acc + i; }
+int main(void) {
+	return fold(add, 4) == 10 && steps == 4 ? 0 : 1;
+}`, sema.SemaOptions{})
+	reg := DefaultExternRegistry(nil, nil)
+	err := reg.RegisterFunc("fold", func(ctx context.Context, ec *ExternContext, fn Ptr, n int32) (int32, error) {
+		acc := int32(0)
+		for i := int32(1); i <= n; i++ {
+			r, err := ec.CallFunction(ctx, uint64(fn), IntValue(bytecode.TypeI32, int64(acc)), IntValue(bytecode.TypeI32, int64(i)))
+			if err != nil {
+				return 0, err
+			}
+			acc = int32(r.Int)
+		}
+		return acc, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterFunc: %v", err)
+	}
+	p, err := LoadModule(mod, LoadOptions{Externs: reg})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	st, err := Run(context.Background(), p, RunOptions{})
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+	if _, err := p.ExternContext().CallFunction(context.Background(), 0); err == nil {
+		t.Fatal("CallFunction outside an extern succeeded")
+	}
+	_, err = Run(context.Background(), p, RunOptions{StepLimit: 20})
+	var trap *TrapError
+	if !errors.As(err, &trap) || !strings.Contains(err.Error(), "step limit") {
+		t.Fatalf("Run error = %v, want step limit trap from the callback", err)
+	}
+}
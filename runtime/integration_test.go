@@ -3,8 +3,10 @@ package runtime
 import (
 	"bytes"
 	"context"
+	"errors"
 	"strings"
 	"testing"
+	"time"
 
 	"shinya.click/cvm/bytecode"
 	"shinya.click/cvm/codegen"
@@ -20,6 +22,28 @@ func compileAndRun(t *testing.T, src string, stdout *bytes.Buffer) (ExitStatus,
 
 func compileAndRunWithOptions(t *testing.T, src string, stdout *bytes.Buffer, opts sema.SemaOptions) (ExitStatus, error) {
 	t.Helper()
+	return Run(context.Background(), compileProgram(t, src, stdout, opts), RunOptions{})
+}
+
+func compileProgram(t *testing.T, src string, stdout *bytes.Buffer, opts sema.SemaOptions) *Program {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := bytecode.EncodeModule(&encoded, compileModule(t, src, opts)); err != nil {
+		t.Fatalf("EncodeModule: %v", err)
+	}
+
+	p, err := Load(bytes.NewReader(encoded.Bytes()), LoadOptions{
+		Externs: DefaultExternRegistry(stdout, nil),
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return p
+}
+
+func compileModule(t testing.TB, src string, opts sema.SemaOptions) *bytecode.Module {
+	t.Helper()
 
 	pp, err := preprocessor.PreprocessSource("main.c", src, preprocessor.Options{})
 	if err != nil {
@@ -37,19 +61,7 @@ func compileAndRunWithOptions(t *testing.T, src string, stdout *bytes.Buffer, op
 	if err != nil {
 		t.Fatalf("codegen: %v", err)
 	}
-
-	var encoded bytes.Buffer
-	if err := bytecode.EncodeModule(&encoded, mod); err != nil {
-		t.Fatalf("EncodeModule: %v", err)
-	}
-
-	p, err := Load(bytes.NewReader(encoded.Bytes()), LoadOptions{
-		Externs: DefaultExternRegistry(stdout, nil),
-	})
-	if err != nil {
-		t.Fatalf("Load: %v", err)
-	}
-	return Run(context.Background(), p, RunOptions{})
+	return mod
 }
 
 func TestCompileAndRunReturnArithmetic(t *testing.T) {
@@ -472,3 +484,762 @@ int main(void) {
 		t.Fatalf("exit code = %d, want 0", st.Code)
 	}
 }
+
+func TestRunEnforcesQuotas(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		opts  RunOptions
+		quota Quota
+	}{
+		{
+			name:  "heap bytes",
+			src:   "#include <stdlib.h>\nint main(void) { for (;;) if (!malloc(1024)) return 1; }",
+			opts:  RunOptions{MaxHeapBytes: 64 * 1024},
+			quota: QuotaHeapBytes,
+		},
+		{
+			name:  "allocation size",
+			src:   "#include <stdlib.h>\nint main(void) { return malloc(1 << 20) != 0; }",
+			opts:  RunOptions{MaxAllocSize: 4096},
+			quota: QuotaAllocSize,
+		},
+		{
+			name:  "live blocks",
+			src:   "#include <stdlib.h>\nint main(void) { for (;;) if (!malloc(1)) return 1; }",
+			opts:  RunOptions{MaxLiveBlocks: 100},
+			quota: QuotaLiveBlocks,
+		},
+		{
+			name:  "call depth",
+			src:   "int f(int n) { return n ? f(n - 1) + 1 : 0; }\nint main(void) { return f(1000); }",
+			opts:  RunOptions{MaxCallDepth: 64},
+			quota: QuotaCallDepth,
+		},
+		{
+			name:  "operand stack depth",
+			src:   "int main(void) { int a = 1; return a + (a + (a + (a + (a + (a + (a + a)))))); }",
+			opts:  RunOptions{MaxStackDepth: 4},
+			quota: QuotaStackDepth,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Run(context.Background(), compileProgram(t, tt.src, nil, sema.SemaOptions{}), tt.opts)
+			var quotaErr *QuotaError
+			if !errors.As(err, &quotaErr) || quotaErr.Quota != tt.quota {
+				t.Fatalf("Run error = %v, want %s quota error", err, tt.quota)
+			}
+			var trap *TrapError
+			if !errors.As(err, &trap) {
+				t.Fatalf("Run error = %T, want TrapError carrying the quota", err)
+			}
+		})
+	}
+}
+
+func TestRunQuotasAllowReusingFreedMemory(t *testing.T) {
+	p := compileProgram(t, `#include <stdlib.h>
+int depth(int n) { return n ? depth(n - 1) : 0; }
+int main(void) {
+	for (int i = 0; i < 1000; i++) {
+		char *p = malloc(512);
+		if (!p) return 1;
+		free(p);
+	}
+	return depth(10);
+}`, nil, sema.SemaOptions{})
+	st, err := Run(context.Background(), p, RunOptions{MaxHeapBytes: 4096, MaxLiveBlocks: 16, MaxCallDepth: 16})
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+}
+
+func TestCompileAndRunLongjmpUnwindsFrames(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <setjmp.h>
+#include <stdio.h>
+#include <stdlib.h>
+static jmp_buf env;
+static int depth;
+
+void dive(int n, int val) {
+	int local[4];
+	local[0] = n;
+	depth++;
+	if (n == 0) longjmp(env, val);
+	dive(n - 1, val);
+	printf("unreachable %d\n", local[0]);
+}
+
+int main(void) {
+	int r = setjmp(env);
+	printf("setjmp %d\n", r);
+	if (r == 0) dive(3, 7);
+	else if (r == 7) dive(2, 0);
+	char *p = malloc(16);
+	free(p);
+	return depth;
+}`, &stdout)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got, want := stdout.String(), "setjmp 0\nsetjmp 7\nsetjmp 1\n"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+	if st.Code != 7 {
+		t.Fatalf("exit code = %d, want 7", st.Code)
+	}
+}
+
+func TestCompileAndRunLongjmpIntoReturnedFrameTraps(t *testing.T) {
+	_, err := compileAndRun(t, `#include <setjmp.h>
+static jmp_buf env;
+int arm(void) { return setjmp(env); }
+int main(void) {
+	arm();
+	longjmp(env, 1);
+	return 0;
+}`, nil)
+	if err == nil || !strings.Contains(err.Error(), "already returned") {
+		t.Fatalf("Run err = %v, want dead frame trap", err)
+	}
+	_, err = compileAndRun(t, `#include <setjmp.h>
+int main(void) {
+	jmp_buf env;
+	longjmp(env, 1);
+	return 0;
+}`, nil)
+	if err == nil || !strings.Contains(err.Error(), "never initialized") {
+		t.Fatalf("Run err = %v, want uninitialized jmp_buf trap", err)
+	}
+}
+
+func TestSetjmpPointsAreDroppedWithTheirFrames(t *testing.T) {
+	mod := compileModule(t, `#include <setjmp.h>
+static int arm(void) {
+	jmp_buf env;
+	if (setjmp(env)) return 1;
+	return 0;
+}
+int main(void) {
+	int n = 0;
+	for (int i = 0; i < 100; i++) n += arm();
+	return n;
+}`, sema.SemaOptions{})
+	p, err := LoadModule(mod, LoadOptions{})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	vm, err := newVM(p, RunOptions{})
+	if err != nil {
+		t.Fatalf("newVM: %v", err)
+	}
+	for {
+		st, done, err := vm.run(context.Background())
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		if done {
+			if st.Code != 0 {
+				t.Fatalf("exit code = %d, want 0", st.Code)
+			}
+			break
+		}
+	}
+	if len(vm.jmpPoints) != 0 {
+		t.Fatalf("%d jmp points outlived their frames", len(vm.jmpPoints))
+	}
+}
+
+func TestCompileAndRunQsortAndBsearch(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <stdio.h>
+#include <stdlib.h>
+struct pair { int key; char tag; };
+static struct pair ps[3] = {{3, 'c'}, {1, 'a'}, {2, 'b'}};
+static int calls;
+static int cmp_int(const void *a, const void *b) {
+	calls++;
+	return *(const int *)a - *(const int *)b;
+}
+static int cmp_pair(const void *a, const void *b) {
+	return ((const struct pair *)a)->key - ((const struct pair *)b)->key;
+}
+int main(void) {
+	int v[7] = {5, 3, 9, 1, 7, 2, 8};
+	qsort(v, 7, sizeof v[0], cmp_int);
+	for (int i = 0; i < 7; i++) printf("%d ", v[i]);
+	qsort(ps, 3, sizeof ps[0], cmp_pair);
+	printf("%c%c%c\n", ps[0].tag, ps[1].tag, ps[2].tag);
+	int key = 7;
+	int *hit = bsearch(&key, v, 7, sizeof v[0], cmp_int);
+	key = 4;
+	int *miss = bsearch(&key, v, 7, sizeof v[0], cmp_int);
+	return hit == &v[4] && miss == 0 && calls > 0 ? 0 : 1;
+}`, &stdout)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if st.Code != 0 {
+		t.Fatalf("exit code = %d, want 0", st.Code)
+	}
+	if got, want := stdout.String(), "1 2 3 5 7 8 9 abc\n"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestCompileAndRunBsearchTrapsOnOversizedArrays(t *testing.T) {
+	for _, tt := range []struct {
+		count, want string
+	}{
+		// 2^62 elements of 8 bytes wrap the midpoint back onto the array.
+		{"(size_t)1 << 62", "overflows"},
+		{"1000", ""},
+	} {
+		_, err := compileAndRun(t, `#include <stdlib.h>
+static int cmp(const void *a, const void *b) { return *(const int *)a - *(const int *)b; }
+int main(void) {
+	long long v[2] = {1, 2};
+	int key = 1;
+	return bsearch(&key, v, `+tt.count+`, sizeof v[0], cmp) != 0;
+}`, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("bsearch over %s elements err = %v, want a trap mentioning %q", tt.count, err, tt.want)
+		}
+	}
+}
+
+func TestCompileAndRunQsortNestedFunctionComparator(t *testing.T) {
+	st, err := compileAndRunWithOptions(t, `#include <stdlib.h>
+int main(void) {
+	int descending = 1;
+	int compared = 0;
+	int cmp(const void *a, const void *b) {
+		compared++;
+		int d = *(const int *)a - *(const int *)b;
+		return descending ? -d : d;
+	}
+	int v[4] = {1, 4, 2, 3};
+	qsort(v, 4, sizeof v[0], cmp);
+	return compared > 0 && v[0] == 4 && v[1] == 3 && v[2] == 2 && v[3] == 1 ? 0 : 1;
+}`, nil, sema.SemaOptions{GNUExtensions: true})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if st.Code != 0 {
+		t.Fatalf("exit code = %d, want 0", st.Code)
+	}
+}
+
+func TestCompileAndRunQsortComparatorExitsAndTraps(t *testing.T) {
+	st, err := compileAndRun(t, `#include <stdlib.h>
+static int cmp(const void *a, const void *b) { exit(42); }
+int main(void) {
+	int v[2] = {2, 1};
+	qsort(v, 2, sizeof v[0], cmp);
+	return 0;
+}`, nil)
+	if err != nil || st.Code != 42 {
+		t.Fatalf("Run = %+v, %v; want exit 42", st, err)
+	}
+	_, err = compileAndRun(t, `#include <setjmp.h>
+#include <stdlib.h>
+static jmp_buf env;
+static int cmp(const void *a, const void *b) { longjmp(env, 1); }
+int main(void) {
+	int v[2] = {2, 1};
+	if (setjmp(env)) return 0;
+	qsort(v, 2, sizeof v[0], cmp);
+	return 1;
+}`, nil)
+	if err == nil || !strings.Contains(err.Error(), "called from an extern") {
+		t.Fatalf("Run err = %v, want longjmp across extern trap", err)
+	}
+}
+
+func TestCompileAndRunSignalHandlers(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <signal.h>
+#include <stdio.h>
+static volatile sig_atomic_t got;
+static void on_int(int sig) { got = sig; }
+int main(void) {
+	if (signal(SIGINT, on_int) != SIG_DFL) return 1;
+	if (raise(SIGINT) != 0 || got != SIGINT) return 2;
+	void (*prev)(int) = signal(SIGINT, SIG_IGN);
+	if (prev != &on_int) return 3;
+	if (raise(SIGINT) != 0) return 4;
+	if (signal(0, on_int) != SIG_ERR) return 5;
+	printf("got %d\n", got);
+	signal(SIGTERM, SIG_DFL);
+	raise(SIGTERM);
+	return 0;
+}`, &stdout)
+	if err == nil || !strings.Contains(err.Error(), "raised SIGTERM") {
+		t.Fatalf("Run = %+v, %v; want SIGTERM trap", st, err)
+	}
+	if got, want := stdout.String(), "got 2\n"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestCompileAndRunReportsAssertionFailure(t *testing.T) {
+	mod := compileModule(t, `#include <assert.h>
+#include <signal.h>
+#include <stdio.h>
+static void on_abort(int sig) { printf("abort handler %d\n", sig); }
+static int check(int n) {
+	assert(n > 0);
+	assert(n < 2);
+	return n;
+}
+int main(int argc, char **argv) {
+	check(1);
+	if (argc > 1)
+		signal(SIGABRT, on_abort);
+	return check(2);
+}`, sema.SemaOptions{})
+	for _, tc := range []struct {
+		args   []string
+		stdout string
+	}{
+		{args: []string{"prog"}},
+		{args: []string{"prog", "-h"}, stdout: "abort handler 6\n"},
+	} {
+		var stdout, stderr bytes.Buffer
+		p, err := LoadModule(mod, LoadOptions{Externs: DefaultExternRegistry(&stdout, &stderr), Args: tc.args})
+		if err != nil {
+			t.Fatalf("LoadModule: %v", err)
+		}
+		st, err := Run(context.Background(), p, RunOptions{})
+		var failure *AssertionFailure
+		if !errors.As(err, &failure) {
+			t.Fatalf("Run(%v) = %+v, %v; want AssertionFailure", tc.args, st, err)
+		}
+		want := AssertionFailure{Expr: "n < 2", File: "main.c", Line: 7, Function: "check"}
+		if *failure != want {
+			t.Fatalf("AssertionFailure = %+v, want %+v", *failure, want)
+		}
+		if got, want := stderr.String(), "prog: main.c:7: check: Assertion `n < 2' failed.\n"; got != want {
+			t.Fatalf("stderr = %q, want %q", got, want)
+		}
+		if got := stdout.String(); got != tc.stdout {
+			t.Fatalf("stdout = %q, want %q", got, tc.stdout)
+		}
+	}
+}
+
+func TestCompileAndRunSignalHandlersForTraps(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <setjmp.h>
+#include <signal.h>
+#include <stdio.h>
+#include <stdlib.h>
+static jmp_buf env;
+static void recover(int sig) { longjmp(env, sig); }
+static void on_abort(int sig) { printf("abort handler %d\n", sig); }
+static int divide(int a, int b) { return a / b; }
+int main(void) {
+	signal(SIGFPE, recover);
+	signal(SIGSEGV, recover);
+	int sig = setjmp(env);
+	if (sig == 0) {
+		divide(1, 0);
+	} else if (sig == SIGFPE) {
+		printf("caught SIGFPE\n");
+		int *p = malloc(sizeof *p);
+		free(p);
+		*p = 1;
+	} else {
+		printf("caught %d\n", sig);
+		signal(SIGABRT, on_abort);
+		abort();
+	}
+	return 0;
+}`, &stdout)
+	if err == nil || !strings.Contains(err.Error(), "abort") {
+		t.Fatalf("Run = %+v, %v; want abort trap", st, err)
+	}
+	if got, want := stdout.String(), "caught SIGFPE\ncaught 11\nabort handler 6\n"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+
+	_, err = compileAndRun(t, `#include <signal.h>
+static void ignore(int sig) {}
+int main(void) {
+	signal(SIGFPE, ignore);
+	int zero = 0;
+	return 1 / zero;
+}`, nil)
+	if err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Fatalf("Run err = %v, want division by zero after the handler returns", err)
+	}
+}
+
+func TestTrapsCarryTheSignalTheyRaise(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		opts RunOptions
+		want int32
+	}{
+		{"division by zero", `int main(void) { int zero = 0; return 1 / zero; }`, RunOptions{}, sigFPE},
+		{"null store", `int main(void) { int *p = 0; *p = 1; return 0; }`, RunOptions{}, sigSEGV},
+		{"step limit", `int main(void) { for (;;); }`, RunOptions{StepLimit: 100}, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mod := compileModule(t, tc.src, sema.SemaOptions{})
+			p, err := LoadModule(mod, LoadOptions{})
+			if err != nil {
+				t.Fatalf("LoadModule: %v", err)
+			}
+			_, err = Run(context.Background(), p, tc.opts)
+			var trap *TrapError
+			if !errors.As(err, &trap) {
+				t.Fatalf("Run err = %v, want a trap", err)
+			}
+			if trap.signal != tc.want {
+				t.Fatalf("%q trap signal = %d, want %d", trap.Reason, trap.signal, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompileAndRunTimeCalendarWithInjectedClock(t *testing.T) {
+	mod := compileModule(t, `#include <stdio.h>
+#include <time.h>
+int main(void) {
+	char buf[512];
+	time_t t = time(NULL);
+	struct tm *g = gmtime(&t);
+	strftime(buf, sizeof buf, "%a|%A|%b|%B|%c|%C|%d|%D|%e|%F|%g|%G|%h|%H|%I|%j|%m|%M|%n|%p|%r|%R|%S|%t|%T|%u|%U|%V|%w|%W|%x|%X|%y|%Y|%z|%Z|%%|%Ec|%Oy", g);
+	printf("%ld\n%s\n", (long)t, buf);
+	struct tm *l = localtime(&t);
+	printf("%s", asctime(l));
+	printf("%s", ctime(&t));
+	strftime(buf, sizeof buf, "%z %Z %H", l);
+	printf("%s\n", buf);
+	static struct tm m;
+	m.tm_year = 120; m.tm_mon = 11; m.tm_mday = 32; m.tm_hour = 9; m.tm_isdst = -1;
+	time_t mt = mktime(&m);
+	printf("%ld %d-%02d-%02d wday=%d yday=%d\n", (long)mt, m.tm_year + 1900, m.tm_mon + 1, m.tm_mday, m.tm_wday, m.tm_yday);
+	printf("%d\n", (int)strftime(buf, 4, "%Y", g));
+	clock_t c0 = clock();
+	clock_t c1 = clock();
+	printf("%ld\n", (long)(c1 - c0));
+	return 0;
+}`, sema.SemaOptions{})
+	var stdout bytes.Buffer
+	reg := DefaultExternRegistry(&stdout, nil)
+	reg.SetClock(SteppedClock(time.Date(2021, 1, 3, 12, 34, 56, 0, time.UTC), time.Second))
+	reg.SetTimeZone(time.FixedZone("JST", 9*3600))
+	p, err := LoadModule(mod, LoadOptions{Externs: reg})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	st, err := Run(context.Background(), p, RunOptions{})
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+	want := "1609677296\n" +
+		"Sun|Sunday|Jan|January|Sun Jan  3 12:34:56 2021|20|03|01/03/21| 3|2021-01-03|20|2020|Jan|12|12|003|01|34|\n" +
+		"|PM|12:34:56 PM|12:34|56|\t|12:34:56|7|01|53|0|00|01/03/21|12:34:56|21|2021|+0000|UTC|%|Sun Jan  3 12:34:56 2021|21\n" +
+		"Sun Jan  3 21:34:56 2021\n" +
+		"Sun Jan  3 21:34:56 2021\n" +
+		"+0900 JST 21\n" +
+		"1609459200 2021-01-01 wday=5 yday=0\n" +
+		"0\n" +
+		"1000000\n"
+	if got := stdout.String(); got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestCompileAndRunMemberInitializersInByteAlignedStructs(t *testing.T) {
+	// Struct objects are only byte aligned, so of four consecutive locals
+	// some land where the nested int members are not 4-byte aligned.
+	st, err := compileAndRun(t, `struct pair { int x; int y; };
+struct outer { char c; struct pair in; };
+int main(void) {
+	struct outer a = { 1, { 2, 3 } }, b = { 1, { 2, 3 } }, c = { 1, { 2, 3 } }, d = { 1, { 2, 3 } };
+	return a.in.x + b.in.x + c.in.x + d.in.y == 9 ? 0 : 1;
+}`, nil)
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+}
+
+func TestCompileAndRunWideStringLiteralsFollowingNarrowOnes(t *testing.T) {
+	st, err := compileAndRun(t, `#include <wchar.h>
+int main(void) {
+	const char *s = "x";
+	const wchar_t *w = L"hi";
+	return s[0] == 'x' && w[0] == L'h' && w[1] == L'i' ? 0 : 1;
+}`, nil)
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+}
+
+func TestCompileAndRunWideStdio(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <stdio.h>
+#include <wchar.h>
+#include <errno.h>
+int main(void) {
+	static unsigned long ap[3] = {1, 1, 7};
+	static wchar_t buf[32];
+	static wchar_t word[8];
+	int n = wprintf(L"%d %ls|%s|%lc|%-4.2ls|\n", 42, L"wide", "narrow", L'x', L"abc");
+	printf("n=%d orient=%d\n", n, fwide(stdout, 0));
+	printf("sw=%d ", swprintf(buf, 32, L"%05.1f/%x", 2.25, 255));
+	printf("%ls ", buf);
+	printf("trunc=%d %ls ", swprintf(buf, 4, L"%s", "abcdef"), buf);
+	printf("v=%d %ls\n", vswprintf(buf, 32, L"[%3d]", ap), buf);
+	errno = 0;
+	printf("eilseq=%d errno=%d\n", swprintf(buf, 32, L"%lc", (wint_t)0xe9), errno);
+
+	FILE *f = tmpfile();
+	printf("unoriented=%d ", fwide(f, 0));
+	fputws(L"line one\n", f);
+	fputwc(L'Z', f);
+	fwprintf(f, L" %d\n", 9);
+	printf("wide=%d byte-put=%d\n", fwide(f, -1), fputwc(L'!', f) == L'!');
+	rewind(f);
+	printf("first=%lc ", (wint_t)fgetwc(f));
+	ungetwc(L'L', f);
+	fgetws(buf, 32, f);
+	printf("line=%ls", buf);
+	int k = 0;
+	printf("scan=%d ", fwscanf(f, L"%ls %d", word, &k));
+	printf("%ls %d\n", word, k);
+	fclose(f);
+
+	FILE *g = tmpfile();
+	fputs("bytes", g);
+	printf("byte=%d weof=%d\n", fwide(g, 1), fputwc(L'a', g) == WEOF);
+
+	int a = 0;
+	wchar_t c[2] = {0};
+	printf("sw=%d ", swscanf(L" 12 q rest", L"%d %lc %ls", &a, c, word));
+	printf("%d %lc %ls\n", a, (wint_t)c[0], word);
+	return 0;
+}`, &stdout)
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+	want := "42 wide|narrow|x|ab  |\n" +
+		"n=23 orient=1\n" +
+		"sw=8 002.2/ff trunc=-1 abc v=5 [  7]\n" +
+		"eilseq=-1 errno=84\n" +
+		"unoriented=0 wide=1 byte-put=1\n" +
+		"first=l line=Line one\n" +
+		"scan=2 Z 9\n" +
+		"byte=-1 weof=1\n" +
+		"sw=3 12 q rest\n"
+	if got := stdout.String(); got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestCompileAndRunVprintfFromVariadicWrapper(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <stdarg.h>
+#include <stdio.h>
+static int say(const char *fmt, ...) {
+	char buf[32];
+	va_list ap, copy;
+	va_start(ap, fmt);
+	va_copy(copy, ap);
+	int first = va_arg(ap, int);
+	int n = vsnprintf(buf, sizeof buf, fmt, copy);
+	va_end(copy);
+	printf("%d:%s|", first, buf);
+	n += vprintf(fmt + 3, ap);
+	va_end(ap);
+	return n;
+}
+int main(void) {
+	int n = say("%d %s %.1f\n", 42, "hi", 1.5);
+	printf("n=%d\n", n);
+	return 0;
+}`, &stdout)
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+	if got, want := stdout.String(), "42:42 hi 1.5\n|hi 1.5\nn=17\n"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestCompileAndRunVscanfWideAndIntmaxConversions(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <stdio.h>
+#include <stdlib.h>
+#include <wchar.h>
+#include <inttypes.h>
+#include <errno.h>
+#include <stdarg.h>
+static int vscan(const char *s, const char *fmt, va_list ap) { return vsscanf(s, fmt, ap); }
+static int scan(const char *s, const char *fmt, ...) {
+	va_list ap;
+	va_start(ap, fmt);
+	int n = vscan(s, fmt, ap);
+	va_end(ap);
+	return n;
+}
+static int fscan(FILE *f, const char *fmt, ...) {
+	va_list ap, copy;
+	va_start(ap, fmt);
+	va_copy(copy, ap);
+	va_end(ap);
+	int n = vfscanf(f, fmt, copy);
+	va_end(copy);
+	return n;
+}
+int main(void) {
+	int a, c;
+	long b;
+	char word[8];
+	printf("vsscanf=%d ", scan("17 -99 tail", "%d %ld %7s", &a, &b, word));
+	printf("%d %ld %s ", a, b, word);
+	FILE *in = tmpfile();
+	fputs("42 x", in);
+	rewind(in);
+	printf("vfscanf=%d %d\n", fscan(in, "%d", &c), c);
+	fclose(in);
+
+	wchar_t *end;
+	long n = wcstol(L"  0x1fZ", &end, 0);
+	printf("wcstol=%ld rest=%ls ", n, end);
+	unsigned long long u = wcstoull(L"777", &end, 8);
+	printf("wcstoull=%llu ", u);
+	double d = wcstod(L"2.5e1x", &end);
+	printf("wcstod=%g rest=%ls ", d, end);
+	float f = wcstof(L"nothing", &end);
+	printf("wcstof=%g none=%d\n", f, *end == L'n');
+
+	char *cend;
+	intmax_t im = strtoimax("-9223372036854775807", &cend, 10);
+	uintmax_t um = strtoumax("ff", &cend, 16);
+	printf("%" PRIdMAX " %" PRIuMAX " %" PRIx64 " ", im, um, (uint64_t)um);
+	imaxdiv_t qr = imaxdiv(-7, 2);
+	printf("%" PRIdMAX ",%" PRIdMAX " abs=%" PRIdMAX " ", qr.quot, qr.rem, imaxabs(-5));
+	printf("%" PRId8 " %" PRIuFAST16 " %" PRIXPTR "\n", (int8_t)-3, (uint_fast16_t)65535, (uintptr_t)255);
+	uint8_t small;
+	sscanf("250", "%" SCNu8, &small);
+	printf("scn=%u\n", small);
+	return 0;
+}`, &stdout)
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+	want := "vsscanf=3 17 -99 tail vfscanf=1 42\n" +
+		"wcstol=31 rest=Z wcstoull=511 wcstod=25 rest=x wcstof=0 none=1\n" +
+		"-9223372036854775807 255 ff -3,-1 abs=5 -3 65535 FF\n" +
+		"scn=250\n"
+	if got := stdout.String(); got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestCompileAndRunFloatingPointEnvironment(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <stdio.h>
+#include <fenv.h>
+#include <math.h>
+#include <float.h>
+int main(void) {
+	volatile double zero = 0.0, one = 1.0, three = 3.0, big = DBL_MAX, tiny = DBL_MIN;
+	volatile double r;
+	volatile int i;
+	feclearexcept(FE_ALL_EXCEPT);
+	r = one / zero;
+	printf("divbyzero=%d ", fetestexcept(FE_ALL_EXCEPT) == FE_DIVBYZERO);
+	feclearexcept(FE_ALL_EXCEPT);
+	r = zero / zero;
+	printf("invalid=%d ", fetestexcept(FE_ALL_EXCEPT) == FE_INVALID);
+	feclearexcept(FE_ALL_EXCEPT);
+	r = big * 2;
+	printf("overflow=%d ", fetestexcept(FE_OVERFLOW | FE_INEXACT) == (FE_OVERFLOW | FE_INEXACT));
+	feclearexcept(FE_ALL_EXCEPT);
+	r = tiny / 3;
+	printf("underflow=%d ", fetestexcept(FE_UNDERFLOW) != 0);
+	feclearexcept(FE_ALL_EXCEPT);
+	r = 0.5 + 0.25;
+	r = one + one;
+	printf("exact=%d ", fetestexcept(FE_ALL_EXCEPT) == 0);
+	r = one / three;
+	printf("inexact=%d ", fetestexcept(FE_INEXACT) != 0);
+	feclearexcept(FE_ALL_EXCEPT);
+	i = (int)(big);
+	printf("cast=%d ", fetestexcept(FE_INVALID) != 0);
+	feclearexcept(FE_ALL_EXCEPT);
+	r = sqrt(-one);
+	printf("sqrt=%d\n", fetestexcept(FE_INVALID) != 0);
+
+	fesetround(FE_UPWARD);
+	double up = one / three;
+	fesetround(FE_DOWNWARD);
+	double down = one / three;
+	printf("round=%d up>down=%d rint=%g\n", fegetround() == FE_DOWNWARD, up > down, rint(2.5));
+
+	fenv_t env;
+	feclearexcept(FE_ALL_EXCEPT);
+	feraiseexcept(FE_OVERFLOW);
+	feholdexcept(&env);
+	printf("held=%d round=%d ", fetestexcept(FE_ALL_EXCEPT), fegetround() == FE_DOWNWARD);
+	feraiseexcept(FE_INVALID);
+	feupdateenv(&env);
+	printf("updated=%d ", fetestexcept(FE_ALL_EXCEPT) == (FE_OVERFLOW | FE_INVALID));
+	fexcept_t saved;
+	fegetexceptflag(&saved, FE_ALL_EXCEPT);
+	fesetenv(FE_DFL_ENV);
+	int dfl = fetestexcept(FE_ALL_EXCEPT) == 0;
+	dfl += fegetround() == FE_TONEAREST;
+	printf("default=%d ", dfl);
+	fesetexceptflag(&saved, FE_INVALID);
+	printf("restored=%d\n", fetestexcept(FE_ALL_EXCEPT) == FE_INVALID);
+	return 0;
+}`, &stdout)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := "divbyzero=1 invalid=1 overflow=1 underflow=1 exact=1 inexact=1 cast=1 sqrt=1\n" +
+		"round=1 up>down=1 rint=2\n" +
+		"held=0 round=1 updated=1 default=2 restored=1\n"
+	if st.Code != 0 || stdout.String() != want {
+		t.Fatalf("exit %d stdout %q, want %q", st.Code, stdout.String(), want)
+	}
+}
+
+func TestCompileAndRunQuietComparisonsEvaluateOnce(t *testing.T) {
+	var stdout bytes.Buffer
+	st, err := compileAndRun(t, `#include <stdio.h>
+#include <fenv.h>
+#include <math.h>
+static int calls;
+static double next(double v) { calls++; return v; }
+int main(void) {
+	double x = 1.0, y = 2.0, nan = NAN;
+	int r = isgreater(x++, y);
+	r += isgreaterequal(next(2.0), y);
+	r += isless(x, y++);
+	r += islessequal(next(1.0), next(1.0));
+	r += islessgreater(next(1.0), 3.0f);
+	printf("r=%d x=%g y=%g calls=%d\n", r, x, y, calls);
+	feclearexcept(FE_ALL_EXCEPT);
+	r = isless(nan, 1.0) + isgreater(1.0, nan) + islessgreater(nan, nan);
+	printf("nan=%d invalid=%d\n", r, fetestexcept(FE_INVALID) != 0);
+	return 0;
+}`, &stdout)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := "r=3 x=2 y=3 calls=4\nnan=0 invalid=0\n"
+	if st.Code != 0 || stdout.String() != want {
+		t.Fatalf("exit %d stdout %q, want %q", st.Code, stdout.String(), want)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"sort"
 
 	"shinya.click/cvm/bytecode"
 )
@@ -22,17 +23,41 @@ type memoryBlock struct {
 	id       int
 	name     string
 	base     uint64
+	size     int64
 	data     []byte
 	align    int64
 	readonly bool
 	freed    bool
+	freeSeq  int
+	tracked  bool
 	kind     blockKind
 }
 
+// reuseQuarantine is how many frees must happen after a block is released
+// before its address range is handed out again, so that short-lived dangling
+// pointers still trap as use after free instead of aliasing a new object.
+const reuseQuarantine = 64
+
 type Memory struct {
 	target bytecode.TargetInfo
 	next   uint64
+	// blocks is ordered by base address; fresh blocks are always allocated
+	// above every existing one and reused blocks keep their slot.
 	blocks []*memoryBlock
+	// free holds released blocks by size, oldest first.
+	free  map[int64][]*memoryBlock
+	frees int
+	// Blocks allocated once a VM has started are tracked against limits.
+	tracking   bool
+	limits     memoryLimits
+	liveBytes  int64
+	liveBlocks int
+}
+
+type memoryLimits struct {
+	heapBytes int64
+	allocSize int64
+	blocks    int
 }
 
 func NewMemory(target bytecode.TargetInfo) *Memory {
@@ -60,14 +85,54 @@ func (m *Memory) TryAlloc(name string, size, align int64, readonly bool, kind bl
 	if 0x10 > math.MaxUint64-end {
 		return 0, fmt.Errorf("memory allocation %q overflows next address", name)
 	}
+	if m.tracking {
+		if err := m.checkLimits(size); err != nil {
+			return 0, err
+		}
+	}
 	data, err := makeBlockData(size)
 	if err != nil {
 		return 0, err
 	}
-	b := &memoryBlock{id: len(m.blocks), name: name, base: base, data: data, align: align, readonly: readonly, kind: kind}
-	m.blocks = append(m.blocks, b)
-	m.next = end + 0x10
-	return base, nil
+	b := m.reusableBlock(size, align)
+	if b == nil {
+		b = &memoryBlock{id: len(m.blocks), base: base}
+		m.blocks = append(m.blocks, b)
+		m.next = end + 0x10
+	}
+	b.name, b.size, b.data, b.align, b.readonly, b.freed, b.tracked, b.kind = name, size, data, align, readonly, false, m.tracking, kind
+	if b.tracked {
+		m.liveBytes += size
+		m.liveBlocks++
+	}
+	return b.base, nil
+}
+
+// reusableBlock takes the oldest freed block of exactly size out of
+// quarantine, if there is one whose base satisfies align.
+func (m *Memory) reusableBlock(size, align int64) *memoryBlock {
+	list := m.free[size]
+	if len(list) == 0 || m.frees-list[0].freeSeq < reuseQuarantine || list[0].base%uint64(align) != 0 {
+		return nil
+	}
+	b := list[0]
+	list[0] = nil
+	if len(list) == 1 {
+		delete(m.free, size)
+	} else {
+		m.free[size] = list[1:]
+	}
+	return b
+}
+
+// blockAt returns the block with the highest base not above addr. Blocks do
+// not overlap, so it is the only one that can contain addr.
+func (m *Memory) blockAt(addr uint64) *memoryBlock {
+	i := sort.Search(len(m.blocks), func(i int) bool { return m.blocks[i].base > addr })
+	if i == 0 {
+		return nil
+	}
+	return m.blocks[i-1]
 }
 
 func (m *Memory) Load(addr uint64, t bytecode.ValueType, align int64) (Value, error) {
@@ -218,25 +283,82 @@ func (m *Memory) ReadCString(addr uint64) (string, error) {
 	return string(b.data[off:end]), nil
 }
 
+// Read returns a copy of size bytes starting at addr.
+func (m *Memory) Read(addr uint64, size int64) ([]byte, error) {
+	b, off, err := m.rangeAccess(addr, size, false)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b.data[off:off+int(size)]...), nil
+}
+
+type MemoryBlockInfo struct {
+	Name     string
+	Base     uint64
+	Size     int64
+	Align    int64
+	Readonly bool
+	Freed    bool
+}
+
+// Block describes the block containing addr, including freed blocks.
+func (m *Memory) Block(addr uint64) (MemoryBlockInfo, bool) {
+	b := m.blockAt(addr)
+	if b == nil || addr-b.base >= uint64(b.size) {
+		return MemoryBlockInfo{}, false
+	}
+	return MemoryBlockInfo{Name: b.name, Base: b.base, Size: b.size, Align: b.align, Readonly: b.readonly, Freed: b.freed}, true
+}
+
 func (m *Memory) WritePointer(addr uint64, ptr uint64) error {
 	return m.Store(addr, bytecode.TypePtr, m.target.PointerAlign, PtrValue(ptr))
 }
 
 func (m *Memory) Free(addr uint64, kind blockKind) error {
-	for _, b := range m.blocks {
-		if b.base != addr {
-			continue
+	b := m.blockAt(addr)
+	if b == nil || b.base != addr {
+		return fmt.Errorf("invalid free at %#x", addr)
+	}
+	if b.kind != kind {
+		return fmt.Errorf("memory block at %#x has kind %d, want %d", addr, b.kind, kind)
+	}
+	if b.freed {
+		return fmt.Errorf("double free at %#x", addr)
+	}
+	b.freed = true
+	if b.tracked {
+		m.liveBytes -= b.size
+		m.liveBlocks--
+	}
+	// Keep the extent so stale pointers still trap, but let the bytes go.
+	b.data = nil
+	if b.size > 0 {
+		if m.free == nil {
+			m.free = make(map[int64][]*memoryBlock)
 		}
-		if b.kind != kind {
-			return fmt.Errorf("memory block at %#x has kind %d, want %d", addr, b.kind, kind)
-		}
-		if b.freed {
-			return fmt.Errorf("double free at %#x", addr)
-		}
-		b.freed = true
-		return nil
+		b.freeSeq = m.frees
+		m.free[b.size] = append(m.free[b.size], b)
 	}
-	return fmt.Errorf("invalid free at %#x", addr)
+	m.frees++
+	return nil
+}
+
+func (m *Memory) setLimits(limits memoryLimits) {
+	m.tracking = true
+	m.limits = limits
+}
+
+func (m *Memory) checkLimits(size int64) error {
+	if m.limits.allocSize > 0 && size > m.limits.allocSize {
+		return &QuotaError{Quota: QuotaAllocSize, Limit: m.limits.allocSize, Requested: size}
+	}
+	if m.limits.heapBytes > 0 && m.liveBytes+size > m.limits.heapBytes {
+		return &QuotaError{Quota: QuotaHeapBytes, Limit: m.limits.heapBytes, Requested: m.liveBytes + size}
+	}
+	if m.limits.blocks > 0 && m.liveBlocks+1 > m.limits.blocks {
+		return &QuotaError{Quota: QuotaLiveBlocks, Limit: int64(m.limits.blocks), Requested: int64(m.liveBlocks + 1)}
+	}
+	return nil
 }
 
 func (m *Memory) access(addr uint64, t bytecode.ValueType, align int64, write bool) (*memoryBlock, int, int, error) {
@@ -263,20 +385,17 @@ func (m *Memory) rangeAccess(addr uint64, size int64, write bool) (*memoryBlock,
 		return nil, 0, fmt.Errorf("invalid memory access at %#x size=%d", addr, size)
 	}
 	end := addr + uSize
-	for _, b := range m.blocks {
-		blockEnd := b.base + uint64(len(b.data))
-		if addr < b.base || end > blockEnd {
-			continue
-		}
-		if b.freed {
-			return nil, 0, fmt.Errorf("use after free at %#x", addr)
-		}
-		if write && b.readonly {
-			return nil, 0, fmt.Errorf("readonly memory write at %#x", addr)
-		}
-		return b, int(addr - b.base), nil
+	b := m.blockAt(addr)
+	if b == nil || end > b.base+uint64(b.size) {
+		return nil, 0, fmt.Errorf("invalid memory access at %#x size=%d", addr, size)
+	}
+	if b.freed {
+		return nil, 0, fmt.Errorf("use after free at %#x", addr)
+	}
+	if write && b.readonly {
+		return nil, 0, fmt.Errorf("readonly memory write at %#x", addr)
 	}
-	return nil, 0, fmt.Errorf("invalid memory access at %#x size=%d", addr, size)
+	return b, int(addr - b.base), nil
 }
 
 func (m *Memory) byteOrder() (binary.ByteOrder, error) {
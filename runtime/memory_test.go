@@ -2,11 +2,14 @@ package runtime
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"math"
 	"strings"
 	"testing"
 
 	"shinya.click/cvm/bytecode"
+	"shinya.click/cvm/sema"
 )
 
 func TestMemoryReadWriteScalar(t *testing.T) {
@@ -185,3 +188,158 @@ func TestMemoryTryAllocRejectsInvalidRanges(t *testing.T) {
 		t.Fatalf("TryAlloc next overflow error = %v, want next address overflow", err)
 	}
 }
+
+func TestMemoryLooksUpBlocksByAddress(t *testing.T) {
+	mem := NewMemory(bytecode.DefaultTarget())
+	addrs := make([]uint64, 100)
+	for i := range addrs {
+		addrs[i] = mustAlloc(t, mem, "global:g", int64(i%7+1), 1, false, blockGlobal)
+	}
+	for i, addr := range addrs {
+		size := int64(i%7 + 1)
+		b, off, err := mem.rangeAccess(addr+uint64(size-1), 1, false)
+		if err != nil || b.base != addr || off != int(size-1) {
+			t.Fatalf("rangeAccess(block %d last byte) = %#x+%d, %v; want %#x", i, b.base, off, err, addr)
+		}
+		if _, _, err := mem.rangeAccess(addr+uint64(size), 1, false); err == nil {
+			t.Fatalf("rangeAccess past block %d succeeded", i)
+		}
+	}
+	if _, _, err := mem.rangeAccess(addrs[0]-1, 1, false); err == nil {
+		t.Fatalf("rangeAccess below first block succeeded")
+	}
+}
+
+func TestMemoryReusesFreedBlocksAfterQuarantine(t *testing.T) {
+	mem := NewMemory(bytecode.DefaultTarget())
+	first := mustAlloc(t, mem, "extern:malloc", 32, 8, false, blockGlobal)
+	if err := mem.Free(first, blockGlobal); err != nil {
+		t.Fatalf("Free: %v", err)
+	}
+	info, ok := mem.Block(first)
+	if !ok || !info.Freed || info.Size != 32 {
+		t.Fatalf("Block(freed) = %+v, %v; want freed 32-byte block", info, ok)
+	}
+	if _, _, err := mem.rangeAccess(first, 4, false); err == nil || !strings.Contains(err.Error(), "use after free") {
+		t.Fatalf("access freed block err = %v, want use after free", err)
+	}
+	if again := mustAlloc(t, mem, "extern:malloc", 32, 8, false, blockGlobal); again == first {
+		t.Fatalf("freed block reused before quarantine elapsed")
+	}
+	for i := 0; i < reuseQuarantine; i++ {
+		addr := mustAlloc(t, mem, "local:f:x", 16, 8, false, blockLocal)
+		if err := mem.Free(addr, blockLocal); err != nil {
+			t.Fatalf("Free local: %v", err)
+		}
+	}
+	blocks := len(mem.blocks)
+	reused := mustAlloc(t, mem, "extern:calloc", 32, 8, false, blockGlobal)
+	if reused != first || len(mem.blocks) != blocks {
+		t.Fatalf("allocation after quarantine = %#x with %d blocks, want reuse of %#x with %d", reused, len(mem.blocks), first, blocks)
+	}
+	got, err := mem.Load(reused, bytecode.TypeI64, 8)
+	if err != nil || got.Int != 0 {
+		t.Fatalf("reused block first word = %v, %v; want zeroed memory", got, err)
+	}
+	if err := mem.Free(reused, blockGlobal); err != nil {
+		t.Fatalf("Free reused block: %v", err)
+	}
+	if err := mem.Free(reused, blockGlobal); err == nil || !strings.Contains(err.Error(), "double free") {
+		t.Fatalf("second Free err = %v, want double free", err)
+	}
+}
+
+// linearBlockAt is the lookup Memory used before blocks were indexed; the
+// benchmarks compare against it.
+func linearBlockAt(m *Memory, addr uint64) *memoryBlock {
+	for _, b := range m.blocks {
+		if addr >= b.base && addr-b.base < uint64(b.size) {
+			return b
+		}
+	}
+	return nil
+}
+
+func BenchmarkMemoryBlockLookup(b *testing.B) {
+	for _, n := range []int{100, 10000} {
+		mem := NewMemory(bytecode.DefaultTarget())
+		addrs := make([]uint64, n)
+		for i := range addrs {
+			addr, err := mem.TryAlloc("extern:malloc", 24, 8, false, blockGlobal)
+			if err != nil {
+				b.Fatal(err)
+			}
+			addrs[i] = addr
+		}
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if mem.blockAt(addrs[i*7919%n]) == nil {
+					b.Fatal("block not found")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if linearBlockAt(mem, addrs[i*7919%n]) == nil {
+					b.Fatal("block not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryAllocFreeChurn(b *testing.B) {
+	mem := NewMemory(bytecode.DefaultTarget())
+	live := make([]uint64, 0, 256)
+	for i := 0; i < b.N; i++ {
+		addr, err := mem.TryAlloc("extern:malloc", 48, 8, false, blockGlobal)
+		if err != nil {
+			b.Fatal(err)
+		}
+		live = append(live, addr)
+		if len(live) == cap(live) {
+			for _, addr := range live {
+				if err := mem.Free(addr, blockGlobal); err != nil {
+					b.Fatal(err)
+				}
+			}
+			live = live[:0]
+		}
+	}
+	b.ReportMetric(float64(len(mem.blocks)), "blocks")
+}
+
+func BenchmarkRunLinkedList(b *testing.B) {
+	src := `#include <stdlib.h>
+struct node { int value; struct node *next; };
+int main(void) {
+	int total = 0;
+	for (int round = 0; round < 4; round++) {
+		struct node *head = 0;
+		for (int i = 0; i < 2000; i++) {
+			struct node *n = malloc(sizeof *n);
+			n->value = i;
+			n->next = head;
+			head = n;
+		}
+		while (head) {
+			struct node *next = head->next;
+			total += head->value & 1;
+			free(head);
+			head = next;
+		}
+	}
+	return total == 4000 ? 0 : 1;
+}`
+	mod := compileModule(b, src, sema.SemaOptions{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p, err := LoadModule(mod, LoadOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if st, err := Run(context.Background(), p, RunOptions{}); err != nil || st.Code != 0 {
+			b.Fatalf("Run = %+v, %v", st, err)
+		}
+	}
+}
@@ -0,0 +1,694 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// RegisterPOSIXSubset adds the POSIX and GNU functions portable C tools tend
+// to rely on: strcasecmp, strncasecmp, memmem, strsep, getline, getdelim,
+// fdopen, asprintf, vasprintf, aligned_alloc, posix_memalign, getopt and
+// getopt_long, together with the optarg, optind, opterr and optopt variables. The ISO C headers declare them
+// once the program defines a feature test macro such as _POSIX_C_SOURCE or
+// _GNU_SOURCE; <unistd.h> and <getopt.h> always do, so programs including
+// them need this profile to load.
+func (r *ExternRegistry) RegisterPOSIXSubset() {
+	r.posix = true
+	r.Register("strcasecmp", stringCaseCompareExtern("strcasecmp", false))
+	r.Register("strncasecmp", stringCaseCompareExtern("strncasecmp", true))
+	r.Register("memmem", memmemExtern("memmem"))
+	r.Register("strsep", strsepExtern("strsep"))
+	r.Register("getline", getdelimExtern("getline", r))
+	r.Register("getdelim", getdelimExtern("getdelim", r))
+	r.Register("fdopen", fdopenExtern("fdopen", r))
+	r.Register("asprintf", asprintfExtern("asprintf", false))
+	r.Register("vasprintf", asprintfExtern("vasprintf", true))
+	r.Register("aligned_alloc", alignedAllocExtern("aligned_alloc", r))
+	r.Register("posix_memalign", posixMemalignExtern("posix_memalign"))
+	r.Register("getopt", getoptExtern("getopt", r))
+	r.Register("getopt_long", getoptExtern("getopt_long", r))
+}
+
+func (r *ExternRegistry) lookupPOSIXVariable(name string, mem *Memory) (uint64, bool, error) {
+	if !r.posix {
+		return 0, false, nil
+	}
+	switch name {
+	case "optind", "opterr":
+		addr, err := r.staticI32Variable(mem, name, 1)
+		return addr, true, err
+	case "optopt":
+		addr, err := r.staticI32Variable(mem, name, '?')
+		return addr, true, err
+	case "optarg":
+		if mem == nil {
+			return 0, true, fmt.Errorf("memory is nil")
+		}
+		addr, _, err := r.staticBlock(mem, name, mem.target.PointerSize, mem.target.PointerAlign)
+		return addr, true, err
+	default:
+		return 0, false, nil
+	}
+}
+
+func memmemExtern(name string) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 4 {
+			return Value{}, nil, fmt.Errorf("%s expects 4 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isIntegerLike(args[1].Type) || !isPointerType(args[2].Type) || !isIntegerLike(args[3].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects haystack, length, needle, and length arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		hayLen, err := memorySizeArg(name, args[1])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		needleLen, err := memorySizeArg(name, args[3])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if needleLen == 0 {
+			return PtrValue(args[0].Int), nil, nil
+		}
+		if needleLen > hayLen {
+			return PtrValue(0), nil, nil
+		}
+		hay, err := ec.Memory.Read(args[0].Int, hayLen)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		needle, err := ec.Memory.Read(args[2].Int, needleLen)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		i := bytes.Index(hay, needle)
+		if i < 0 {
+			return PtrValue(0), nil, nil
+		}
+		return PtrValue(args[0].Int + uint64(i)), nil, nil
+	}
+}
+
+func strsepExtern(name string) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects string pointer and delimiter arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		delims, err := ec.Memory.ReadCString(args[1].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		sv, err := ec.Memory.Load(args[0].Int, bytecode.TypePtr, ec.Memory.target.PointerAlign)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		start := sv.Int
+		if start == 0 {
+			return PtrValue(0), nil, nil
+		}
+		s, err := ec.Memory.ReadCString(start)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		next := uint64(0)
+		if i := strings.IndexAny(s, delims); i >= 0 && delims != "" {
+			if err := writeMemoryByte(ec.Memory, start+uint64(i), 0); err != nil {
+				return Value{}, nil, err
+			}
+			next = start + uint64(i) + 1
+		}
+		if err := ec.Memory.WritePointer(args[0].Int, next); err != nil {
+			return Value{}, nil, err
+		}
+		return PtrValue(start), nil, nil
+	}
+}
+
+// getdelimExtern implements getline and getdelim. The line buffer grows the
+// way realloc would, so *lineptr must be null or come from malloc.
+func getdelimExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		want := 4
+		if name == "getline" {
+			want = 3
+		}
+		if len(args) != want {
+			return Value{}, nil, fmt.Errorf("%s expects %d arguments", name, want)
+		}
+		stream := args[want-1]
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) || !isPointerType(stream.Type) || (want == 4 && !isIntegerLike(args[2].Type)) {
+			return Value{}, nil, fmt.Errorf("%s expects line, size, and stream arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		delim := byte('\n')
+		if want == 4 {
+			delim = byte(args[2].Int)
+		}
+		if _, ok := r.lookupHostWriter(stream.Int); !ok {
+			return Value{}, nil, fmt.Errorf("unknown stream handle %#x", stream.Int)
+		}
+		if args[0].Int == 0 || args[1].Int == 0 {
+			return IntValue(bytecode.TypeI64, -1), nil, r.setErrno(ec.Memory, 22)
+		}
+		r.orientStream(stream.Int, -1)
+		if r.markHostReadErrorIfUnreadable(stream.Int) {
+			return IntValue(bytecode.TypeI64, -1), nil, nil
+		}
+		var line []byte
+		for {
+			ch, ok := r.readHostChar(stream.Int)
+			if !ok {
+				break
+			}
+			line = append(line, ch)
+			if ch == delim {
+				break
+			}
+		}
+		if len(line) == 0 {
+			r.hostEOF[stream.Int] = true
+			return IntValue(bytecode.TypeI64, -1), nil, nil
+		}
+		ptrAlign := ec.Memory.target.PointerAlign
+		buf, err := ec.Memory.Load(args[0].Int, bytecode.TypePtr, ptrAlign)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		size, err := ec.Memory.Load(args[1].Int, bytecode.TypeU64, ptrAlign)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		addr := buf.Int
+		if addr == 0 || size.Int < uint64(len(line))+1 {
+			grown := max(uint64(len(line))+1, 2*size.Int, 120)
+			addr, err = ec.Memory.TryAlloc("extern:"+name, int64(grown), ptrAlign, false, blockGlobal)
+			if err != nil {
+				return Value{}, nil, err
+			}
+			if buf.Int != 0 {
+				if err := ec.Memory.Free(buf.Int, blockGlobal); err != nil {
+					return Value{}, nil, err
+				}
+			}
+			if err := ec.Memory.WritePointer(args[0].Int, addr); err != nil {
+				return Value{}, nil, err
+			}
+			if err := ec.Memory.Store(args[1].Int, bytecode.TypeU64, ptrAlign, UIntValue(bytecode.TypeU64, grown)); err != nil {
+				return Value{}, nil, err
+			}
+		}
+		if err := writeMemoryBytes(ec.Memory, addr, append(line, 0)); err != nil {
+			return Value{}, nil, err
+		}
+		return IntValue(bytecode.TypeI64, int64(len(line))), nil, nil
+	}
+}
+
+var standardStreamNames = [...]string{"stdin", "stdout", "stderr"}
+
+// fdopenExtern returns the open stream that already owns fd. The standard
+// descriptors are always available.
+func fdopenExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
+		if !isIntegerLike(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects descriptor and mode arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		mode, err := ec.Memory.ReadCString(args[1].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if mode == "" || strings.IndexByte("rwa", mode[0]) < 0 {
+			return PtrValue(0), nil, r.setErrno(ec.Memory, 22)
+		}
+		fd := int32(signedInt(args[0]))
+		var handle uint64
+		for addr, owner := range r.hostFDs {
+			if owner == fd && !r.hostClosed[addr] && (handle == 0 || addr < handle) {
+				handle = addr
+			}
+		}
+		if handle != 0 {
+			return PtrValue(handle), nil, nil
+		}
+		if fd >= 0 && int(fd) < len(standardStreamNames) {
+			addr, _, err := r.LookupVariableAddr(standardStreamNames[fd], ec.Memory)
+			if err != nil {
+				return Value{}, nil, err
+			}
+			return PtrValue(addr), nil, nil
+		}
+		return PtrValue(0), nil, r.setErrno(ec.Memory, 9)
+	}
+}
+
+func asprintfExtern(name string, vaList bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) < 2 || (vaList && len(args) != 3) {
+			return Value{}, nil, fmt.Errorf("%s expects result, format, and argument list", name)
+		}
+		if !isPointerType(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects result and format pointers", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		var out string
+		var err error
+		if vaList {
+			out, err = formatVaListCString(name, ec, args[1].Int, args[2].Int)
+		} else {
+			out, err = formatCString(name, ec.Memory, args[1].Int, args[2:])
+		}
+		if err != nil {
+			return Value{}, nil, err
+		}
+		data := append([]byte(out), 0)
+		addr, err := ec.Memory.TryAlloc("extern:"+name, int64(len(data)), 1, false, blockGlobal)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if err := writeMemoryBytes(ec.Memory, addr, data); err != nil {
+			return Value{}, nil, err
+		}
+		if err := ec.Memory.WritePointer(args[0].Int, addr); err != nil {
+			return Value{}, nil, err
+		}
+		return IntValue(bytecode.TypeI32, int64(len(out))), nil, nil
+	}
+}
+
+func validAlignment(align uint64) bool {
+	return align != 0 && align&(align-1) == 0 && align <= 1<<30
+}
+
+func alignedAllocExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
+		if !isIntegerLike(args[0].Type) || !isIntegerLike(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects alignment and size arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		align := unsignedInt(args[0])
+		if !validAlignment(align) {
+			return PtrValue(0), nil, r.setErrno(ec.Memory, 22)
+		}
+		size, err := memorySizeArg(name, args[1])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		addr, err := ec.Memory.TryAlloc("extern:"+name, nonzeroAllocSize(size), int64(align), false, blockGlobal)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return PtrValue(addr), nil, nil
+	}
+}
+
+func posixMemalignExtern(name string) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 3 {
+			return Value{}, nil, fmt.Errorf("%s expects 3 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isIntegerLike(args[1].Type) || !isIntegerLike(args[2].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects result, alignment, and size arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		align := unsignedInt(args[1])
+		if !validAlignment(align) || align%uint64(ec.Memory.target.PointerSize) != 0 {
+			return IntValue(bytecode.TypeI32, 22), nil, nil
+		}
+		size, err := memorySizeArg(name, args[2])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		addr, err := ec.Memory.TryAlloc("extern:"+name, nonzeroAllocSize(size), int64(align), false, blockGlobal)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if err := ec.Memory.WritePointer(args[0].Int, addr); err != nil {
+			return Value{}, nil, err
+		}
+		return IntValue(bytecode.TypeI32, 0), nil, nil
+	}
+}
+
+// getoptState is the guest side of getopt: the optind, optarg, opterr and
+// optopt variables and the argument vector being parsed.
+type getoptState struct {
+	mem    *Memory
+	argc   int64
+	argv   uint64
+	optind uint64
+	optarg uint64
+	optopt uint64
+	opterr bool
+	prog   string
+}
+
+func (r *ExternRegistry) getoptState(mem *Memory, argc int64, argv uint64) (*getoptState, error) {
+	st := &getoptState{mem: mem, argc: argc, argv: argv}
+	var err error
+	if st.optind, _, err = r.lookupPOSIXVariable("optind", mem); err != nil {
+		return nil, err
+	}
+	if st.optarg, _, err = r.lookupPOSIXVariable("optarg", mem); err != nil {
+		return nil, err
+	}
+	if st.optopt, _, err = r.lookupPOSIXVariable("optopt", mem); err != nil {
+		return nil, err
+	}
+	opterrAddr, _, err := r.lookupPOSIXVariable("opterr", mem)
+	if err != nil {
+		return nil, err
+	}
+	opterr, err := mem.Load(opterrAddr, bytecode.TypeI32, 4)
+	if err != nil {
+		return nil, err
+	}
+	st.opterr = opterr.Int != 0
+	if argc > 0 {
+		if prog, err := st.arg(0); err == nil && prog != 0 {
+			st.prog, _ = mem.ReadCString(prog)
+		}
+	}
+	return st, nil
+}
+
+func (st *getoptState) arg(i int64) (uint64, error) {
+	v, err := st.mem.Load(st.argv+uint64(i*st.mem.target.PointerSize), bytecode.TypePtr, st.mem.target.PointerAlign)
+	return v.Int, err
+}
+
+func (st *getoptState) index() (int64, error) {
+	v, err := st.mem.Load(st.optind, bytecode.TypeI32, 4)
+	return signedInt(v), err
+}
+
+func (st *getoptState) setIndex(i int64) error {
+	return st.mem.Store(st.optind, bytecode.TypeI32, 4, IntValue(bytecode.TypeI32, i))
+}
+
+func (st *getoptState) setArg(addr uint64) error {
+	return st.mem.WritePointer(st.optarg, addr)
+}
+
+func (st *getoptState) setOpt(opt int64) error {
+	return st.mem.Store(st.optopt, bytecode.TypeI32, 4, IntValue(bytecode.TypeI32, opt))
+}
+
+// getoptExtern implements getopt and getopt_long. Arguments are not permuted:
+// parsing stops at the first operand, as glibc does under POSIXLY_CORRECT.
+// Setting optind to 0 restarts the scan.
+func getoptExtern(name string, r *ExternRegistry) ExternFunc {
+	long := name == "getopt_long"
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		want := 3
+		if long {
+			want = 5
+		}
+		if len(args) != want {
+			return Value{}, nil, fmt.Errorf("%s expects %d arguments", name, want)
+		}
+		if !isIntegerLike(args[0].Type) || !isPointerType(args[1].Type) || !isPointerType(args[2].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects argc, argv, and option string arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		optstring, err := ec.Memory.ReadCString(args[2].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		st, err := r.getoptState(ec.Memory, signedInt(args[0]), args[1].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		optstring = strings.TrimLeft(optstring, "+-")
+		colon := strings.HasPrefix(optstring, ":")
+		if colon {
+			st.opterr = false
+		}
+		result, err := r.getopt(ec, st, optstring, colon, args)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return IntValue(bytecode.TypeI32, result), nil, nil
+	}
+}
+
+func (r *ExternRegistry) getopt(ec *ExternContext, st *getoptState, optstring string, colon bool, args []Value) (int64, error) {
+	if err := st.setArg(0); err != nil {
+		return 0, err
+	}
+	optind, err := st.index()
+	if err != nil {
+		return 0, err
+	}
+	if r.getoptNext == nil {
+		r.getoptNext = make(map[*Memory]int)
+	}
+	if optind == 0 {
+		optind = 1
+		r.getoptNext[st.mem] = 0
+		if err := st.setIndex(optind); err != nil {
+			return 0, err
+		}
+	}
+	if optind < 1 || optind >= st.argc {
+		r.getoptNext[st.mem] = 0
+		return -1, nil
+	}
+	argAddr, err := st.arg(optind)
+	if err != nil {
+		return 0, err
+	}
+	if argAddr == 0 {
+		return -1, nil
+	}
+	arg, err := st.mem.ReadCString(argAddr)
+	if err != nil {
+		return 0, err
+	}
+	next := r.getoptNext[st.mem]
+	if next <= 0 || next >= len(arg) {
+		if len(arg) < 2 || arg[0] != '-' {
+			return -1, nil
+		}
+		if arg == "--" {
+			return -1, st.setIndex(optind + 1)
+		}
+		if len(args) == 5 && strings.HasPrefix(arg, "--") {
+			r.getoptNext[st.mem] = 0
+			return r.getoptLong(ec, st, args[3].Int, args[4].Int, optind, argAddr, arg, colon)
+		}
+		next = 1
+	}
+
+	ch := arg[next]
+	next++
+	advance := func() error {
+		if next < len(arg) {
+			r.getoptNext[st.mem] = next
+			return nil
+		}
+		r.getoptNext[st.mem] = 0
+		return st.setIndex(optind + 1)
+	}
+	spec := strings.IndexByte(optstring, ch)
+	if ch == ':' || spec < 0 {
+		if err := advance(); err != nil {
+			return 0, err
+		}
+		if err := st.setOpt(int64(ch)); err != nil {
+			return 0, err
+		}
+		return '?', r.getoptError(ec, st, fmt.Sprintf("invalid option -- '%c'", ch))
+	}
+	takesArg := strings.HasPrefix(optstring[spec+1:], ":")
+	optional := strings.HasPrefix(optstring[spec+1:], "::")
+	if !takesArg {
+		return int64(ch), advance()
+	}
+	r.getoptNext[st.mem] = 0
+	switch {
+	case next < len(arg):
+		if err := st.setArg(argAddr + uint64(next)); err != nil {
+			return 0, err
+		}
+	case optional:
+	case optind+1 < st.argc:
+		value, err := st.arg(optind + 1)
+		if err != nil {
+			return 0, err
+		}
+		if err := st.setArg(value); err != nil {
+			return 0, err
+		}
+		optind++
+	default:
+		if err := st.setIndex(optind + 1); err != nil {
+			return 0, err
+		}
+		if err := st.setOpt(int64(ch)); err != nil {
+			return 0, err
+		}
+		if colon {
+			return ':', nil
+		}
+		return '?', r.getoptError(ec, st, fmt.Sprintf("option requires an argument -- '%c'", ch))
+	}
+	return int64(ch), st.setIndex(optind + 1)
+}
+
+// Members of struct option are laid out back to back: name, has_arg, flag
+// and val.
+func optionLayout(mem *Memory) (hasArg, flag, val, size int64) {
+	ptrSize := mem.target.PointerSize
+	return ptrSize, ptrSize + 4, 2*ptrSize + 4, 2*ptrSize + 8
+}
+
+func (r *ExternRegistry) getoptLong(ec *ExternContext, st *getoptState, longopts, longindex uint64, optind int64, argAddr uint64, arg string, colon bool) (int64, error) {
+	if err := st.setIndex(optind + 1); err != nil {
+		return 0, err
+	}
+	nameText, _, hasValue := strings.Cut(arg[2:], "=")
+	valueAddr := argAddr + uint64(2+len(nameText)+1)
+	hasArgOff, flagOff, valOff, size := optionLayout(st.mem)
+	match, matches := int64(-1), 0
+	for i := int64(0); longopts != 0; i++ {
+		nameAddr, err := st.mem.Load(longopts+uint64(i*size), bytecode.TypePtr, 1)
+		if err != nil {
+			return 0, err
+		}
+		if nameAddr.Int == 0 {
+			break
+		}
+		name, err := st.mem.ReadCString(nameAddr.Int)
+		if err != nil {
+			return 0, err
+		}
+		if name == nameText {
+			match, matches = i, 1
+			break
+		}
+		if strings.HasPrefix(name, nameText) {
+			if matches == 0 {
+				match = i
+			}
+			matches++
+		}
+	}
+	if err := st.setOpt(0); err != nil {
+		return 0, err
+	}
+	if matches != 1 {
+		msg := fmt.Sprintf("unrecognized option '--%s'", nameText)
+		if matches > 1 {
+			msg = fmt.Sprintf("option '--%s' is ambiguous", nameText)
+		}
+		return '?', r.getoptError(ec, st, msg)
+	}
+
+	entry := longopts + uint64(match*size)
+	load := func(off int64, t bytecode.ValueType) (Value, error) {
+		return st.mem.Load(entry+uint64(off), t, 1)
+	}
+	hasArg, err := load(hasArgOff, bytecode.TypeI32)
+	if err != nil {
+		return 0, err
+	}
+	flag, err := load(flagOff, bytecode.TypePtr)
+	if err != nil {
+		return 0, err
+	}
+	val, err := load(valOff, bytecode.TypeI32)
+	if err != nil {
+		return 0, err
+	}
+	nameAddr, err := load(0, bytecode.TypePtr)
+	if err != nil {
+		return 0, err
+	}
+	fullName, err := st.mem.ReadCString(nameAddr.Int)
+	if err != nil {
+		return 0, err
+	}
+	switch signedInt(hasArg) {
+	case 0:
+		if hasValue {
+			if err := st.setOpt(signedInt(val)); err != nil {
+				return 0, err
+			}
+			return '?', r.getoptError(ec, st, fmt.Sprintf("option '--%s' doesn't allow an argument", fullName))
+		}
+	case 1:
+		if !hasValue {
+			if optind+1 >= st.argc {
+				if err := st.setOpt(signedInt(val)); err != nil {
+					return 0, err
+				}
+				if colon {
+					return ':', nil
+				}
+				return '?', r.getoptError(ec, st, fmt.Sprintf("option '--%s' requires an argument", fullName))
+			}
+			next, err := st.arg(optind + 1)
+			if err != nil {
+				return 0, err
+			}
+			valueAddr, hasValue = next, true
+			if err := st.setIndex(optind + 2); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if hasValue {
+		if err := st.setArg(valueAddr); err != nil {
+			return 0, err
+		}
+	}
+	if longindex != 0 {
+		if err := st.mem.Store(longindex, bytecode.TypeI32, 4, IntValue(bytecode.TypeI32, match)); err != nil {
+			return 0, err
+		}
+	}
+	if flag.Int != 0 {
+		return 0, st.mem.Store(flag.Int, bytecode.TypeI32, 4, val)
+	}
+	return signedInt(val), nil
+}
+
+func (r *ExternRegistry) getoptError(ec *ExternContext, st *getoptState, msg string) error {
+	if !st.opterr {
+		return nil
+	}
+	_, err := fmt.Fprintf(r.externStderr(ec), "%s: %s\n", st.prog, msg)
+	return err
+}
@@ -0,0 +1,177 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"shinya.click/cvm/bytecode"
+	"shinya.click/cvm/sema"
+)
+
+func TestPOSIXSubsetIsOptIn(t *testing.T) {
+	reg := DefaultExternRegistry(nil, nil)
+	mem := NewMemory(bytecode.DefaultTarget())
+	for _, name := range []string{"getline", "strcasecmp", "strncasecmp"} {
+		if _, ok := reg.Lookup(name); ok {
+			t.Fatalf("default registry provides %s", name)
+		}
+	}
+	if _, ok := reg.LookupVariable("optind", mem); ok {
+		t.Fatalf("default registry provides optind")
+	}
+	reg.RegisterPOSIXSubset()
+	for _, name := range []string{"strcasecmp", "strncasecmp", "memmem", "strsep", "getline", "getdelim", "fdopen", "asprintf", "vasprintf", "aligned_alloc", "posix_memalign", "getopt", "getopt_long"} {
+		if _, ok := reg.Lookup(name); !ok {
+			t.Fatalf("POSIX subset is missing %s", name)
+		}
+	}
+	addr, ok := reg.LookupVariable("optind", mem)
+	if !ok {
+		t.Fatalf("POSIX subset is missing optind")
+	}
+	if v, err := mem.Load(addr, bytecode.TypeI32, 4); err != nil || v.Int != 1 {
+		t.Fatalf("optind = %+v, %v; want 1", v, err)
+	}
+}
+
+func TestCompileAndRunPOSIXSubset(t *testing.T) {
+	mod := compileModule(t, `#define _GNU_SOURCE
+#include <stddef.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <unistd.h>
+static const char hay[] = "find the\0needle";
+int main(void) {
+	FILE *f = fopen("in.txt", "r");
+	char *line = NULL;
+	size_t cap = 0;
+	ssize_t n;
+	while ((n = getline(&line, &cap, f)) > 0)
+		printf("%ld:%s", (long)n, line);
+	printf("eof=%ld\n", (long)getline(&line, &cap, f));
+	free(line);
+	fclose(f);
+
+	char buf[8];
+	strcpy(buf, "a,b,,c");
+	char *rest = buf, *tok;
+	while ((tok = strsep(&rest, ",")) != NULL)
+		printf("[%s]", tok);
+	printf("\n");
+
+	printf("%d %d %d\n", strcasecmp("Hello", "hELLO") == 0, strncasecmp("abcX", "ABCY", 3) == 0, strcasecmp("a", "B") < 0);
+	char *at = memmem(hay, sizeof hay, "needle", 6);
+	printf("memmem=%ld\n", (long)(at - hay));
+
+	char *s;
+	int len = asprintf(&s, "%s-%d", "v", 42);
+	printf("%d %s\n", len, s);
+	free(s);
+
+	void *p = aligned_alloc(64, 10);
+	void *q;
+	int rc = posix_memalign(&q, 32, 5);
+	printf("%d %d %d %d\n", (int)((unsigned long)p % 64), rc, (int)((unsigned long)q % 32), posix_memalign(&q, 3, 5));
+	free(p);
+	free(q);
+
+	FILE *out = fdopen(STDOUT_FILENO, "w");
+	fprintf(out, "fdopen ok\n");
+	return 0;
+}`, sema.SemaOptions{})
+	var stdout bytes.Buffer
+	reg := DefaultExternRegistry(&stdout, nil)
+	reg.RegisterPOSIXSubset()
+	reg.AddFile("in.txt", []byte("one\nlonger line\nlast"))
+	p, err := LoadModule(mod, LoadOptions{Externs: reg})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	if _, err := Run(context.Background(), p, RunOptions{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := "4:one\n12:longer line\n4:lasteof=-1\n[a][b][][c]\n1 1 1\nmemmem=9\n4 v-42\n0 0 0 22\nfdopen ok\n"
+	if got := stdout.String(); got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestCompileAndRunGetopt(t *testing.T) {
+	mod := compileModule(t, `#include <stddef.h>
+#include <stdio.h>
+#include <getopt.h>
+static int verbose;
+static const struct option opts[] = {
+	{"verbose", no_argument, &verbose, 1},
+	{"output", required_argument, NULL, 'o'},
+	{"level", optional_argument, NULL, 'l'},
+	{NULL, 0, NULL, 0},
+};
+int main(int argc, char **argv) {
+	int c, idx = -1;
+	while ((c = getopt_long(argc, argv, "ab:o:", opts, &idx)) != -1) {
+		switch (c) {
+		case 0:
+			printf("flag %s\n", opts[idx].name);
+			break;
+		case 'l':
+			if (optarg)
+				printf("level %s\n", optarg);
+			else
+				printf("level\n");
+			break;
+		case '?':
+			printf("bad %d\n", optopt);
+			break;
+		default:
+			if (optarg)
+				printf("opt %c %s\n", c, optarg);
+			else
+				printf("opt %c\n", c);
+		}
+	}
+	for (; optind < argc; optind++)
+		printf("operand %s\n", argv[optind]);
+	return verbose;
+}`, sema.SemaOptions{})
+	var stdout, stderr bytes.Buffer
+	reg := DefaultExternRegistry(&stdout, &stderr)
+	reg.RegisterPOSIXSubset()
+	args := []string{"tool", "-ab", "x", "-bvalue", "--verb", "--output=out.txt", "--output", "o2", "--level", "--level=3", "-z", "--nope", "--", "-a", "file"}
+	p, err := LoadModule(mod, LoadOptions{Externs: reg, Args: args})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	st, err := Run(context.Background(), p, RunOptions{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if st.Code != 1 {
+		t.Fatalf("exit code = %d, want verbose flag 1", st.Code)
+	}
+	want := strings.Join([]string{
+		"opt a",
+		"opt b x",
+		"opt b value",
+		"flag verbose",
+		"opt o out.txt",
+		"opt o o2",
+		"level",
+		"level 3",
+		"bad 122",
+		"bad 0",
+		"operand -a",
+		"operand file",
+		"",
+	}, "\n")
+	if got := stdout.String(); got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "tool: invalid option -- 'z'\ntool: unrecognized option '--nope'\n"; got != want {
+		t.Fatalf("stderr = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,316 @@
+package runtime
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// Profile collects execution counts while a VM runs with RunOptions.Profile
+// set. Every executed instruction is charged to the full call stack it ran
+// under, so the totals are exact rather than timer samples. With SamplePeriod
+// above one only every Nth instruction is recorded, weighted by N.
+type Profile struct {
+	SamplePeriod int
+
+	module *bytecode.Module
+	nodes  []profileNode
+	index  map[profileNodeKey]int
+	steps  map[profileSite]int64
+	tick   int
+}
+
+// profileNode is one distinct call path. callPC is the pc of the call
+// instruction in the parent frame.
+type profileNode struct {
+	parent int
+	fn     int
+	callPC int
+	calls  int64
+}
+
+type profileNodeKey struct {
+	parent int
+	fn     int
+	callPC int
+}
+
+type profileSite struct {
+	node int
+	pc   int
+}
+
+// FunctionProfile summarizes one function. Steps counts instructions executed
+// in the function itself; InclusiveSteps adds everything it called.
+type FunctionProfile struct {
+	Name           string
+	ID             int
+	Calls          int64
+	Steps          int64
+	InclusiveSteps int64
+}
+
+func NewProfile() *Profile {
+	return &Profile{index: map[profileNodeKey]int{}, steps: map[profileSite]int64{}}
+}
+
+func (p *Profile) enter(module *bytecode.Module, parent, fn, callPC int) int {
+	p.module = module
+	key := profileNodeKey{parent: parent, fn: fn, callPC: callPC}
+	id, ok := p.index[key]
+	if !ok {
+		id = len(p.nodes)
+		p.nodes = append(p.nodes, profileNode{parent: parent, fn: fn, callPC: callPC})
+		p.index[key] = id
+	}
+	p.nodes[id].calls++
+	return id
+}
+
+func (p *Profile) step(node, pc int) {
+	weight := int64(1)
+	if p.SamplePeriod > 1 {
+		p.tick++
+		if p.tick < p.SamplePeriod {
+			return
+		}
+		p.tick = 0
+		weight = int64(p.SamplePeriod)
+	}
+	p.steps[profileSite{node: node, pc: pc}] += weight
+}
+
+// Functions returns per-function totals ordered by exclusive steps, largest
+// first.
+func (p *Profile) Functions() []FunctionProfile {
+	byFunc := map[int]*FunctionProfile{}
+	get := func(fn int) *FunctionProfile {
+		fp, ok := byFunc[fn]
+		if !ok {
+			fp = &FunctionProfile{ID: fn, Name: p.functionName(fn)}
+			byFunc[fn] = fp
+		}
+		return fp
+	}
+	for _, n := range p.nodes {
+		get(n.fn).Calls += n.calls
+	}
+	for site, n := range p.steps {
+		node := p.nodes[site.node]
+		get(node.fn).Steps += n
+		// Recursive functions appear several times on a stack but are only
+		// charged once per step.
+		seen := map[int]bool{}
+		for id := site.node; id >= 0; id = p.nodes[id].parent {
+			fn := p.nodes[id].fn
+			if !seen[fn] {
+				seen[fn] = true
+				get(fn).InclusiveSteps += n
+			}
+		}
+	}
+	out := make([]FunctionProfile, 0, len(byFunc))
+	for _, fp := range byFunc {
+		out = append(out, *fp)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Steps != out[j].Steps {
+			return out[i].Steps > out[j].Steps
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+func (p *Profile) functionName(fn int) string {
+	if p.module != nil && fn >= 0 && fn < len(p.module.Functions) && p.module.Functions[fn].Name != "" {
+		return p.module.Functions[fn].Name
+	}
+	return fmt.Sprintf("fn#%d", fn)
+}
+
+// WritePprof writes the profile as a gzip-compressed pprof protobuf with two
+// sample values, executed steps and calls. Locations carry source lines when
+// the module has debug info.
+func (p *Profile) WritePprof(w io.Writer) error {
+	enc := newPprofEncoder(p)
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(enc.encode()); err != nil {
+		_ = gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+type pprofEncoder struct {
+	p         *Profile
+	strings   []string
+	stringIDs map[string]int64
+	funcs     map[int]uint64
+	funcOrder []int
+	locs      map[[2]int]uint64
+	locOrder  [][2]int
+}
+
+func newPprofEncoder(p *Profile) *pprofEncoder {
+	return &pprofEncoder{
+		p:         p,
+		strings:   []string{""},
+		stringIDs: map[string]int64{"": 0},
+		funcs:     map[int]uint64{},
+		locs:      map[[2]int]uint64{},
+	}
+}
+
+func (e *pprofEncoder) str(s string) int64 {
+	id, ok := e.stringIDs[s]
+	if !ok {
+		id = int64(len(e.strings))
+		e.strings = append(e.strings, s)
+		e.stringIDs[s] = id
+	}
+	return id
+}
+
+func (e *pprofEncoder) location(fn, pc int) uint64 {
+	key := [2]int{fn, pc}
+	id, ok := e.locs[key]
+	if !ok {
+		if _, ok := e.funcs[fn]; !ok {
+			e.funcs[fn] = uint64(len(e.funcOrder) + 1)
+			e.funcOrder = append(e.funcOrder, fn)
+		}
+		id = uint64(len(e.locOrder) + 1)
+		e.locs[key] = id
+		e.locOrder = append(e.locOrder, key)
+	}
+	return id
+}
+
+func (e *pprofEncoder) stack(node, pc int) []uint64 {
+	var ids []uint64
+	for id := node; id >= 0; id = e.p.nodes[id].parent {
+		ids = append(ids, e.location(e.p.nodes[id].fn, pc))
+		pc = e.p.nodes[id].callPC
+	}
+	return ids
+}
+
+func (e *pprofEncoder) encode() []byte {
+	var out protoBuffer
+	for _, st := range [][2]string{{"steps", "count"}, {"calls", "count"}} {
+		var vt protoBuffer
+		vt.int64Field(1, e.str(st[0]))
+		vt.int64Field(2, e.str(st[1]))
+		out.bytesField(1, vt.data)
+	}
+
+	sites := make([]profileSite, 0, len(e.p.steps))
+	for site := range e.p.steps {
+		sites = append(sites, site)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].node != sites[j].node {
+			return sites[i].node < sites[j].node
+		}
+		return sites[i].pc < sites[j].pc
+	})
+	for _, site := range sites {
+		out.bytesField(2, encodeSample(e.stack(site.node, site.pc), e.p.steps[site], 0))
+	}
+	for id, n := range e.p.nodes {
+		if n.calls > 0 {
+			out.bytesField(2, encodeSample(e.stack(id, 0), 0, n.calls))
+		}
+	}
+
+	for i, key := range e.locOrder {
+		var loc protoBuffer
+		loc.uint64Field(1, uint64(i+1))
+		var line protoBuffer
+		line.uint64Field(1, e.funcs[key[0]])
+		if src, ok := e.sourceLocation(key[0], key[1]); ok {
+			line.int64Field(2, int64(src.Line))
+		}
+		loc.bytesField(4, line.data)
+		out.bytesField(4, loc.data)
+	}
+	for i, fn := range e.funcOrder {
+		var f protoBuffer
+		f.uint64Field(1, uint64(i+1))
+		name := e.str(e.p.functionName(fn))
+		f.int64Field(2, name)
+		f.int64Field(3, name)
+		if src, ok := e.sourceLocation(fn, 0); ok {
+			f.int64Field(4, e.str(src.File))
+			f.int64Field(5, int64(src.Line))
+		}
+		out.bytesField(5, f.data)
+	}
+	var period protoBuffer
+	period.int64Field(1, e.str("steps"))
+	period.int64Field(2, e.str("count"))
+	// The string table goes last, once every string has been interned.
+	for _, s := range e.strings {
+		out.stringField(6, s)
+	}
+	out.bytesField(11, period.data)
+	out.int64Field(12, int64(max(e.p.SamplePeriod, 1)))
+	out.int64Field(14, e.str("steps"))
+	return out.data
+}
+
+func (e *pprofEncoder) sourceLocation(fn, pc int) (bytecode.SourceLocation, bool) {
+	if e.p.module == nil {
+		return bytecode.SourceLocation{}, false
+	}
+	return e.p.module.Debug.Lookup(fn, pc)
+}
+
+func encodeSample(locations []uint64, steps, calls int64) []byte {
+	var s, locs, values protoBuffer
+	for _, id := range locations {
+		locs.varint(id)
+	}
+	values.varint(uint64(steps))
+	values.varint(uint64(calls))
+	s.bytesField(1, locs.data)
+	s.bytesField(2, values.data)
+	return s.data
+}
+
+// protoBuffer is the small slice of protobuf wire encoding the pprof format
+// needs.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.data = append(b.data, byte(v)|0x80)
+		v >>= 7
+	}
+	b.data = append(b.data, byte(v))
+}
+
+func (b *protoBuffer) uint64Field(field int, v uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+func (b *protoBuffer) int64Field(field int, v int64) {
+	b.uint64Field(field, uint64(v))
+}
+
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) stringField(field int, s string) {
+	b.bytesField(field, []byte(s))
+}
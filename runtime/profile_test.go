@@ -0,0 +1,287 @@
+package runtime
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"shinya.click/cvm/bytecode"
+	"shinya.click/cvm/sema"
+)
+
+const profileSource = `int fib(int n) { return n < 2 ? n : fib(n - 1) + fib(n - 2); }
+int sq(int x) { return x * x; }
+int main(void) {
+	int t = 0;
+	for (int i = 0; i < 10; i++) t += sq(i);
+	return fib(10) + t - 340;
+}`
+
+func TestProfileCountsCallsAndSteps(t *testing.T) {
+	prof := NewProfile()
+	st, err := Run(context.Background(), compileProgram(t, profileSource, nil, sema.SemaOptions{}), RunOptions{Profile: prof})
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+	funcs := map[string]FunctionProfile{}
+	var total int64
+	for _, fp := range prof.Functions() {
+		funcs[fp.Name] = fp
+		total += fp.Steps
+	}
+	if funcs["main"].Calls != 1 || funcs["sq"].Calls != 10 || funcs["fib"].Calls != 177 {
+		t.Fatalf("calls = main %d, sq %d, fib %d; want 1, 10, 177", funcs["main"].Calls, funcs["sq"].Calls, funcs["fib"].Calls)
+	}
+	if funcs["main"].InclusiveSteps != total {
+		t.Fatalf("main inclusive steps = %d, want all %d steps", funcs["main"].InclusiveSteps, total)
+	}
+	if fib := funcs["fib"]; fib.InclusiveSteps != fib.Steps || fib.Steps == 0 {
+		t.Fatalf("fib steps = %+v, want recursive steps counted once", fib)
+	}
+	if sq := funcs["sq"]; sq.Steps%10 != 0 {
+		t.Fatalf("sq steps = %d, want a multiple of its 10 calls", sq.Steps)
+	}
+}
+
+func TestProfileSamplePeriodWeightsSamples(t *testing.T) {
+	exact, sampled := NewProfile(), NewProfile()
+	sampled.SamplePeriod = 5
+	for _, prof := range []*Profile{exact, sampled} {
+		if _, err := Run(context.Background(), compileProgram(t, profileSource, nil, sema.SemaOptions{}), RunOptions{Profile: prof}); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	}
+	sum := func(p *Profile) (n int64) {
+		for _, fp := range p.Functions() {
+			n += fp.Steps
+		}
+		return n
+	}
+	if e, s := sum(exact), sum(sampled); s > e || e-s >= 5 {
+		t.Fatalf("sampled steps = %d, want within one period of exact %d", s, e)
+	}
+}
+
+func TestProfileWritesPprof(t *testing.T) {
+	for _, withLines := range []bool{false, true} {
+		mod := compileModule(t, profileSource, sema.SemaOptions{})
+		if withLines {
+			mod.Debug = &bytecode.DebugInfo{Files: []string{"prof.c"}}
+			for i := range mod.Functions {
+				mod.Debug.Functions = append(mod.Debug.Functions, bytecode.FunctionDebugInfo{
+					Func:  i,
+					Lines: []bytecode.LineEntry{{PC: 0, File: 0, Line: i + 1, Column: 1}},
+				})
+			}
+		}
+		p, err := LoadModule(mod, LoadOptions{})
+		if err != nil {
+			t.Fatalf("LoadModule: %v", err)
+		}
+		prof := NewProfile()
+		if _, err := Run(context.Background(), p, RunOptions{Profile: prof}); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := prof.WritePprof(&buf); err != nil {
+			t.Fatalf("WritePprof: %v", err)
+		}
+		zr, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatalf("gzip: %v", err)
+		}
+		raw, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("read profile: %v", err)
+		}
+		checkPprof(t, raw, mod, prof, withLines)
+	}
+}
+
+// protoField is one decoded protobuf field: varint holds varint values and
+// data the payload of length-delimited ones.
+type protoField struct {
+	num    int
+	varint uint64
+	data   []byte
+}
+
+func decodeProtoFields(t *testing.T, data []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(data) != 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("malformed protobuf key")
+		}
+		data = data[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("malformed varint in field %d", f.num)
+			}
+			data = data[n:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				t.Fatalf("malformed length in field %d", f.num)
+			}
+			f.data = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d in field %d", key&7, f.num)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func decodePackedVarints(t *testing.T, data []byte) []uint64 {
+	t.Helper()
+	var out []uint64
+	for len(data) != 0 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("malformed packed varint")
+		}
+		out = append(out, v)
+		data = data[n:]
+	}
+	return out
+}
+
+// checkPprof walks the profile.proto message: sample types, samples,
+// locations, functions and the string table.
+func checkPprof(t *testing.T, raw []byte, mod *bytecode.Module, prof *Profile, withLines bool) {
+	t.Helper()
+	type function struct {
+		name, file string
+		startLine  uint64
+	}
+	type location struct{ fn, line uint64 }
+	var strs []string
+	var sampleTypes [][2]uint64
+	var samples [][2][]uint64
+	locations := map[uint64]location{}
+	functions := map[uint64]function{}
+	var fnFields [][]protoField
+	for _, f := range decodeProtoFields(t, raw) {
+		switch f.num {
+		case 1:
+			var vt [2]uint64
+			for _, g := range decodeProtoFields(t, f.data) {
+				vt[g.num-1] = g.varint
+			}
+			sampleTypes = append(sampleTypes, vt)
+		case 2:
+			var sample [2][]uint64
+			for _, g := range decodeProtoFields(t, f.data) {
+				sample[g.num-1] = decodePackedVarints(t, g.data)
+			}
+			samples = append(samples, sample)
+		case 4:
+			var id uint64
+			var loc location
+			for _, g := range decodeProtoFields(t, f.data) {
+				switch g.num {
+				case 1:
+					id = g.varint
+				case 4:
+					for _, h := range decodeProtoFields(t, g.data) {
+						switch h.num {
+						case 1:
+							loc.fn = h.varint
+						case 2:
+							loc.line = h.varint
+						}
+					}
+				}
+			}
+			locations[id] = loc
+		case 5:
+			fnFields = append(fnFields, decodeProtoFields(t, f.data))
+		case 6:
+			strs = append(strs, string(f.data))
+		}
+	}
+	str := func(i uint64) string {
+		if i >= uint64(len(strs)) {
+			t.Fatalf("string index %d outside table of %d", i, len(strs))
+		}
+		return strs[i]
+	}
+	for _, fields := range fnFields {
+		var id uint64
+		var fn function
+		for _, g := range fields {
+			switch g.num {
+			case 1:
+				id = g.varint
+			case 2:
+				fn.name = str(g.varint)
+			case 4:
+				fn.file = str(g.varint)
+			case 5:
+				fn.startLine = g.varint
+			}
+		}
+		functions[id] = fn
+	}
+
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("string table = %q, want a leading empty string", strs)
+	}
+	if len(sampleTypes) != 2 || str(sampleTypes[0][0]) != "steps" || str(sampleTypes[0][1]) != "count" ||
+		str(sampleTypes[1][0]) != "calls" || str(sampleTypes[1][1]) != "count" {
+		t.Fatalf("sample types = %v, want steps/count and calls/count", sampleTypes)
+	}
+
+	// Lines were injected as function index + 1 for every pc.
+	wantLine := map[string]uint64{}
+	for i, fn := range mod.Functions {
+		wantLine[fn.Name] = uint64(i + 1)
+	}
+	for id, loc := range locations {
+		fn, ok := functions[loc.fn]
+		if !ok {
+			t.Fatalf("location %d references unknown function %d", id, loc.fn)
+		}
+		want, file := uint64(0), ""
+		if withLines {
+			want, file = wantLine[fn.name], "prof.c"
+		}
+		if loc.line != want || fn.startLine != want || fn.file != file {
+			t.Fatalf("location %d in %s at line %d (start %d, file %q), want line %d in %q", id, fn.name, loc.line, fn.startLine, fn.file, want, file)
+		}
+	}
+
+	var steps int64
+	calls := map[string]int64{}
+	for _, sample := range samples {
+		if len(sample[0]) == 0 || len(sample[1]) != 2 {
+			t.Fatalf("sample = %v, want locations and two values", sample)
+		}
+		for _, id := range sample[0] {
+			if _, ok := locations[id]; !ok {
+				t.Fatalf("sample references unknown location %d", id)
+			}
+		}
+		steps += int64(sample[1][0])
+		calls[functions[locations[sample[0][0]].fn].name] += int64(sample[1][1])
+	}
+	var wantSteps int64
+	for _, fp := range prof.Functions() {
+		wantSteps += fp.Steps
+		if calls[fp.Name] != fp.Calls {
+			t.Fatalf("%s calls in samples = %d, want %d", fp.Name, calls[fp.Name], fp.Calls)
+		}
+	}
+	if steps != wantSteps {
+		t.Fatalf("steps in samples = %d, want %d", steps, wantSteps)
+	}
+}
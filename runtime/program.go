@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math"
@@ -22,9 +23,12 @@ type Program struct {
 	funcAddr   []uint64
 	stringAddr []uint64
 	externs    map[int]ExternFunc
+	code       []*decodedFunc
 	externCtx  *ExternContext
 	externReg  *ExternRegistry
-	entryFunc  int
+	fenv       floatEnv
+	progName   string
+	entryFunc  int // -1 when the module has no entry
 	entryArgs  []Value
 }
 
@@ -33,10 +37,22 @@ func Load(r io.Reader, opts LoadOptions) (*Program, error) {
 	if err != nil {
 		return nil, &LoadError{Reason: "decode module", Cause: err}
 	}
-	if mod.Entry == nil || mod.Entry.Global == bytecode.NoEntryGlobal {
-		return nil, &LoadError{Reason: "module has no runnable entry"}
+	return loadModule(mod, opts)
+}
+
+// LoadModule loads an in-memory module, such as one fresh out of codegen,
+// without going through the binary encoding.
+func LoadModule(mod *bytecode.Module, opts LoadOptions) (*Program, error) {
+	if mod == nil {
+		return nil, &LoadError{Reason: "nil module"}
 	}
+	if err := bytecode.ValidateModule(mod); err != nil {
+		return nil, &LoadError{Reason: "validate module", Cause: err}
+	}
+	return loadModule(mod, opts)
+}
 
+func loadModule(mod *bytecode.Module, opts LoadOptions) (*Program, error) {
 	reg := opts.Externs
 	if reg == nil {
 		reg = DefaultExternRegistry(nil, nil)
@@ -50,8 +66,14 @@ func Load(r io.Reader, opts LoadOptions) (*Program, error) {
 		stringAddr: make([]uint64, len(mod.Strings)),
 		externs:    make(map[int]ExternFunc),
 		externReg:  reg,
+		progName:   "cvm",
+	}
+	if len(opts.Args) > 0 {
+		p.progName = opts.Args[0]
 	}
 	p.externCtx = reg.context(p.memory)
+	p.externCtx.Layouts = mod.Layouts
+	p.externCtx.fenv = &p.fenv
 	if err := p.allocateGlobals(reg); err != nil {
 		return nil, err
 	}
@@ -59,7 +81,14 @@ func Load(r io.Reader, opts LoadOptions) (*Program, error) {
 		return nil, err
 	}
 	p.protectReadonlyGlobals()
+	p.decodeFunctions()
 
+	// A module without an entry, such as a library, can still be loaded
+	// for Call; only Run needs one.
+	p.entryFunc = -1
+	if mod.Entry == nil || mod.Entry.Global == bytecode.NoEntryGlobal {
+		return p, nil
+	}
 	entryGlobal := mod.Globals[mod.Entry.Global]
 	p.entryFunc = entryGlobal.Func
 	entryArgs, err := p.defaultEntryArgs(entryGlobal.Sig, opts.Args)
@@ -72,6 +101,79 @@ func Load(r io.Reader, opts LoadOptions) (*Program, error) {
 
 func (p *Program) Module() *bytecode.Module { return p.module }
 
+// Call runs the function name to completion on a fresh VM and returns its
+// result. The VM shares the program's memory, so globals keep the values left
+// by earlier runs and calls. A void function returns the zero Value; a struct
+// result is returned as the address of a copy in program memory.
+func (p *Program) Call(ctx context.Context, name string, args ...Value) (Value, error) {
+	return p.CallWithOptions(ctx, RunOptions{}, name, args...)
+}
+
+// CallWithOptions is Call with the step limit, quotas and profile of opts
+// applied to the call.
+func (p *Program) CallWithOptions(ctx context.Context, opts RunOptions, name string, args ...Value) (Value, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if p == nil || p.module == nil {
+		return Value{}, fmt.Errorf("nil program")
+	}
+	globalID, ok := p.functionGlobal(name)
+	if !ok {
+		return Value{}, fmt.Errorf("no function named %q", name)
+	}
+	g := p.module.Globals[globalID]
+	sig := p.module.Sigs[g.Sig]
+	if len(args) < len(sig.Params) || !sig.Variadic && len(args) > len(sig.Params) {
+		return Value{}, fmt.Errorf("%s expects %d arguments, got %d", name, len(sig.Params), len(args))
+	}
+	for i, param := range sig.Params {
+		if args[i].Type != param {
+			return Value{}, fmt.Errorf("%s argument %d has type %s, want %s", name, i, args[i].Type, param)
+		}
+	}
+	vm, err := newIdleVM(p, opts)
+	if err != nil {
+		return Value{}, err
+	}
+	st, done, err := vm.invokeGlobal(ctx, globalID, g.Sig, args)
+	for !done && err == nil && len(vm.frames) != 0 {
+		st, done, err = vm.run(ctx)
+	}
+	cleanupErr := vm.cleanupFrames()
+	if err != nil {
+		return Value{}, err
+	}
+	if cleanupErr != nil {
+		return Value{}, cleanupErr
+	}
+	if done {
+		return Value{}, &ExitError{Status: st}
+	}
+	if sig.Ret == bytecode.TypeVoid || len(vm.stack) == 0 {
+		return Value{}, nil
+	}
+	return vm.stack[len(vm.stack)-1], nil
+}
+
+// functionGlobal finds the defined function called name, preferring an
+// external definition over internal ones that happen to share the name.
+func (p *Program) functionGlobal(name string) (int, bool) {
+	found := -1
+	for id, g := range p.module.Globals {
+		if g.Kind != bytecode.GlobalFunc || g.Name != name {
+			continue
+		}
+		if !g.Internal {
+			return id, true
+		}
+		if found < 0 {
+			found = id
+		}
+	}
+	return found, found >= 0
+}
+
 func (p *Program) Memory() *Memory { return p.memory }
 
 func (p *Program) GlobalAddr(id int) uint64 { return p.globalAddr[id] }
@@ -134,7 +236,7 @@ func (p *Program) ExternContext() *ExternContext {
 	if p.externCtx != nil {
 		return p.externCtx
 	}
-	return &ExternContext{Memory: p.memory}
+	return &ExternContext{Memory: p.memory, Layouts: p.module.Layouts, fenv: &p.fenv}
 }
 
 func (p *Program) TryGlobalAddr(id int) (uint64, error) {
@@ -205,8 +307,10 @@ func (p *Program) allocateGlobals(reg *ExternRegistry) error {
 		}
 	}
 
+	// Literals are aligned for wchar_t so wide strings can be loaded a
+	// character at a time.
 	for _, s := range p.module.Strings {
-		addr, err := p.memory.TryAlloc(fmt.Sprintf("string:%d", s.ID), int64(len(s.Bytes)), 1, false, blockString)
+		addr, err := p.memory.TryAlloc(fmt.Sprintf("string:%d", s.ID), int64(len(s.Bytes)), 4, false, blockString)
 		if err != nil {
 			return &LoadError{Reason: fmt.Sprintf("allocate string %d", s.ID), Cause: err}
 		}
@@ -264,7 +368,9 @@ func (p *Program) applyRelocations() error {
 			if err != nil {
 				return &LoadError{Reason: "relocation for global " + g.Name, Cause: err}
 			}
-			if err := p.memory.WritePointer(base+uint64(r.Offset), value); err != nil {
+			// Struct members are packed, so a pointer inside an aggregate
+			// initializer need not be aligned.
+			if err := p.memory.Store(base+uint64(r.Offset), bytecode.TypePtr, 1, PtrValue(value)); err != nil {
 				return &LoadError{Reason: "write relocation for global " + g.Name, Cause: err}
 			}
 		}
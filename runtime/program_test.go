@@ -2,21 +2,46 @@ package runtime
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"strings"
 	"testing"
 
 	"shinya.click/cvm/bytecode"
+	"shinya.click/cvm/sema"
 )
 
-func TestLoadRejectsNoEntryModule(t *testing.T) {
+func TestLoadAcceptsModuleWithoutEntry(t *testing.T) {
 	mod := bytecode.NewModule()
 	var buf bytes.Buffer
 	if err := bytecode.EncodeModule(&buf, mod); err != nil {
 		t.Fatalf("EncodeModule: %v", err)
 	}
-	_, err := Load(bytes.NewReader(buf.Bytes()), LoadOptions{})
-	if err == nil || !strings.Contains(err.Error(), "entry") {
-		t.Fatalf("Load error = %v, want entry failure", err)
+	p, err := Load(bytes.NewReader(buf.Bytes()), LoadOptions{})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, err := Run(context.Background(), p, RunOptions{}); err == nil || !strings.Contains(err.Error(), "entry") {
+		t.Fatalf("Run error = %v, want entry failure", err)
+	}
+}
+
+func TestCallIntoLibraryWithoutMain(t *testing.T) {
+	mod := compileModule(t, `static int total;
+int add(int n) { total += n; return total; }`, sema.SemaOptions{})
+	p, err := LoadModule(mod, LoadOptions{})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	ctx := context.Background()
+	if got, err := p.Call(ctx, "add", IntValue(bytecode.TypeI32, 40)); err != nil || got.Int != 40 {
+		t.Fatalf("add(40) = %+v, %v", got, err)
+	}
+	if got, err := p.Call(ctx, "add", IntValue(bytecode.TypeI32, 2)); err != nil || got.Int != 42 {
+		t.Fatalf("add(2) = %+v, %v", got, err)
+	}
+	if _, err := Run(ctx, p, RunOptions{}); err == nil || !strings.Contains(err.Error(), "no runnable entry") {
+		t.Fatalf("Run error = %v, want missing entry", err)
 	}
 }
 
@@ -44,6 +69,40 @@ func TestLoadAppliesGlobalRelocation(t *testing.T) {
 	}
 }
 
+func TestLoadRelocatesPointerMembersOfPackedStructs(t *testing.T) {
+	// Members are packed, so p and q sit at offsets 1 and 10 and at most
+	// one of them can be pointer aligned.
+	mod := compileModule(t, `struct s { char c; const char *p; char d; const char *q; };
+struct s g = { 'x', "hi", 'y', "ok" };
+int main(void) { return g.p[1] == 'i' && g.q[0] == 'o' ? 0 : 1; }`, sema.SemaOptions{})
+	p, err := LoadModule(mod, LoadOptions{})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	st, err := Run(context.Background(), p, RunOptions{})
+	if err != nil || st.Code != 0 {
+		t.Fatalf("Run = %+v, %v; want exit 0", st, err)
+	}
+}
+
+func TestLoadModuleRunsInMemoryModule(t *testing.T) {
+	p, err := LoadModule(testMainModule(bytecode.I32Const(5), bytecode.Return(bytecode.TypeI32)), LoadOptions{})
+	if err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	st, err := Run(context.Background(), p, RunOptions{})
+	if err != nil || st.Code != 5 {
+		t.Fatalf("Run = %+v, %v; want exit 5", st, err)
+	}
+
+	bad := testMainModule(bytecode.I32Const(0), bytecode.Return(bytecode.TypeI32))
+	bad.Functions[0].Sig = 99
+	var loadErr *LoadError
+	if _, err := LoadModule(bad, LoadOptions{}); !errors.As(err, &loadErr) || loadErr.Reason != "validate module" {
+		t.Fatalf("LoadModule invalid module error = %v, want validate module LoadError", err)
+	}
+}
+
 func TestLoadReturnsErrorForStdoutExternVariableWithUnsupportedPointerSize(t *testing.T) {
 	mod := testMainModule(bytecode.I32Const(0), bytecode.Return(bytecode.TypeI32))
 	mod.Target.PointerSize = 3
@@ -97,3 +156,71 @@ func TestLoadRejectsNilExternFunction(t *testing.T) {
 		t.Fatalf("Load error = %v, want unresolved nil extern", err)
 	}
 }
+
+func TestProgramCallRunsFunctionsAgainstSharedMemory(t *testing.T) {
+	var stdout bytes.Buffer
+	p := compileProgram(t, `#include <stdio.h>
+#include <stdlib.h>
+static int counter;
+struct pair { int a, b; };
+int bump(int by) { counter += by; return counter; }
+double scale(double x, long k) { return x * k; }
+void report(void) { printf("counter=%d\n", counter); }
+struct pair swap(int a, int b) { struct pair p = { b, a }; return p; }
+void quit(void) { exit(3); }
+int main(void) { return bump(1); }
+`, &stdout, sema.SemaOptions{})
+	ctx := context.Background()
+	if st, err := Run(ctx, p, RunOptions{}); err != nil || st.Code != 1 {
+		t.Fatalf("Run = %+v, %v; want exit 1", st, err)
+	}
+	got, err := p.Call(ctx, "bump", IntValue(bytecode.TypeI32, 41))
+	if err != nil || got.Type != bytecode.TypeI32 || int32(got.Int) != 42 {
+		t.Fatalf("Call(bump) = %v, %v; want i32 42", got, err)
+	}
+	got, err = p.Call(ctx, "scale", FloatValue(bytecode.TypeF64, 1.5), IntValue(bytecode.TypeI64, 4))
+	if err != nil || got.Float != 6 {
+		t.Fatalf("Call(scale) = %v, %v; want 6", got, err)
+	}
+	if got, err := p.Call(ctx, "report"); err != nil || got != (Value{}) {
+		t.Fatalf("Call(report) = %v, %v; want void", got, err)
+	}
+	if stdout.String() != "counter=42\n" {
+		t.Fatalf("stdout = %q", stdout.String())
+	}
+	got, err = p.Call(ctx, "swap", IntValue(bytecode.TypeI32, 1), IntValue(bytecode.TypeI32, 2))
+	if err != nil {
+		t.Fatalf("Call(swap): %v", err)
+	}
+	first, err := p.Memory().Load(got.Int, bytecode.TypeI32, 4)
+	if err != nil || first.Int != 2 {
+		t.Fatalf("swap result first field = %v, %v; want 2", first, err)
+	}
+
+	profile := NewProfile()
+	if _, err := p.CallWithOptions(ctx, RunOptions{StepLimit: 3, Profile: profile}, "bump", IntValue(bytecode.TypeI32, 1)); err == nil || !strings.Contains(err.Error(), "step limit exceeded") {
+		t.Fatalf("CallWithOptions(bump) error = %v, want step limit trap", err)
+	}
+	if fns := profile.Functions(); len(fns) != 1 || fns[0].Name != "bump" || fns[0].Calls != 1 || fns[0].Steps != 3 {
+		t.Fatalf("profile = %+v, want one call of bump with 3 steps", fns)
+	}
+
+	var exitErr *ExitError
+	if _, err := p.Call(ctx, "quit"); !errors.As(err, &exitErr) || exitErr.Status.Code != 3 {
+		t.Fatalf("Call(quit) error = %v, want exit 3", err)
+	}
+	for _, tt := range []struct {
+		name string
+		args []Value
+		want string
+	}{
+		{"missing", nil, "no function"},
+		{"counter", nil, "no function"},
+		{"bump", nil, "expects 1 arguments"},
+		{"bump", []Value{IntValue(bytecode.TypeI64, 1)}, "argument 0 has type i64, want i32"},
+	} {
+		if _, err := p.Call(ctx, tt.name, tt.args...); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("Call(%s) error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// jmpPoint is what setjmp records: the frame that called it, identified by
+// serial so a frame that has since returned is never resumed, the pc after
+// the call and the operand stack height at the call.
+type jmpPoint struct {
+	serial uint64
+	depth  int
+	pc     int
+	stack  int
+}
+
+func registerSetjmpExterns(r *ExternRegistry) {
+	for _, name := range []string{"setjmp", "_setjmp", "longjmp", "_longjmp"} {
+		r.Register(name, vmHandledExtern(name))
+	}
+}
+
+// vmHandledExtern stands in for externs the VM implements itself, so modules
+// using them still resolve at load time.
+func vmHandledExtern(name string) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		return Value{}, nil, fmt.Errorf("%s can only be called by the VM", name)
+	}
+}
+
+func (vm *VM) setjmp(name string, args []Value) error {
+	if len(args) != 1 || !isPointerType(args[0].Type) {
+		return vm.trap(fmt.Sprintf("%s expects a jmp_buf argument", name))
+	}
+	if len(vm.frames) == 0 {
+		return vm.trap("empty call stack")
+	}
+	fr := &vm.frames[len(vm.frames)-1]
+	point := jmpPoint{serial: fr.serial, depth: len(vm.frames), pc: fr.pc, stack: len(vm.stack)}
+	if err := vm.program.memory.Store(args[0].Int, bytecode.TypeU64, 1, UIntValue(bytecode.TypeU64, point.serial)); err != nil {
+		return vm.trapWithCause(fmt.Sprintf("%s could not write jmp_buf", name), err)
+	}
+	if vm.jmpPoints == nil {
+		vm.jmpPoints = make(map[uint64]jmpPoint)
+	}
+	// The frame forgets its buffers when it returns, so the map only holds
+	// points that can still be resumed.
+	if old, ok := vm.jmpPoints[args[0].Int]; !ok || old.serial != fr.serial {
+		fr.jmpBufs = append(fr.jmpBufs, args[0].Int)
+	}
+	vm.jmpPoints[args[0].Int] = point
+	vm.stack = append(vm.stack, IntValue(bytecode.TypeI32, 0))
+	return nil
+}
+
+func (vm *VM) longjmp(name string, args []Value) error {
+	if len(args) != 2 || !isPointerType(args[0].Type) || args[1].Type != bytecode.TypeI32 {
+		return vm.trap(fmt.Sprintf("%s expects jmp_buf and int arguments", name))
+	}
+	tag, err := vm.program.memory.Load(args[0].Int, bytecode.TypeU64, 1)
+	if err != nil {
+		return vm.trapWithCause(fmt.Sprintf("%s could not read jmp_buf", name), err)
+	}
+	point, ok := vm.jmpPoints[args[0].Int]
+	if !ok {
+		// A tag naming a frame this VM has run means the frame has since
+		// returned and taken its point with it.
+		if tag.Int != 0 && tag.Int <= vm.frameSerial {
+			return vm.trap(fmt.Sprintf("%s into a function that has already returned", name))
+		}
+		return vm.trap(fmt.Sprintf("%s with a jmp_buf that setjmp never initialized", name))
+	}
+	if tag.Int != point.serial {
+		return vm.trap(fmt.Sprintf("%s with a clobbered jmp_buf", name))
+	}
+	if point.depth > len(vm.frames) || vm.frames[point.depth-1].serial != point.serial {
+		return vm.trap(fmt.Sprintf("%s into a function that has already returned", name))
+	}
+	if point.depth <= vm.callbackDepth {
+		return vm.trap(fmt.Sprintf("%s out of a function called from an extern", name))
+	}
+	for len(vm.frames) > point.depth {
+		if err := vm.popFrame(); err != nil {
+			return err
+		}
+	}
+	if point.stack > len(vm.stack) {
+		return vm.trap(fmt.Sprintf("%s found a corrupted operand stack", name))
+	}
+	vm.frames[point.depth-1].pc = point.pc
+	vm.stack = vm.stack[:point.stack]
+	val := int32(args[1].Int)
+	if val == 0 {
+		val = 1
+	}
+	vm.stack = append(vm.stack, IntValue(bytecode.TypeI32, int64(val)))
+	return nil
+}
@@ -0,0 +1,205 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	"shinya.click/cvm/bytecode"
+)
+
+const (
+	sigINT  = 2
+	sigILL  = 4
+	sigABRT = 6
+	sigFPE  = 8
+	sigKILL = 9
+	sigSEGV = 11
+	sigTERM = 15
+	sigSTOP = 19
+	nsig    = 32
+)
+
+// Handler values with a special meaning, matching SIG_DFL, SIG_IGN and
+// SIG_ERR in <signal.h>.
+const (
+	sigDFL uint64 = 0
+	sigIGN uint64 = 1
+	sigERR uint64 = ^uint64(0)
+)
+
+var signalNames = map[int32]string{
+	sigINT:  "SIGINT",
+	sigILL:  "SIGILL",
+	sigABRT: "SIGABRT",
+	sigFPE:  "SIGFPE",
+	sigSEGV: "SIGSEGV",
+	sigTERM: "SIGTERM",
+}
+
+func signalName(sig int32) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("signal %d", sig)
+}
+
+func validSignal(sig int32) bool {
+	return sig > 0 && sig < nsig
+}
+
+// fault raises a trap that a hosted implementation would report as sig.
+func (vm *VM) fault(sig int32, reason string, cause error) *TrapError {
+	trap := vm.trapWithCause(reason, cause)
+	trap.signal = sig
+	return trap
+}
+
+func (r *ExternRegistry) signalHandler(sig int32) uint64 {
+	if r == nil {
+		return sigDFL
+	}
+	return r.signalHandlers[sig]
+}
+
+func registerSignalExterns(r *ExternRegistry) {
+	r.Register("signal", signalExtern(r))
+	r.Register("raise", vmHandledExtern("raise"))
+	r.Register("__assert_fail", vmHandledExtern("__assert_fail"))
+}
+
+func signalExtern(r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 || !isIntegerLike(args[0].Type) || !isPointerType(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("signal expects signal number and handler arguments")
+		}
+		sig := int32(signedInt(args[0]))
+		if !validSignal(sig) || sig == sigKILL || sig == sigSTOP || args[1].Int == sigERR {
+			if ec != nil && ec.Memory != nil {
+				if err := r.setErrno(ec.Memory, 22); err != nil {
+					return Value{}, nil, err
+				}
+			}
+			return PtrValue(sigERR), nil, nil
+		}
+		if r.signalHandlers == nil {
+			r.signalHandlers = make(map[int32]uint64)
+		}
+		prev := r.signalHandlers[sig]
+		r.signalHandlers[sig] = args[1].Int
+		return PtrValue(prev), nil, nil
+	}
+}
+
+func (vm *VM) raise(ctx context.Context, args []Value) (ExitStatus, bool, error) {
+	if len(args) != 1 || !isIntegerLike(args[0].Type) {
+		return ExitStatus{}, true, vm.trap("raise expects a signal number")
+	}
+	sig := int32(signedInt(args[0]))
+	if !validSignal(sig) {
+		vm.stack = append(vm.stack, IntValue(bytecode.TypeI32, -1))
+		return ExitStatus{}, false, nil
+	}
+	switch handler := vm.program.externReg.signalHandler(sig); handler {
+	case sigDFL:
+		if sig == sigABRT {
+			return ExitStatus{}, true, vm.trap("abort")
+		}
+		return ExitStatus{}, true, vm.trap("raised " + signalName(sig))
+	case sigIGN:
+		vm.stack = append(vm.stack, IntValue(bytecode.TypeI32, 0))
+		return ExitStatus{}, false, nil
+	default:
+		vm.stack = append(vm.stack, IntValue(bytecode.TypeI32, 0))
+		return vm.deliverSignal(ctx, sig, handler, nil)
+	}
+}
+
+// abort runs an installed SIGABRT handler before terminating. Without one it
+// is left to the abort extern.
+func (vm *VM) abort(ctx context.Context) (ExitStatus, bool, bool, error) {
+	handler := vm.program.externReg.signalHandler(sigABRT)
+	if handler == sigDFL || handler == sigIGN {
+		return ExitStatus{}, false, false, nil
+	}
+	st, done, err := vm.deliverSignal(ctx, sigABRT, handler, vm.trap("abort"))
+	return st, done, true, err
+}
+
+// assertFail reports a failed assert on stderr the way glibc does, then
+// aborts with an AssertionFailure as the trap cause.
+func (vm *VM) assertFail(ctx context.Context, args []Value) (ExitStatus, bool, error) {
+	if len(args) != 4 || !isPointerType(args[0].Type) || !isPointerType(args[1].Type) ||
+		!isIntegerLike(args[2].Type) || !isPointerType(args[3].Type) {
+		return ExitStatus{}, true, vm.trap("__assert_fail expects expression, file, line and function arguments")
+	}
+	var strs [3]string
+	for i, arg := range []Value{args[0], args[1], args[3]} {
+		s, err := vm.program.memory.ReadCString(arg.Int)
+		if err != nil {
+			return ExitStatus{}, true, vm.fault(sigSEGV, "memory load failed", err)
+		}
+		strs[i] = s
+	}
+	failure := &AssertionFailure{Expr: strs[0], File: strs[1], Line: int(uint32(args[2].Int)), Function: strs[2]}
+	reg := vm.program.externReg
+	fmt.Fprintf(reg.externStderr(vm.program.externCtx), "%s: %s\n", vm.program.progName, failure.Error())
+	trap := vm.trapWithCause("assertion failed", failure)
+	handler := reg.signalHandler(sigABRT)
+	if handler == sigDFL || handler == sigIGN {
+		return ExitStatus{}, true, trap
+	}
+	return vm.deliverSignal(ctx, sigABRT, handler, trap)
+}
+
+// signalTrap gives an installed handler the chance to deal with a trap that
+// would be a signal on a real machine. The handler runs on top of the
+// faulting frame, so it may longjmp out or exit; if it returns, the original
+// trap ends the run.
+func (vm *VM) signalTrap(ctx context.Context, err error) (ExitStatus, bool, error) {
+	trap, ok := err.(*TrapError)
+	if !ok || trap.signaled {
+		return ExitStatus{}, true, err
+	}
+	sig := trap.signal
+	if sig == 0 {
+		return ExitStatus{}, true, err
+	}
+	handler := vm.program.externReg.signalHandler(sig)
+	if handler == sigDFL || handler == sigIGN {
+		return ExitStatus{}, true, err
+	}
+	// The signal stays blocked while its handler runs, so a second fault
+	// inside the handler is fatal.
+	for _, fr := range vm.frames {
+		if fr.signal == sig {
+			return ExitStatus{}, true, err
+		}
+	}
+	trap.signaled = true
+	return vm.deliverSignal(ctx, sig, handler, err)
+}
+
+// deliverSignal calls handler with sig. after, when set, is the error that
+// ends the run once the handler returns.
+func (vm *VM) deliverSignal(ctx context.Context, sig int32, handler uint64, after error) (ExitStatus, bool, error) {
+	globalID, sigID, captures, err := vm.resolveFunctionPointer(handler, "invalid signal handler")
+	if err != nil {
+		return ExitStatus{}, true, err
+	}
+	depth := len(vm.frames)
+	args := append([]Value{IntValue(bytecode.TypeI32, int64(sig))}, captures...)
+	st, done, err := vm.invokeGlobal(ctx, globalID, sigID, args)
+	if done || err != nil {
+		return st, done, err
+	}
+	if len(vm.frames) > depth {
+		fr := &vm.frames[len(vm.frames)-1]
+		fr.signal = sig
+		fr.afterSignal = after
+		return ExitStatus{}, false, nil
+	}
+	if after != nil {
+		return ExitStatus{}, true, after
+	}
+	return ExitStatus{}, false, nil
+}
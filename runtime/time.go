@@ -0,0 +1,599 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"shinya.click/cvm/bytecode"
+)
+
+// Clock is the source of wall-clock time for time, clock and the calendar
+// functions. Now is called once for every reading the program makes.
+type Clock interface {
+	Now() time.Time
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// FixedClock returns a clock that always reads t.
+func FixedClock(t time.Time) Clock {
+	return fixedClock(t)
+}
+
+type steppedClock struct {
+	next time.Time
+	step time.Duration
+}
+
+func (c *steppedClock) Now() time.Time {
+	t := c.next
+	c.next = c.next.Add(c.step)
+	return t
+}
+
+// SteppedClock returns a clock that first reads start and moves forward by
+// step on every reading after that.
+func SteppedClock(start time.Time, step time.Duration) Clock {
+	return &steppedClock{next: start, step: step}
+}
+
+// SetClock replaces the clock the program reads. Without one, time reports
+// the Unix epoch and clock reports no elapsed processor time.
+func (r *ExternRegistry) SetClock(c Clock) {
+	r.clock = c
+	r.clockStarted = false
+}
+
+// SetTimeZone sets the zone localtime, mktime and ctime work in. The default
+// is UTC.
+func (r *ExternRegistry) SetTimeZone(loc *time.Location) {
+	r.timeZone = loc
+}
+
+func (r *ExternRegistry) now() time.Time {
+	if r.clock == nil {
+		return time.Unix(0, 0)
+	}
+	return r.clock.Now()
+}
+
+func (r *ExternRegistry) location() *time.Location {
+	if r.timeZone == nil {
+		return time.UTC
+	}
+	return r.timeZone
+}
+
+// timeLocale holds the names strftime uses. Only the C locale exists, which
+// is also all setlocale accepts.
+type timeLocale struct {
+	days       [7]string
+	months     [12]string
+	dateTime   string
+	date       string
+	time       string
+	time12     string
+	amPM       [2]string
+	abbrLength int
+}
+
+var cTimeLocale = timeLocale{
+	days:       [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+	months:     [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+	dateTime:   "%a %b %e %H:%M:%S %Y",
+	date:       "%m/%d/%y",
+	time:       "%H:%M:%S",
+	time12:     "%I:%M:%S %p",
+	amPM:       [2]string{"AM", "PM"},
+	abbrLength: 3,
+}
+
+func (l *timeLocale) day(wday int32, abbr bool) string {
+	if wday < 0 || wday > 6 {
+		return "?"
+	}
+	if abbr {
+		return l.days[wday][:l.abbrLength]
+	}
+	return l.days[wday]
+}
+
+func (l *timeLocale) month(mon int32, abbr bool) string {
+	if mon < 0 || mon > 11 {
+		return "?"
+	}
+	if abbr {
+		return l.months[mon][:l.abbrLength]
+	}
+	return l.months[mon]
+}
+
+func registerTimeExterns(r *ExternRegistry) {
+	r.Register("clock", clockExtern("clock", r))
+	r.Register("difftime", difftimeExtern("difftime"))
+	r.Register("time", timeExtern("time", r))
+	r.Register("mktime", mktimeExtern("mktime", r))
+	r.Register("gmtime", brokenDownTimeExtern("gmtime", r, false))
+	r.Register("localtime", brokenDownTimeExtern("localtime", r, true))
+	r.Register("asctime", asctimeExtern("asctime", r))
+	r.Register("ctime", ctimeExtern("ctime", r))
+	r.Register("strftime", strftimeExtern("strftime", r))
+}
+
+func clockExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 0 {
+			return Value{}, nil, fmt.Errorf("%s expects 0 arguments", name)
+		}
+		now := r.now()
+		if !r.clockStarted {
+			r.clockStart, r.clockStarted = now, true
+		}
+		return IntValue(bytecode.TypeI64, now.Sub(r.clockStart).Microseconds()), nil, nil
+	}
+}
+
+func difftimeExtern(name string) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 2 {
+			return Value{}, nil, fmt.Errorf("%s expects 2 arguments", name)
+		}
+		if !isIntegerLike(args[0].Type) || !isIntegerLike(args[1].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects time arguments", name)
+		}
+		return FloatValue(bytecode.TypeF64, float64(signedInt(args[0])-signedInt(args[1]))), nil, nil
+	}
+}
+
+func timeExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 {
+			return Value{}, nil, fmt.Errorf("%s expects 1 argument", name)
+		}
+		if !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects result pointer", name)
+		}
+		now := IntValue(bytecode.TypeI64, r.now().Unix())
+		if args[0].Int != 0 {
+			if ec == nil || ec.Memory == nil {
+				return Value{}, nil, fmt.Errorf("%s requires memory", name)
+			}
+			if err := ec.Memory.Store(args[0].Int, bytecode.TypeI64, 8, now); err != nil {
+				return Value{}, nil, err
+			}
+		}
+		return now, nil, nil
+	}
+}
+
+// brokenDownTime mirrors struct tm from <time.h>, including the tm_gmtoff and
+// tm_zone extensions that let strftime print the zone of gmtime results.
+type brokenDownTime struct {
+	sec, min, hour, mday, mon, year, wday, yday, isdst int32
+	gmtoff                                             int64
+	zone                                               uint64
+}
+
+// Struct members are laid out back to back, so tm_gmtoff and tm_zone are only
+// 4-byte aligned.
+const (
+	tmIntFields    = 9
+	tmGmtoffOffset = 36
+	tmZoneOffset   = 44
+)
+
+func tmSize(mem *Memory) int64 {
+	return tmZoneOffset + mem.target.PointerSize
+}
+
+func readBrokenDownTime(mem *Memory, addr uint64) (brokenDownTime, error) {
+	var fields [tmIntFields]int32
+	for i := range fields {
+		v, err := mem.Load(addr+uint64(i*4), bytecode.TypeI32, 4)
+		if err != nil {
+			return brokenDownTime{}, err
+		}
+		fields[i] = int32(signedInt(v))
+	}
+	gmtoff, err := mem.Load(addr+tmGmtoffOffset, bytecode.TypeI64, 4)
+	if err != nil {
+		return brokenDownTime{}, err
+	}
+	zone, err := mem.Load(addr+tmZoneOffset, bytecode.TypePtr, 4)
+	if err != nil {
+		return brokenDownTime{}, err
+	}
+	return brokenDownTime{
+		sec: fields[0], min: fields[1], hour: fields[2], mday: fields[3], mon: fields[4],
+		year: fields[5], wday: fields[6], yday: fields[7], isdst: fields[8],
+		gmtoff: signedInt(gmtoff), zone: zone.Int,
+	}, nil
+}
+
+func (r *ExternRegistry) writeBrokenDownTime(mem *Memory, addr uint64, t time.Time) error {
+	tm, err := r.brokenDown(mem, t)
+	if err != nil {
+		return err
+	}
+	fields := [tmIntFields]int32{tm.sec, tm.min, tm.hour, tm.mday, tm.mon, tm.year, tm.wday, tm.yday, tm.isdst}
+	for i, v := range fields {
+		if err := mem.Store(addr+uint64(i*4), bytecode.TypeI32, 4, IntValue(bytecode.TypeI32, int64(v))); err != nil {
+			return err
+		}
+	}
+	if err := mem.Store(addr+tmGmtoffOffset, bytecode.TypeI64, 4, IntValue(bytecode.TypeI64, tm.gmtoff)); err != nil {
+		return err
+	}
+	return mem.Store(addr+tmZoneOffset, bytecode.TypePtr, 4, PtrValue(tm.zone))
+}
+
+func (r *ExternRegistry) brokenDown(mem *Memory, t time.Time) (brokenDownTime, error) {
+	zoneName, offset := t.Zone()
+	zone, err := r.staticCString(mem, "tm_zone:"+zoneName, zoneName)
+	if err != nil {
+		return brokenDownTime{}, err
+	}
+	isdst := int32(0)
+	if t.IsDST() {
+		isdst = 1
+	}
+	return brokenDownTime{
+		sec: int32(t.Second()), min: int32(t.Minute()), hour: int32(t.Hour()),
+		mday: int32(t.Day()), mon: int32(t.Month()) - 1, year: int32(t.Year() - 1900),
+		wday: int32(t.Weekday()), yday: int32(t.YearDay() - 1), isdst: isdst,
+		gmtoff: int64(offset), zone: zone,
+	}, nil
+}
+
+// yearFits reports whether t's year can be stored in tm_year.
+func yearFits(t time.Time) bool {
+	year := int64(t.Year()) - 1900
+	return year >= math.MinInt32 && year <= math.MaxInt32
+}
+
+func mktimeExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 || !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects a struct tm pointer", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		tm, err := readBrokenDownTime(ec.Memory, args[0].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		// time.Date normalizes out-of-range fields the way mktime must.
+		t := time.Date(int(tm.year)+1900, time.Month(tm.mon)+1, int(tm.mday), int(tm.hour), int(tm.min), int(tm.sec), 0, r.location())
+		if !yearFits(t) {
+			if err := r.setErrno(ec.Memory, 75); err != nil {
+				return Value{}, nil, err
+			}
+			return IntValue(bytecode.TypeI64, -1), nil, nil
+		}
+		if err := r.writeBrokenDownTime(ec.Memory, args[0].Int, t); err != nil {
+			return Value{}, nil, err
+		}
+		return IntValue(bytecode.TypeI64, t.Unix()), nil, nil
+	}
+}
+
+func brokenDownTimeExtern(name string, r *ExternRegistry, local bool) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 || !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects a time_t pointer", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		t, err := loadTimeT(ec.Memory, args[0].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if local {
+			t = t.In(r.location())
+		}
+		if !yearFits(t) {
+			if err := r.setErrno(ec.Memory, 75); err != nil {
+				return Value{}, nil, err
+			}
+			return PtrValue(0), nil, nil
+		}
+		// gmtime and localtime share one static result, as in most C
+		// libraries.
+		addr, _, err := r.staticBlock(ec.Memory, "tm", tmSize(ec.Memory), 8)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		if err := r.writeBrokenDownTime(ec.Memory, addr, t); err != nil {
+			return Value{}, nil, err
+		}
+		return PtrValue(addr), nil, nil
+	}
+}
+
+func loadTimeT(mem *Memory, addr uint64) (time.Time, error) {
+	v, err := mem.Load(addr, bytecode.TypeI64, 8)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(signedInt(v), 0).UTC(), nil
+}
+
+func asctimeExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 || !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects a struct tm pointer", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		tm, err := readBrokenDownTime(ec.Memory, args[0].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return r.staticAsctime(ec.Memory, tm)
+	}
+}
+
+func ctimeExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 1 || !isPointerType(args[0].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects a time_t pointer", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		t, err := loadTimeT(ec.Memory, args[0].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		t = t.In(r.location())
+		if !yearFits(t) {
+			if err := r.setErrno(ec.Memory, 75); err != nil {
+				return Value{}, nil, err
+			}
+			return PtrValue(0), nil, nil
+		}
+		tm, err := r.brokenDown(ec.Memory, t)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		return r.staticAsctime(ec.Memory, tm)
+	}
+}
+
+// staticAsctime formats tm the way C99 7.23.3.1 spells out and returns the
+// shared static buffer holding it.
+func (r *ExternRegistry) staticAsctime(mem *Memory, tm brokenDownTime) (Value, *ExitStatus, error) {
+	l := &cTimeLocale
+	s := fmt.Sprintf("%.3s %.3s%3d %.2d:%.2d:%.2d %d\n", l.day(tm.wday, true), l.month(tm.mon, true), tm.mday, tm.hour, tm.min, tm.sec, int64(tm.year)+1900)
+	addr, _, err := r.staticBlock(mem, "asctime", 64, 1)
+	if err != nil {
+		return Value{}, nil, err
+	}
+	if err := writeMemoryBytes(mem, addr, append([]byte(s), 0)); err != nil {
+		return Value{}, nil, err
+	}
+	return PtrValue(addr), nil, nil
+}
+
+func strftimeExtern(name string, r *ExternRegistry) ExternFunc {
+	return func(ctx context.Context, ec *ExternContext, args []Value) (Value, *ExitStatus, error) {
+		if len(args) != 4 {
+			return Value{}, nil, fmt.Errorf("%s expects 4 arguments", name)
+		}
+		if !isPointerType(args[0].Type) || !isIntegerLike(args[1].Type) || !isPointerType(args[2].Type) || !isPointerType(args[3].Type) {
+			return Value{}, nil, fmt.Errorf("%s expects buffer, size, format, and struct tm arguments", name)
+		}
+		if ec == nil || ec.Memory == nil {
+			return Value{}, nil, fmt.Errorf("%s requires memory", name)
+		}
+		limit, err := memorySizeArg(name, args[1])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		format, err := ec.Memory.ReadCString(args[2].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		tm, err := readBrokenDownTime(ec.Memory, args[3].Int)
+		if err != nil {
+			return Value{}, nil, err
+		}
+		zone := ""
+		if tm.zone != 0 {
+			if zone, err = ec.Memory.ReadCString(tm.zone); err != nil {
+				return Value{}, nil, err
+			}
+		}
+		out := formatStrftime(&cTimeLocale, format, tm, zone)
+		if int64(len(out)) >= limit {
+			return IntValue(bytecode.TypeU64, 0), nil, nil
+		}
+		if err := writeMemoryBytes(ec.Memory, args[0].Int, append([]byte(out), 0)); err != nil {
+			return Value{}, nil, err
+		}
+		return IntValue(bytecode.TypeU64, int64(len(out))), nil, nil
+	}
+}
+
+// formatStrftime expands every C99 strftime conversion. The E and O
+// modifiers select alternative representations the C locale does not have,
+// so they are accepted and ignored. Unknown conversions are copied as is.
+func formatStrftime(l *timeLocale, format string, tm brokenDownTime, zone string) string {
+	var b strings.Builder
+	year := int64(tm.year) + 1900
+	pad := func(v int64, width int) {
+		s := strconv.FormatInt(v, 10)
+		if v < 0 {
+			b.WriteString(s)
+			return
+		}
+		for i := len(s); i < width; i++ {
+			b.WriteByte('0')
+		}
+		b.WriteString(s)
+	}
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 >= len(format) {
+			b.WriteByte(c)
+			continue
+		}
+		start := i
+		i++
+		if (format[i] == 'E' || format[i] == 'O') && i+1 < len(format) {
+			i++
+		}
+		switch format[i] {
+		case 'a':
+			b.WriteString(l.day(tm.wday, true))
+		case 'A':
+			b.WriteString(l.day(tm.wday, false))
+		case 'b', 'h':
+			b.WriteString(l.month(tm.mon, true))
+		case 'B':
+			b.WriteString(l.month(tm.mon, false))
+		case 'c':
+			b.WriteString(formatStrftime(l, l.dateTime, tm, zone))
+		case 'C':
+			pad(floorDiv(year, 100), 2)
+		case 'd':
+			pad(int64(tm.mday), 2)
+		case 'D':
+			b.WriteString(formatStrftime(l, "%m/%d/%y", tm, zone))
+		case 'e':
+			fmt.Fprintf(&b, "%2d", tm.mday)
+		case 'F':
+			b.WriteString(formatStrftime(l, "%Y-%m-%d", tm, zone))
+		case 'g':
+			isoYear, _ := isoWeek(year, tm.yday, tm.wday)
+			pad(floorMod(isoYear, 100), 2)
+		case 'G':
+			isoYear, _ := isoWeek(year, tm.yday, tm.wday)
+			pad(isoYear, 1)
+		case 'H':
+			pad(int64(tm.hour), 2)
+		case 'I':
+			pad(int64(hour12(tm.hour)), 2)
+		case 'j':
+			pad(int64(tm.yday)+1, 3)
+		case 'm':
+			pad(int64(tm.mon)+1, 2)
+		case 'M':
+			pad(int64(tm.min), 2)
+		case 'n':
+			b.WriteByte('\n')
+		case 'p':
+			if tm.hour >= 12 {
+				b.WriteString(l.amPM[1])
+			} else {
+				b.WriteString(l.amPM[0])
+			}
+		case 'r':
+			b.WriteString(formatStrftime(l, l.time12, tm, zone))
+		case 'R':
+			b.WriteString(formatStrftime(l, "%H:%M", tm, zone))
+		case 'S':
+			pad(int64(tm.sec), 2)
+		case 't':
+			b.WriteByte('\t')
+		case 'T':
+			b.WriteString(formatStrftime(l, "%H:%M:%S", tm, zone))
+		case 'u':
+			pad(int64((tm.wday+6)%7)+1, 1)
+		case 'U':
+			pad(int64((tm.yday+7-tm.wday)/7), 2)
+		case 'V':
+			_, week := isoWeek(year, tm.yday, tm.wday)
+			pad(week, 2)
+		case 'w':
+			pad(int64(tm.wday), 1)
+		case 'W':
+			pad(int64((tm.yday+7-(tm.wday+6)%7)/7), 2)
+		case 'x':
+			b.WriteString(formatStrftime(l, l.date, tm, zone))
+		case 'X':
+			b.WriteString(formatStrftime(l, l.time, tm, zone))
+		case 'y':
+			pad(floorMod(year, 100), 2)
+		case 'Y':
+			pad(year, 1)
+		case 'z':
+			if tm.isdst < 0 {
+				break
+			}
+			off := tm.gmtoff
+			sign := byte('+')
+			if off < 0 {
+				sign, off = '-', -off
+			}
+			b.WriteByte(sign)
+			pad(off/3600, 2)
+			pad(off/60%60, 2)
+		case 'Z':
+			if tm.isdst >= 0 {
+				b.WriteString(zone)
+			}
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteString(format[start : i+1])
+		}
+	}
+	return b.String()
+}
+
+func hour12(hour int32) int32 {
+	if h := hour % 12; h != 0 {
+		return h
+	}
+	return 12
+}
+
+// isoWeek returns the ISO 8601 week-based year and week number of the day
+// with the given tm_yday and tm_wday in year.
+func isoWeek(year int64, yday, wday int32) (int64, int64) {
+	days := isoWeekDays(int64(yday), int64(wday))
+	if days < 0 {
+		year--
+		days = isoWeekDays(int64(yday)+daysInYear(year), int64(wday))
+	} else if d := isoWeekDays(int64(yday)-daysInYear(year), int64(wday)); d >= 0 {
+		year++
+		days = d
+	}
+	return year, days/7 + 1
+}
+
+// isoWeekDays counts days from the Monday starting ISO week 1 of the year to
+// yday; week 1 is the one holding the year's first Thursday.
+func isoWeekDays(yday, wday int64) int64 {
+	const bigEnoughMultipleOf7 = (366/7 + 2) * 7
+	return yday - (yday-wday+4+bigEnoughMultipleOf7)%7 + 3
+}
+
+func daysInYear(year int64) int64 {
+	if year%4 == 0 && (year%100 != 0 || year%400 == 0) {
+		return 366
+	}
+	return 365
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func floorMod(a, b int64) int64 {
+	return a - floorDiv(a, b)*b
+}
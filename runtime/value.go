@@ -33,6 +33,25 @@ func FloatValue(t bytecode.ValueType, v float64) Value {
 	return Value{Type: t, Float: v}
 }
 
+func (v Value) String() string {
+	switch v.Type {
+	case bytecode.TypeI8:
+		return fmt.Sprintf("%s %d", v.Type, int8(v.Int))
+	case bytecode.TypeI16:
+		return fmt.Sprintf("%s %d", v.Type, int16(v.Int))
+	case bytecode.TypeI32:
+		return fmt.Sprintf("%s %d", v.Type, int32(v.Int))
+	case bytecode.TypeI64:
+		return fmt.Sprintf("%s %d", v.Type, int64(v.Int))
+	case bytecode.TypePtr, bytecode.TypeObjectAddr:
+		return fmt.Sprintf("%s %#x", v.Type, v.Int)
+	case bytecode.TypeF32, bytecode.TypeF64, bytecode.TypeFLong:
+		return fmt.Sprintf("%s %g", v.Type, v.Float)
+	default:
+		return fmt.Sprintf("%s %d", v.Type, v.Int)
+	}
+}
+
 func (v Value) ExitCode() (int, error) {
 	switch v.Type {
 	case bytecode.TypeI8:
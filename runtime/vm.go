@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 
@@ -10,6 +11,18 @@ import (
 
 type RunOptions struct {
 	StepLimit int
+	// The memory quotas cover blocks allocated while the program runs: heap
+	// allocations, local objects and VLAs. Globals and strings placed by Load
+	// are not counted. Zero leaves a quota unlimited.
+	MaxHeapBytes  int64
+	MaxAllocSize  int64
+	MaxLiveBlocks int
+	// MaxCallDepth bounds the number of active frames and MaxStackDepth the
+	// number of values on the operand stack.
+	MaxCallDepth  int
+	MaxStackDepth int
+	// Profile, when set, accumulates execution counts for this run.
+	Profile *Profile
 }
 
 type VM struct {
@@ -18,8 +31,15 @@ type VM struct {
 	frames          []frame
 	closures        map[uint64]closure
 	expiredClosures map[uint64]expiredClosure
+	vaListHandles   map[uint64]vaListHandle
+	jmpPoints       map[uint64]jmpPoint
+	frameSerial     uint64
+	callbackDepth   int
 	steps           int
 	limit           int
+	maxCallDepth    int
+	maxStackDepth   int
+	profile         *Profile
 }
 
 type frame struct {
@@ -29,12 +49,18 @@ type frame struct {
 	locals         []Value
 	variadicArgs   []Value
 	vaLists        map[int]int
+	vaListAddrs    map[int]uint64
 	activeVaList   int
 	hasActiveVa    bool
-	labels         map[int]int
+	code           *decodedFunc
 	localObjects   map[int]uint64
 	dynamicObjects map[int]uint64
 	closures       []uint64
+	jmpBufs        []uint64
+	profileNode    int
+	serial         uint64
+	signal         int32
+	afterSignal    error
 }
 
 type closure struct {
@@ -43,6 +69,13 @@ type closure struct {
 	captures []Value
 }
 
+// vaListHandle is the frame and slot behind the address va_start stores in
+// a va_list local, so externs such as vprintf can find the arguments.
+type vaListHandle struct {
+	serial uint64
+	slot   int
+}
+
 type expiredClosure struct {
 	creator string
 	global  int
@@ -52,47 +85,79 @@ func Run(ctx context.Context, p *Program, opts RunOptions) (ExitStatus, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	vm, err := newVM(p, opts)
+	if err != nil {
+		return ExitStatus{}, err
+	}
+	for {
+		st, done, err := vm.run(ctx)
+		if done || err != nil {
+			return vm.finish(ctx, st, err)
+		}
+	}
+}
+
+func newVM(p *Program, opts RunOptions) (*VM, error) {
+	vm, err := newIdleVM(p, opts)
+	if err != nil {
+		return nil, err
+	}
+	if p.entryFunc < 0 {
+		return nil, &TrapError{Reason: "module has no runnable entry"}
+	}
+	if err := vm.pushFrameAsEntry(p.entryFunc, p.entryArgs); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// newIdleVM returns a VM over p with an empty call stack.
+func newIdleVM(p *Program, opts RunOptions) (*VM, error) {
 	if p == nil {
-		return ExitStatus{}, &TrapError{Reason: "nil program"}
+		return nil, &TrapError{Reason: "nil program"}
 	}
 	if p.module == nil {
-		return ExitStatus{}, &TrapError{Reason: "program module is nil"}
+		return nil, &TrapError{Reason: "program module is nil"}
 	}
 	if p.memory == nil {
-		return ExitStatus{}, &TrapError{Reason: "program memory is nil"}
+		return nil, &TrapError{Reason: "program memory is nil"}
 	}
 	vm := &VM{
 		program:         p,
 		closures:        make(map[uint64]closure),
 		expiredClosures: make(map[uint64]expiredClosure),
+		vaListHandles:   make(map[uint64]vaListHandle),
 		limit:           opts.StepLimit,
+		maxCallDepth:    opts.MaxCallDepth,
+		maxStackDepth:   opts.MaxStackDepth,
+		profile:         opts.Profile,
 	}
-	if err := vm.pushFrameAsEntry(p.entryFunc, p.entryArgs); err != nil {
-		return ExitStatus{}, err
+	p.memory.setLimits(memoryLimits{heapBytes: opts.MaxHeapBytes, allocSize: opts.MaxAllocSize, blocks: opts.MaxLiveBlocks})
+	return vm, nil
+}
+
+func (vm *VM) finish(ctx context.Context, st ExitStatus, err error) (ExitStatus, error) {
+	cleanupErr := vm.cleanupFrames()
+	if err != nil {
+		return st, err
 	}
-	for {
-		st, done, err := vm.step(ctx)
-		if done || err != nil {
-			cleanupErr := vm.cleanupFrames()
-			if err != nil {
-				return st, err
-			}
-			if cleanupErr != nil {
-				return st, cleanupErr
-			}
-			if !st.skipAtexit {
-				atexitStatus, atexitDone, atexitErr := vm.runAtexitHandlers(ctx)
-				if atexitErr != nil {
-					return st, atexitErr
-				}
-				if atexitDone {
-					st = atexitStatus
-				}
-			}
-			st.skipAtexit = false
-			return st, nil
+	if cleanupErr != nil {
+		return st, cleanupErr
+	}
+	if !st.skipAtexit {
+		atexitStatus, atexitDone, atexitErr := vm.runAtexitHandlers(ctx)
+		if atexitErr != nil {
+			return st, atexitErr
+		}
+		if atexitDone {
+			st = atexitStatus
+		}
+		if err := vm.program.externReg.closeFiles(); err != nil {
+			return st, err
 		}
 	}
+	st.skipAtexit = false
+	return st, nil
 }
 
 func (vm *VM) pushFrame(funcID int, args []Value) error {
@@ -109,31 +174,15 @@ func (vm *VM) pushFrameWithMode(funcID int, args []Value, entry bool) error {
 	}
 
 	fn := &vm.program.module.Functions[funcID]
-	maxSlot := -1
-	for _, param := range fn.Params {
-		if param.Slot < 0 {
-			return vm.trap(fmt.Sprintf("negative param slot %d in function %s", param.Slot, fn.Name))
-		}
-		if param.Slot > maxSlot {
-			maxSlot = param.Slot
-		}
+	if vm.maxCallDepth > 0 && len(vm.frames) >= vm.maxCallDepth {
+		return vm.trapWithCause("call depth limit exceeded", &QuotaError{Quota: QuotaCallDepth, Limit: int64(vm.maxCallDepth), Requested: int64(len(vm.frames) + 1)})
 	}
-	for _, local := range fn.Locals {
-		if local.ID < 0 {
-			return vm.trap(fmt.Sprintf("negative local slot %d in function %s", local.ID, fn.Name))
-		}
-		if local.ID > maxSlot {
-			maxSlot = local.ID
-		}
+	code := vm.program.decodedFunction(funcID)
+	if code.frameErr != "" {
+		return vm.trap(code.frameErr)
 	}
 
-	locals := make([]Value, maxSlot+1)
-	for _, param := range fn.Params {
-		locals[param.Slot] = zeroValue(param.Type)
-	}
-	for _, local := range fn.Locals {
-		locals[local.ID] = zeroValue(local.Type)
-	}
+	locals := append([]Value(nil), code.locals...)
 	sig := vm.program.module.Sigs[fn.Sig]
 	if !sig.Variadic && len(args) != len(fn.Params) {
 		return vm.trap(fmt.Sprintf("function %s expects %d args, got %d", fn.Name, len(fn.Params), len(args)))
@@ -148,16 +197,18 @@ func (vm *VM) pushFrameWithMode(funcID int, args []Value, entry bool) error {
 		}
 		locals[param.Slot] = arg
 	}
+	// The va_list and dynamic object maps are only written after a lookup
+	// that cannot succeed without variadic args or VLAs, so other frames
+	// leave them nil.
 	var variadicArgs []Value
+	var vaLists map[int]int
 	if sig.Variadic {
 		variadicArgs = append([]Value(nil), args[len(fn.Params):]...)
+		vaLists = make(map[int]int)
 	}
-
-	labels := make(map[int]int)
-	for pc, ins := range fn.Instrs {
-		if ins.Op == bytecode.OpLabel {
-			labels[ins.Label] = pc
-		}
+	var dynamicObjects map[int]uint64
+	if len(fn.DynamicObjects) != 0 {
+		dynamicObjects = make(map[int]uint64)
 	}
 
 	localObjects := make(map[int]uint64, len(fn.Objects))
@@ -172,44 +223,257 @@ func (vm *VM) pushFrameWithMode(funcID int, args []Value, entry bool) error {
 		localObjects[object.ID] = addr
 	}
 
+	vm.frameSerial++
+	profileNode := -1
+	if vm.profile != nil {
+		parent, callPC := -1, 0
+		if len(vm.frames) != 0 {
+			caller := vm.frames[len(vm.frames)-1]
+			parent, callPC = caller.profileNode, max(caller.pc-1, 0)
+		}
+		profileNode = vm.profile.enter(vm.program.module, parent, funcID, callPC)
+	}
+
 	vm.frames = append(vm.frames, frame{
 		fn:             fn,
 		entry:          entry,
 		locals:         locals,
 		variadicArgs:   variadicArgs,
-		vaLists:        make(map[int]int),
+		vaLists:        vaLists,
 		activeVaList:   -1,
-		labels:         labels,
+		code:           code,
 		localObjects:   localObjects,
-		dynamicObjects: make(map[int]uint64),
+		dynamicObjects: dynamicObjects,
+		profileNode:    profileNode,
+		serial:         vm.frameSerial,
 	})
 	return nil
 }
 
+// runBatch is how many instructions run executes between context checks.
+const runBatch = 1024
+
+// step executes a single instruction, which is what the debugger needs.
 func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
+	return vm.stepN(ctx, 1)
+}
+
+// run executes up to runBatch instructions. It returns early whenever a call,
+// return or longjmp changes the frame stack, so callers waiting for a frame to
+// return never run past it.
+func (vm *VM) run(ctx context.Context) (ExitStatus, bool, error) {
+	return vm.stepN(ctx, runBatch)
+}
+
+func (vm *VM) stepN(ctx context.Context, n int) (ExitStatus, bool, error) {
+	st, done, err := vm.execute(ctx, n)
+	if err != nil {
+		return vm.signalTrap(ctx, err)
+	}
+	return st, done, nil
+}
+
+func (vm *VM) execute(ctx context.Context, n int) (ExitStatus, bool, error) {
 	if len(vm.frames) == 0 {
 		return ExitStatus{}, true, vm.trap("empty call stack")
 	}
-	fr := &vm.frames[len(vm.frames)-1]
+	depth := len(vm.frames)
+	fr := &vm.frames[depth-1]
 
 	if err := ctx.Err(); err != nil {
 		return ExitStatus{}, true, vm.trapAtPCWithCause("context canceled", fr.pc, false, err)
 	}
-	if vm.limit > 0 && vm.steps >= vm.limit {
-		return ExitStatus{}, true, vm.trapAtPC("step limit exceeded", fr.pc, false)
-	}
 
-	if fr.pc < 0 || fr.pc >= len(fr.fn.Instrs) {
-		return ExitStatus{}, true, vm.trapAtPC("program counter out of range", fr.pc, false)
-	}
+	ops := fr.code.ops
+	for ; n > 0; n-- {
+		if vm.limit > 0 && vm.steps >= vm.limit {
+			return ExitStatus{}, true, vm.trapAtPC("step limit exceeded", fr.pc, false)
+		}
+		pc := fr.pc
+		if pc < 0 || pc >= len(ops) {
+			return ExitStatus{}, true, vm.trapAtPC("program counter out of range", pc, false)
+		}
+		if vm.profile != nil {
+			vm.profile.step(fr.profileNode, pc)
+		}
+		fr.pc++
+		vm.steps++
+
+		o := &ops[pc]
+		s := vm.stack
+		top := len(s) - 1
+		switch o.kind {
+		case opNop:
+			continue
+		case opPush:
+			vm.stack = append(s, o.val)
+			if err := vm.checkStackDepth(); err != nil {
+				return ExitStatus{}, true, err
+			}
+			continue
+		case opDup:
+			if top >= 0 {
+				vm.stack = append(s, s[top])
+				if err := vm.checkStackDepth(); err != nil {
+					return ExitStatus{}, true, err
+				}
+				continue
+			}
+		case opPop:
+			if top >= 0 {
+				vm.stack = s[:top]
+				continue
+			}
+		case opSwap:
+			if top >= 1 {
+				s[top], s[top-1] = s[top-1], s[top]
+				continue
+			}
+		case opLoadLocal:
+			if v := fr.locals[o.arg]; v.Type == o.typ {
+				vm.stack = append(s, v)
+				if err := vm.checkStackDepth(); err != nil {
+					return ExitStatus{}, true, err
+				}
+				continue
+			}
+		case opStoreLocal:
+			if cur := fr.locals[o.arg].Type; top >= 0 && s[top].Type == o.typ && (cur == bytecode.TypeVoid || cur == o.typ) {
+				fr.locals[o.arg] = s[top]
+				vm.stack = s[:top]
+				continue
+			}
+		case opLoad:
+			if top >= 0 && s[top].Type == bytecode.TypeObjectAddr {
+				if v, err := vm.program.memory.Load(s[top].Int, o.typ, o.align); err == nil {
+					s[top] = v
+					continue
+				}
+			}
+		case opLoadConst:
+			if v, err := vm.program.memory.Load(o.val.Int, o.typ, o.align); err == nil {
+				vm.stack = append(s, v)
+				if err := vm.checkStackDepth(); err != nil {
+					return ExitStatus{}, true, err
+				}
+				continue
+			}
+		case opStore:
+			if top >= 1 && s[top].Type == o.typ && s[top-1].Type == bytecode.TypeObjectAddr {
+				if err := vm.program.memory.Store(s[top-1].Int, o.typ, o.align, s[top]); err == nil {
+					vm.stack = s[:top-1]
+					continue
+				}
+			}
+		case opOffset:
+			if top >= 0 && s[top].Type == bytecode.TypeObjectAddr {
+				if out, err := addSignedOffset(s[top].Int, o.arg); err == nil {
+					s[top] = ObjectAddrValue(out)
+					continue
+				}
+			}
+		case opBitFieldLoad:
+			if top >= 0 && s[top].Type == bytecode.TypeObjectAddr {
+				if v, err := vm.loadBitField(s[top].Int, fr.code.bitFields[o.arg], o.typ); err == nil {
+					s[top] = v
+					continue
+				}
+			}
+		case opBitFieldStore:
+			if top >= 1 && s[top].Type == o.typ && s[top-1].Type == bytecode.TypeObjectAddr {
+				if err := vm.storeBitField(s[top-1].Int, fr.code.bitFields[o.arg], s[top]); err == nil {
+					vm.stack = s[:top-1]
+					continue
+				}
+			}
+		case opPtrAdd:
+			if top >= 1 && isIntegerLike(s[top].Type) && isPointerType(s[top-1].Type) {
+				if out, err := addPointerIndex(s[top-1].Int, s[top], o.arg); err == nil {
+					s[top-1] = UIntValue(s[top-1].Type, out)
+					vm.stack = s[:top]
+					continue
+				}
+			}
+		case opAdd, opSub, opMul, opAnd, opOr, opXor, opShl, opShrS, opShrU,
+			opDivS, opDivU, opRemS, opRemU,
+			opEq, opNe, opLtS, opLtU, opLeS, opLeU, opGtS, opGtU, opGeS, opGeU:
+			if top >= 1 && s[top].Type == o.typ && s[top-1].Type == o.typ {
+				if v, ok := o.binary(s[top-1].Int&o.mask, s[top].Int&o.mask); ok {
+					s[top-1] = v
+					vm.stack = s[:top]
+					continue
+				}
+			}
+		case opNeg:
+			if top >= 0 && s[top].Type == o.typ {
+				s[top] = UIntValue(o.typ, uint64(-o.signed(s[top].Int))&o.mask)
+				continue
+			}
+		case opCastSame:
+			if top >= 0 && s[top].Type == o.typ {
+				continue
+			}
+		case opCastBool:
+			if top >= 0 && s[top].Type == o.typ {
+				s[top] = UIntValue(bytecode.TypeBool, uint64(boolInt(!s[top].IsZero())))
+				continue
+			}
+		case opZExt:
+			if top >= 0 && s[top].Type == o.typ {
+				s[top] = UIntValue(o.typ2, s[top].Int&o.mask&o.mask2)
+				continue
+			}
+		case opSExt:
+			if top >= 0 && s[top].Type == o.typ {
+				s[top] = UIntValue(o.typ2, uint64(o.signed(s[top].Int))&o.mask2)
+				continue
+			}
+		case opJump:
+			fr.pc = int(o.arg)
+			continue
+		case opJumpIfZero, opJumpIfNonZero:
+			if top >= 0 && s[top].Type == o.typ {
+				if s[top].IsZero() == (o.kind == opJumpIfZero) {
+					fr.pc = int(o.arg)
+				}
+				vm.stack = s[:top]
+				continue
+			}
+		case opSwitch:
+			if top >= 0 && s[top].Type == o.typ {
+				table := &fr.code.switches[o.arg]
+				fr.pc = table.def
+				for _, c := range table.cases {
+					if switchCaseMatches(o.typ, s[top], c.value) {
+						fr.pc = c.pc
+						break
+					}
+				}
+				vm.stack = s[:top]
+				continue
+			}
+		}
 
-	ins := fr.fn.Instrs[fr.pc]
-	fr.pc++
-	vm.steps++
+		st, done, err := vm.executeInstr(ctx, fr, &fr.fn.Instrs[pc])
+		if done || err != nil {
+			return st, done, err
+		}
+		if err := vm.checkStackDepth(); err != nil {
+			return ExitStatus{}, true, err
+		}
+		if len(vm.frames) != depth || fr != &vm.frames[depth-1] {
+			return ExitStatus{}, false, nil
+		}
+	}
+	return ExitStatus{}, false, nil
+}
 
+// executeInstr runs ins with every operand checked, for instructions the
+// decoded form has no fast path for and for fast paths that would trap.
+func (vm *VM) executeInstr(ctx context.Context, fr *frame, ins *bytecode.Instr) (ExitStatus, bool, error) {
 	switch ins.Op {
 	case bytecode.OpConst:
-		vm.stack = append(vm.stack, constValue(ins))
+		vm.stack = append(vm.stack, constValue(*ins))
 	case bytecode.OpDup:
 		if len(vm.stack) == 0 {
 			return ExitStatus{}, true, vm.trap("stack underflow")
@@ -338,7 +602,7 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 		}
 		v, err := vm.program.Memory().Load(addr.Int, ins.Type, ins.Align)
 		if err != nil {
-			return ExitStatus{}, true, vm.trapWithCause("memory load failed", err)
+			return ExitStatus{}, true, vm.fault(sigSEGV, "memory load failed", err)
 		}
 		vm.stack = append(vm.stack, v)
 	case bytecode.OpStore:
@@ -351,7 +615,7 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 			return ExitStatus{}, true, err
 		}
 		if err := vm.program.Memory().Store(addr.Int, ins.Type, ins.Align, v); err != nil {
-			return ExitStatus{}, true, vm.trapWithCause("memory store failed", err)
+			return ExitStatus{}, true, vm.fault(sigSEGV, "memory store failed", err)
 		}
 	case bytecode.OpMemCopy:
 		src, err := vm.pop(bytecode.TypeObjectAddr)
@@ -363,7 +627,7 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 			return ExitStatus{}, true, err
 		}
 		if err := vm.program.Memory().Copy(dst.Int, src.Int, ins.Size); err != nil {
-			return ExitStatus{}, true, vm.trapWithCause("memory copy failed", err)
+			return ExitStatus{}, true, vm.fault(sigSEGV, "memory copy failed", err)
 		}
 	case bytecode.OpMemSet:
 		v, err := vm.pop(bytecode.TypeI32)
@@ -375,7 +639,7 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 			return ExitStatus{}, true, err
 		}
 		if err := vm.program.Memory().Set(dst.Int, byte(v.Int), ins.Size); err != nil {
-			return ExitStatus{}, true, vm.trapWithCause("memory set failed", err)
+			return ExitStatus{}, true, vm.fault(sigSEGV, "memory set failed", err)
 		}
 	case bytecode.OpOffset:
 		addr, err := vm.pop(bytecode.TypeObjectAddr)
@@ -409,13 +673,13 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 		if err != nil {
 			return ExitStatus{}, true, err
 		}
-		bf, err := vm.bitFieldLayout(ins)
+		bf, err := vm.bitFieldLayout(*ins)
 		if err != nil {
 			return ExitStatus{}, true, vm.trapWithCause("invalid bit-field", err)
 		}
 		value, err := vm.loadBitField(addr.Int, bf, ins.Type)
 		if err != nil {
-			return ExitStatus{}, true, vm.trapWithCause("bit-field load failed", err)
+			return ExitStatus{}, true, vm.fault(sigSEGV, "bit-field load failed", err)
 		}
 		vm.stack = append(vm.stack, value)
 	case bytecode.OpBitFieldStore:
@@ -427,12 +691,12 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 		if err != nil {
 			return ExitStatus{}, true, err
 		}
-		bf, err := vm.bitFieldLayout(ins)
+		bf, err := vm.bitFieldLayout(*ins)
 		if err != nil {
 			return ExitStatus{}, true, vm.trapWithCause("invalid bit-field", err)
 		}
 		if err := vm.storeBitField(addr.Int, bf, value); err != nil {
-			return ExitStatus{}, true, vm.trapWithCause("bit-field store failed", err)
+			return ExitStatus{}, true, vm.fault(sigSEGV, "bit-field store failed", err)
 		}
 	case bytecode.OpPtrAdd:
 		index, err := vm.popInteger()
@@ -481,15 +745,15 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 		}
 		vm.stack = append(vm.stack, IntValue(bytecode.TypeI64, diff))
 	case bytecode.OpBinary:
-		if err := vm.binary(ins); err != nil {
+		if err := vm.binary(*ins); err != nil {
 			return ExitStatus{}, true, err
 		}
 	case bytecode.OpUnary:
-		if err := vm.unary(ins); err != nil {
+		if err := vm.unary(*ins); err != nil {
 			return ExitStatus{}, true, err
 		}
 	case bytecode.OpCast:
-		if err := vm.cast(ins); err != nil {
+		if err := vm.cast(*ins); err != nil {
 			return ExitStatus{}, true, err
 		}
 	case bytecode.OpJump:
@@ -565,7 +829,7 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 		}
 		globalID, err := vm.program.FuncGlobalByAddress(callee.Int)
 		if err != nil {
-			return ExitStatus{}, true, vm.trapWithCause("invalid indirect call target", err)
+			return ExitStatus{}, true, vm.fault(sigSEGV, "invalid indirect call target", err)
 		}
 		st, done, err := vm.invokeGlobal(ctx, globalID, ins.Sig, args)
 		if done || err != nil {
@@ -596,17 +860,25 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 			}
 			return ExitStatus{Code: code}, true, nil
 		}
+		after := fr.afterSignal
 		if err := vm.popFrame(); err != nil {
 			return ExitStatus{}, true, err
 		}
+		if after != nil {
+			return ExitStatus{}, true, after
+		}
 		vm.stack = append(vm.stack, v)
 	case bytecode.OpReturnVoid:
 		if fr.entry {
 			return ExitStatus{}, true, vm.trap("void return from entry function")
 		}
+		after := fr.afterSignal
 		if err := vm.popFrame(); err != nil {
 			return ExitStatus{}, true, err
 		}
+		if after != nil {
+			return ExitStatus{}, true, after
+		}
 	case bytecode.OpReturnObject:
 		addr, err := vm.pop(bytecode.TypeObjectAddr)
 		if err != nil {
@@ -632,6 +904,9 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 		fr.vaLists[ins.Slot] = 0
 		fr.activeVaList = ins.Slot
 		fr.hasActiveVa = true
+		if err := vm.bindVaList(fr, ins.Slot); err != nil {
+			return ExitStatus{}, true, err
+		}
 	case bytecode.OpVaArg:
 		slot := ins.Slot
 		cursor, ok := fr.vaLists[slot]
@@ -660,6 +935,9 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 			return ExitStatus{}, true, vm.trap("va_copy from inactive va_list")
 		}
 		fr.vaLists[ins.Slot] = cursor
+		if err := vm.bindVaList(fr, ins.Slot); err != nil {
+			return ExitStatus{}, true, err
+		}
 	case bytecode.OpVaEnd:
 		delete(fr.vaLists, ins.Slot)
 		if fr.hasActiveVa && fr.activeVaList == ins.Slot {
@@ -674,8 +952,65 @@ func (vm *VM) step(ctx context.Context) (ExitStatus, bool, error) {
 	return ExitStatus{}, false, nil
 }
 
+// bindVaList stores a handle for the va_list in slot into the slot itself,
+// so passing it to an extern such as vprintf hands over the frame's
+// remaining variadic arguments.
+func (vm *VM) bindVaList(fr *frame, slot int) error {
+	addr, ok := fr.vaListAddrs[slot]
+	if !ok {
+		var err error
+		addr, err = vm.program.Memory().TryAlloc(
+			fmt.Sprintf("va_list:%s:%d", fr.fn.Name, slot),
+			vm.program.module.Target.PointerSize,
+			vm.program.module.Target.PointerAlign,
+			false,
+			blockLocal,
+		)
+		if err != nil {
+			return vm.trapWithCause("va_list allocation failed", err)
+		}
+		if fr.vaListAddrs == nil {
+			fr.vaListAddrs = make(map[int]uint64)
+		}
+		fr.vaListAddrs[slot] = addr
+		vm.vaListHandles[addr] = vaListHandle{serial: fr.serial, slot: slot}
+	}
+	if slot >= 0 && slot < len(fr.locals) && fr.locals[slot].Type == bytecode.TypePtr {
+		fr.locals[slot] = PtrValue(addr)
+	}
+	return nil
+}
+
+// vaListArgs returns the variadic arguments still to be read through the
+// va_list handle at addr, if it belongs to a live frame and was not ended.
+func (vm *VM) vaListArgs(addr uint64) ([]Value, bool) {
+	h, ok := vm.vaListHandles[addr]
+	if !ok {
+		return nil, false
+	}
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		fr := &vm.frames[i]
+		if fr.serial != h.serial {
+			continue
+		}
+		cursor, ok := fr.vaLists[h.slot]
+		if !ok || cursor < 0 || cursor > len(fr.variadicArgs) {
+			return nil, false
+		}
+		return fr.variadicArgs[cursor:], true
+	}
+	return nil, false
+}
+
+func (vm *VM) checkStackDepth() error {
+	if vm.maxStackDepth > 0 && len(vm.stack) > vm.maxStackDepth {
+		return vm.trapWithCause("operand stack limit exceeded", &QuotaError{Quota: QuotaStackDepth, Limit: int64(vm.maxStackDepth), Requested: int64(len(vm.stack))})
+	}
+	return nil
+}
+
 func (fr *frame) jump(label int) error {
-	pc, ok := fr.labels[label]
+	pc, ok := fr.code.labels[label]
 	if !ok {
 		return fmt.Errorf("missing label L%d", label)
 	}
@@ -714,6 +1049,17 @@ func (vm *VM) popFrame() error {
 			return vm.trapWithCause(fmt.Sprintf("closure %x free failed", addr), err)
 		}
 	}
+	for _, addr := range fr.vaListAddrs {
+		delete(vm.vaListHandles, addr)
+		if err := vm.program.Memory().Free(addr, blockLocal); err != nil {
+			return vm.trapWithCause(fmt.Sprintf("va_list %x free failed", addr), err)
+		}
+	}
+	for _, addr := range fr.jmpBufs {
+		if point, ok := vm.jmpPoints[addr]; ok && point.serial == fr.serial {
+			delete(vm.jmpPoints, addr)
+		}
+	}
 	for objectID, addr := range fr.localObjects {
 		if err := vm.program.Memory().Free(addr, blockLocal); err != nil {
 			return vm.trapWithCause(fmt.Sprintf("local object %d free failed", objectID), err)
@@ -777,7 +1123,7 @@ func (vm *VM) runAtexitHandlers(ctx context.Context) (ExitStatus, bool, error) {
 			return st, done, nil
 		}
 		for len(vm.frames) != 0 {
-			st, done, err = vm.step(ctx)
+			st, done, err = vm.run(ctx)
 			if done || err != nil {
 				cleanupErr := vm.cleanupFrames()
 				if err != nil {
@@ -809,6 +1155,66 @@ func (vm *VM) invokeAtexitHandler(ctx context.Context, addr uint64) (ExitStatus,
 	return vm.invokeGlobal(ctx, globalID, g.Sig, nil)
 }
 
+// resolveFunctionPointer finds the global and signature behind a function
+// pointer, including the captures of a nested function closure.
+func (vm *VM) resolveFunctionPointer(addr uint64, what string) (int, int, []Value, error) {
+	if cl, ok := vm.closures[addr]; ok {
+		return cl.global, cl.sig, cl.captures, nil
+	}
+	if expired, ok := vm.expiredClosures[addr]; ok {
+		return 0, 0, nil, vm.trap(fmt.Sprintf("expired closure pointer %#x from %s to global %d", addr, expired.creator, expired.global))
+	}
+	globalID, err := vm.program.FuncGlobalByAddress(addr)
+	if err != nil {
+		return 0, 0, nil, vm.trapWithCause(what, err)
+	}
+	g, err := vm.program.global(globalID)
+	if err != nil {
+		return 0, 0, nil, vm.trapWithCause(what, err)
+	}
+	return globalID, g.Sig, nil, nil
+}
+
+// callFunctionPointer runs the guest function at addr to completion on top
+// of the current frames and returns its result. While it runs, callbackDepth
+// keeps longjmp from unwinding past the extern that made the call.
+func (vm *VM) callFunctionPointer(ctx context.Context, addr uint64, args []Value) (Value, error) {
+	globalID, sigID, captures, err := vm.resolveFunctionPointer(addr, "invalid callback target")
+	if err != nil {
+		return Value{}, err
+	}
+	sig := vm.program.module.Sigs[sigID]
+	if len(args)+len(captures) < len(sig.Params) || !sig.Variadic && len(args)+len(captures) > len(sig.Params) {
+		return Value{}, vm.trap(fmt.Sprintf("callback global %d expects %d arguments, got %d", globalID, len(sig.Params)-len(captures), len(args)))
+	}
+	for i, arg := range args {
+		if i < len(sig.Params) && arg.Type != sig.Params[i] {
+			return Value{}, vm.trap(fmt.Sprintf("callback argument %d has type %s, want %s", i, arg.Type, sig.Params[i]))
+		}
+	}
+
+	depth, stackHeight := len(vm.frames), len(vm.stack)
+	prevDepth := vm.callbackDepth
+	vm.callbackDepth = depth
+	defer func() { vm.callbackDepth = prevDepth }()
+	st, done, err := vm.invokeGlobal(ctx, globalID, sigID, append(append([]Value(nil), args...), captures...))
+	for !done && err == nil && len(vm.frames) > depth {
+		st, done, err = vm.run(ctx)
+	}
+	if err != nil {
+		return Value{}, err
+	}
+	if done {
+		return Value{}, &ExitError{Status: st}
+	}
+	var ret Value
+	if sig.Ret != bytecode.TypeVoid && len(vm.stack) > stackHeight {
+		ret = vm.stack[len(vm.stack)-1]
+	}
+	vm.stack = vm.stack[:stackHeight]
+	return ret, nil
+}
+
 func (vm *VM) popCallArgs(sigID, argc int) ([]Value, error) {
 	if vm.program == nil || vm.program.module == nil {
 		return nil, vm.trap("nil program")
@@ -900,6 +1306,7 @@ func (vm *VM) makeClosure(globalID, sigID int, captures []Value) (uint64, error)
 	if err != nil {
 		return 0, vm.trapWithCause("closure allocation failed", err)
 	}
+	delete(vm.expiredClosures, addr)
 	vm.closures[addr] = closure{
 		global:   globalID,
 		sig:      sigID,
@@ -934,12 +1341,31 @@ func (vm *VM) invokeGlobal(ctx context.Context, globalID, sigID int, args []Valu
 		if !isExternFunction(g) {
 			return ExitStatus{}, true, vm.trap(fmt.Sprintf("global %d is not an extern function", globalID))
 		}
+		if g.Extern.Module == "" {
+			if st, done, ok, err := vm.callVMExtern(ctx, g.Extern.Name, args); ok {
+				return st, done || err != nil, err
+			}
+		}
 		fn, err := vm.program.ExternByGlobal(globalID)
 		if err != nil {
 			return ExitStatus{}, true, vm.trapWithCause("invalid extern call target", err)
 		}
-		ret, exit, err := fn(ctx, vm.program.ExternContext(), args)
+		ec := vm.program.ExternContext()
+		prevVM := ec.vm
+		ec.vm = vm
+		ret, exit, err := fn(ctx, ec, args)
+		ec.vm = prevVM
 		if err != nil {
+			// Exits and traps inside guest callbacks end the run as they would
+			// have without the extern in between.
+			var exitErr *ExitError
+			if errors.As(err, &exitErr) {
+				return exitErr.Status, true, nil
+			}
+			var trapErr *TrapError
+			if errors.As(err, &trapErr) && trapErr.HasLocation {
+				return ExitStatus{}, true, err
+			}
 			return ExitStatus{}, true, vm.trapWithCause(fmt.Sprintf("extern %s failed", g.Extern.Name), err)
 		}
 		if exit != nil {
@@ -958,6 +1384,26 @@ func (vm *VM) invokeGlobal(ctx context.Context, globalID, sigID int, args []Valu
 	}
 }
 
+// callVMExtern runs the externs that manipulate the call stack or deliver
+// signals. It reports false for every other extern.
+func (vm *VM) callVMExtern(ctx context.Context, name string, args []Value) (ExitStatus, bool, bool, error) {
+	switch name {
+	case "setjmp", "_setjmp":
+		return ExitStatus{}, false, true, vm.setjmp(name, args)
+	case "longjmp", "_longjmp":
+		return ExitStatus{}, false, true, vm.longjmp(name, args)
+	case "raise":
+		st, done, err := vm.raise(ctx, args)
+		return st, done, true, err
+	case "abort", "__builtin_abort":
+		return vm.abort(ctx)
+	case "__assert_fail":
+		st, done, err := vm.assertFail(ctx, args)
+		return st, done, true, err
+	}
+	return ExitStatus{}, false, false, nil
+}
+
 func (vm *VM) binary(ins bytecode.Instr) error {
 	r, err := vm.pop(ins.Type)
 	if err != nil {
@@ -990,33 +1436,33 @@ func (vm *VM) binary(ins bytecode.Instr) error {
 	case bytecode.BinDivS:
 		rs := signedInt(r)
 		if rs == 0 {
-			return vm.trap("division by zero")
+			return vm.fault(sigFPE, "division by zero", nil)
 		}
 		ls := signedInt(l)
 		if ls == minSigned(width) && rs == -1 {
-			return vm.trap("signed division overflow")
+			return vm.fault(sigFPE, "signed division overflow", nil)
 		}
 		out = IntValue(ins.Type, ls/rs)
 	case bytecode.BinDivU:
 		ru := unsignedInt(r)
 		if ru == 0 {
-			return vm.trap("division by zero")
+			return vm.fault(sigFPE, "division by zero", nil)
 		}
 		out = UIntValue(ins.Type, unsignedInt(l)/ru)
 	case bytecode.BinRemS:
 		rs := signedInt(r)
 		if rs == 0 {
-			return vm.trap("division by zero")
+			return vm.fault(sigFPE, "division by zero", nil)
 		}
 		ls := signedInt(l)
 		if ls == minSigned(width) && rs == -1 {
-			return vm.trap("signed remainder overflow")
+			return vm.fault(sigFPE, "signed remainder overflow", nil)
 		}
 		out = IntValue(ins.Type, ls%rs)
 	case bytecode.BinRemU:
 		ru := unsignedInt(r)
 		if ru == 0 {
-			return vm.trap("division by zero")
+			return vm.fault(sigFPE, "division by zero", nil)
 		}
 		out = UIntValue(ins.Type, unsignedInt(l)%ru)
 	case bytecode.BinAnd:
@@ -1087,14 +1533,8 @@ func (vm *VM) pointerBinary(ins bytecode.Instr, l, r Value) error {
 func (vm *VM) floatBinary(ins bytecode.Instr, l, r Value) error {
 	var out Value
 	switch ins.Binary {
-	case bytecode.BinAdd:
-		out = floatResult(ins.Type, l.Float+r.Float)
-	case bytecode.BinSub:
-		out = floatResult(ins.Type, l.Float-r.Float)
-	case bytecode.BinMul:
-		out = floatResult(ins.Type, l.Float*r.Float)
-	case bytecode.BinDivS:
-		out = floatResult(ins.Type, l.Float/r.Float)
+	case bytecode.BinAdd, bytecode.BinSub, bytecode.BinMul, bytecode.BinDivS:
+		out = FloatValue(ins.Type, vm.program.fenv.arith(ins.Type, ins.Binary, l.Float, r.Float))
 	case bytecode.BinEq:
 		out = UIntValue(bytecode.TypeBool, uint64(boolInt(l.Float == r.Float)))
 	case bytecode.BinNe:
@@ -1110,6 +1550,9 @@ func (vm *VM) floatBinary(ins bytecode.Instr, l, r Value) error {
 	default:
 		return vm.trap(fmt.Sprintf("unsupported float binary op %s", ins.Binary))
 	}
+	if out.Type == bytecode.TypeBool {
+		vm.program.fenv.compare(ins.Binary, l.Float, r.Float)
+	}
 	vm.stack = append(vm.stack, out)
 	return nil
 }
@@ -1191,25 +1634,17 @@ func (vm *VM) cast(ins bytecode.Instr) error {
 		if !isFloatType(ins.Type) || !isFloatType(ins.Type2) {
 			return vm.trap(fmt.Sprintf("unsupported float cast %s->%s", ins.Type, ins.Type2))
 		}
-		vm.stack = append(vm.stack, floatResult(ins.Type2, v.Float))
+		vm.stack = append(vm.stack, FloatValue(ins.Type2, vm.program.fenv.rounded(ins.Type2, v.Float, 0, false)))
 	case bytecode.CastIntToFloat:
 		if !isIntegerLike(ins.Type) || !isFloatType(ins.Type2) {
 			return vm.trap(fmt.Sprintf("unsupported int-to-float cast %s->%s", ins.Type, ins.Type2))
 		}
-		f := float64(signedInt(v))
-		if isUnsignedIntegerType(ins.Type) {
-			f = float64(unsignedInt(v))
-		}
-		vm.stack = append(vm.stack, floatResult(ins.Type2, f))
+		vm.stack = append(vm.stack, FloatValue(ins.Type2, vm.program.fenv.intToFloat(ins.Type2, v)))
 	case bytecode.CastFloatToInt:
 		if !isFloatType(ins.Type) || !isIntegerLike(ins.Type2) {
 			return vm.trap(fmt.Sprintf("unsupported float-to-int cast %s->%s", ins.Type, ins.Type2))
 		}
-		if isUnsignedIntegerType(ins.Type2) {
-			vm.stack = append(vm.stack, normalizeInt(UIntValue(ins.Type2, uint64(v.Float))))
-		} else {
-			vm.stack = append(vm.stack, normalizeInt(IntValue(ins.Type2, int64(v.Float))))
-		}
+		vm.stack = append(vm.stack, vm.program.fenv.floatToInt(ins.Type2, v.Float))
 	default:
 		return vm.trap(fmt.Sprintf("unsupported cast op %d", int(ins.Cast)))
 	}
@@ -1622,9 +2057,17 @@ func (vm *VM) trapAtPCWithCause(reason string, pc int, includeOpcode bool, cause
 	if includeOpcode && pc >= 0 && pc < len(fr.fn.Instrs) {
 		err.Opcode = fr.fn.Instrs[pc].Op
 	}
+	err.Source, err.HasSource = vm.sourceLocation(fr.fn.ID, pc)
 	return err
 }
 
+func (vm *VM) sourceLocation(funcID, pc int) (bytecode.SourceLocation, bool) {
+	if vm.program == nil || vm.program.module == nil {
+		return bytecode.SourceLocation{}, false
+	}
+	return vm.program.module.Debug.Lookup(funcID, pc)
+}
+
 func (vm *VM) stackTrace() []string {
 	if len(vm.frames) == 0 {
 		return nil
@@ -1637,6 +2080,13 @@ func (vm *VM) stackTrace() []string {
 			name = "fn"
 		}
 		stack[i] = fmt.Sprintf("%s#%d", name, fr.fn.ID)
+		pc := fr.pc
+		if pc > 0 {
+			pc--
+		}
+		if loc, ok := vm.sourceLocation(fr.fn.ID, pc); ok {
+			stack[i] += " (" + loc.String() + ")"
+		}
 	}
 	return stack
 }
@@ -15,12 +15,19 @@ func Analyze(candidates []*entity.AstNode) (*Program, error) {
 }
 
 func AnalyzeWithOptions(candidates []*entity.AstNode, opts SemaOptions) (*Program, error) {
+	prog, _, err := AnalyzeWithWarnings(candidates, opts)
+	return prog, err
+}
+
+// AnalyzeWithWarnings 与 AnalyzeWithOptions 相同，但另外返回警告；
+// 出错时 Program 为 nil，警告仍是被选中候选已收集到的那些。
+func AnalyzeWithWarnings(candidates []*entity.AstNode, opts SemaOptions) (*Program, []*common.CvmError, error) {
 	survivors, prefilterErrs := PreFilter(candidates)
 	if len(survivors) == 0 {
 		if len(prefilterErrs) > 0 {
-			return nil, prefilterErrs[0]
+			return nil, nil, prefilterErrs[0]
 		}
-		return nil, fmt.Errorf("no candidates remain after PreFilter")
+		return nil, nil, fmt.Errorf("no candidates remain after PreFilter")
 	}
 
 	results := make([]*SemaResult, len(survivors))
@@ -43,18 +50,22 @@ func AnalyzeWithOptions(candidates []*entity.AstNode, opts SemaOptions) (*Progra
 
 	switch len(clean) {
 	case 1:
-		return clean[0].Program, nil
+		if err := promotedWarnings(clean[0].Warnings); err != nil {
+			return nil, nil, err
+		}
+		clean[0].Program.Warnings = clean[0].Warnings
+		return clean[0].Program, clean[0].Warnings, nil
 	case 0:
 		best := pickBestErrorResult(results)
 		if best != nil && len(best.Errors) > 0 {
-			return nil, best.Errors[0]
+			return nil, best.Warnings, best.Errors[0]
 		}
 		if len(prefilterErrs) > 0 {
-			return nil, prefilterErrs[0]
+			return nil, nil, prefilterErrs[0]
 		}
-		return nil, fmt.Errorf("no result and no errors recorded")
+		return nil, nil, fmt.Errorf("no result and no errors recorded")
 	default:
-		return nil, ambiguousParse(clean)
+		return nil, nil, ambiguousParse(clean)
 	}
 }
 
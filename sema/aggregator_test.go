@@ -86,3 +86,14 @@ func TestAggregator_ConcurrencyStress(t *testing.T) {
 		}
 	}
 }
+
+func TestAggregator_WarningsSurviveAnError(t *testing.T) {
+	src := "int f(void) { int unused; return 0; }\nint main() { return undeclared_var; }"
+	prog, warnings, err := AnalyzeWithWarnings(parseCandidates(t, src), SemaOptions{Warnings: WarningsAll})
+	if err == nil || prog != nil {
+		t.Fatalf("prog = %+v, err = %v; want nil program and an error", prog, err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "unused variable 'unused'") {
+		t.Fatalf("warnings = %v", warnings)
+	}
+}
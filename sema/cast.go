@@ -212,6 +212,7 @@ func (s *Sema) assignmentConversion(e Expr, target Type, pos entity.SourcePos) E
 		return s.castNullPointerConstant(e, target)
 	}
 	if isArithmetic(from) && isArithmetic(target) {
+		s.checkConversion(e, target, pos)
 		return s.arithmeticConversion(e, target)
 	}
 	if pf, ok := unqual(from).(*PointerType); ok {
@@ -477,7 +477,7 @@ func (s *Sema) lookupVar(node *entity.AstNode, scope *Scope) Expr {
 	}
 	switch sym.Kind {
 	case SymVar, SymParam, SymFunc:
-		if sym.Name == "__func__" {
+		if sym.Kind != SymFunc {
 			sym.Used = true
 		}
 		return &VarRef{Sym: sym, T: sym.T, Range: node.SourceRange}
@@ -575,6 +575,7 @@ func (s *Sema) binaryOpFromOperator(opNode *entity.AstNode) BinaryOp {
 
 func (s *Sema) balanceComparison(op BinaryOp, l, r Expr, pos entity.SourcePos) (Expr, Expr) {
 	if isArithmetic(l.GetType()) && isArithmetic(r.GetType()) {
+		s.checkSignCompare(l, r, pos)
 		l, r, _ = s.castUsualArithmetic(l, r)
 		return l, r
 	}
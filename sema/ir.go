@@ -1,6 +1,9 @@
 package sema
 
-import "shinya.click/cvm/entity"
+import (
+	"shinya.click/cvm/common"
+	"shinya.click/cvm/entity"
+)
 
 type Node interface {
 	Pos() entity.SourceRange
@@ -31,10 +34,11 @@ const (
 )
 
 type Program struct {
-	Globals []Decl
-	Funcs   []*FuncDef
-	Types   *TypeTable
-	SymTab  *SymbolTable
+	Globals  []Decl
+	Funcs    []*FuncDef
+	Types    *TypeTable
+	SymTab   *SymbolTable
+	Warnings []*common.CvmError
 }
 
 type Block struct {
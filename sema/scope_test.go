@@ -53,7 +53,7 @@ func TestScopeNamespaceIsolation(t *testing.T) {
 	s := NewScope(ScopeFile, nil)
 	intT := NewTypeTable().Builtin(Int)
 	s.Insert("foo", &Symbol{Name: "foo", Kind: SymVar, T: intT})
-	tagId := NewTypeTable().NewTagID()
+	tagId := NewTypeTable().NewTagID("")
 	s.InsertTag("foo", &TagInfo{Tag: tagId})
 	if s.Lookup("foo", NSOrdinary) == nil {
 		t.Fatalf("ordinary 'foo' lost")
@@ -7,11 +7,12 @@ import (
 )
 
 type Sema struct {
-	Types   *TypeTable
-	SymTab  *SymbolTable
-	Options SemaOptions
-	scope   *Scope
-	errors  []*common.CvmError
+	Types    *TypeTable
+	SymTab   *SymbolTable
+	Options  SemaOptions
+	scope    *Scope
+	errors   []*common.CvmError
+	warnings []*common.CvmError
 
 	pendingFuncs   []*pendingFunc
 	funcCtx        *funcCtx
@@ -23,6 +24,9 @@ type SemaOptions struct {
 	GNUExtensions                   bool
 	Permissive                      bool
 	WErrorDeclarationAfterStatement bool
+	Warnings                        WarningSet
+	ErrorWarnings                   WarningSet
+	WarningsAsErrors                bool
 }
 
 type pendingFunc struct {
@@ -32,9 +36,10 @@ type pendingFunc struct {
 }
 
 type SemaResult struct {
-	Program *Program
-	Errors  []*common.CvmError
-	Source  *entity.AstNode
+	Program  *Program
+	Errors   []*common.CvmError
+	Warnings []*common.CvmError
+	Source   *entity.AstNode
 }
 
 func NewSema() *Sema {
@@ -57,7 +62,7 @@ func (s *Sema) analyzeOne(root *entity.AstNode) *SemaResult {
 	s.markStaticFunctionUsesInGlobals(prog)
 	s.validateStaticFunctionDefinitions(prog)
 	FinalizeProgramLayout(prog)
-	return &SemaResult{Program: prog, Errors: s.errors, Source: root}
+	return &SemaResult{Program: prog, Errors: s.errors, Warnings: s.warnings, Source: root}
 }
 
 func (s *Sema) report(err *common.CvmError) {
@@ -110,6 +115,9 @@ func (s *Sema) walkFunctionDefinition(node *entity.AstNode, prog *Program) {
 	sym := s.scope.LookupCurrent(name, NSOrdinary)
 	if sym == nil {
 		sym = &Symbol{Name: name, Kind: SymFunc, T: ft, Storage: spec.Storage, Linkage: LinkageExternal, Pos: node.Children[1].SourceStart}
+		if s.scope.Kind != ScopeFile {
+			sym.Linkage = LinkageNone
+		}
 		s.scope.Insert(name, sym)
 	} else if sym.Kind != SymFunc {
 		s.report(RedefinitionSymbol(node.Children[1].SourceStart, sym.Pos, name))
@@ -450,6 +458,7 @@ func (s *Sema) walkFunctionBody(pf *pendingFunc, prog *Program) {
 	resolveGotos(ctx.pendingGotos, pf.def.Labels, ctx.vmScopes, s)
 	s.validateInlineDefinitionBody(pf.def)
 	s.markStaticFunctionUsesInStmt(body)
+	s.checkFunctionWarnings(pf.def)
 	_ = prog
 }
 
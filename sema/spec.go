@@ -266,7 +266,7 @@ func (s *Sema) buildStructUnion(node *entity.AstNode) Type {
 }
 
 func (s *Sema) newAnonStructUnion(isUnion bool) Type {
-	tag := s.Types.NewTagID()
+	tag := s.Types.NewTagID("")
 	if isUnion {
 		return s.Types.Union(tag)
 	}
@@ -307,7 +307,7 @@ func tagInfoMatchesStructUnion(t Type, isUnion bool) bool {
 }
 
 func (s *Sema) createTag(name string, isUnion bool, pos entity.SourcePos) Type {
-	tag := s.Types.NewTagID()
+	tag := s.Types.NewTagID(name)
 	var t Type
 	if isUnion {
 		t = s.Types.Union(tag)
@@ -496,12 +496,12 @@ func (s *Sema) buildEnum(node *entity.AstNode) Type {
 			return existing.T
 		}
 		// GCC 的 C99 warning-only 用例会接受 enum 前向声明；当前没有 warning 通道，因此按可继续分析处理。
-		tag := s.Types.NewTagID()
+		tag := s.Types.NewTagID(name)
 		et := s.Types.Enum(tag)
 		_ = s.scope.InsertTagChecked(name, &TagInfo{Tag: tag, T: et, Pos: node.SourceStart}, node.SourceStart)
 		return et
 	case node.ReducedBy(parser.EnumSpecifier, 1), node.ReducedBy(parser.EnumSpecifier, 3):
-		tag := s.Types.NewTagID()
+		tag := s.Types.NewTagID("")
 		et := s.Types.Enum(tag)
 		enums := s.parseEnumeratorList(node.Children[2], intT)
 		s.Types.CompleteEnum(et, intT, enums)
@@ -514,7 +514,7 @@ func (s *Sema) buildEnum(node *entity.AstNode) Type {
 			et, _ = existing.T.(*EnumType)
 		}
 		if et == nil {
-			tag := s.Types.NewTagID()
+			tag := s.Types.NewTagID(name)
 			et = s.Types.Enum(tag)
 			_ = s.scope.InsertTagChecked(name, &TagInfo{Tag: tag, T: et, Pos: node.SourceStart}, node.SourceStart)
 		}
@@ -184,7 +184,16 @@ func (q *QualType) String() string {
 }
 
 type TagID struct {
-	id int
+	id   int
+	name string
+}
+
+// tagString 为具名标签渲染 "struct name" 形式
+func tagString(kind string, tag *TagID) string {
+	if tag == nil || tag.name == "" {
+		return ""
+	}
+	return kind + " " + tag.name
 }
 
 type Field struct {
@@ -205,6 +214,9 @@ type StructType struct {
 func (*StructType) isType() {}
 
 func (s *StructType) String() string {
+	if name := tagString("struct", s.Tag); name != "" {
+		return name
+	}
 	if !s.Complete {
 		return "struct<incomplete>"
 	}
@@ -220,6 +232,9 @@ type UnionType struct {
 func (*UnionType) isType() {}
 
 func (u *UnionType) String() string {
+	if name := tagString("union", u.Tag); name != "" {
+		return name
+	}
 	if !u.Complete {
 		return "union<incomplete>"
 	}
@@ -242,6 +257,9 @@ type EnumType struct {
 func (*EnumType) isType() {}
 
 func (e *EnumType) String() string {
+	if name := tagString("enum", e.Tag); name != "" {
+		return name
+	}
 	if !e.Complete {
 		return "enum<incomplete>"
 	}
@@ -153,9 +153,9 @@ func (tt *TypeTable) Qualified(base Type, isConst, isVolatile, isRestrict bool)
 	return q
 }
 
-func (tt *TypeTable) NewTagID() *TagID {
+func (tt *TypeTable) NewTagID(name string) *TagID {
 	tt.nextTagID++
-	return &TagID{id: tt.nextTagID}
+	return &TagID{id: tt.nextTagID, name: name}
 }
 
 func (tt *TypeTable) Struct(tag *TagID) *StructType {
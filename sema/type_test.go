@@ -230,7 +230,7 @@ func TestQualTypeAllC99QualifierCombinations(t *testing.T) {
 
 func TestStructTypeForwardCompletion(t *testing.T) {
 	tt := NewTypeTable()
-	tag := tt.NewTagID()
+	tag := tt.NewTagID("")
 	st := tt.Struct(tag)
 	if st.Complete {
 		t.Fatalf("forward struct should be incomplete")
@@ -249,10 +249,33 @@ func TestStructTypeForwardCompletion(t *testing.T) {
 	}
 }
 
+func TestTaggedTypesRenderTheirTagName(t *testing.T) {
+	tt := NewTypeTable()
+	named := tt.Struct(tt.NewTagID("point"))
+	if got := tt.Pointer(named).String(); got != "struct point*" {
+		t.Fatalf("named struct pointer = %q", got)
+	}
+	tt.CompleteStruct(named, []*Field{{Name: "x", T: tt.Builtin(Int)}})
+	if got := named.String(); got != "struct point" {
+		t.Fatalf("completed named struct = %q", got)
+	}
+	if got := tt.Union(tt.NewTagID("u")).String(); got != "union u" {
+		t.Fatalf("named union = %q", got)
+	}
+	if got := tt.Enum(tt.NewTagID("color")).String(); got != "enum color" {
+		t.Fatalf("named enum = %q", got)
+	}
+	anon := tt.Struct(tt.NewTagID(""))
+	tt.CompleteStruct(anon, []*Field{{Name: "x", T: tt.Builtin(Int)}})
+	if got := anon.String(); got != "struct{...}" {
+		t.Fatalf("anonymous struct = %q", got)
+	}
+}
+
 func TestStructUnionEnumTagIdentityIsNominal(t *testing.T) {
 	tt := NewTypeTable()
-	tag1 := tt.NewTagID()
-	tag2 := tt.NewTagID()
+	tag1 := tt.NewTagID("")
+	tag2 := tt.NewTagID("")
 	if tag1 == tag2 {
 		t.Fatalf("NewTagID returned identical pointers")
 	}
@@ -273,7 +296,7 @@ func TestStructUnionEnumTagIdentityIsNominal(t *testing.T) {
 func TestUnionAndEnum(t *testing.T) {
 	tt := NewTypeTable()
 
-	uTag := tt.NewTagID()
+	uTag := tt.NewTagID("")
 	u := tt.Union(uTag)
 	if u.Complete {
 		t.Fatalf("forward union should be incomplete")
@@ -284,7 +307,7 @@ func TestUnionAndEnum(t *testing.T) {
 		t.Fatalf("CompleteUnion failed: %+v", u)
 	}
 
-	eTag := tt.NewTagID()
+	eTag := tt.NewTagID("")
 	e := tt.Enum(eTag)
 	tt.CompleteEnum(e, intT, []*Enumerator{{Name: "RED", Value: 0}})
 	if !e.Complete || e.Underlying != intT || len(e.Enumerators) != 1 {
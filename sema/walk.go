@@ -0,0 +1,117 @@
+package sema
+
+// Walk 以先序遍历 IR 节点及其子节点；fn 返回 false 时不再进入该节点的子节点。
+func Walk(node Node, fn func(Node) bool) {
+	if isNilNode(node) || !fn(node) {
+		return
+	}
+	switch x := node.(type) {
+	case *VarDecl:
+		walkExpr(x.Init, fn)
+	case *FuncDef:
+		for _, p := range x.Params {
+			Walk(p, fn)
+		}
+		if x.Body != nil {
+			Walk(x.Body, fn)
+		}
+	case *Block:
+		for _, item := range x.Items {
+			Walk(item, fn)
+		}
+	case *DeclStmt:
+		for _, d := range x.Decls {
+			Walk(d, fn)
+		}
+	case *IfStmt:
+		walkExpr(x.Cond, fn)
+		Walk(x.Then, fn)
+		Walk(x.Else, fn)
+	case *WhileStmt:
+		walkExpr(x.Cond, fn)
+		Walk(x.Body, fn)
+	case *ForStmt:
+		Walk(x.Init, fn)
+		walkExpr(x.Cond, fn)
+		walkExpr(x.Post, fn)
+		Walk(x.Body, fn)
+	case *SwitchStmt:
+		walkExpr(x.Cond, fn)
+		Walk(x.Body, fn)
+	case *CaseStmt:
+		Walk(x.Body, fn)
+	case *DefaultStmt:
+		Walk(x.Body, fn)
+	case *LabeledStmt:
+		Walk(x.Body, fn)
+	case *ReturnStmt:
+		walkExpr(x.Value, fn)
+	case *ExprStmt:
+		walkExpr(x.Expr, fn)
+	case *StmtExpr:
+		if x.Block != nil {
+			Walk(x.Block, fn)
+		}
+	case *BinOp:
+		walkExpr(x.L, fn)
+		walkExpr(x.R, fn)
+	case *UnOp:
+		walkExpr(x.X, fn)
+	case *AssignExpr:
+		walkExpr(x.L, fn)
+		walkExpr(x.R, fn)
+	case *CompoundAssign:
+		walkExpr(x.L, fn)
+		walkExpr(x.R, fn)
+	case *CallExpr:
+		walkExpr(x.Callee, fn)
+		for _, arg := range x.Args {
+			walkExpr(arg, fn)
+		}
+	case *MemberExpr:
+		walkExpr(x.Base, fn)
+	case *IndexExpr:
+		walkExpr(x.Base, fn)
+		walkExpr(x.Index, fn)
+	case *CondExpr:
+		walkExpr(x.Cond, fn)
+		walkExpr(x.Then, fn)
+		walkExpr(x.Else, fn)
+	case *SizeofExpr:
+		walkExpr(x.Operand.Expr, fn)
+	case *CommaExpr:
+		walkExpr(x.L, fn)
+		walkExpr(x.R, fn)
+	case *CompoundLit:
+		if x.Init != nil {
+			Walk(x.Init, fn)
+		}
+	case *InitList:
+		for _, elem := range x.Elems {
+			walkExpr(elem.Value, fn)
+		}
+	case *ImplicitCast:
+		walkExpr(x.X, fn)
+	case *ExplicitCast:
+		walkExpr(x.X, fn)
+	}
+}
+
+func walkExpr(e Expr, fn func(Node) bool) {
+	if e != nil {
+		Walk(e, fn)
+	}
+}
+
+// isNilNode 同时挡住接口 nil 和常见的带类型 nil 语句，例如没有 else 分支的 IfStmt。
+func isNilNode(node Node) bool {
+	switch x := node.(type) {
+	case nil:
+		return true
+	case *Block:
+		return x == nil
+	case *InitList:
+		return x == nil
+	}
+	return false
+}
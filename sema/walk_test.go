@@ -0,0 +1,41 @@
+package sema
+
+import "testing"
+
+func TestWalkVisitsNestedExpressions(t *testing.T) {
+	prog := mustAnalyzeWithOptions(t, `int g;
+int f(int a) {
+	int x = a + 1;
+	if (x) { g = x * 2; } else return (x, a);
+	return sizeof(x) + ({ int y = x; y; });
+}`, SemaOptions{GNUExtensions: true})
+	var refs, decls int
+	Walk(prog.Funcs[0], func(n Node) bool {
+		switch x := n.(type) {
+		case *VarRef:
+			if x.Sym.Name == "x" || x.Sym.Name == "y" {
+				refs++
+			}
+		case *VarDecl:
+			decls++
+		}
+		return true
+	})
+	// x：if 条件、g = x * 2、逗号表达式、sizeof、y 的初始化；y：语句表达式的值。
+	if refs != 6 {
+		t.Fatalf("refs to x/y = %d, want 6", refs)
+	}
+	if decls != 3 {
+		t.Fatalf("decls = %d, want a, x and y", decls)
+	}
+
+	var visited int
+	Walk(prog.Funcs[0], func(n Node) bool {
+		visited++
+		_, isDef := n.(*FuncDef)
+		return isDef
+	})
+	if visited != 3 {
+		t.Fatalf("visited = %d, want the def, its parameter and its body", visited)
+	}
+}
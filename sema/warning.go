@@ -0,0 +1,428 @@
+package sema
+
+import (
+	"fmt"
+	"math"
+
+	"shinya.click/cvm/common"
+	"shinya.click/cvm/entity"
+)
+
+// Warning 是一个可以用 -W<name> / -Wno-<name> 单独开关的语义检查。
+type Warning int
+
+const (
+	WarnUnusedVariable Warning = iota
+	WarnUnusedParameter
+	WarnConversion
+	WarnReturnType
+	WarnSignCompare
+	WarnUnreachableCode
+	WarnImplicitFallthrough
+)
+
+var warningNames = [...]string{
+	WarnUnusedVariable:      "unused-variable",
+	WarnUnusedParameter:     "unused-parameter",
+	WarnConversion:          "conversion",
+	WarnReturnType:          "return-type",
+	WarnSignCompare:         "sign-compare",
+	WarnUnreachableCode:     "unreachable-code",
+	WarnImplicitFallthrough: "implicit-fallthrough",
+}
+
+func (w Warning) String() string {
+	if w >= 0 && int(w) < len(warningNames) {
+		return warningNames[w]
+	}
+	return fmt.Sprintf("warning(%d)", int(w))
+}
+
+func ParseWarning(name string) (Warning, bool) {
+	for w, n := range warningNames {
+		if n == name {
+			return Warning(w), true
+		}
+	}
+	return 0, false
+}
+
+type WarningSet uint32
+
+// WarningsAll / WarningsExtra 对应 -Wall 与 -Wextra 打开的集合，与 GCC 的分组一致；
+// conversion 和 unreachable-code 只能按名字打开。
+const (
+	WarningsAll   = WarningSet(1<<WarnUnusedVariable | 1<<WarnReturnType)
+	WarningsExtra = WarningsAll | WarningSet(1<<WarnUnusedParameter|1<<WarnSignCompare|1<<WarnImplicitFallthrough)
+)
+
+func (ws WarningSet) Has(w Warning) bool { return ws&(1<<w) != 0 }
+
+func (ws WarningSet) With(w Warning) WarningSet { return ws | 1<<w }
+
+func (ws WarningSet) Without(w Warning) WarningSet { return ws &^ (1 << w) }
+
+// warn 记录一条警告；警告与 errors 分开存放，不影响候选语法树的取舍。
+// 被 -Werror 提升的警告以 error 级别记录，由 AnalyzeWithOptions 决定是否失败。
+func (s *Sema) warn(w Warning, pos entity.SourcePos, msg string) {
+	if !s.Options.Warnings.Has(w) {
+		return
+	}
+	if s.Options.WarningsAsErrors || s.Options.ErrorWarnings.Has(w) {
+		s.warnings = append(s.warnings, common.NewCvmError(common.NewErrorMessage(pos, msg+" [-Werror="+w.String()+"]")))
+		return
+	}
+	s.warnings = append(s.warnings, common.NewCvmError(common.NewWarningMessage(pos, msg+" [-W"+w.String()+"]")))
+}
+
+func promotedWarnings(warnings []*common.CvmError) *common.CvmError {
+	var messages []*common.CvmErrorMessages
+	promoted := false
+	for _, w := range warnings {
+		for _, m := range w.Messages {
+			promoted = promoted || m.Level == common.MessageLevelError
+			messages = append(messages, m)
+		}
+	}
+	if !promoted {
+		return nil
+	}
+	return common.NewCvmError(messages...)
+}
+
+func (s *Sema) checkFunctionWarnings(def *FuncDef) {
+	if s.Options.Warnings == 0 || def.Body == nil {
+		return
+	}
+	for _, p := range def.Params {
+		if p.Sym != nil && p.Sym.Name != "" && !p.Sym.Used {
+			s.warn(WarnUnusedParameter, p.Sym.Pos, fmt.Sprintf("unused parameter '%s'", p.Sym.Name))
+		}
+	}
+	for _, vd := range def.Locals {
+		if vd.Sym != nil && vd.Sym.Name != "__func__" && vd.Storage != StorageExtern && !vd.Sym.Used {
+			s.warn(WarnUnusedVariable, vd.Sym.Pos, fmt.Sprintf("unused variable '%s'", vd.Sym.Name))
+		}
+	}
+	if bt, ok := unqual(def.T.Ret).(*BuiltinType); !(ok && bt.Kind == Void) && def.Sym.Name != "main" && s.stmtCompletes(def.Body) {
+		s.warn(WarnReturnType, def.Body.Range.SourceEnd, "control reaches end of non-void function")
+	}
+	s.checkStmtWarnings(def.Body)
+}
+
+func (s *Sema) checkStmtWarnings(stmt Stmt) {
+	switch x := stmt.(type) {
+	case *Block:
+		for i, item := range x.Items {
+			if _, ok := unlabeledStmt(item).(*ReturnStmt); ok {
+				if next := firstUnlabeledStmt(x.Items[i+1:]); next != nil {
+					s.warn(WarnUnreachableCode, next.Pos().SourceStart, "code will never be executed")
+				}
+			}
+		}
+	case *SwitchStmt:
+		s.checkSwitchFallthrough(x)
+	}
+	for _, child := range childStmts(stmt) {
+		s.checkStmtWarnings(child)
+	}
+}
+
+// firstUnlabeledStmt 返回 return 之后第一条只能顺序到达的语句；遇到标号则说明后面的代码可以经由跳转到达。
+func firstUnlabeledStmt(items []Stmt) Stmt {
+	for _, item := range items {
+		switch item.(type) {
+		case *EmptyStmt:
+			continue
+		case *LabeledStmt, *CaseStmt, *DefaultStmt:
+			return nil
+		}
+		return item
+	}
+	return nil
+}
+
+func (s *Sema) checkSwitchFallthrough(sw *SwitchStmt) {
+	body, ok := sw.Body.(*Block)
+	if !ok {
+		return
+	}
+	live, nonEmpty := false, false
+	for _, item := range body.Items {
+		if label, inner := switchLabel(item); label != nil {
+			if live && nonEmpty {
+				s.warn(WarnImplicitFallthrough, label.Pos().SourceStart, "unannotated fall-through between switch labels")
+			}
+			_, empty := inner.(*EmptyStmt)
+			nonEmpty = inner != nil && !empty
+			live = s.stmtCompletes(inner)
+			continue
+		}
+		if _, empty := item.(*EmptyStmt); !empty {
+			nonEmpty = true
+		}
+		if live {
+			live = s.stmtCompletes(item)
+		}
+	}
+}
+
+func unlabeledStmt(stmt Stmt) Stmt {
+	for {
+		switch x := stmt.(type) {
+		case *LabeledStmt:
+			stmt = x.Body
+		case *CaseStmt:
+			stmt = x.Body
+		case *DefaultStmt:
+			stmt = x.Body
+		default:
+			return stmt
+		}
+	}
+}
+
+// switchLabel 拆开 "case 1: case 2: stmt" 这样连续的标号，返回第一个标号和最终的语句。
+func switchLabel(stmt Stmt) (Stmt, Stmt) {
+	switch stmt.(type) {
+	case *CaseStmt, *DefaultStmt:
+		return stmt, unlabeledStmt(stmt)
+	}
+	return nil, stmt
+}
+
+// stmtCompletes 保守地判断控制流能否从语句末尾继续往下走：拿不准时一律认为可以。
+func (s *Sema) stmtCompletes(stmt Stmt) bool {
+	switch x := stmt.(type) {
+	case *ReturnStmt, *GotoStmt, *BreakStmt, *ContinueStmt:
+		return false
+	case *ExprStmt:
+		return !isNoReturnCall(x.Expr)
+	case *Block:
+		live := true
+		for _, item := range x.Items {
+			if live || containsLabel(item) {
+				live = s.stmtCompletes(item)
+			}
+		}
+		return live
+	case *IfStmt:
+		return x.Else == nil || s.stmtCompletes(x.Then) || s.stmtCompletes(x.Else)
+	case *WhileStmt:
+		if s.alwaysTrue(x.Cond) {
+			return containsBreak(x.Body, false)
+		}
+		if x.DoWhile {
+			return s.stmtCompletes(x.Body) || containsBreak(x.Body, false) || containsContinue(x.Body)
+		}
+	case *ForStmt:
+		if x.Cond == nil || s.alwaysTrue(x.Cond) {
+			return containsBreak(x.Body, false)
+		}
+	case *SwitchStmt:
+		return x.Default == nil || containsBreak(x.Body, false) || s.stmtCompletes(x.Body)
+	case *LabeledStmt:
+		return s.stmtCompletes(x.Body)
+	case *CaseStmt:
+		return s.stmtCompletes(x.Body)
+	case *DefaultStmt:
+		return s.stmtCompletes(x.Body)
+	}
+	return true
+}
+
+func (s *Sema) alwaysTrue(cond Expr) bool {
+	cv, ok := NewEvaluator(s).EvalC99IntegerConstantExpression(cond)
+	return ok && constNonZero(cv)
+}
+
+var noReturnFunctions = map[string]bool{
+	"abort": true, "exit": true, "_Exit": true, "longjmp": true, "siglongjmp": true,
+	"__assert_fail": true, "__builtin_abort": true, "__builtin_trap": true, "__builtin_unreachable": true,
+}
+
+func isNoReturnCall(e Expr) bool {
+	call, ok := e.(*CallExpr)
+	if !ok {
+		return false
+	}
+	callee := call.Callee
+	for {
+		cast, ok := callee.(*ImplicitCast)
+		if !ok {
+			break
+		}
+		callee = cast.X
+	}
+	ref, ok := callee.(*VarRef)
+	return ok && ref.Sym != nil && ref.Sym.Kind == SymFunc && noReturnFunctions[ref.Sym.Name]
+}
+
+func containsLabel(stmt Stmt) bool {
+	switch stmt.(type) {
+	case *LabeledStmt, *CaseStmt, *DefaultStmt:
+		return true
+	}
+	for _, child := range childStmts(stmt) {
+		if containsLabel(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsBreak 查找会跳出当前循环或 switch 的 break；嵌套的循环和 switch
+// 会吞掉普通 break，但带名字的 break 可能跳得更远，保守地算上。
+func containsBreak(stmt Stmt, nested bool) bool {
+	switch x := stmt.(type) {
+	case *BreakStmt:
+		return !nested || x.Name != ""
+	case *WhileStmt, *ForStmt, *SwitchStmt:
+		nested = true
+	}
+	for _, child := range childStmts(stmt) {
+		if containsBreak(child, nested) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsContinue(stmt Stmt) bool {
+	switch stmt.(type) {
+	case *ContinueStmt:
+		return true
+	case *WhileStmt, *ForStmt:
+		return false
+	}
+	for _, child := range childStmts(stmt) {
+		if containsContinue(child) {
+			return true
+		}
+	}
+	return false
+}
+
+func childStmts(stmt Stmt) []Stmt {
+	switch x := stmt.(type) {
+	case *Block:
+		return x.Items
+	case *IfStmt:
+		if x.Else == nil {
+			return []Stmt{x.Then}
+		}
+		return []Stmt{x.Then, x.Else}
+	case *WhileStmt:
+		return []Stmt{x.Body}
+	case *ForStmt:
+		if x.Init == nil {
+			return []Stmt{x.Body}
+		}
+		return []Stmt{x.Init, x.Body}
+	case *SwitchStmt:
+		return []Stmt{x.Body}
+	case *CaseStmt:
+		return []Stmt{x.Body}
+	case *DefaultStmt:
+		return []Stmt{x.Body}
+	case *LabeledStmt:
+		return []Stmt{x.Body}
+	}
+	return nil
+}
+
+func (s *Sema) checkConversion(e Expr, target Type, pos entity.SourcePos) {
+	if !s.Options.Warnings.Has(WarnConversion) || isComplexType(e.GetType()) || isComplexType(target) {
+		return
+	}
+	src, srcOk := unqualifiedBuiltin(e.GetType())
+	dst, dstOk := unqualifiedBuiltin(target)
+	if !srcOk || !dstOk || dst.Kind == Bool {
+		return
+	}
+	srcFloat, dstFloat := isFloating(src.Kind), isFloating(dst.Kind)
+	switch {
+	case srcFloat && dstFloat:
+		if arithmeticRankBuiltin(dst) >= arithmeticRankBuiltin(src) {
+			return
+		}
+	case !srcFloat && dstFloat:
+		return
+	case !srcFloat && !dstFloat:
+		if integerValueBits(dst.Kind) >= integerValueBits(src.Kind) {
+			return
+		}
+	}
+	if s.constantFits(e, src, dst) {
+		return
+	}
+	s.warn(WarnConversion, pos, fmt.Sprintf("conversion from '%s' to '%s' may change value", e.GetType(), target))
+}
+
+// constantFits 判断常量在目标类型里能否原样表示，这样 "char c = 'a';" 之类的写法不会报警。
+func (s *Sema) constantFits(e Expr, src, dst *BuiltinType) bool {
+	ev := NewEvaluator(s)
+	if !isFloating(src.Kind) {
+		cv, ok := ev.EvalC99IntegerConstantExpression(e)
+		if !ok {
+			return false
+		}
+		if !isSignedIntegerKind(src.Kind) && cv.Int < 0 {
+			return false
+		}
+		return integerFits(cv.Int, dst.Kind)
+	}
+	cv, ok := ev.EvalC99ArithmeticConstantExpression(e)
+	if !ok {
+		return false
+	}
+	v := constToFloat(cv)
+	if isFloating(dst.Kind) {
+		return dst.Kind != Float || float64(float32(v)) == v
+	}
+	return v == math.Trunc(v) && math.Abs(v) < 1<<62 && integerFits(int64(v), dst.Kind)
+}
+
+func integerFits(v int64, k BuiltinKind) bool {
+	bits := integerValueBits(k)
+	if bits >= 64 {
+		return isSignedIntegerKind(k) || v >= 0
+	}
+	if isSignedIntegerKind(k) {
+		return v >= -(1<<(bits-1)) && v < 1<<(bits-1)
+	}
+	return v >= 0 && v < 1<<bits
+}
+
+func (s *Sema) checkSignCompare(l, r Expr, pos entity.SourcePos) {
+	if !s.Options.Warnings.Has(WarnSignCompare) {
+		return
+	}
+	lk, lok := promotedIntegerKind(l.GetType())
+	rk, rok := promotedIntegerKind(r.GetType())
+	if !lok || !rok || isSignedIntegerKind(lk) == isSignedIntegerKind(rk) {
+		return
+	}
+	signed, signedKind, unsignedKind := l, lk, rk
+	if !isSignedIntegerKind(lk) {
+		signed, signedKind, unsignedKind = r, rk, lk
+	}
+	if signedCanRepresentUnsigned(signedKind, unsignedKind) {
+		return
+	}
+	if cv, ok := NewEvaluator(s).EvalC99IntegerConstantExpression(signed); ok && cv.Int >= 0 {
+		return
+	}
+	s.warn(WarnSignCompare, pos, fmt.Sprintf("comparison of integer expressions of different signedness: '%s' and '%s'", l.GetType(), r.GetType()))
+}
+
+func promotedIntegerKind(t Type) (BuiltinKind, bool) {
+	bt, ok := unqualifiedBuiltin(t)
+	if !ok || !isInteger(t) {
+		return 0, false
+	}
+	if integerValueBits(bt.Kind) < integerValueBits(Int) {
+		return Int, true
+	}
+	return bt.Kind, true
+}
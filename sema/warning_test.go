@@ -0,0 +1,155 @@
+package sema
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"shinya.click/cvm/common"
+)
+
+func warningTexts(prog *Program) []string {
+	var out []string
+	for _, w := range prog.Warnings {
+		for _, m := range w.Messages {
+			out = append(out, m.CustomMessage)
+		}
+	}
+	return out
+}
+
+func TestWarningsAreOffByDefault(t *testing.T) {
+	prog := mustAnalyze(t, `int f(int a) { int x; }`)
+	if len(prog.Warnings) != 0 {
+		t.Fatalf("warnings = %v, want none", warningTexts(prog))
+	}
+}
+
+func TestWarningChecks(t *testing.T) {
+	tests := []struct {
+		name string
+		w    Warning
+		src  string
+		want []string
+	}{
+		{"unused", WarnUnusedVariable, `int f(int a) { int x, y = a; static int z; extern int e; return y; }`,
+			[]string{"unused variable 'x' [-Wunused-variable]", "unused variable 'z' [-Wunused-variable]"}},
+		{"unused-parameter", WarnUnusedParameter, `int f(int a, int b, int) { (void)b; return 0; }`,
+			[]string{"unused parameter 'a' [-Wunused-parameter]"}},
+		{"conversion", WarnConversion, `void f(int i, long l, double d) {
+	char c = i; char k = 'a'; short s = 70000; float x = 1.5f; float y = 0.1; int n = d; long m = i;
+	c = l; (void)c; (void)k; (void)s; (void)x; (void)y; (void)n; (void)m;
+}`,
+			[]string{
+				"conversion from 'int' to 'char' may change value [-Wconversion]",
+				"conversion from 'int' to 'short' may change value [-Wconversion]",
+				"conversion from 'double' to 'float' may change value [-Wconversion]",
+				"conversion from 'double' to 'int' may change value [-Wconversion]",
+				"conversion from 'long' to 'char' may change value [-Wconversion]",
+			}},
+		{"return-type", WarnReturnType, `void abort(void);
+int a(int x) { if (x) return 1; }
+int b(int x) { if (x) return 1; else return 2; }
+int c(int x) { while (1) { if (x) return 1; } }
+int d(int x) { for (;;) { if (x) break; } }
+int e(int x) { switch (x) { case 1: return 1; default: return 0; } }
+int f(int x) { if (x) return 1; abort(); }
+int main(void) { }`,
+			[]string{"control reaches end of non-void function [-Wreturn-type]", "control reaches end of non-void function [-Wreturn-type]"}},
+		{"sign-compare", WarnSignCompare, `int f(unsigned u, int i, long l, unsigned short us) {
+	return (u < i) + (u < 3) + (l < u) + (us < i) + (i == u);
+}`,
+			[]string{
+				"comparison of integer expressions of different signedness: 'unsigned int' and 'int' [-Wsign-compare]",
+				"comparison of integer expressions of different signedness: 'int' and 'unsigned int' [-Wsign-compare]",
+			}},
+		{"unreachable-code", WarnUnreachableCode, `int f(int x) {
+	switch (x) {
+	case 1:
+		return 1;
+		x++;
+	case 2:
+		return 2;
+	}
+	return x;
+	x--;
+}`,
+			[]string{"code will never be executed [-Wunreachable-code]", "code will never be executed [-Wunreachable-code]"}},
+		{"implicit-fallthrough", WarnImplicitFallthrough, `int f(int x) {
+	switch (x) {
+	case 0:
+	case 1:
+		x++;
+	case 2:
+		x++;
+		break;
+	case 3:
+		return x;
+	case 4:
+		if (x) break; else return 0;
+	default:
+		x--;
+	}
+	return x;
+}`,
+			[]string{"unannotated fall-through between switch labels [-Wimplicit-fallthrough]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog := mustAnalyzeWithOptions(t, tt.src, SemaOptions{Warnings: WarningSet(0).With(tt.w)})
+			if got := warningTexts(prog); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("warnings = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarningPositionsAndGroups(t *testing.T) {
+	prog := mustAnalyzeWithOptions(t, "int f(int a, unsigned b) {\n    int unused;\n    if (a < b) return 1;\n}", SemaOptions{Warnings: WarningsAll})
+	var got []string
+	for _, w := range prog.Warnings {
+		m := w.Messages[0]
+		if m.Level != common.MessageLevelWarning {
+			t.Fatalf("level = %v, want warning", m.Level)
+		}
+		got = append(got, fmt.Sprintf("%d:%s", m.SourcePos.Line, m.CustomMessage))
+	}
+	want := []string{"2:unused variable 'unused' [-Wunused-variable]", "4:control reaches end of non-void function [-Wreturn-type]"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("-Wall warnings = %q, want %q", got, want)
+	}
+	extra := mustAnalyzeWithOptions(t, "int f(int a, unsigned b) {\n    int unused;\n    if (a < b) return 1;\n}", SemaOptions{Warnings: WarningsExtra.Without(WarnReturnType)})
+	if got := len(extra.Warnings); got != 2 {
+		t.Fatalf("-Wextra -Wno-return-type warnings = %q, want unused and sign-compare", warningTexts(extra))
+	}
+}
+
+func TestWarningsAsErrors(t *testing.T) {
+	src := `int f(int a) { int x; return a; }`
+	for _, opts := range []SemaOptions{
+		{Warnings: WarningsAll, WarningsAsErrors: true},
+		{Warnings: WarningsAll, ErrorWarnings: WarningSet(0).With(WarnUnusedVariable)},
+	} {
+		_, err := AnalyzeWithOptions(parseCandidates(t, src), opts)
+		cerr, ok := err.(*common.CvmError)
+		if !ok || len(cerr.Messages) != 1 || cerr.Messages[0].Level != common.MessageLevelError ||
+			cerr.Messages[0].CustomMessage != "unused variable 'x' [-Werror=unused-variable]" {
+			t.Fatalf("AnalyzeWithOptions(%+v) error = %v, want promoted unused-variable", opts, err)
+		}
+	}
+	prog := mustAnalyzeWithOptions(t, src, SemaOptions{Warnings: WarningsAll, ErrorWarnings: WarningSet(0).With(WarnReturnType)})
+	if len(prog.Warnings) != 1 {
+		t.Fatalf("warnings = %q, want the unpromoted unused-variable warning", warningTexts(prog))
+	}
+}
+
+func TestParseWarning(t *testing.T) {
+	for w := WarnUnusedVariable; w <= WarnImplicitFallthrough; w++ {
+		if got, ok := ParseWarning(w.String()); !ok || got != w {
+			t.Fatalf("ParseWarning(%q) = %v, %v", w.String(), got, ok)
+		}
+	}
+	if _, ok := ParseWarning("everything"); ok {
+		t.Fatalf("ParseWarning accepted an unknown name")
+	}
+}